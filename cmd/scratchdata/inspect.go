@@ -0,0 +1,46 @@
+package scratchdata
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/scratchdata/scratchdata/pkg/datasink/filesystem"
+)
+
+// Inspect prints a summary of the filesystem data sink's data directory at
+// dir: the files and bytes in each folder, how long the oldest closed file
+// has been waiting, and any files with an incomplete last line. It only
+// reads, so it's safe to run against a live node. It returns false if any
+// file is incomplete.
+func Inspect(w io.Writer, dir string) (bool, error) {
+	report, err := filesystem.InspectDataDir(dir)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(w, "%-10s %8s %14s\n", "folder", "files", "bytes")
+	fmt.Fprintf(w, "%-10s %8d %14d\n", filesystem.OpenFolder, report.Open.Files, report.Open.Bytes)
+	fmt.Fprintf(w, "%-10s %8d %14d\n", filesystem.ClosedFolder, report.Closed.Files, report.Closed.Bytes)
+	fmt.Fprintf(w, "%-10s %8d %14d\n", filesystem.OutboxFolder, report.Outbox.Files, report.Outbox.Bytes)
+	fmt.Fprintf(w, "%-10s %8d %14d\n", filesystem.DeadLetterFolder, report.DeadLetter.Files, report.DeadLetter.Bytes)
+	fmt.Fprintln(w)
+
+	if report.OldestPending.IsZero() {
+		fmt.Fprintln(w, "oldest pending: none")
+	} else {
+		age := time.Since(report.OldestPending).Round(time.Second)
+		fmt.Fprintf(w, "oldest pending: %s (%s ago)\n", report.OldestPending.Format(time.RFC3339), age)
+	}
+
+	if len(report.Incomplete) == 0 {
+		fmt.Fprintln(w, "incomplete trailing lines: none")
+		return true, nil
+	}
+
+	fmt.Fprintf(w, "incomplete trailing lines: %d\n", len(report.Incomplete))
+	for _, path := range report.Incomplete {
+		fmt.Fprintf(w, "  %s\n", path)
+	}
+	return false, nil
+}
@@ -2,16 +2,20 @@ package scratchdata
 
 import (
 	"context"
+	"io"
 	"os"
 	"os/signal"
 	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/scratchdata/scratchdata/models"
+	"github.com/scratchdata/scratchdata/pkg/admin"
 	"github.com/scratchdata/scratchdata/pkg/datasink"
 	"github.com/scratchdata/scratchdata/pkg/destinations"
+	"github.com/scratchdata/scratchdata/pkg/preflight"
 	"github.com/scratchdata/scratchdata/pkg/storage/blobstore"
 	"github.com/scratchdata/scratchdata/pkg/storage/queue"
 
@@ -63,6 +67,22 @@ func setupLogs(logConfig config.Logging) {
 	} else {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05"}).With().Caller().Logger()
 	}
+
+	// Sample repetitive low-level messages
+	if logConfig.Sampling.Burst > 0 {
+		period := time.Duration(logConfig.Sampling.PeriodSeconds) * time.Second
+		if period <= 0 {
+			period = time.Second
+		}
+		sampler := func() zerolog.Sampler {
+			return &zerolog.BurstSampler{Burst: logConfig.Sampling.Burst, Period: period}
+		}
+		log.Logger = log.Sample(zerolog.LevelSampler{
+			TraceSampler: sampler(),
+			DebugSampler: sampler(),
+			InfoSampler:  sampler(),
+		})
+	}
 }
 
 func GetStorageServices(c config.ScratchDataConfig) (*models.StorageServices, error) {
@@ -89,8 +109,8 @@ func GetStorageServices(c config.ScratchDataConfig) (*models.StorageServices, er
 	return rc, nil
 }
 
-func GetMux(storageServices *models.StorageServices, destinationManager *destinations.DestinationManager, dataSink datasink.DataSink) (*chi.Mux, error) {
-	apiFunctions, err := api.NewScratchDataAPI(storageServices, destinationManager, dataSink)
+func GetMux(conf config.API, storageServices *models.StorageServices, destinationManager *destinations.DestinationManager, dataSink datasink.DataSink) (*chi.Mux, error) {
+	apiFunctions, err := api.NewScratchDataAPI(conf, storageServices, destinationManager, dataSink)
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to start API")
 		return nil, err
@@ -100,7 +120,80 @@ func GetMux(storageServices *models.StorageServices, destinationManager *destina
 	return mux, nil
 }
 
-func Run(config config.ScratchDataConfig, storageServices *models.StorageServices, destinationManager *destinations.DestinationManager, dataSink datasink.DataSink, mux *chi.Mux) {
+// Reload applies settings from a newly read config to running services, and
+// returns the config now in effect, to compare the next reload against.
+// Settings which can't be changed while running are logged and ignored.
+func Reload(current config.ScratchDataConfig, next config.ScratchDataConfig, dataSink datasink.DataSink) config.ScratchDataConfig {
+	applied := current
+
+	if next.DataSink.Type != current.DataSink.Type {
+		log.Warn().Str("type", next.DataSink.Type).Msg("Data sink type cannot be changed while running, restart to apply")
+	} else if reloadable, ok := dataSink.(datasink.Reloadable); ok {
+		err := reloadable.Reload(next.DataSink.Settings)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to reload data sink settings")
+		} else {
+			applied.DataSink = next.DataSink
+		}
+	}
+
+	if next.Workers.Count != current.Workers.Count {
+		log.Warn().Int("count", next.Workers.Count).Msg("Worker count cannot be changed while running, restart to apply")
+	}
+
+	if next.BlobStore.Type != current.BlobStore.Type || next.Queue.Type != current.Queue.Type {
+		log.Warn().Msg("Blob store and queue cannot be changed while running, restart to apply")
+	}
+
+	return applied
+}
+
+// defaultPreflightTimeout bounds preflight checks when no timeout is configured
+const defaultPreflightTimeout = 30 * time.Second
+
+// preflightContext returns the context bounding preflight checks
+func preflightContext(conf config.Preflight) (context.Context, context.CancelFunc) {
+	timeout := defaultPreflightTimeout
+	if conf.TimeoutSeconds > 0 {
+		timeout = time.Duration(conf.TimeoutSeconds) * time.Second
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// Preflight runs preflight checks, logging each result, and returns an error
+// if any failed
+func Preflight(conf config.ScratchDataConfig, storageServices *models.StorageServices, destinationManager *destinations.DestinationManager) error {
+	ctx, cancel := preflightContext(conf.Preflight)
+	defer cancel()
+
+	return logPreflight(preflight.Run(ctx, conf, storageServices, destinationManager))
+}
+
+// CheckStorage runs the blob store and queue preflight checks, logging each
+// result, and returns an error if any failed
+func CheckStorage(conf config.ScratchDataConfig, storageServices *models.StorageServices) error {
+	ctx, cancel := preflightContext(conf.Preflight)
+	defer cancel()
+
+	return logPreflight(preflight.CheckStorage(ctx, storageServices))
+}
+
+func logPreflight(results preflight.Results) error {
+	for _, result := range results {
+		switch {
+		case result.Skipped:
+			log.Info().Str("check", result.Name).Msg("Preflight check not supported, skipped")
+		case result.Err != nil:
+			log.Error().Err(result.Err).Str("check", result.Name).Msg("Preflight check failed")
+		default:
+			log.Info().Str("check", result.Name).Msg("Preflight check passed")
+		}
+	}
+
+	return results.Err()
+}
+
+func Run(config config.ScratchDataConfig, storageServices *models.StorageServices, destinationManager *destinations.DestinationManager, dataSink datasink.DataSink, mux *chi.Mux, readConfig func() (config.ScratchDataConfig, error)) {
 	setupLogs(config.Logging)
 
 	log.Debug().Msg("Starting Scratch Data")
@@ -128,6 +221,20 @@ func Run(config config.ScratchDataConfig, storageServices *models.StorageService
 		}()
 	}
 
+	// Run admin server
+	if config.Admin.Enabled {
+		sink, ok := dataSink.(admin.Introspector)
+		if ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				admin.RunAdmin(ctx, config.Admin, admin.CreateMux(admin.NewAdminAPI(sink)))
+			}()
+		} else {
+			log.Warn().Msg("Admin server is enabled but the data sink does not support introspection")
+		}
+	}
+
 	// Run workers
 	if config.Workers.Enabled {
 		wg.Add(1)
@@ -141,6 +248,28 @@ func Run(config config.ScratchDataConfig, storageServices *models.StorageService
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
 
+	// Reload config on SIGHUP
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+
+	go func() {
+		current := config
+		for {
+			select {
+			case <-hups:
+				log.Info().Msg("Received SIGHUP, reloading config")
+				next, err := readConfig()
+				if err != nil {
+					log.Error().Err(err).Msg("Unable to reload config")
+					continue
+				}
+				current = Reload(current, next, dataSink)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	// Block until a signal is received
 	go func() {
 		sig := <-sigs
@@ -154,5 +283,11 @@ func Run(config config.ScratchDataConfig, storageServices *models.StorageService
 
 	destinationManager.CloseAll()
 
+	if closer, ok := storageServices.BlobStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Error().Err(err).Msg("Unable to close blob store")
+		}
+	}
+
 	log.Debug().Msg("Done")
 }
@@ -1,8 +1,16 @@
 package config
 
 type Logging struct {
-	JSONFormat bool   `yaml:"json_format"`
-	Level      string `yaml:"level"`
+	JSONFormat bool        `yaml:"json_format"`
+	Level      string      `yaml:"level" env:"SCRATCH_LOG_LEVEL"`
+	Sampling   LogSampling `yaml:"sampling"`
+}
+
+// LogSampling limits trace, debug and info logs to Burst messages per
+// PeriodSeconds for each level. Warnings and errors are never sampled.
+type LogSampling struct {
+	Burst         uint32 `yaml:"burst"`
+	PeriodSeconds int    `yaml:"period_seconds"`
 }
 
 type API struct {
@@ -13,6 +21,37 @@ type API struct {
 	MaxAgeSeconds       int    `yaml:"max_age_seconds"`
 	MaxSizeBytes        int64  `yaml:"max_size_bytes"`
 	HealthCheckFailFile string `yaml:"healthcheck_fail_file"`
+
+	// MetadataKey, if set, nests the fields scratchdata adds to each row
+	// under this key, e.g. {"_scratch": {"row_id": 1}}, instead of adding
+	// them at the top level (__row_id), so they can't collide with user fields
+	MetadataKey string `yaml:"metadata_key"`
+}
+
+// RowIDField returns the path of the row id scratchdata adds to each row,
+// e.g. __row_id or _scratch.row_id
+func (a API) RowIDField() string {
+	if a.MetadataKey != "" {
+		return a.MetadataKey + ".row_id"
+	}
+	return "__row_id"
+}
+
+type Admin struct {
+	Enabled bool   `yaml:"enabled" env:"SCRATCH_ADMIN_ENABLED"`
+	Address string `yaml:"address"`
+}
+
+// Preflight checks the blob store, queue and destinations are reachable.
+// OnStartup refuses to start if any check fails; Only exits after checking,
+// for use in CI. Otherwise the blob store and queue are still checked at
+// startup, so a bad bucket or missing permissions fail immediately rather
+// than on the first upload, unless SkipStorageCheck is set for offline use.
+type Preflight struct {
+	OnStartup        bool `yaml:"on_startup" env:"SCRATCH_PREFLIGHT_ON_STARTUP"`
+	Only             bool `yaml:"only" env:"SCRATCH_PREFLIGHT_ONLY"`
+	SkipStorageCheck bool `yaml:"skip_storage_check" env:"SCRATCH_PREFLIGHT_SKIP_STORAGE_CHECK"`
+	TimeoutSeconds   int  `yaml:"timeout_seconds"`
 }
 
 type Workers struct {
@@ -20,6 +59,46 @@ type Workers struct {
 	Count                  int    `yaml:"count"`
 	DataDirectory          string `yaml:"data_directory"`
 	FreeSpaceRequiredBytes int64  `yaml:"free_space_required_bytes"`
+
+	// ZstdDictionaries are paths to the dictionaries uploaded files may be
+	// compressed with. The right one is picked by the id in each file.
+	ZstdDictionaries []string `yaml:"zstd_dictionaries"`
+
+	// Checkpoint records which files have been inserted so redelivered
+	// messages are skipped. Defaults to a file in DataDirectory.
+	Checkpoint Checkpoint `yaml:"checkpoint"`
+
+	// SchemaVersion picks each file's target table from a tag on its
+	// dataset's schema definition object
+	SchemaVersion SchemaVersion `yaml:"schema_version"`
+}
+
+// SchemaVersion reads a dataset's schema version from a tag on an object in
+// the blob store, so flipping the tag moves inserts to another table for
+// blue/green migrations. Each lookup is a GetObjectTagging request on S3,
+// billed like a GET, so tags are cached for CacheSeconds.
+type SchemaVersion struct {
+	// ObjectKey is the schema definition object's key, with {database_id}
+	// and {table} replaced, e.g. "schemas/{database_id}/{table}.json". Empty
+	// disables schema versions, inserting into each message's table.
+	ObjectKey string `yaml:"object_key"`
+
+	// Tag holds the version. Defaults to "schema_version".
+	Tag string `yaml:"tag"`
+
+	// TableFormat is the target table's name, with {table} and {version}
+	// replaced. Defaults to "{table}_{version}". Files are inserted into the
+	// message's table when the object or tag doesn't exist.
+	TableFormat string `yaml:"table_format"`
+
+	// CacheSeconds is how long a dataset's version is kept before its tags
+	// are read again. Zero reads them for every file.
+	CacheSeconds int `yaml:"cache_seconds"`
+}
+
+type Checkpoint struct {
+	Type     string         `yaml:"type"`
+	Settings map[string]any `yaml:"settings"`
 }
 
 type Queue struct {
@@ -40,6 +119,9 @@ type Database struct {
 type BlobStore struct {
 	Type     string         `yaml:"type"`
 	Settings map[string]any `yaml:"settings"`
+
+	// URI sets the type, bucket and prefix in one go, e.g. s3://bucket/ingest/
+	URI string `yaml:"uri"`
 }
 
 type Destination struct {
@@ -56,6 +138,8 @@ type DataSink struct {
 type ScratchDataConfig struct {
 	Logging      Logging       `yaml:"logging"`
 	API          API           `yaml:"api"`
+	Admin        Admin         `yaml:"admin"`
+	Preflight    Preflight     `yaml:"preflight"`
 	Workers      Workers       `yaml:"workers"`
 	DataSink     DataSink      `yaml:"data_sink"`
 	Queue        Queue         `yaml:"queue"`
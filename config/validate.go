@@ -0,0 +1,52 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Validate checks the config for missing or inconsistent settings. It doesn't
+// connect to anything; see preflight for that.
+func (c ScratchDataConfig) Validate() error {
+	var errs []error
+
+	if c.API.Enabled && c.API.Port <= 0 {
+		errs = append(errs, errors.New("api.port is required when the api is enabled"))
+	}
+	if strings.ContainsAny(c.API.MetadataKey, ".*?|#@\\") {
+		errs = append(errs, fmt.Errorf("api.metadata_key %q must be a plain field name", c.API.MetadataKey))
+	}
+
+	if c.Workers.Enabled {
+		if c.Workers.Count <= 0 {
+			errs = append(errs, errors.New("workers.count must be positive when workers are enabled"))
+		}
+		if c.Workers.DataDirectory == "" {
+			errs = append(errs, errors.New("workers.data_directory is required when workers are enabled"))
+		}
+	}
+
+	if c.DataSink.Type == "" {
+		errs = append(errs, errors.New("data_sink.type is required"))
+	}
+	// A data sink which doesn't notify, relying on blob store events
+	// instead, only needs a queue if workers are consuming one
+	if c.Queue.Type == "" && (c.Workers.Enabled || c.DataSink.Settings["notify"] != "none") {
+		errs = append(errs, errors.New("queue.type is required"))
+	}
+	if c.BlobStore.Type == "" && c.BlobStore.URI == "" {
+		errs = append(errs, errors.New("blob_store.type or blob_store.uri is required"))
+	}
+
+	if len(c.Destinations) == 0 {
+		errs = append(errs, errors.New("at least one destination is required"))
+	}
+	for i, destination := range c.Destinations {
+		if destination.Type == "" {
+			errs = append(errs, fmt.Errorf("destinations[%d].type is required", i))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -17,11 +17,49 @@ import (
 //go:embed config.yaml
 var defaultConfig embed.FS
 
+// readConfig reads the config file given on the command line, or the embedded
+// default config if there isn't one
+func readConfig() (config.ScratchDataConfig, error) {
+	var configOptions config.ScratchDataConfig
+
+	useDefaultConfig := len(os.Args) == 1
+
+	if useDefaultConfig {
+		f, err := defaultConfig.Open("config.yaml")
+		if err != nil {
+			return configOptions, err
+		}
+		defer f.Close()
+
+		err = cleanenv.ParseYAML(f, &configOptions)
+		return configOptions, err
+	}
+
+	err := cleanenv.ReadConfig(os.Args[1], &configOptions)
+	return configOptions, err
+}
+
 func main() {
 	// Set default log format before we read config
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
 
-	var configOptions config.ScratchDataConfig
+	// scratchdata inspect <data dir> summarises a filesystem data sink's
+	// directory without changing it
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		if len(os.Args) != 3 {
+			fmt.Fprintln(os.Stderr, "usage: scratchdata inspect <data dir>")
+			os.Exit(2)
+		}
+
+		ok, err := scratchdata.Inspect(os.Stdout, os.Args[2])
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to inspect data directory")
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
 
 	useDefaultConfig := len(os.Args) == 1
 
@@ -33,22 +71,11 @@ func main() {
 			log.Fatal().Err(err).Msg("Unable to read config")
 		}
 		fmt.Println(string(config))
+	}
 
-		f, err := defaultConfig.Open("config.yaml")
-		if err != nil {
-			log.Fatal().Err(err).Msg("Unable to parse open config")
-		}
-		err = cleanenv.ParseYAML(f, &configOptions)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Unable to read config")
-		}
-
-		f.Close()
-	} else {
-		err := cleanenv.ReadConfig(os.Args[1], &configOptions)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Unable to read configuration file")
-		}
+	configOptions, err := readConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to read configuration file")
 	}
 
 	storageServices, err := scratchdata.GetStorageServices(configOptions)
@@ -57,16 +84,33 @@ func main() {
 	}
 
 	destinationManager := destinations.NewDestinationManager(storageServices)
+	destinationManager.RowIDField = configOptions.API.RowIDField()
 
-	dataSink, err := datasink.NewDataSink(configOptions.DataSink, storageServices)
+	dataSink, err := datasink.NewDataSink(configOptions.DataSink, storageServices, destinationManager)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Unable to set up data sink")
 	}
 
-	mux, err := scratchdata.GetMux(storageServices, destinationManager, dataSink)
+	if configOptions.Preflight.OnStartup || configOptions.Preflight.Only {
+		err = scratchdata.Preflight(configOptions, storageServices, destinationManager)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Preflight checks failed")
+		}
+		if configOptions.Preflight.Only {
+			log.Info().Msg("Preflight checks passed")
+			return
+		}
+	} else if !configOptions.Preflight.SkipStorageCheck {
+		err = scratchdata.CheckStorage(configOptions, storageServices)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Blob store or queue is not usable; set preflight.skip_storage_check to start anyway")
+		}
+	}
+
+	mux, err := scratchdata.GetMux(configOptions.API, storageServices, destinationManager, dataSink)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Unable to set up data sink")
 	}
 
-	scratchdata.Run(configOptions, storageServices, destinationManager, dataSink, mux)
+	scratchdata.Run(configOptions, storageServices, destinationManager, dataSink, mux, readConfig)
 }
@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"github.com/scratchdata/scratchdata/config"
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
+)
+
+// DefaultAddress is used when no admin address is configured. It is only
+// reachable locally.
+const DefaultAddress = "127.0.0.1:8081"
+
+// Introspector is implemented by data sinks which can report on their open files
+type Introspector interface {
+	Writers() []models.WriterInfo
+	StagedFiles(includeOpen bool) []models.StagedFileInfo
+	FlushWriter(id string) error
+}
+
+// HealthChecker is implemented by data sinks which can tell when they've
+// stopped making progress
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+type AdminAPI struct {
+	sink Introspector
+}
+
+func NewAdminAPI(sink Introspector) *AdminAPI {
+	return &AdminAPI{sink: sink}
+}
+
+func (a *AdminAPI) ListWriters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(a.sink.Writers())
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to encode writers")
+	}
+}
+
+// ListFiles lists the files waiting to be uploaded, including open files
+// with ?open=true
+func (a *AdminAPI) ListFiles(w http.ResponseWriter, r *http.Request) {
+	includeOpen, _ := strconv.ParseBool(r.URL.Query().Get("open"))
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(a.sink.StagedFiles(includeOpen))
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to encode files")
+	}
+}
+
+// Healthz returns 503 if the sink reports it's unhealthy, for liveness
+// probes. Sinks which can't check their health are always healthy.
+func (a *AdminAPI) Healthz(w http.ResponseWriter, r *http.Request) {
+	if checker, ok := a.sink.(HealthChecker); ok {
+		if err := checker.CheckHealth(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	w.Write([]byte("ok"))
+}
+
+func (a *AdminAPI) FlushWriter(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	err := a.sink.FlushWriter(id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+func CreateMux(a *AdminAPI) *chi.Mux {
+	r := chi.NewRouter()
+	r.Handle("/metrics", promhttp.Handler())
+	r.Get("/writers", a.ListWriters)
+	r.Post("/writers/{id}/flush", a.FlushWriter)
+	r.Get("/files", a.ListFiles)
+	r.Get("/healthz", a.Healthz)
+	return r
+}
+
+func RunAdmin(ctx context.Context, config config.Admin, mux *chi.Mux) {
+	address := config.Address
+	if address == "" {
+		address = DefaultAddress
+	}
+
+	log.Debug().Str("address", address).Msg("Starting admin server")
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		log.Debug().Msg("Stopping admin server")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Error().Err(err).Msg("Error shutting down admin server")
+		}
+	}()
+
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Err(err).Msg("Error serving admin server")
+	}
+
+	log.Debug().Msg("Admin server stopped")
+}
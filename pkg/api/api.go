@@ -12,6 +12,7 @@ import (
 
 	"github.com/bwmarrin/snowflake"
 	"github.com/go-chi/chi/v5"
+	"github.com/oklog/ulid/v2"
 	"github.com/rs/zerolog/log"
 	"github.com/scratchdata/scratchdata/config"
 )
@@ -21,9 +22,13 @@ type ScratchDataAPIStruct struct {
 	destinationManager *destinations.DestinationManager
 	dataSink           datasink.DataSink
 	snow               *snowflake.Node
+	config             config.API
+
+	// newULID, if set, generates vertically flattened documents' ids
+	newULID func() ulid.ULID
 }
 
-func NewScratchDataAPI(storageServices *models.StorageServices, destinationManager *destinations.DestinationManager, dataSink datasink.DataSink) (*ScratchDataAPIStruct, error) {
+func NewScratchDataAPI(conf config.API, storageServices *models.StorageServices, destinationManager *destinations.DestinationManager, dataSink datasink.DataSink) (*ScratchDataAPIStruct, error) {
 	snow, err := util.NewSnowflakeGenerator()
 	if err != nil {
 		return nil, err
@@ -34,6 +39,7 @@ func NewScratchDataAPI(storageServices *models.StorageServices, destinationManag
 		destinationManager: destinationManager,
 		dataSink:           dataSink,
 		snow:               snow,
+		config:             conf,
 	}
 
 	return &rc, nil
@@ -1,16 +1,89 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog/log"
+	"github.com/scratchdata/scratchdata/pkg/datasink"
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
+// traceHeaders are the trace context headers passed on to the data sink with
+// inserted rows
+var traceHeaders = []string{"traceparent", "tracestate", "baggage"}
+
+// requestTrace returns r's trace context headers, or nil if it has none
+func requestTrace(r *http.Request) map[string]string {
+	var rc map[string]string
+	for _, header := range traceHeaders {
+		if value := r.Header.Get(header); value != "" {
+			if rc == nil {
+				rc = map[string]string{}
+			}
+			rc[header] = value
+		}
+	}
+	return rc
+}
+
+// writeData writes data to the data sink, along with trace if the sink can
+// carry it to the queue
+func (a *ScratchDataAPIStruct) writeData(databaseID int64, table string, data []byte, trace map[string]string) error {
+	if writer, ok := a.dataSink.(datasink.TraceWriter); ok && trace != nil {
+		return writer.WriteBatchTrace(databaseID, table, [][]byte{data}, trace)
+	}
+	return a.dataSink.WriteData(databaseID, table, data)
+}
+
+// gzipResponse gzips the response if the client accepts it. The returned
+// func must be called once the response has been written.
+func gzipResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r) {
+		return w, func() {}
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	return &gzipResponseWriter{ResponseWriter: w, gz: gz}, func() { gz.Close() }
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+			if strings.TrimSpace(name) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+// RetryAfterSeconds is returned in the Retry-After header when the data sink
+// applies backpressure
+const RetryAfterSeconds = 10
+
 func (a *ScratchDataAPIStruct) Select(w http.ResponseWriter, r *http.Request) {
 	databaseID := a.AuthGetDatabaseID(r.Context())
 
@@ -42,6 +115,9 @@ func (a *ScratchDataAPIStruct) Select(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w, closeWriter := gzipResponse(w, r)
+	defer closeWriter()
+
 	switch strings.ToLower(format) {
 	case "csv":
 		w.Header().Set("Content-Type", "text/csv")
@@ -62,10 +138,11 @@ func (a *ScratchDataAPIStruct) Insert(w http.ResponseWriter, r *http.Request) {
 	databaseID := a.AuthGetDatabaseID(r.Context())
 	table := chi.URLParam(r, "table")
 	flatten := r.URL.Query().Get("flatten")
+	trace := requestTrace(r)
 
 	var flattener Flattener
 	if flatten == "vertical" {
-		flattener = VerticalFlattener{}
+		flattener = VerticalFlattener{NewULID: a.newULID}
 	} else {
 		flattener = HorizontalFlattener{}
 	}
@@ -77,6 +154,15 @@ func (a *ScratchDataAPIStruct) Insert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !a.checkWrite(w, databaseID) {
+		return
+	}
+
+	if raw, ok := a.dataSink.(datasink.RawWriter); ok && raw.WritesRaw() {
+		a.insertRaw(w, databaseID, table, body, trace)
+		return
+	}
+
 	if !gjson.ValidBytes(body) {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("Invalid JSON"))
@@ -89,8 +175,10 @@ func (a *ScratchDataAPIStruct) Insert(w http.ResponseWriter, r *http.Request) {
 	lines := parsed.Array()
 
 	errorItems := map[int]bool{}
+	backpressure := false
 	for i, line := range lines {
-		flatItems, err := flattener.Flatten(table, line.Raw)
+		raw, metadata := a.splitMetadata(line.Raw)
+		flatItems, err := flattener.Flatten(table, raw)
 		if err != nil {
 			errorItems[i] = true
 			log.Trace().Err(err).Str("json", line.Raw).Msg("Unable to flatten JSON")
@@ -102,32 +190,160 @@ func (a *ScratchDataAPIStruct) Insert(w http.ResponseWriter, r *http.Request) {
 			var toWrite string
 
 			toWrite = flatItem.JSON
+			if metadata != "" {
+				if toWrite, err = sjson.SetRaw(toWrite, a.config.MetadataKey, metadata); err != nil {
+					log.Trace().Err(err).Str("json", flatItem.JSON).Msg("Unable to restore metadata")
+				}
+			}
 
-			if !gjson.Get(flatItem.JSON, "__row_id").Exists() {
+			rowIDField := a.config.RowIDField()
+			if !gjson.Get(toWrite, rowIDField).Exists() {
 				snowID := a.snow.Generate()
 				rowID := snowID.Int64()
-				if toWrite, err = sjson.Set(flatItem.JSON, "__row_id", rowID); err != nil {
-					log.Trace().Err(err).Str("json", flatItem.JSON).Msg("Unable to add __row_id")
+				if toWrite, err = sjson.Set(toWrite, rowIDField, rowID); err != nil {
+					log.Trace().Err(err).Str("json", flatItem.JSON).Str("field", rowIDField).Msg("Unable to add row id")
 				}
 			}
 
-			writeErr = a.dataSink.WriteData(databaseID, flatItem.Table, []byte(toWrite))
+			writeErr = a.writeData(databaseID, flatItem.Table, []byte(toWrite), trace)
 
 			if writeErr != nil {
 				errorItems[i] = true
+				if errors.Is(writeErr, models.ErrBackpressure) || errors.Is(writeErr, models.ErrDiskFull) {
+					backpressure = true
+				}
 				log.Trace().Err(writeErr).Str("json", flatItem.JSON).Msg("Unable to write JSON")
 			}
 		}
 	}
 
-	if len(errorItems) > 0 {
-		if len(errorItems) == len(lines) {
+	failed := make([]int, 0, len(errorItems))
+	for i := range errorItems {
+		failed = append(failed, i)
+	}
+	sort.Ints(failed)
+
+	insertResponse(w, failed, len(lines), backpressure)
+}
+
+// checkWrite turns the request away with insertResponse if the data sink
+// would refuse writes for the database, so none of it is written, and
+// returns whether to carry on
+func (a *ScratchDataAPIStruct) checkWrite(w http.ResponseWriter, databaseID int64) bool {
+	checker, ok := a.dataSink.(datasink.WriteChecker)
+	if !ok {
+		return true
+	}
+
+	err := checker.CheckWrite(databaseID)
+	if err == nil {
+		return true
+	}
+
+	log.Trace().Err(err).Int64("database_id", databaseID).Msg("Refusing insert")
+	if errors.Is(err, models.ErrBackpressure) || errors.Is(err, models.ErrDiskFull) {
+		insertResponse(w, nil, 0, true)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Unable to insert data"))
+	}
+	return false
+}
+
+// splitMetadata takes the metadata key's object out of a row, so the row can
+// be flattened without flattening the metadata into it, and returns both
+func (a *ScratchDataAPIStruct) splitMetadata(row string) (string, string) {
+	if a.config.MetadataKey == "" {
+		return row, ""
+	}
+
+	metadata := gjson.Get(row, a.config.MetadataKey)
+	if !metadata.IsObject() {
+		return row, ""
+	}
+	rest, err := sjson.Delete(row, a.config.MetadataKey)
+	if err != nil {
+		return row, ""
+	}
+	return rest, metadata.Raw
+}
+
+// insertRaw writes the lines of an NDJSON body to the data sink as they are,
+// as one batch if the sink supports it. The whole batch succeeds or fails,
+// so a failed batch reports every line as failed.
+func (a *ScratchDataAPIStruct) insertRaw(w http.ResponseWriter, databaseID int64, table string, body []byte, trace map[string]string) {
+	records := [][]byte{}
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		records = append(records, line)
+	}
+
+	var failed []int
+	backpressure := false
+	fail := func(i int, err error) {
+		failed = append(failed, i)
+		if errors.Is(err, models.ErrBackpressure) || errors.Is(err, models.ErrDiskFull) {
+			backpressure = true
+		}
+	}
+
+	var err error
+	batched := true
+	if writer, ok := a.dataSink.(datasink.TraceWriter); ok && trace != nil {
+		err = writer.WriteBatchTrace(databaseID, table, records, trace)
+	} else if writer, ok := a.dataSink.(datasink.BatchWriter); ok {
+		err = writer.WriteBatch(databaseID, table, records)
+	} else {
+		batched = false
+	}
+
+	if batched {
+		if err != nil {
+			log.Trace().Err(err).Int("lines", len(records)).Msg("Unable to write raw JSON")
+			for i := range records {
+				fail(i, err)
+			}
+		}
+	} else {
+		for i, record := range records {
+			if err := a.dataSink.WriteData(databaseID, table, record); err != nil {
+				log.Trace().Err(err).Bytes("json", record).Msg("Unable to write raw JSON")
+				fail(i, err)
+			}
+		}
+	}
+
+	insertResponse(w, failed, len(records), backpressure)
+}
+
+// insertResponse reports which of an insert's lines, by index, failed to be
+// written. Backpressure is only reported as such when nothing was written,
+// so clients don't retry lines which made it in.
+func insertResponse(w http.ResponseWriter, failed []int, lines int, backpressure bool) {
+	// Let load balancers know to send data elsewhere until uploads catch up
+	if backpressure {
+		w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+		if len(failed) == lines {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Too much data pending, try again later"))
+			return
+		}
+	}
+
+	if len(failed) > 0 {
+		if len(failed) == lines {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Unable to insert data"))
 			return
 		} else {
+			indexes := make([]string, len(failed))
+			for i, index := range failed {
+				indexes[i] = strconv.Itoa(index)
+			}
 			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Partially inserted data"))
+			w.Write([]byte("Partially inserted data; failed items: " + strings.Join(indexes, ",")))
 			return
 		}
 	}
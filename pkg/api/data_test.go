@@ -0,0 +1,322 @@
+package api
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/oklog/ulid/v2"
+	"github.com/scratchdata/scratchdata/config"
+	"github.com/scratchdata/scratchdata/pkg/datasink"
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
+	"github.com/tidwall/gjson"
+)
+
+// testSink records what's written to it. Writes fail with err once
+// failAfter records have been written, CheckWrite returns checkErr and
+// WritesRaw returns raw.
+type testSink struct {
+	mu        sync.Mutex
+	records   map[string][]string
+	written   int
+	failAfter int
+	err       error
+	checkErr  error
+	raw       bool
+}
+
+func (s *testSink) Start(context.Context) error { return nil }
+
+func (s *testSink) WritesRaw() bool { return s.raw }
+
+func (s *testSink) CheckWrite(databaseID int64) error { return s.checkErr }
+
+func (s *testSink) WriteData(databaseID int64, table string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil && s.written >= s.failAfter {
+		return s.err
+	}
+	s.written++
+	if s.records == nil {
+		s.records = map[string][]string{}
+	}
+	s.records[table] = append(s.records[table], string(data))
+	return nil
+}
+
+func newTestAPI(t *testing.T, conf config.API, sink datasink.DataSink) *ScratchDataAPIStruct {
+	t.Helper()
+
+	a, err := NewScratchDataAPI(conf, nil, nil, sink)
+	if err != nil {
+		t.Fatalf("Cannot create API: %s", err)
+	}
+	return a
+}
+
+// insert posts body to a's Insert handler for table as database 1
+func insert(a *ScratchDataAPIStruct, table, query, body string) *httptest.ResponseRecorder {
+	routeCtx := chi.NewRouteContext()
+	routeCtx.URLParams.Add("table", table)
+	ctx := context.WithValue(context.Background(), chi.RouteCtxKey, routeCtx)
+	ctx = context.WithValue(ctx, "databaseId", int64(1))
+
+	r := httptest.NewRequest(http.MethodPost, "/api/data/insert/"+table+query, strings.NewReader(body)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	a.Insert(w, r)
+	return w
+}
+
+func TestInsertRowID(t *testing.T) {
+	sink := &testSink{}
+	a := newTestAPI(t, config.API{}, sink)
+
+	w := insert(a, "events", "", `[{"n":1},{"n":2,"__row_id":7}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200; Got %d: %s", w.Code, w.Body.String())
+	}
+
+	rows := sink.records["events"]
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows; Got %v", rows)
+	}
+	if id := gjson.Get(rows[0], "__row_id"); id.Type != gjson.Number || id.Int() == 0 {
+		t.Fatalf("Expected a row id to be added; Got %s", rows[0])
+	}
+	if id := gjson.Get(rows[1], "__row_id").Int(); id != 7 {
+		t.Fatalf("Expected the row's own id to be kept; Got %s", rows[1])
+	}
+}
+
+func TestInsertRowIDMetadataKey(t *testing.T) {
+	sink := &testSink{}
+	a := newTestAPI(t, config.API{MetadataKey: "_scratch"}, sink)
+
+	w := insert(a, "events", "", `[{"n":1},{"n":2,"_scratch":{"row_id":7}}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200; Got %d: %s", w.Code, w.Body.String())
+	}
+
+	rows := sink.records["events"]
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows; Got %v", rows)
+	}
+	if gjson.Get(rows[0], "__row_id").Exists() {
+		t.Fatalf("Expected no top level row id; Got %s", rows[0])
+	}
+	if id := gjson.Get(rows[0], "_scratch.row_id"); id.Type != gjson.Number || id.Int() == 0 {
+		t.Fatalf("Expected a row id under _scratch; Got %s", rows[0])
+	}
+	if id := gjson.Get(rows[1], "_scratch.row_id").Int(); id != 7 {
+		t.Fatalf("Expected the row's own id to be kept; Got %s", rows[1])
+	}
+}
+
+func TestInsertRowIDMetadataKeyVertical(t *testing.T) {
+	sink := &testSink{}
+	a := newTestAPI(t, config.API{MetadataKey: "_scratch"}, sink)
+
+	w := insert(a, "events", "?flatten=vertical", `{"n":1,"items":[{"a":1},{"a":2}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200; Got %d: %s", w.Code, w.Body.String())
+	}
+
+	for table, rows := range sink.records {
+		for _, row := range rows {
+			if gjson.Get(row, "__row_id").Exists() || !gjson.Get(row, "_scratch.row_id").Exists() {
+				t.Fatalf("Expected row id only under _scratch in %s; Got %s", table, row)
+			}
+		}
+	}
+}
+
+func TestInsertBackpressureBeforeWriting(t *testing.T) {
+	sink := &testSink{checkErr: models.ErrBackpressure}
+	a := newTestAPI(t, config.API{}, sink)
+
+	for _, raw := range []bool{false, true} {
+		sink.raw = raw
+		w := insert(a, "events", "", `[{"n":1},{"n":2}]`)
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+			t.Fatalf("Expected 503 with Retry-After; Got %d %v", w.Code, w.Header())
+		}
+	}
+	if len(sink.records) != 0 {
+		t.Fatalf("Expected nothing to be written; Got %v", sink.records)
+	}
+}
+
+func TestInsertBackpressurePartial(t *testing.T) {
+	sink := &testSink{err: models.ErrBackpressure, failAfter: 2}
+	a := newTestAPI(t, config.API{}, sink)
+
+	w := insert(a, "events", "", `[{"n":1},{"n":2},{"n":3},{"n":4}]`)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500 for a partial insert; Got %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.HasSuffix(body, "failed items: 2,3") {
+		t.Fatalf("Expected the failed items to be listed; Got %q", body)
+	}
+	if len(sink.records["events"]) != 2 {
+		t.Fatalf("Expected 2 rows written; Got %v", sink.records)
+	}
+}
+
+func TestInsertRawBackpressurePartial(t *testing.T) {
+	sink := &testSink{err: models.ErrBackpressure, failAfter: 1, raw: true}
+	a := newTestAPI(t, config.API{}, sink)
+
+	w := insert(a, "events", "", "{\"n\":1}\n\n{\"n\":2}\n")
+	if body := w.Body.String(); w.Code != http.StatusInternalServerError || !strings.HasSuffix(body, "failed items: 1") {
+		t.Fatalf("Expected a partial insert failing item 1; Got %d %q", w.Code, body)
+	}
+}
+
+// batchSink is a testSink which writes batches, all or nothing
+type batchSink struct {
+	testSink
+	batches [][]string
+}
+
+func (s *batchSink) WriteBatch(databaseID int64, table string, records [][]byte) error {
+	if s.err != nil && s.written+len(records) > s.failAfter {
+		return s.err
+	}
+
+	batch := []string{}
+	for _, record := range records {
+		batch = append(batch, string(record))
+		s.testSink.WriteData(databaseID, table, record)
+	}
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *batchSink) WriteData(databaseID int64, table string, data []byte) error {
+	return s.WriteBatch(databaseID, table, [][]byte{data})
+}
+
+func TestInsertRawBatch(t *testing.T) {
+	sink := &batchSink{testSink: testSink{raw: true}}
+	a := newTestAPI(t, config.API{}, sink)
+
+	w := insert(a, "events", "", "{\"n\":1}\n\n{\"n\":2,\"__row_id\":7}\n{\"n\":{\"a\":3}}")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200; Got %d: %s", w.Code, w.Body.String())
+	}
+
+	exp := []string{`{"n":1}`, `{"n":2,"__row_id":7}`, `{"n":{"a":3}}`}
+	if len(sink.batches) != 1 || strings.Join(sink.batches[0], "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("Expected the lines to be written as they are in one batch; Got %q", sink.batches)
+	}
+}
+
+func TestInsertRawBatchFailed(t *testing.T) {
+	sink := &batchSink{testSink: testSink{raw: true, err: models.ErrBackpressure, failAfter: 1}}
+	a := newTestAPI(t, config.API{}, sink)
+
+	w := insert(a, "events", "", "{\"n\":1}\n{\"n\":2}\n")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a failed batch to fail every line; Got %d %q", w.Code, w.Body.String())
+	}
+	if len(sink.records) != 0 {
+		t.Fatalf("Expected nothing to be written; Got %v", sink.records)
+	}
+}
+
+func TestInsertVerticalDocumentID(t *testing.T) {
+	sink := &testSink{}
+	a := newTestAPI(t, config.API{}, sink)
+
+	// A seeded source gives the same ids every run
+	entropy := ulid.Monotonic(rand.New(rand.NewSource(1)), 0)
+	ms := ulid.Timestamp(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	a.newULID = func() ulid.ULID { return ulid.MustNew(ms, entropy) }
+
+	exp := ulid.MustNew(ms, ulid.Monotonic(rand.New(rand.NewSource(1)), 0)).String()
+
+	w := insert(a, "events", "?flatten=vertical", `{"n":1,"items":[{"a":1},{"a":2}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200; Got %d: %s", w.Code, w.Body.String())
+	}
+
+	rows := sink.records["events"]
+	if len(rows) != 2 {
+		t.Fatalf("Expected a row per item; Got %v", rows)
+	}
+	for _, row := range rows {
+		if id := gjson.Get(row, "___document_id").String(); id != exp {
+			t.Fatalf("Expected every row to have document id %s; Got %s", exp, row)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		encoding []string
+		expected bool
+	}{
+		{encoding: nil, expected: false},
+		{encoding: []string{"gzip"}, expected: true},
+		{encoding: []string{"deflate, gzip;q=0.5"}, expected: true},
+		{encoding: []string{"br", " gzip "}, expected: true},
+		{encoding: []string{"gzip;q=0"}, expected: false},
+		{encoding: []string{"gzip; q = 0"}, expected: false},
+		{encoding: []string{"x-gzip, deflate"}, expected: false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, value := range test.encoding {
+			r.Header.Add("Accept-Encoding", value)
+		}
+		if got := acceptsGzip(r); got != test.expected {
+			t.Fatalf("Expected %v for %q; Got %v", test.expected, test.encoding, got)
+		}
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	rec := httptest.NewRecorder()
+	w, closeWriter := gzipResponse(rec, r)
+	w.Write([]byte(`{"n":1}`))
+	closeWriter()
+
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("Expected gzip headers; Got %v", rec.Header())
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Cannot read gzipped response: %s", err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil || string(body) != `{"n":1}` {
+		t.Fatalf("Expected the body to be gzipped; Got %q, %v", body, err)
+	}
+
+	r.Header.Del("Accept-Encoding")
+	rec = httptest.NewRecorder()
+	w, closeWriter = gzipResponse(rec, r)
+	w.Write([]byte(`{"n":1}`))
+	closeWriter()
+
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != `{"n":1}` {
+		t.Fatalf("Expected a plain response; Got %v %q", rec.Header(), rec.Body.String())
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("Expected Vary on a plain response; Got %v", rec.Header())
+	}
+}
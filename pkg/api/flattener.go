@@ -17,7 +17,19 @@ type Flattener interface {
 	Flatten(table string, json string) ([]JSONData, error)
 }
 
-type VerticalFlattener struct{}
+type VerticalFlattener struct {
+	// NewULID, if set, generates each document's ___document_id instead of
+	// ulid.Make, e.g. from a seeded entropy source in tests
+	NewULID func() ulid.ULID
+}
+
+// documentID returns a new ___document_id
+func (e VerticalFlattener) documentID() string {
+	if e.NewULID != nil {
+		return e.NewULID().String()
+	}
+	return ulid.Make().String()
+}
 
 func (e VerticalFlattener) parseMap(obj map[string]interface{}, path []string, useIndices bool) [][]map[string]interface{} {
 	var result [][]map[string]interface{}
@@ -116,7 +128,7 @@ func (e VerticalFlattener) flattenJSON(obj string, path []string, useIndices boo
 }
 
 func (e VerticalFlattener) Flatten(table string, json string) ([]JSONData, error) {
-	documentId := ulid.Make().String()
+	documentId := e.documentID()
 	dataWithDocumentId, err := sjson.Set(json, "___document_id", documentId)
 
 	var flattened []string
@@ -0,0 +1,157 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultRefreshInterval is how long a resolved secret is cached before it is read again
+const DefaultRefreshInterval = 5 * time.Minute
+
+// Provider resolves a secret at runtime
+type Provider interface {
+	Get() (string, error)
+}
+
+// Static returns a fixed value, typically taken directly from the config file
+type Static string
+
+func (s Static) Get() (string, error) {
+	return string(s), nil
+}
+
+// Env reads the secret from an environment variable
+type Env string
+
+func (e Env) Get() (string, error) {
+	v, ok := os.LookupEnv(string(e))
+	if !ok {
+		return "", errors.New("environment variable " + string(e) + " is not set")
+	}
+	return v, nil
+}
+
+// File reads the secret from a file, e.g. one mounted by Vault or Kubernetes.
+// Surrounding whitespace is trimmed.
+type File string
+
+func (f File) Get() (string, error) {
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Cached wraps a provider and only calls it again once the refresh interval has passed.
+// If a refresh fails the error is logged and the last known value is kept.
+type Cached struct {
+	mu       sync.Mutex
+	provider Provider
+	refresh  time.Duration
+	now      func() time.Time
+
+	value   string
+	fetched time.Time
+}
+
+func (c *Cached) Get() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetched.IsZero() && c.now().Sub(c.fetched) < c.refresh {
+		return c.value, nil
+	}
+
+	value, err := c.provider.Get()
+	if err != nil {
+		if !c.fetched.IsZero() {
+			log.Warn().Err(err).Time("fetched", c.fetched).Msg("Unable to refresh secret, using the last known value")
+			return c.value, nil
+		}
+		return "", err
+	}
+
+	c.value = value
+	c.fetched = c.now()
+	return value, nil
+}
+
+// NewCached returns a provider which caches p for the given interval
+func NewCached(p Provider, refresh time.Duration) *Cached {
+	if refresh <= 0 {
+		refresh = DefaultRefreshInterval
+	}
+	return &Cached{provider: p, refresh: refresh, now: time.Now}
+}
+
+var (
+	schemesMu sync.RWMutex
+	schemes   = map[string]func(ref string) Provider{
+		"env":  func(ref string) Provider { return Env(ref) },
+		"file": func(ref string) Provider { return File(ref) },
+	}
+)
+
+// Register adds a secret source for values of the form scheme://ref, such as
+// a secrets manager, replacing any source already registered for scheme.
+// newProvider is passed ref, and the providers it returns are cached. Call
+// it before the config is parsed.
+func Register(scheme string, newProvider func(ref string) Provider) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	schemes[scheme] = newProvider
+}
+
+// Parse returns a provider for a config value. Values may reference a secret
+// source registered with Register, of which these are built in:
+//
+//	env://NAME     read from the environment variable NAME
+//	file:///path   read from the file at /path
+//
+// Anything else, including values with an unregistered scheme, is treated as
+// a literal value. Non-static providers are cached.
+func Parse(value string) Provider {
+	scheme, ref, ok := strings.Cut(value, "://")
+	if !ok {
+		return Static(value)
+	}
+
+	schemesMu.RLock()
+	newProvider, ok := schemes[scheme]
+	schemesMu.RUnlock()
+	if !ok {
+		return Static(value)
+	}
+	return NewCached(newProvider(ref), DefaultRefreshInterval)
+}
+
+// AWSCredentials adapts access key and secret providers to an aws.CredentialsProvider.
+// Credentials expire after the refresh interval so the AWS SDK re-resolves them.
+func AWSCredentials(accessKeyID Provider, secretAccessKey Provider) aws.CredentialsProvider {
+	return aws.NewCredentialsCache(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		id, err := accessKeyID.Get()
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+		secret, err := secretAccessKey.Get()
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+
+		return aws.Credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			Source:          "scratchdata",
+			CanExpire:       true,
+			Expires:         time.Now().Add(DefaultRefreshInterval),
+		}, nil
+	}))
+}
@@ -0,0 +1,117 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countingProvider returns value, or err while it's set, counting calls
+type countingProvider struct {
+	value string
+	err   error
+	calls int
+}
+
+func (p *countingProvider) Get() (string, error) {
+	p.calls++
+	if p.err != nil {
+		return "", p.err
+	}
+	return p.value, nil
+}
+
+func TestParse(t *testing.T) {
+	t.Setenv("TEST_SECRET", "from-env")
+
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("Cannot write secret: %s", err)
+	}
+
+	Register("test", func(ref string) Provider { return Static("from-" + ref) })
+	t.Cleanup(func() {
+		schemesMu.Lock()
+		delete(schemes, "test")
+		schemesMu.Unlock()
+	})
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{value: "literal", expected: "literal"},
+		{value: "env://TEST_SECRET", expected: "from-env"},
+		{value: "file://" + path, expected: "from-file"},
+		{value: "test://registry", expected: "from-registry"},
+		{value: "https://example.com", expected: "https://example.com"},
+	}
+
+	for _, test := range tests {
+		value, err := Parse(test.value).Get()
+		if err != nil || value != test.expected {
+			t.Errorf("%s: expected %q; Got %q, %v", test.value, test.expected, value, err)
+		}
+	}
+
+	if _, err := Parse("env://TEST_SECRET_MISSING").Get(); err == nil {
+		t.Error("Expected an error for an unset environment variable")
+	}
+}
+
+func TestCached(t *testing.T) {
+	p := &countingProvider{value: "first"}
+	c := NewCached(p, time.Minute)
+
+	now := time.Unix(1700000000, 0)
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if value, err := c.Get(); err != nil || value != "first" {
+			t.Fatalf("Expected first; Got %q, %v", value, err)
+		}
+	}
+	if p.calls != 1 {
+		t.Fatalf("Expected the value to be cached; Got %d calls", p.calls)
+	}
+
+	p.value = "second"
+	now = now.Add(time.Minute)
+	if value, _ := c.Get(); value != "second" || p.calls != 2 {
+		t.Fatalf("Expected a refresh once the interval passes; Got %q after %d calls", value, p.calls)
+	}
+
+	// A failed refresh keeps the last known value, and retries next time
+	p.err = errors.New("unavailable")
+	now = now.Add(time.Minute)
+	if value, err := c.Get(); err != nil || value != "second" {
+		t.Fatalf("Expected the last known value; Got %q, %v", value, err)
+	}
+	c.Get()
+	if p.calls != 4 {
+		t.Fatalf("Expected a failed refresh to be retried; Got %d calls", p.calls)
+	}
+
+	if _, err := NewCached(&countingProvider{err: p.err}, time.Minute).Get(); err == nil {
+		t.Fatal("Expected an error without a known value")
+	}
+}
+
+func TestAWSCredentials(t *testing.T) {
+	secret := &countingProvider{value: "secret"}
+	creds, err := AWSCredentials(Static("id"), secret).Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Cannot retrieve credentials: %s", err)
+	}
+	if creds.AccessKeyID != "id" || creds.SecretAccessKey != "secret" || !creds.CanExpire {
+		t.Fatalf("Unexpected credentials %+v", creds)
+	}
+
+	secret.err = errors.New("unavailable")
+	if _, err := AWSCredentials(Static("id"), secret).Retrieve(context.Background()); !errors.Is(err, secret.err) {
+		t.Fatalf("Expected the provider's error; Got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
+	"github.com/scratchdata/scratchdata/pkg/destinations"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// DataSink batches records in memory and inserts them straight into each
+// database's ClickHouse destination, skipping the blob store and queue. It's
+// meant for low-latency streams, typically into a Buffer table. Batches are
+// flushed on the same size, row and age thresholds as files.
+//
+// Batches are lost if the process dies before they're flushed. When an
+// insert fails the batch is kept and retried, and writes to that table fail
+// with ErrBackpressure until it succeeds.
+type DataSink struct {
+	MaxSizeBytes int64 `mapstructure:"max_size_bytes"`
+	MaxRows      int64 `mapstructure:"max_rows"`
+	MaxAgeMillis int   `mapstructure:"max_age_millis"`
+
+	destinations destinationSource
+	now          func() time.Time
+
+	// mutex guards the batches map. Each batch has its own lock, held while
+	// it's inserted, so a slow insert only holds up writes to its table.
+	mutex   sync.Mutex
+	batches map[string]*batch
+}
+
+// destinationSource returns each database's destination, as
+// destinations.DestinationManager does
+type destinationSource interface {
+	Destination(databaseID int64) (destinations.Destination, error)
+}
+
+// inserter is implemented by destinations which can take batches directly
+type inserter interface {
+	CreateEmptyTable(table string) error
+	InsertJSONEachRow(table string, input io.ReadSeeker) error
+}
+
+type batch struct {
+	mu sync.Mutex
+
+	databaseID int64
+	table      string
+
+	data    bytes.Buffer
+	rows    int64
+	created time.Time
+
+	// err is the last failed insert, cleared once the batch is flushed
+	err error
+
+	// tableCreated is set once the table is known to exist
+	tableCreated bool
+}
+
+// defaultMaxAge is used when max_age_millis is not configured
+const defaultMaxAge = 1 * time.Second
+
+func (m *DataSink) maxAge() time.Duration {
+	if m.MaxAgeMillis <= 0 {
+		return defaultMaxAge
+	}
+	return time.Duration(m.MaxAgeMillis) * time.Millisecond
+}
+
+func (m *DataSink) key(databaseID int64, table string) string {
+	return fmt.Sprintf("%d_%s", databaseID, table)
+}
+
+func (m *DataSink) needsFlush(b *batch) bool {
+	if b.rows == 0 {
+		return false
+	}
+	if m.MaxSizeBytes > 0 && int64(b.data.Len()) >= m.MaxSizeBytes {
+		return true
+	}
+	if m.MaxRows > 0 && b.rows >= m.MaxRows {
+		return true
+	}
+	return m.now().Sub(b.created) >= m.maxAge()
+}
+
+// flush inserts the batch. The caller must hold b.mu.
+func (m *DataSink) flush(b *batch) error {
+	if b.rows == 0 {
+		return nil
+	}
+
+	err := m.insert(b)
+	if err != nil {
+		b.err = err
+		return err
+	}
+
+	b.data.Reset()
+	b.rows = 0
+	b.err = nil
+	return nil
+}
+
+func (m *DataSink) insert(b *batch) error {
+	destination, err := m.destinations.Destination(b.databaseID)
+	if err != nil {
+		return err
+	}
+
+	dest, ok := destination.(inserter)
+	if !ok {
+		return fmt.Errorf("destination for database %d does not support direct inserts", b.databaseID)
+	}
+
+	if !b.tableCreated {
+		err = dest.CreateEmptyTable(b.table)
+		if err != nil {
+			return err
+		}
+		b.tableCreated = true
+	}
+
+	return dest.InsertJSONEachRow(b.table, bytes.NewReader(b.data.Bytes()))
+}
+
+// FlushAll flushes every batch which needs it, or every batch if force is set
+func (m *DataSink) FlushAll(force bool) {
+	m.mutex.Lock()
+	batches := make(map[string]*batch, len(m.batches))
+	for key, b := range m.batches {
+		batches[key] = b
+	}
+	m.mutex.Unlock()
+
+	for key, b := range batches {
+		b.mu.Lock()
+		if force || m.needsFlush(b) {
+			if err := m.flush(b); err != nil {
+				log.Error().Err(err).Str("batch", key).Msg("Unable to insert batch")
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// batch returns the batch for a table, creating it if needed
+func (m *DataSink) batch(databaseID int64, table string) *batch {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := m.key(databaseID, table)
+	b, ok := m.batches[key]
+	if !ok {
+		b = &batch{databaseID: databaseID, table: table}
+		m.batches[key] = b
+	}
+	return b
+}
+
+func (m *DataSink) WriteData(databaseID int64, table string, data []byte) error {
+	key := m.key(databaseID, table)
+	b := m.batch(databaseID, table)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Don't accept more data for a table ClickHouse is rejecting
+	if b.err != nil {
+		if err := m.flush(b); err != nil {
+			return fmt.Errorf("%w: %w", models.ErrBackpressure, err)
+		}
+	}
+
+	if b.rows == 0 {
+		b.created = m.now()
+	}
+	b.data.Write(data)
+	b.data.WriteByte('\n')
+	b.rows++
+
+	if m.needsFlush(b) {
+		if err := m.flush(b); err != nil {
+			// The record is in the batch and will be retried
+			log.Error().Err(err).Str("batch", key).Msg("Unable to insert batch")
+		}
+	}
+
+	return nil
+}
+
+func (m *DataSink) Start(ctx context.Context) error {
+	ticker := time.NewTicker(m.maxAge() / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.FlushAll(false)
+		case <-ctx.Done():
+			m.FlushAll(true)
+			return nil
+		}
+	}
+}
+
+func NewClickHouseDataSink(settings map[string]any, destinationManager *destinations.DestinationManager) (*DataSink, error) {
+	if destinationManager == nil {
+		return nil, errors.New("clickhouse data sink requires a destination manager")
+	}
+
+	settings, err := util.ByteSizeSettings(settings, "max_size_bytes")
+	if err != nil {
+		return nil, err
+	}
+
+	rc := util.ConfigToStruct[DataSink](settings)
+	rc.destinations = destinationManager
+	rc.now = time.Now
+	rc.batches = map[string]*batch{}
+
+	return rc, nil
+}
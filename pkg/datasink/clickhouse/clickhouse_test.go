@@ -0,0 +1,194 @@
+package clickhouse
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
+	"github.com/scratchdata/scratchdata/pkg/destinations"
+)
+
+// testDestination records the batches inserted into it. Inserts fail with
+// err while it's set, and inserts into block signal started, then wait until
+// release is closed.
+type testDestination struct {
+	destinations.Destination
+
+	mu       sync.Mutex
+	inserted map[string][]string
+	err      error
+	block    string
+	started  chan struct{}
+	release  chan struct{}
+}
+
+// testDestinations returns dest for every database
+type testDestinations struct {
+	dest *testDestination
+}
+
+func (s testDestinations) Destination(databaseID int64) (destinations.Destination, error) {
+	return s.dest, nil
+}
+
+func (d *testDestination) CreateEmptyTable(table string) error { return nil }
+
+func (d *testDestination) InsertJSONEachRow(table string, input io.ReadSeeker) error {
+	if table == d.block {
+		close(d.started)
+		<-d.release
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return d.err
+	}
+	data, _ := io.ReadAll(input)
+	d.inserted[table] = append(d.inserted[table], string(data))
+	return nil
+}
+
+func (d *testDestination) batches(table string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inserted[table]
+}
+
+func newTestSink(t *testing.T, settings map[string]any, dest *testDestination) *DataSink {
+	t.Helper()
+
+	sink, err := NewClickHouseDataSink(settings, destinations.NewDestinationManager(nil))
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	dest.inserted = map[string][]string{}
+	sink.destinations = testDestinations{dest: dest}
+	return sink
+}
+
+func TestFlushTriggers(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]any
+		writes   int
+		flushed  []string
+	}{
+		{name: "rows", settings: map[string]any{"max_rows": 2}, writes: 3, flushed: []string{"{\"a\":1}\n{\"a\":1}\n"}},
+		{name: "size", settings: map[string]any{"max_size_bytes": 16}, writes: 3, flushed: []string{"{\"a\":1}\n{\"a\":1}\n"}},
+		{name: "under limits", settings: map[string]any{"max_rows": 10, "max_size_bytes": "1KiB"}, writes: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dest := &testDestination{}
+			sink := newTestSink(t, test.settings, dest)
+
+			for i := 0; i < test.writes; i++ {
+				if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+					t.Fatalf("Cannot write data: %s", err)
+				}
+			}
+
+			if batches := dest.batches("events"); len(batches) != len(test.flushed) || (len(batches) > 0 && batches[0] != test.flushed[0]) {
+				t.Fatalf("Expected %q to be inserted; Got %q", test.flushed, batches)
+			}
+		})
+	}
+}
+
+func TestFlushAge(t *testing.T) {
+	dest := &testDestination{}
+	sink := newTestSink(t, map[string]any{"max_age_millis": 1000}, dest)
+
+	now := time.Unix(1700000000, 0)
+	sink.now = func() time.Time { return now }
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.FlushAll(false)
+	if batches := dest.batches("events"); len(batches) != 0 {
+		t.Fatalf("Expected no insert before max_age_millis; Got %q", batches)
+	}
+
+	now = now.Add(time.Second)
+	sink.FlushAll(false)
+	if batches := dest.batches("events"); len(batches) != 1 {
+		t.Fatalf("Expected an insert once max_age_millis passes; Got %q", batches)
+	}
+
+	// Forcing flushes batches whatever their age
+	if err := sink.WriteData(1, "events", []byte(`{"a":2}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.FlushAll(true)
+	if batches := dest.batches("events"); len(batches) != 2 || batches[1] != "{\"a\":2}\n" {
+		t.Fatalf("Expected a forced insert; Got %q", batches)
+	}
+}
+
+func TestBackpressureAfterFailure(t *testing.T) {
+	dest := &testDestination{err: errors.New("too many parts")}
+	sink := newTestSink(t, map[string]any{"max_rows": 1}, dest)
+
+	// The failed batch is kept to be retried
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Expected the first write to be accepted: %s", err)
+	}
+
+	err := sink.WriteData(1, "events", []byte(`{"a":2}`))
+	if !errors.Is(err, models.ErrBackpressure) {
+		t.Fatalf("Expected backpressure while inserts fail; Got %v", err)
+	}
+
+	// Other tables aren't held back
+	dest.mu.Lock()
+	dest.err = nil
+	dest.mu.Unlock()
+	if err := sink.WriteData(1, "clicks", []byte(`{"a":3}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":2}`)); err != nil {
+		t.Fatalf("Expected writes to be accepted once inserts succeed: %s", err)
+	}
+	if batches := dest.batches("events"); len(batches) != 2 || batches[0] != "{\"a\":1}\n" || batches[1] != "{\"a\":2}\n" {
+		t.Fatalf("Expected the kept batch to be inserted first; Got %q", batches)
+	}
+}
+
+func TestSlowInsertOnlyBlocksItsTable(t *testing.T) {
+	dest := &testDestination{block: "slow", started: make(chan struct{}), release: make(chan struct{})}
+	sink := newTestSink(t, map[string]any{"max_rows": 1}, dest)
+
+	done := make(chan error)
+	go func() {
+		done <- sink.WriteData(1, "slow", []byte(`{"a":1}`))
+	}()
+
+	<-dest.started
+
+	fast := make(chan error)
+	go func() {
+		fast <- sink.WriteData(1, "fast", []byte(`{"a":1}`))
+	}()
+
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a write to another table not to wait for the slow insert")
+	}
+
+	close(dest.release)
+	if err := <-done; err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+}
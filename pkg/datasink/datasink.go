@@ -1,12 +1,20 @@
 package datasink
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+
 	"github.com/scratchdata/scratchdata/config"
 	"github.com/scratchdata/scratchdata/models"
+	"github.com/scratchdata/scratchdata/pkg/datasink/clickhouse"
 	"github.com/scratchdata/scratchdata/pkg/datasink/filesystem"
 	"github.com/scratchdata/scratchdata/pkg/datasink/memory"
+	"github.com/scratchdata/scratchdata/pkg/destinations"
+	"github.com/tidwall/gjson"
 )
 
 type DataSink interface {
@@ -14,8 +22,53 @@ type DataSink interface {
 	WriteData(databaseID int64, table string, data []byte) error
 }
 
-func NewDataSink(conf config.DataSink, storage *models.StorageServices) (DataSink, error) {
+// Reloadable is implemented by data sinks which can apply new settings while running
+type Reloadable interface {
+	Reload(settings map[string]any) error
+}
+
+// SyncWriter is implemented by data sinks which can acknowledge a write only
+// once it's durably in the blob store. It's much slower than WriteData.
+type SyncWriter interface {
+	WriteSync(ctx context.Context, databaseID int64, table string, records [][]byte) error
+}
+
+// TraceWriter is implemented by data sinks which can carry a write's trace
+// context through to the queue message for the file it's written to
+type TraceWriter interface {
+	WriteBatchTrace(databaseID int64, table string, records [][]byte, trace map[string]string) error
+}
+
+// BatchWriter is implemented by data sinks which can write many records to a
+// table in one call
+type BatchWriter interface {
+	WriteBatch(databaseID int64, table string, records [][]byte) error
+}
+
+// RawWriter is implemented by data sinks which can be set to write records
+// exactly as they're given. While WritesRaw is true the API passes insert
+// bodies through as they are, without flattening them or adding row ids.
+type RawWriter interface {
+	WritesRaw() bool
+}
+
+// WriteChecker is implemented by data sinks which can say up front whether
+// writes for a database would be refused right now, such as for
+// backpressure, so a request can be turned away before any of it is written
+type WriteChecker interface {
+	CheckWrite(databaseID int64) error
+}
+
+// Drainer is implemented by data sinks which can upload everything pending
+// while carrying on accepting writes
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+func NewDataSink(conf config.DataSink, storage *models.StorageServices, destinationManager *destinations.DestinationManager) (DataSink, error) {
 	switch conf.Type {
+	case "clickhouse":
+		return clickhouse.NewClickHouseDataSink(conf.Settings, destinationManager)
 	case "memory":
 		return memory.NewMemoryDataSink(storage)
 	case "filesystem":
@@ -24,3 +77,160 @@ func NewDataSink(conf config.DataSink, storage *models.StorageServices) (DataSin
 
 	return nil, errors.New("Unsupported data sink")
 }
+
+// WriteReader reads newline-delimited JSON from r and writes each record to the sink.
+// Blank lines are skipped. It stops at the first invalid record or write error,
+// returning the number of records written so far.
+func WriteReader(sink DataSink, databaseID int64, table string, r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	maxCapacity := 100_000_000
+	buf := make([]byte, 2_000)
+	scanner.Buffer(buf, maxCapacity)
+
+	n := 0
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		if !gjson.ValidBytes(data) {
+			return n, fmt.Errorf("WriteReader: invalid JSON on line %d", line)
+		}
+
+		if err := sink.WriteData(databaseID, table, data); err != nil {
+			return n, fmt.Errorf("WriteReader: line %d: %w", line, err)
+		}
+		n++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return n, fmt.Errorf("WriteReader: line %d: %w", line+1, err)
+	}
+
+	return n, nil
+}
+
+// TableWriter writes newline-delimited JSON to one table of a data sink. It
+// implements io.Writer and io.ReaderFrom, so a file can be io.Copy'd straight
+// into a table. Records are passed to the sink in a reused buffer, which
+// every sink copies before WriteData returns. Call Close to write a final
+// record with no trailing newline.
+type TableWriter struct {
+	Sink       DataSink
+	DatabaseID int64
+	Table      string
+
+	// partial holds an incomplete record between calls to Write
+	partial []byte
+	line    int
+}
+
+// NewTableWriter returns a TableWriter for one table of sink
+func NewTableWriter(sink DataSink, databaseID int64, table string) *TableWriter {
+	return &TableWriter{Sink: sink, DatabaseID: databaseID, Table: table}
+}
+
+// readFromBufferSize is the buffer ReadFrom reads lines into. Longer lines
+// are assembled in a separate buffer.
+const readFromBufferSize = 64 * 1024
+
+// ReadFrom implements io.ReaderFrom, writing each line of r as a record.
+// Blank lines are skipped. It stops at the first invalid record or write
+// error, returning the number of bytes consumed up to the end of the last
+// line written.
+func (w *TableWriter) ReadFrom(r io.Reader) (int64, error) {
+	reader := bufio.NewReaderSize(r, readFromBufferSize)
+
+	// pending counts the bytes of a long line read so far
+	var n, pending int64
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		pending += int64(len(chunk))
+		if err == bufio.ErrBufferFull {
+			w.partial = append(w.partial, chunk...)
+			continue
+		}
+
+		record := chunk
+		if len(w.partial) > 0 {
+			w.partial = append(w.partial, chunk...)
+			record = w.partial
+		}
+
+		if err == io.EOF {
+			// Keep an unterminated final line for Close or the next Write
+			if len(w.partial) == 0 {
+				w.partial = append(w.partial, chunk...)
+			}
+			return n + pending, nil
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if writeErr := w.writeRecord(record); writeErr != nil {
+			return n, writeErr
+		}
+		n += pending
+		pending = 0
+		w.partial = w.partial[:0]
+	}
+}
+
+// Write implements io.Writer. Complete lines are written as records and any
+// incomplete trailing line is kept until the next Write or Close.
+func (w *TableWriter) Write(p []byte) (int, error) {
+	written := 0
+	for {
+		i := bytes.IndexByte(p[written:], '\n')
+		if i < 0 {
+			w.partial = append(w.partial, p[written:]...)
+			return len(p), nil
+		}
+
+		record := p[written : written+i+1]
+		if len(w.partial) > 0 {
+			w.partial = append(w.partial, record...)
+			record = w.partial
+		}
+
+		if err := w.writeRecord(record); err != nil {
+			return written, err
+		}
+		written += i + 1
+		w.partial = w.partial[:0]
+	}
+}
+
+// Close writes any final record which had no trailing newline
+func (w *TableWriter) Close() error {
+	if len(w.partial) == 0 {
+		return nil
+	}
+
+	err := w.writeRecord(w.partial)
+	w.partial = w.partial[:0]
+	return err
+}
+
+func (w *TableWriter) writeRecord(record []byte) error {
+	w.line++
+
+	data := bytes.TrimSpace(record)
+	if len(data) == 0 {
+		return nil
+	}
+
+	if !gjson.ValidBytes(data) {
+		return fmt.Errorf("TableWriter: invalid JSON on line %d", w.line)
+	}
+
+	if err := w.Sink.WriteData(w.DatabaseID, w.Table, data); err != nil {
+		return fmt.Errorf("TableWriter: line %d: %w", w.line, err)
+	}
+	return nil
+}
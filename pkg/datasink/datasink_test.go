@@ -0,0 +1,121 @@
+package datasink
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/scratchdata/scratchdata/models"
+	"github.com/scratchdata/scratchdata/pkg/datasink/memory"
+	blobmemory "github.com/scratchdata/scratchdata/pkg/storage/blobstore/memory"
+	queuememory "github.com/scratchdata/scratchdata/pkg/storage/queue/memory"
+)
+
+type recordingSink struct {
+	records []string
+}
+
+func (s *recordingSink) Start(context.Context) error { return nil }
+
+func (s *recordingSink) WriteData(databaseID int64, table string, data []byte) error {
+	s.records = append(s.records, string(data))
+	return nil
+}
+
+func TestTableWriterReadFrom(t *testing.T) {
+	long := `{"a":"` + strings.Repeat("x", 2*readFromBufferSize) + `"}`
+	input := "{\"a\":1}\n\n" + long + "\n{\"a\":2}"
+
+	sink := &recordingSink{}
+	w := NewTableWriter(sink, 1, "events")
+
+	// strings.Reader implements io.WriterTo, so hide it to exercise ReadFrom
+	n, err := io.Copy(w, struct{ io.Reader }{strings.NewReader(input)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != int64(len(input)) {
+		t.Fatalf("Expected %d bytes; got %d", len(input), n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []string{`{"a":1}`, long, `{"a":2}`}
+	if len(sink.records) != len(expected) {
+		t.Fatalf("Expected %d records; got %d", len(expected), len(sink.records))
+	}
+	for i := range expected {
+		if sink.records[i] != expected[i] {
+			t.Errorf("Record %d: expected %.20s; got %.20s", i, expected[i], sink.records[i])
+		}
+	}
+}
+
+func TestTableWriterWrite(t *testing.T) {
+	sink := &recordingSink{}
+	w := NewTableWriter(sink, 1, "events")
+
+	for _, chunk := range []string{`{"a":`, "1}\n{\"a\"", ":2}\n"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	w.Close()
+
+	if len(sink.records) != 2 || sink.records[0] != `{"a":1}` || sink.records[1] != `{"a":2}` {
+		t.Fatalf("Unexpected records %v", sink.records)
+	}
+
+	if _, err := w.Write([]byte("not json\n")); err == nil {
+		t.Fatal("Expected an error for invalid JSON")
+	}
+}
+
+func TestWriteReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		written int
+		err     string
+	}{
+		{name: "trailing blank line", input: "{\"a\":1}\n{\"a\":2}\n\n", written: 2},
+		{name: "blank lines", input: "\n{\"a\":1}\n  \n{\"a\":2}", written: 2},
+		{name: "invalid line", input: "{\"a\":1}\n\n{\"a\":\n{\"a\":3}\n", written: 1, err: "line 3"},
+		{name: "later invalid line", input: "{\"a\":1}\nnope\n{\"a\":\n", written: 1, err: "line 2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blobStore, _ := blobmemory.NewStorage(nil)
+			queue, _ := queuememory.NewQueue(nil)
+			sink, err := memory.NewMemoryDataSink(&models.StorageServices{BlobStore: blobStore, Queue: queue})
+			if err != nil {
+				t.Fatalf("Cannot create data sink: %s", err)
+			}
+
+			n, err := WriteReader(sink, 1, "events", strings.NewReader(test.input))
+			if test.err == "" && err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("Expected an error on %s; Got %v", test.err, err)
+			}
+			if n != test.written {
+				t.Fatalf("Expected %d records written; Got %d", test.written, n)
+			}
+
+			queued := 0
+			for {
+				if _, ok := queue.Dequeue(); !ok {
+					break
+				}
+				queued++
+			}
+			if queued != test.written {
+				t.Fatalf("Expected %d records in the sink; Got %d", test.written, queued)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package filesystem
+
+import (
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
+)
+
+// Backpressure modes for when MaxPendingBytes is exceeded
+const (
+	BackpressureReject = "reject"
+	BackpressureBlock  = "block"
+)
+
+// closedBytes returns the total size of files waiting to be uploaded
+func (m *DataSink) closedBytes() int64 {
+	var total int64
+	closedFiles := filepath.Join(m.DataDir, ClosedFolder)
+	walkDir(m.fs, closedFiles, func(path string, di fs.DirEntry) error {
+		if info, err := di.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// PendingBytes returns the number of bytes in closed files waiting to be uploaded
+func (m *DataSink) PendingBytes() int64 {
+	return m.pendingBytes.Load()
+}
+
+// overPendingLimit returns true if MaxPendingBytes is set and has been exceeded
+func (m *DataSink) overPendingLimit() bool {
+	m.settingsMutex.RLock()
+	defer m.settingsMutex.RUnlock()
+
+	return m.MaxPendingBytes > 0 && m.pendingBytes.Load() >= m.MaxPendingBytes
+}
+
+// checkBackpressure returns models.ErrBackpressure if too much data is waiting
+// to be uploaded. In block mode it waits up to BackpressureWaitSeconds for
+// uploads to catch up first.
+func (m *DataSink) checkBackpressure() error {
+	if !m.overPendingLimit() {
+		return nil
+	}
+
+	if m.Backpressure == BackpressureBlock {
+		m.settingsMutex.RLock()
+		wait := time.Duration(m.BackpressureWaitSeconds) * time.Second
+		m.settingsMutex.RUnlock()
+
+		deadline := time.Now().Add(wait)
+		for time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+			if !m.overPendingLimit() {
+				return nil
+			}
+		}
+	}
+
+	return models.ErrBackpressure
+}
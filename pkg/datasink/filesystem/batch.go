@@ -0,0 +1,65 @@
+package filesystem
+
+import (
+	"sync"
+)
+
+// RejectedRecord is a record WriteBatchResult didn't write, and why
+type RejectedRecord struct {
+	Index int
+	Err   error
+}
+
+// BatchResult reports what happened to each record passed to
+// WriteBatchResult, by index into the batch
+type BatchResult struct {
+	Written  []int
+	Rejected []RejectedRecord
+
+	// Dropped are the records the Transform hook dropped
+	Dropped []int
+}
+
+// OK reports whether every record was written or deliberately dropped
+func (r BatchResult) OK() bool {
+	return len(r.Rejected) == 0
+}
+
+// WriteBatchResult writes records to a table like WriteBatch, but carries on
+// past records which can't be written, so callers can retry or dead-letter
+// just those. Records are rejected individually if they aren't objects,
+// can't be coerced, or fail the SchemaDrift policy or VerifyOnWrite. When
+// the whole write fails, such as when the disk is full or the sink is
+// applying backpressure, every record not yet written is rejected with the
+// same error.
+func (m *DataSink) WriteBatchResult(databaseID int64, table string, records [][]byte) BatchResult {
+	var mu sync.Mutex
+	rejected := make([]error, len(records))
+
+	kept, err := m.writeBatch(databaseID, table, records, nil, func(i int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		rejected[i] = err
+	})
+
+	written := make([]bool, len(records))
+	for _, i := range kept {
+		written[i] = rejected[i] == nil
+	}
+
+	rc := BatchResult{}
+	for i := range records {
+		switch {
+		case rejected[i] != nil:
+			rc.Rejected = append(rc.Rejected, RejectedRecord{Index: i, Err: rejected[i]})
+		case kept == nil && err != nil:
+			// The batch failed before any record was looked at
+			rc.Rejected = append(rc.Rejected, RejectedRecord{Index: i, Err: err})
+		case written[i]:
+			rc.Written = append(rc.Written, i)
+		default:
+			rc.Dropped = append(rc.Dropped, i)
+		}
+	}
+	return rc
+}
@@ -0,0 +1,104 @@
+package filesystem
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// closedFolder returns the closed dir a table's file is moved to on rotation.
+// Partitioned files go in their partition's directory. With
+// ClosedSubdirChars set, files are spread over subdirectories named by the
+// last characters of their id, so no one directory grows too large.
+func (m *DataSink) closedFolder(databaseID int64, table, partition, fileID string) string {
+	dir := filepath.Join(m.DataDir, ClosedFolder, fmt.Sprintf("%d", databaseID), table)
+	if partition != "" {
+		dir = filepath.Join(dir, partitionDir(partition))
+	}
+
+	n := m.ClosedSubdirChars
+	if n <= 0 {
+		return dir
+	}
+	if n > len(fileID) {
+		n = len(fileID)
+	}
+	return filepath.Join(dir, fileID[len(fileID)-n:])
+}
+
+// closedFile is a file in the closed dir, located by its path
+type closedFile struct {
+	databaseID int64
+	dbID       string
+	table      string
+	partition  string
+	name       string
+}
+
+// parseClosedPath splits the path of a closed file into its database id,
+// table, partition and file name. Any other subdirectories between the table
+// and the file are skipped, so files are found whatever ClosedSubdirChars was
+// when they were closed.
+func (m *DataSink) parseClosedPath(path string) (closedFile, error) {
+	rel, err := filepath.Rel(filepath.Join(m.DataDir, ClosedFolder), path)
+	if err != nil {
+		return closedFile{}, err
+	}
+
+	tokens := strings.Split(rel, string(filepath.Separator))
+	if len(tokens) < 3 {
+		return closedFile{}, fmt.Errorf("unexpected closed file path %s", path)
+	}
+
+	databaseID, err := strconv.ParseInt(tokens[0], 10, 64)
+	if err != nil {
+		return closedFile{}, err
+	}
+
+	rc := closedFile{
+		databaseID: databaseID,
+		dbID:       tokens[0],
+		table:      tokens[1],
+		name:       tokens[len(tokens)-1],
+	}
+	if len(tokens) > 3 {
+		rc.partition, _ = parsePartitionDir(tokens[2])
+	}
+	return rc, nil
+}
+
+// pendingFiles returns the number of closed files waiting to be uploaded for a table
+func (m *DataSink) pendingFiles(databaseID int64, table string) int {
+	dir := filepath.Join(m.DataDir, ClosedFolder, fmt.Sprintf("%d", databaseID), table)
+
+	rc := 0
+	walkDir(m.fs, dir, func(path string, di fs.DirEntry) error {
+		if !isIndexFile(path) {
+			rc++
+		}
+		return nil
+	})
+	return rc
+}
+
+// contentName returns the name a closed file gets with ContentAddressed: the
+// SHA-256 of its contents with the open file's extensions
+func (m *DataSink) contentName(details *FileDetails) (string, error) {
+	fd, err := m.openFile(details.path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	checksum, err := util.SHA256(fd)
+	if err != nil {
+		return "", err
+	}
+
+	_, ext, _ := strings.Cut(details.Name(), ".")
+	return checksum + "." + ext, nil
+}
@@ -0,0 +1,240 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// compactCandidate is a small closed file which may be merged with others
+// from the same table
+type compactCandidate struct {
+	path   string
+	closed closedFile
+	size   int64
+
+	// trace is the file's trace context, if it has one
+	trace map[string]string
+}
+
+// compactBatch collects candidates from one table until they reach the
+// target size
+type compactBatch struct {
+	files []compactCandidate
+	size  int64
+}
+
+// compactClosed concatenates closed files smaller than CompactTargetBytes
+// into files of up to that size, so low-volume tables upload
+// fewer, larger objects. Only files of the same database, table and
+// partition, and so the same tags and key prefix, are merged, and only if
+// they carry the same trace, so no file's trace is lost to another's.
+// Gzipped files aren't compacted, and nothing is
+// when IndexField is set, as index offsets would no longer match, or when
+// UploadOrder is set, as a combined file's new id would sort it after files
+// written later. It stops once ctx is done, leaving the remaining files as
+// they are.
+func (m *DataSink) compactClosed(ctx context.Context) {
+	target := m.CompactTargetBytes
+	if target <= 0 || m.IndexField != "" || m.UploadOrder != UploadOrderUnordered {
+		return
+	}
+
+	// Files with different traces are batched apart
+	batches := map[string]*compactBatch{}
+	flush := func(batch *compactBatch) {
+		if len(batch.files) > 1 {
+			if err := m.compactFiles(batch.files); err != nil {
+				m.log().Error().Err(err).Str("table", batch.files[0].closed.table).Msg("Unable to compact closed files")
+			}
+		}
+		*batch = compactBatch{}
+	}
+	flushAll := func() {
+		for _, batch := range batches {
+			flush(batch)
+		}
+		batches = map[string]*compactBatch{}
+	}
+	var last closedFile
+
+	// walkDir visits each table's files together, including any subdirectories
+	// from ClosedSubdirChars, so one table's batches at a time are enough
+	walkDir(m.fs, filepath.Join(m.DataDir, ClosedFolder), func(path string, di fs.DirEntry) error {
+		if err := ctx.Err(); err != nil {
+			batches = map[string]*compactBatch{}
+			return err
+		}
+		if isIndexFile(path) || strings.HasSuffix(path, ".gz") {
+			return nil
+		}
+
+		info, err := di.Info()
+		if err != nil || info.Size() >= target {
+			return nil
+		}
+
+		closed, err := m.parseClosedPath(path)
+		if err != nil {
+			return nil
+		}
+
+		if last.databaseID != closed.databaseID || last.table != closed.table || last.partition != closed.partition {
+			flushAll()
+		}
+		last = closed
+
+		id, _, _ := strings.Cut(closed.name, ".")
+		trace := m.traces.load(closedRef(closed.databaseID, closed.table, id))
+
+		key := traceKey(trace)
+		batch, ok := batches[key]
+		if !ok {
+			batch = &compactBatch{}
+			batches[key] = batch
+		}
+		if batch.size+info.Size() > target {
+			flush(batch)
+		}
+
+		batch.files = append(batch.files, compactCandidate{path: path, closed: closed, size: info.Size(), trace: trace})
+		batch.size += info.Size()
+		return nil
+	})
+	flushAll()
+}
+
+// compactFiles writes files, all from one table, into a single new closed
+// file with a new file id, then removes them. A crash before they're removed
+// leaves the records in both, so they may be uploaded twice but never lost.
+func (m *DataSink) compactFiles(files []compactCandidate) error {
+	closed := files[0].closed
+
+	// Keep records in the order they were written, as far as file ids tell
+	sort.Slice(files, func(i, j int) bool { return files[i].closed.name < files[j].closed.name })
+
+	tmp, err := m.fs.CreateTemp(m.DataDir, "compact-*.ndjson")
+	if err != nil {
+		return diskError(err)
+	}
+	defer m.fs.Remove(tmp.Name())
+
+	var before int64
+	for _, file := range files {
+		before += file.size
+
+		if _, err := repairTrailingLine(m.fs, file.path); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := m.appendFile(tmp, file.path); err != nil {
+			tmp.Close()
+			return diskError(err)
+		}
+	}
+
+	err = tmp.Sync()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return diskError(err)
+	}
+
+	info, err := m.fs.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	fileID := m.fileID()
+	name := fileID + ".ndjson"
+	if m.ContentAddressed {
+		fd, err := m.openFile(tmp.Name())
+		if err != nil {
+			return err
+		}
+		checksum, err := util.SHA256(fd)
+		fd.Close()
+		if err != nil {
+			return err
+		}
+		name = checksum + ".ndjson"
+	}
+
+	closedID, _, _ := strings.Cut(name, ".")
+	dir := m.closedFolder(closed.databaseID, closed.table, closed.partition, closedID)
+	if err := m.fs.MkdirAll(dir, os.ModePerm); err != nil {
+		return diskError(err)
+	}
+	if err := m.fs.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return diskError(err)
+	}
+
+	// The combined file's latency is measured from its earliest first write,
+	// and it carries the trace the files share
+	var firstWrite time.Time
+	for _, file := range files {
+		if err := m.fs.Remove(file.path); err != nil {
+			m.log().Error().Err(err).Str("path", file.path).Msg("Unable to remove compacted file")
+		}
+
+		id, _, _ := strings.Cut(file.closed.name, ".")
+		ref := closedRef(file.closed.databaseID, file.closed.table, id)
+		if t, ok := m.firstWrites.take(ref); ok && (firstWrite.IsZero() || t.Before(firstWrite)) {
+			firstWrite = t
+		}
+		m.traces.take(ref)
+	}
+
+	if !firstWrite.IsZero() {
+		m.firstWrites.store(closedRef(closed.databaseID, closed.table, closedID), firstWrite)
+	}
+	if trace := files[0].trace; trace != nil {
+		m.traces.store(closedRef(closed.databaseID, closed.table, closedID), trace)
+	}
+
+	// Repairs may have dropped incomplete trailing lines
+	m.pendingBytes.Add(info.Size() - before)
+	m.usage.add(closed.databaseID, info.Size()-before)
+	m.counters.compactedFiles.Add(int64(len(files)))
+
+	m.log().Debug().
+		Str("database_id", closed.dbID).
+		Str("table", closed.table).
+		Int("files", len(files)).
+		Int64("bytes", info.Size()).
+		Str("file", name).
+		Msg("Compacted closed files")
+	return nil
+}
+
+// appendFile copies the file at path onto the end of dst, adding a newline
+// if its last record doesn't have one
+func (m *DataSink) appendFile(dst File, path string) error {
+	src, err := m.openFile(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	n, err := io.Copy(dst, src)
+	if err != nil || n == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err := src.ReadAt(last, n-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = dst.Write(m.terminator())
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+package filesystem
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// Compression algorithms for closed files
+const (
+	CompressionNone = ""
+	CompressionZstd = "zstd"
+	CompressionLZ4  = "lz4"
+
+	// OpenFileCompressionGzip compresses records as they're written
+	OpenFileCompressionGzip = "gzip"
+)
+
+// compressionExtensions is the suffix added to upload keys for each algorithm
+var compressionExtensions = map[string]string{
+	CompressionZstd: ".zst",
+	CompressionLZ4:  ".lz4",
+}
+
+// loadCompressionDictionary reads the configured zstd dictionary, if any
+func (m *DataSink) loadCompressionDictionary() error {
+	if m.CompressionDictionary == "" {
+		return nil
+	}
+
+	dict, err := os.ReadFile(m.CompressionDictionary)
+	if err != nil {
+		return err
+	}
+
+	id, err := util.ZstdDictionaryID(dict)
+	if err != nil {
+		return err
+	}
+
+	m.dictionary = dict
+	m.dictionaryID = id
+	return nil
+}
+
+// compressFile compresses path into a temporary file outside the closed
+// folder and returns the temporary file's path. The caller removes it.
+func (m *DataSink) compressFile(path string) (string, error) {
+	src, err := m.openFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := m.fs.CreateTemp(m.DataDir, "upload-*"+compressionExtensions[m.Compression])
+	if err != nil {
+		return "", err
+	}
+
+	switch m.Compression {
+	case CompressionLZ4:
+		err = util.CompressLZ4(dst, src)
+	default:
+		err = util.CompressZstd(dst, src, m.dictionary)
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		m.fs.Remove(dst.Name())
+		return "", err
+	}
+
+	return dst.Name(), nil
+}
+
+// compressionMetadata returns the object metadata consumers need to decompress a file
+func (m *DataSink) compressionMetadata() map[string]string {
+	rc := map[string]string{"compression": m.Compression}
+	if len(m.dictionary) > 0 {
+		rc["zstd-dictionary-id"] = strconv.FormatUint(uint64(m.dictionaryID), 10)
+	}
+	return rc
+}
@@ -0,0 +1,62 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// diskError wraps err with models.ErrDiskFull if it was caused by running out
+// of space
+func diskError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return fmt.Errorf("%w: %w", models.ErrDiskFull, err)
+	}
+	return err
+}
+
+// checkDataDir confirms DataDir can be written to, so a full disk is
+// reported when the sink is created rather than on the first write
+func (m *DataSink) checkDataDir() error {
+	isFull, err := m.IsDiskFull()
+	if err != nil {
+		return err
+	}
+	if isFull {
+		return fmt.Errorf("%s: %w", m.DataDir, models.ErrDiskFull)
+	}
+
+	fd, err := m.fs.CreateTemp(m.DataDir, ".probe-*")
+	if err != nil {
+		return diskError(err)
+	}
+	defer m.fs.Remove(fd.Name())
+
+	_, err = fd.Write([]byte("\n"))
+	if err == nil {
+		err = fd.Sync()
+	}
+	closeErr := fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return diskError(err)
+}
+
+// IsDiskFull returns true if less than FreeSpaceRequiredBytes is available
+// in DataDir. Space is checked on every write, so writes resume as soon as
+// uploads have freed enough.
+func (m *DataSink) IsDiskFull() (bool, error) {
+	if m.FreeSpaceRequiredBytes <= 0 {
+		return false, nil
+	}
+
+	free, err := util.AvailableDiskSpace(m.DataDir)
+	if err != nil {
+		return false, err
+	}
+	return free < uint64(m.FreeSpaceRequiredBytes), nil
+}
@@ -0,0 +1,85 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// drainRetryInterval is how long Drain waits before another pass over files
+// which didn't upload
+const drainRetryInterval = time.Second
+
+// Drain closes every open file and uploads all closed files, retrying until
+// none are left and, unless Notify is none, every message is queued. Unlike
+// Shutdown the sink keeps accepting writes, so it can be used to reach an
+// empty data directory before maintenance. Open files are only closed once,
+// when Drain starts: records written after that stay in open files, though
+// files they fill or age out while it runs are drained too. Messages the
+// queue will never accept are moved to DeadLetterFolder rather than waited
+// for. If ctx is done first it returns how much was left.
+func (m *DataSink) Drain(ctx context.Context) error {
+	m.RotateAllFiles(true, false)
+
+	for {
+		err := m.drainPass(ctx)
+
+		files, messages := m.drainRemaining()
+		if files == 0 && messages == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(drainRetryInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("drain: %d files and %d messages pending: %w", files, messages, errors.Join(ctx.Err(), err))
+		case <-timer.C:
+		}
+	}
+}
+
+// drainPass queues spooled messages and uploads each closed file once,
+// returning the last error
+func (m *DataSink) drainPass(ctx context.Context) error {
+	m.uploadMutex.Lock()
+	defer m.uploadMutex.Unlock()
+
+	if m.Notify != NotifyNone {
+		m.publishOutbox()
+	}
+
+	var lastErr error
+	walkDir(m.fs, filepath.Join(m.DataDir, ClosedFolder), func(path string, di fs.DirEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isIndexFile(path) {
+			return nil
+		}
+		if err := m.safeUploadFile(ctx, path); err != nil {
+			lastErr = err
+		}
+		return nil
+	})
+	return lastErr
+}
+
+// drainRemaining counts the closed files and spooled messages Drain is
+// waiting for
+func (m *DataSink) drainRemaining() (files int, messages int) {
+	walkDir(m.fs, filepath.Join(m.DataDir, ClosedFolder), func(path string, di fs.DirEntry) error {
+		if !isIndexFile(path) {
+			files++
+		}
+		return nil
+	})
+	walkDir(m.fs, filepath.Join(m.DataDir, OutboxFolder), func(path string, di fs.DirEntry) error {
+		messages++
+		return nil
+	})
+	return files, messages
+}
@@ -0,0 +1,52 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// Line terminators written after each record
+const (
+	LineTerminatorLF   = ""
+	LineTerminatorCRLF = "crlf"
+)
+
+// Policies for records which aren't valid UTF-8
+const (
+	InvalidUTF8Allow    = ""
+	InvalidUTF8Reject   = "reject"
+	InvalidUTF8Sanitize = "sanitize"
+)
+
+// ErrInvalidUTF8 is returned for records which aren't valid UTF-8, or start
+// with a byte order mark, when InvalidUTF8 is "reject"
+var ErrInvalidUTF8 = errors.New("record is not valid UTF-8")
+
+var byteOrderMark = []byte("\xef\xbb\xbf")
+
+// terminator returns the bytes written after each record. Both end in a
+// newline, so files are still split into records on '\n'.
+func (m *DataSink) terminator() []byte {
+	if m.LineTerminator == LineTerminatorCRLF {
+		return []byte("\r\n")
+	}
+	return []byte("\n")
+}
+
+// utf8Record applies the InvalidUTF8 policy to a record. Sanitizing drops a
+// leading byte order mark and replaces invalid bytes with U+FFFD.
+func utf8Record(policy string, data []byte) ([]byte, error) {
+	if policy == InvalidUTF8Allow {
+		return data, nil
+	}
+
+	if utf8.Valid(data) && !bytes.HasPrefix(data, byteOrderMark) {
+		return data, nil
+	}
+
+	if policy == InvalidUTF8Reject {
+		return nil, ErrInvalidUTF8
+	}
+	return bytes.ToValidUTF8(bytes.TrimPrefix(data, byteOrderMark), []byte("\uFFFD")), nil
+}
@@ -0,0 +1,57 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestUTF8Record(t *testing.T) {
+	tests := []struct {
+		input     string
+		sanitized string
+	}{
+		{`{"a":"é"}`, `{"a":"é"}`},
+		{"{\"a\":\"\xff\"}", "{\"a\":\"�\"}"},
+		{"\xef\xbb\xbf{\"a\":1}", `{"a":1}`},
+	}
+
+	for _, test := range tests {
+		rc, err := utf8Record(InvalidUTF8Allow, []byte(test.input))
+		if err != nil || string(rc) != test.input {
+			t.Errorf("%q: expected record to be kept; got %q, %v", test.input, rc, err)
+		}
+
+		rc, err = utf8Record(InvalidUTF8Sanitize, []byte(test.input))
+		if err != nil || string(rc) != test.sanitized {
+			t.Errorf("%q: expected %q; got %q, %v", test.input, test.sanitized, rc, err)
+		}
+
+		_, err = utf8Record(InvalidUTF8Reject, []byte(test.input))
+		if valid := test.input == test.sanitized; valid != (err == nil) || (!valid && !errors.Is(err, ErrInvalidUTF8)) {
+			t.Errorf("%q: unexpected rejection result %v", test.input, err)
+		}
+	}
+}
+
+func TestLineTerminatorCRLF(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "line_terminator": "crlf", "verify_on_write": true})
+
+	for i := 0; i < 2; i++ {
+		if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+
+	details := sink.files[sink.fileKey(1, "events", 0)]
+	data, err := os.ReadFile(details.path)
+	if err != nil {
+		t.Fatalf("Cannot read open file: %s", err)
+	}
+	if s, exp := string(data), "{\"a\":1}\r\n{\"a\":1}\r\n"; s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+	if details.byteCount != int64(len(data)) {
+		t.Fatalf("Expected %d bytes counted; Got %d", len(data), details.byteCount)
+	}
+}
@@ -0,0 +1,69 @@
+package filesystem
+
+import (
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// seenFields remembers the top-level fields written to each dataset since
+// startup
+type seenFields struct {
+	mutex  sync.Mutex
+	fields map[string]map[string]bool
+}
+
+// add records the top-level fields in data and returns those which hadn't
+// been seen before for dataset
+func (s *seenFields) add(dataset string, data []byte) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.fields == nil {
+		s.fields = map[string]map[string]bool{}
+	}
+	seen, ok := s.fields[dataset]
+	if !ok {
+		seen = map[string]bool{}
+		s.fields[dataset] = seen
+	}
+
+	var rc []string
+	gjson.ParseBytes(data).ForEach(func(key, value gjson.Result) bool {
+		if !seen[key.String()] {
+			seen[key.String()] = true
+			rc = append(rc, key.String())
+		}
+		return true
+	})
+	return rc
+}
+
+// trackFields notes any new fields in data, calling OnNewField for each
+func (m *DataSink) trackFields(databaseID int64, table string, data []byte) {
+	if !m.TrackNewFields && m.OnNewField == nil {
+		return
+	}
+
+	dataset := m.key(databaseID, table)
+	for _, field := range m.seen.add(dataset, data) {
+		m.counters.newFields.Add(1)
+		newFieldsTotal.Inc()
+		m.runOnNewField(dataset, field)
+	}
+}
+
+// runOnNewField calls the OnNewField hook, logging any panic
+func (m *DataSink) runOnNewField(dataset, field string) {
+	if m.OnNewField == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			m.log().Error().Interface("panic", r).Str("dataset", dataset).Str("field", field).Msg("OnNewField hook panicked")
+		}
+	}()
+
+	m.OnNewField(dataset, field)
+}
@@ -0,0 +1,68 @@
+package filesystem
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestOnNewField(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	var mu sync.Mutex
+	var calls []string
+	sink.OnNewField = func(dataset, field string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, dataset+"."+field)
+		if field == "boom" {
+			panic("hook failed")
+		}
+	}
+
+	writes := []struct {
+		table string
+		data  string
+	}{
+		{"events", `{"a":1,"b":{"c":1}}`},
+		{"events", `{"a":2,"b":{"d":1}}`},
+		{"events", `{"a":3,"boom":true}`},
+		{"other", `{"a":1}`},
+	}
+	for _, write := range writes {
+		if err := sink.WriteData(1, write.table, []byte(write.data)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+
+	// Only new top-level fields count, once per dataset, and a panicking
+	// hook doesn't fail the write
+	exp := []string{"1_events.a", "1_events.b", "1_events.boom", "1_other.a"}
+	if !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("Expected %v; Got %v", exp, calls)
+	}
+	if n := sink.Stats().NewFields; n != 4 {
+		t.Fatalf("Expected 4 new fields; Got %d", n)
+	}
+}
+
+func TestTrackNewFields(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "track_new_fields": true})
+
+	for _, data := range []string{`{"a":1}`, `{"a":2,"b":1}`} {
+		if err := sink.WriteData(1, "events", []byte(data)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	if n := sink.Stats().NewFields; n != 2 {
+		t.Fatalf("Expected 2 new fields counted without a hook; Got %d", n)
+	}
+
+	untracked, _ := newTestSink(t, map[string]any{"max_age_seconds": 60})
+	if err := untracked.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	if n := untracked.Stats().NewFields; n != 0 {
+		t.Fatalf("Expected new fields not to be tracked by default; Got %d", n)
+	}
+}
@@ -1,55 +1,419 @@
 package filesystem
 
 import (
+	"compress/gzip"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/EagleChen/mapmutex"
 	"github.com/bwmarrin/snowflake"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"github.com/scratchdata/scratchdata/models"
-	queuemodels "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+	datasinkmodels "github.com/scratchdata/scratchdata/pkg/datasink/models"
 	"github.com/scratchdata/scratchdata/util"
 )
 
 const OpenFolder = "open"
 const ClosedFolder = "closed"
 
+// Values for Notify
+const (
+	NotifyQueue = "queue"
+	NotifyNone  = "none"
+)
+
+// Policies for table names which are not normalized identifiers
+const (
+	TableNamesAllow    = ""
+	TableNamesSanitize = "sanitize"
+	TableNamesReject   = "reject"
+)
+
+// Policies for tag keys which are not normalized identifiers
+const (
+	TagKeysAllow    = ""
+	TagKeysSanitize = "sanitize"
+	TagKeysReject   = "reject"
+)
+
+// DataSink settings ending in _bytes, and tenant quotas, can be given as
+// sizes such as "128MiB" or "1GB" as well as numbers of bytes.
 type DataSink struct {
 	DataDir           string `mapstructure:"data"`
 	MaxFileSize       int64  `mapstructure:"max_size_bytes"`
 	MaxRows           int64  `mapstructure:"max_rows"`
 	MaxFileAgeSeconds int    `mapstructure:"max_age_seconds"`
 
+	// IdleSeconds rotates a file once nothing has been written to it for this
+	// long, independently of MaxFileAgeSeconds. Zero disables idle rotation.
+	IdleSeconds int `mapstructure:"idle_seconds"`
+
+	// RotationJitter, a fraction from 0 to 1, rotates each file up to that
+	// fraction of MaxFileAgeSeconds early, picked at random per file, and
+	// delays the first rotation and upload checks by up to that fraction of
+	// their interval. Sinks started together then spread their rotations and
+	// uploads out rather than all running at once.
+	RotationJitter float64 `mapstructure:"rotation_jitter"`
+
+	// OversizedRecords controls records bigger than MaxFileSize on their own:
+	// "reject" (the default, also "") fails them with ErrRecordTooLarge, and
+	// "own_file" writes each to a file of its own which is closed straight
+	// away. Otherwise a file is rotated before a write which would take it
+	// past MaxFileSize.
+	OversizedRecords string `mapstructure:"oversized_records"`
+
+	// WriteShards spreads each table's writes over this many open files, so
+	// concurrent writers and large batches don't serialize behind one lock.
+	// Records written together stay in order within their file, but there's
+	// no ordering across files: __row_id values interleave between files
+	// rather than increasing through a table's uploads. Defaults to 1.
+	WriteShards int `mapstructure:"write_shards"`
+
+	// Notify is "queue" (default) to queue a message for each uploaded
+	// file, or "none" to only upload, for deployments which pick files up
+	// from blob store events such as S3 event notifications instead
+	Notify string `mapstructure:"notify"`
+
+	// UploadTimeoutSeconds bounds each attempt to upload a file and queue its
+	// message. A timed out upload is retried on the next pass. Zero means no
+	// timeout.
+	UploadTimeoutSeconds int `mapstructure:"upload_timeout_seconds"`
+
+	// UploadDelaySeconds holds closed files back from upload passes until
+	// this long after they were last written, leaving a window to inspect or
+	// remove them. Zero uploads them on the next pass. Shutdown and WriteSync
+	// don't wait.
+	UploadDelaySeconds int `mapstructure:"upload_delay_seconds"`
+
+	// UploadOrder orders upload passes: directory order (default), oldest
+	// file first, or "strict" oldest first, stopping at a file which fails
+	// so none is delivered ahead of it. Ordering lists every closed file
+	// before uploading any, and strict ordering trades throughput for the
+	// guarantee, as one failing file holds back the whole backlog. Shutdown,
+	// Drain and WriteSync don't order their uploads.
+	UploadOrder string `mapstructure:"upload_order"`
+
+	// HealthWindowSeconds (default DefaultHealthWindowSeconds) is how long
+	// CheckHealth allows files to wait without an upload or upload pass
+	HealthWindowSeconds int `mapstructure:"health_window_seconds"`
+
+	// Retry retries uploads and queue sends which fail with a retryable
+	// error, such as a timeout or throttling, within each attempt's timeout.
+	// Retry.IsRetryable, set with WithRetryable, replaces the default
+	// classifier.
+	Retry util.RetryPolicy `mapstructure:"retry"`
+
+	// FreeSpaceRequiredBytes refuses writes with ErrDiskFull while less than
+	// this much space is free in DataDir. Zero only fails when writes do.
+	FreeSpaceRequiredBytes int64 `mapstructure:"free_space_required_bytes"`
+
+	// IndexField, if set, writes a sidecar index for each file with an
+	// {"id", "offset", "row"} entry per record which has that field. It's
+	// uploaded to index/<database_id>/<table>/<file id>.ndjson with each entry's
+	// "key" set to the data file's key, so a record can be found by id without
+	// scanning. Offsets are byte positions in the uncompressed file. It costs
+	// a field lookup and a small extra write per record, plus an extra upload
+	// per file. Open files aren't resumed when it's set.
+	IndexField string `mapstructure:"index_field"`
+
+	// ClosedSubdirChars spreads each table's closed files over subdirectories
+	// named by the last this many characters of the file id, e.g. 2 for up
+	// to 100 subdirectories, so scanning a large backlog stays fast. Zero
+	// (default) keeps every closed file in the table's directory.
+	ClosedSubdirChars int `mapstructure:"closed_subdir_chars"`
+
+	// ContentAddressed renames each file at rotation to the SHA-256 of its
+	// contents, e.g. <sha256>.ndjson, so identical content always gets the
+	// same key and S3 and consumers can dedup it. A file identical to one
+	// still waiting in the closed dir is dropped. It costs a full read of
+	// every file at rotation. Leftover open files recovered at startup keep
+	// their names.
+	ContentAddressed bool `mapstructure:"content_addressed"`
+
+	// CompactTargetBytes, if set, concatenates each table's closed files
+	// smaller than this into files of up to this size before each upload
+	// pass, so frequent or idle rotation doesn't produce lots of tiny objects
+	// and ClickHouse parts. Combined files get a new file id. Gzipped files
+	// aren't compacted, and nothing is when IndexField or UploadOrder is set.
+	CompactTargetBytes int64 `mapstructure:"compact_target_bytes"`
+
+	// MetadataTags stores the file's tags, such as database_id and table, as
+	// user metadata on each uploaded object (x-amz-meta-* on S3), with keys
+	// normalized to lowercase letters, digits and dashes. MetadataTagKeys
+	// limits which tags are stored; empty means all of them.
+	MetadataTags    bool     `mapstructure:"metadata_tags"`
+	MetadataTagKeys []string `mapstructure:"metadata_tag_keys"`
+
+	// TableTags maps table => tags added to that table's files, on top of
+	// the sink's own tags from WithTags. A table tag overrides a sink tag of
+	// the same name, and database_id and table always override both. The
+	// merged tags are sent in each queue message, passed to OnUpload and
+	// reported by Writers.
+	TableTags map[string]map[string]string `mapstructure:"table_tags"`
+
+	// TableRotation maps table => rotation thresholds overriding
+	// max_size_bytes and max_age_seconds for that table's files, e.g. large,
+	// slowly rotated files for a busy table and small, quick ones for a
+	// latency-sensitive one. Each file keeps the overrides it was created
+	// with.
+	TableRotation map[string]TableRotation `mapstructure:"table_rotation"`
+
+	// TableNames controls what happens to table names which aren't lowercase
+	// alphanumeric identifiers: allowed as-is (default), sanitized or rejected.
+	// Names with no letters or digits are rejected by sanitize too.
+	TableNames string `mapstructure:"table_names"`
+
+	// TagKeys controls the keys of tags from WithTags and TableTags which
+	// aren't lowercase alphanumeric identifiers, as they may end up as column
+	// names downstream: allowed as-is (default), sanitized, e.g. "My Tag!" to
+	// "my_tag_", or rejected. It's applied once, when the sink is created,
+	// which fails for rejected keys, keys with no letters or digits, and keys
+	// which sanitize to the same name.
+	TagKeys string `mapstructure:"tag_keys"`
+
+	// NonObjects controls records which are valid JSON but not objects:
+	// rejected with ErrNotObject (default) or wrapped as {"value": ...}.
+	// Invalid JSON is always rejected, with ErrInvalidJSON.
+	NonObjects string `mapstructure:"non_objects"`
+
+	// LineTerminator is written after each record: "\n" (default) or
+	// "crlf" for "\r\n". With crlf, CSV uploads use "\r\n" too.
+	LineTerminator string `mapstructure:"line_terminator"`
+
+	// InvalidUTF8 controls records which aren't valid UTF-8 or start with a
+	// byte order mark: written as they are (default), rejected with
+	// ErrInvalidUTF8, or "sanitize" to drop the mark and replace invalid
+	// bytes with U+FFFD
+	InvalidUTF8 string `mapstructure:"invalid_utf8"`
+
+	// RawPassthrough writes records exactly as they're given, for data which
+	// is already finalized NDJSON. Transform, InvalidUTF8, NonObjects,
+	// Coerce, SchemaDrift and new field tracking are skipped, so records are
+	// never parsed; each is only checked for embedded newlines. The API
+	// reads it through WritesRaw, so inserts aren't flattened or given row
+	// ids either.
+	RawPassthrough bool `mapstructure:"raw_passthrough"`
+
+	// SchemaDrift controls what happens when a record adds a new top-level
+	// field to an open file: allow, error, ignore the new fields, or rotate
+	// so each file has a consistent set of columns. The default is rotate
+	// when Formats includes a columnar format such as CSVWithNames, so a
+	// file's header isn't every field any of its records had, and allow
+	// otherwise.
+	SchemaDrift string `mapstructure:"schema_drift"`
+
+	// Coerce maps table => field => type ("int", "float" or "bool"). String
+	// values of those fields are converted before being written. Values which
+	// can't be converted are written as-is, or rejected if CoerceStrict is set.
+	Coerce       map[string]map[string]string `mapstructure:"coerce"`
+	CoerceStrict bool                         `mapstructure:"coerce_strict"`
+
+	// MaxPendingBytes limits how much closed data may wait for upload before
+	// writes are refused. Zero means unlimited. Backpressure is "reject"
+	// (default) to fail immediately, or "block" to wait up to
+	// BackpressureWaitSeconds for uploads to catch up.
+	MaxPendingBytes         int64  `mapstructure:"max_pending_bytes"`
+	Backpressure            string `mapstructure:"backpressure"`
+	BackpressureWaitSeconds int    `mapstructure:"backpressure_wait_seconds"`
+
+	// Compression compresses closed files before upload: "" (none), "zstd"
+	// or "lz4" (frame format, which ClickHouse reads natively).
+	// CompressionDictionary is the path to a zstd dictionary, trained offline,
+	// which makes small files with repetitive records compress much better.
+	Compression           string `mapstructure:"compression"`
+	CompressionDictionary string `mapstructure:"compression_dictionary"`
+
+	// OpenFileCompression set to "gzip" writes records straight into a gzip
+	// stream, saving local disk. Closed .ndjson.gz files are uploaded as-is.
+	// Size limits still apply to uncompressed bytes, so files on disk are
+	// smaller than MaxFileSize. A crash leaves the open file's gzip stream
+	// unterminated, so incomplete trailing lines can't be repaired the way
+	// they are for plain files. It can't be combined with Compression.
+	OpenFileCompression string `mapstructure:"open_file_compression"`
+
+	// VerifyOnWrite syncs each record to disk, reads it back and checks it's
+	// unchanged, valid JSON before the write returns. A record which fails is
+	// truncated from the file and the write returns models.ErrVerifyFailed.
+	// It's much slower, so it's meant for low-volume, high-value datasets.
+	// It can't be combined with OpenFileCompression.
+	VerifyOnWrite bool `mapstructure:"verify_on_write"`
+
+	// Formats lists the formats each closed file is uploaded in, each as its
+	// own object and queue message: "JSONEachRow" (NDJSON, the default) and
+	// "CSVWithNames". Records are always buffered on disk as NDJSON, so extra
+	// formats don't hold records in memory: each is converted from the closed
+	// file into a temporary file at upload time, costing another read of the
+	// file and up to its size again in disk space. CSV conversion holds only
+	// the file's set of column names in memory. Formats other than
+	// JSONEachRow can't be combined with OpenFileCompression. The bundled
+	// workers only insert JSONEachRow, so only it gets a queue message; other
+	// formats are for consumers of their own, which can find them with
+	// OnUpload or blob store events.
+	Formats []string `mapstructure:"formats"`
+
+	// ResumeOpenFiles reopens each table's newest open file left by a previous
+	// process and keeps appending to it, as long as it's still under the size,
+	// row and age limits. An incomplete trailing line is truncated first.
+	// Gzipped files are never resumed. Other leftover open files are moved to
+	// the closed dir for upload either way.
+	ResumeOpenFiles bool `mapstructure:"resume_open_files"`
+
+	// TenantQuotas limits the bytes on disk, open and closed, for each
+	// database id. Databases which aren't listed get DefaultTenantQuota. Zero
+	// means unlimited. Writes over quota fail with ErrBackpressure while other
+	// databases carry on. Gzipped open files count uncompressed bytes until
+	// they're recounted at the next upload.
+	TenantQuotas       map[string]int64 `mapstructure:"tenant_quotas"`
+	DefaultTenantQuota int64            `mapstructure:"default_tenant_quota"`
+
+	// OnUpload, if set, is called after a file has been uploaded and its
+	// message queued. Errors are logged and don't affect the upload.
+	OnUpload func(key string, tags map[string]string, rows int64) error `mapstructure:"-"`
+
+	// Transform, if set, is called with each record before it's written.
+	// The returned record replaces it; returning an error drops it, which is
+	// counted in Stats.TransformDropped. It runs before the InvalidUTF8 and
+	// NonObjects policies, coercion and the schema policy, and may be called
+	// concurrently. It isn't called with RawPassthrough. The sink adds
+	// nothing to records itself, but those inserted through the API already
+	// carry the row id the API adds, as __row_id or under the metadata key,
+	// so Transform sees it and should keep it.
+	Transform func(raw string) (string, error) `mapstructure:"-"`
+
+	// OnNewField, if set, is called the first time a top-level field is
+	// written to a dataset ("<database_id>_<table>") since startup, e.g. to
+	// propose ALTER TABLE ADD COLUMN downstream. It's called with the file's
+	// lock held, so it must be quick. TrackNewFields counts new fields in
+	// Stats and metrics without a hook.
+	OnNewField     func(dataset, field string) `mapstructure:"-"`
+	TrackNewFields bool                        `mapstructure:"track_new_fields"`
+
+	// OnRotate, if set, is called after a file is rotated with the ids of the
+	// closed file and the file replacing it, e.g. to checkpoint producer
+	// offsets at file boundaries. newFileID is empty if no new file was
+	// created. It's called with the file's lock held, so it must be quick.
+	OnRotate func(oldFileID, newFileID string) `mapstructure:"-"`
+
+	// PartitionFunc, if set, returns a key prefix for each record, such as
+	// "tenant=7/date=2024-05-01". Records with different prefixes go to
+	// different open files, uploaded to data/<database_id>/<table>/<prefix>/.
+	// An empty prefix uses the table's usual file. Returning an error rejects
+	// the record with ErrPartition. It may be called concurrently.
+	// MaxOpenPartitions (default DefaultMaxOpenPartitions) bounds the open
+	// partition files across all tables; the least recently written is
+	// closed to make room for another.
+	PartitionFunc     func(record string) (prefix string, err error) `mapstructure:"-"`
+	MaxOpenPartitions int                                            `mapstructure:"max_open_partitions"`
+
 	storage *models.StorageServices
-	snow    *snowflake.Node
 	enabled bool
 	wg      sync.WaitGroup
 
 	fileMutex *mapmutex.Mutex
-	files     map[string]*FileDetails
+
+	// files are the open files by key, guarded by filesMutex
+	files      map[string]*FileDetails
+	filesMutex sync.RWMutex
+	partitions openPartitions
 
 	uploadMutex *sync.Mutex
+
+	// rotating is set while a pass over every open file is rotating them
+	rotating atomic.Bool
+
+	// settingsMutex guards the settings which can be changed by Reload
+	settingsMutex sync.RWMutex
+
+	counters     counters
+	pendingBytes atomic.Int64
+	usage        tenantUsage
+	shardCounter atomic.Uint64
+	seen         seenFields
+	firstWrites  firstWrites
+	traces       fileTraces
+	subscribers  subscribers
+	ids          fileIDs
+
+	dictionary   []byte
+	dictionaryID uint32
+
+	// manual disables the background rotation and upload loops
+	manual bool
+
+	// lockFile holds the flock on DataDir
+	lockFile File
+
+	// startedAt is when the sink was created, which CheckHealth measures
+	// from until the first upload
+	startedAt time.Time
+
+	// staticMetadata is the object metadata for tags which are the same for
+	// every file, and metadataDatabaseID and metadataTable say whether the
+	// per-file tags are stored too; see prepareTagMetadata
+	staticMetadata     map[string]string
+	metadataDatabaseID bool
+	metadataTable      bool
+
+	// messageTags and tableMessageTags are the tags sent in queue messages,
+	// for tables without and with TableTags; see prepareMessageTags
+	messageTags      map[string]string
+	tableMessageTags map[string]map[string]string
+
+	// Set by options; see options.go
+	fs     FS
+	tags   map[string]string
+	logger *zerolog.Logger
+	now    func() time.Time
+	newID  func() string
+
+	snowflakeNode *int64
 }
 
 type FileDetails struct {
-	fd        *os.File
+	fd        File
+	gz        *gzip.Writer
 	path      string
 	rowCount  int64
 	byteCount int64
 	created   time.Time
+	lastWrite time.Time
+
+	// firstWrite is when the first record was written, for IngestLatency
+	firstWrite time.Time
+
+	// index is the IndexField sidecar, if enabled
+	index File
+
+	// partition is the key prefix PartitionFunc picked for the file's
+	// records, or "" for the table's default file
+	partition string
+
+	// rotation is the table's TableRotation when the file was created
+	rotation TableRotation
+
+	// jitter, from 0 to 1, is how much of RotationJitter applies to the file
+	jitter float64
+
+	// trace is the trace context of the file's first traced write
+	trace map[string]string
+
+	// columns is the set of top-level fields written to this file, used by the
+	// SchemaDrift policy
+	columns map[string]bool
 
 	databaseId int64
 	table      string
+	shard      int
 }
 
 func (d *FileDetails) Directory() string {
@@ -60,29 +424,73 @@ func (d *FileDetails) Name() string {
 	return filepath.Base(d.path)
 }
 
+// ID returns the file's snowflake id, which is also used in its upload key
+func (d *FileDetails) ID() string {
+	name := d.Name()
+	if i := strings.Index(name, "."); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// writer returns where records for this file should be written
+func (d *FileDetails) writer() io.Writer {
+	if d.gz != nil {
+		return d.gz
+	}
+	return d.fd
+}
+
+// diskSize returns the open file's size on disk. byteCount is the
+// uncompressed size, so it's the same unless the file is gzipped, in which
+// case data still buffered in the gzip writer isn't counted yet.
+func (d *FileDetails) diskSize() int64 {
+	info, err := d.fd.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// close flushes any compressed data and closes the file
+func (d *FileDetails) close() error {
+	if d.index != nil {
+		d.index.Close()
+	}
+	if d.gz != nil {
+		if err := d.gz.Close(); err != nil {
+			d.fd.Close()
+			return err
+		}
+	}
+	return d.fd.Close()
+}
+
 func (m *DataSink) Start(ctx context.Context) error {
 	m.enabled = true
 
-	m.wg.Add(1)
-	go m.MonitorFiles(ctx)
+	if !m.manual {
+		m.wg.Add(1)
+		go m.MonitorFiles(ctx)
 
-	m.wg.Add(1)
-	go m.MonitorUploads(ctx)
+		m.wg.Add(1)
+		go m.MonitorUploads(ctx)
+	}
 
 	<-ctx.Done()
 	return m.Shutdown()
 }
 
 func (m *DataSink) RotateAllFiles(forceRotation bool, createNew bool) {
-	for key := range m.files {
+	for _, key := range m.fileKeys() {
 		if m.fileMutex.TryLock(key) {
-			fileDetails, ok := m.files[key]
+			fileDetails, ok := m.getFile(key)
 			if fileDetails != nil && ok {
 				if m.NeedsRotation(fileDetails) || forceRotation {
-					log.Trace().Str("file", fileDetails.path).Msg("Rotating")
+					m.log().Trace().Str("file", fileDetails.path).Msg("Rotating")
 					_, err := m.RotateFile(fileDetails, createNew)
 					if err != nil {
-						log.Error().Err(err).Str("file", fileDetails.path).Msg("Unable to auto-rotate file")
+						m.log().Error().Err(err).Str("file", fileDetails.path).Msg("Unable to auto-rotate file")
 					}
 				}
 			}
@@ -91,84 +499,299 @@ func (m *DataSink) RotateAllFiles(forceRotation bool, createNew bool) {
 	}
 }
 
-func (m *DataSink) visit(path string, di fs.DirEntry, e error) error {
+func (m *DataSink) visit(path string, di fs.DirEntry) error {
+	err := m.visitFile(path, di)
+	if errors.Is(err, errNotQueued) || errors.Is(err, errUploadPanicked) {
+		// Don't return an error because we want the walk to continue
+		return nil
+	}
+	return err
+}
+
+// visitFile is visit, returning every error from uploading the file
+func (m *DataSink) visitFile(path string, di fs.DirEntry) error {
 	if di.IsDir() {
 		return nil
 	}
 
-	tokens := strings.Split(path, string(os.PathSeparator))
-	dbId := tokens[len(tokens)-3]
-	table := tokens[len(tokens)-2]
-	file := tokens[len(tokens)-1]
+	if isIndexFile(path) {
+		// Uploaded along with its data file
+		return nil
+	}
+
+	if m.UploadDelaySeconds > 0 {
+		info, err := di.Info()
+		if err != nil || m.now().Sub(info.ModTime()) < time.Duration(m.UploadDelaySeconds)*time.Second {
+			// Gone already, or not due yet
+			return nil
+		}
+	}
+
+	return m.safeUploadFile(context.Background(), path)
+}
+
+// errNotQueued is returned by uploadFile when a file was uploaded but its
+// message couldn't be queued
+var errNotQueued = errors.New("uploaded file was not queued")
+
+// errUploadPanicked is returned by safeUploadFile when uploading a file
+// panicked
+var errUploadPanicked = errors.New("upload panicked")
+
+// safeUploadFile is uploadFile, turning a panic, such as from a corrupt
+// file, into an error so one bad file can't stop every other upload. The
+// file is left in place to be retried.
+func (m *DataSink) safeUploadFile(ctx context.Context, path string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.log().Error().Interface("panic", r).Str("path", path).Msg("Uploading file panicked")
+			err = fmt.Errorf("%w: %v", errUploadPanicked, r)
+		}
+	}()
+
+	return m.uploadFile(ctx, path)
+}
+
+// uploadFile uploads one closed file, queues its message and deletes it. It
+// gives up when ctx is done.
+func (m *DataSink) uploadFile(ctx context.Context, path string) error {
+	results, err := m.uploadFileResults(ctx, path)
+	for _, result := range results {
+		m.log().Debug().
+			Str("key", result.Key).
+			Int64("bytes", result.Bytes).
+			Dur("duration", result.Duration).
+			Str("etag", result.ETag).
+			Msg("Uploaded object")
+	}
+	return err
+}
 
-	dbIdInt64, err := strconv.ParseInt(dbId, 10, 64)
+// uploadFileResults is uploadFile, returning an UploadResult for each object
+// uploaded, one per format. Results are returned along with errors from
+// queueing, as the objects were uploaded all the same.
+func (m *DataSink) uploadFileResults(ctx context.Context, path string) ([]UploadResult, error) {
+	closed, err := m.parseClosedPath(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	dbId, dbIdInt64, table, file := closed.dbID, closed.databaseID, closed.table, closed.name
+
+	// Gzipped open files are uploaded as-is
+	gzipped := strings.HasSuffix(file, ".gz")
+
+	dropped := int64(0)
+	if !gzipped {
+		dropped, err = repairTrailingLine(m.fs, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dropped > 0 {
+		m.log().Warn().Str("path", path).Int64("bytes", dropped).Msg("Dropped incomplete trailing line before upload")
+
+		if info, err := m.fs.Stat(path); err == nil && info.Size() == 0 {
+			m.removeIndex(path)
+			return nil, m.fs.Remove(path)
+		}
 	}
 
-	key := fmt.Sprintf("data/%s/%s/%s", dbId, table, file)
-	fd, err := os.Open(path)
+	info, err := m.fs.Stat(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	uploadErr := m.storage.BlobStore.Upload(key, fd)
-	if uploadErr != nil {
-		return uploadErr
+	rows, err := m.countRows(path)
+	if err != nil {
+		return nil, err
 	}
 
-	uploadMessage := queuemodels.FileUploadMessage{
-		DatabaseID: dbIdInt64,
-		Table:      table,
-		Key:        key,
+	// One deadline covers both the uploads and queueing their messages
+	ctx, cancel := m.uploadContext(ctx)
+	defer cancel()
+
+	objects := make([]uploadedObject, 0, len(m.Formats))
+	for _, format := range m.Formats {
+		object, err := m.uploadObject(ctx, closed, path, format, gzipped, rows)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
 	}
 
-	message, err := json.Marshal(uploadMessage)
+	results := make([]UploadResult, len(objects))
+	for i, object := range objects {
+		results[i] = object.result
+	}
+
+	fileID, _, _ := strings.Cut(file, ".")
+	err = m.uploadIndex(ctx, path, dbId, table, fileID, objects[0].key)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Spool the messages before deleting the file, so if queueing fails it's
+	// retried from the outbox without uploading the file again
+	spooled := make([]string, len(objects))
+	for i, object := range objects {
+		if !object.queued(m.Notify) {
+			continue
+		}
+		spooled[i], err = m.spoolMessage(dbIdInt64, table, object.name, rows, object.message)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// We delete the file locally before queuing. That way if the delete fails
 	// then we will preserve data but not try to requeue.
-	err = os.Remove(path)
+	err = m.fs.Remove(path)
 	if err != nil {
-		log.Error().Err(err).Str("path", path).Str("message", string(message)).Msg("Did not delete file after uploading. Needs to be queued.")
+		m.log().Error().Err(err).Str("path", path).Str("message", string(objects[0].message)).Msg("Did not delete file after uploading. Needs to be queued.")
 		// Don't return an error because we want the walk to continue
+	} else {
+		m.removeIndex(path)
+		m.traces.take(closedRef(dbIdInt64, table, fileID))
+		m.pendingBytes.Add(-info.Size())
+		m.usage.add(dbIdInt64, -info.Size())
+	}
+
+	// Objects which aren't queued are done once uploaded. Queued objects run
+	// their hooks, and record the latency, once their message is queued.
+	queued := false
+	var publishErr error
+	for i, object := range objects {
+		if !object.queued(m.Notify) {
+			m.runOnUpload(object.key, dbId, table, rows)
+			continue
+		}
+		queued = true
+		err = m.publish(ctx, spooled[i], outboxEntry{File: object.name, Rows: rows, Message: object.message})
+		if publishErr == nil {
+			publishErr = err
+		}
+	}
+	if !queued {
+		m.recordIngestLatency(dbIdInt64, table, file)
 	}
 
-	err = m.storage.Queue.Enqueue(message)
+	return results, publishErr
+}
+
+// uploadContext returns the context for one upload attempt, derived from parent
+func (m *DataSink) uploadContext(parent context.Context) (context.Context, context.CancelFunc) {
+	m.settingsMutex.RLock()
+	timeout := time.Duration(m.UploadTimeoutSeconds) * time.Second
+	m.settingsMutex.RUnlock()
+
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// countRows returns the number of lines in the file at path
+func (m *DataSink) countRows(path string) (int64, error) {
+	fd, err := m.openFile(path)
 	if err != nil {
-		log.Error().Err(err).Str("path", path).Str("message", string(message)).Msg("Did not enqueue file. Needs to be queued.")
-		// Don't return an error because we want the walk to continue
+		return 0, err
 	}
+	defer fd.Close()
 
-	return nil
+	if !strings.HasSuffix(path, ".gz") {
+		return util.CountLines(fd)
+	}
+
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	return util.CountReaderLines(gz)
+}
+
+// runOnUpload calls the OnUpload hook, logging any error or panic
+func (m *DataSink) runOnUpload(key string, databaseID string, table string, rows int64) {
+	if m.OnUpload == nil {
+		return
+	}
+	tags := m.fileTags(databaseID, table)
+
+	defer func() {
+		if r := recover(); r != nil {
+			m.log().Error().Interface("panic", r).Str("key", key).Msg("OnUpload hook panicked")
+		}
+	}()
+
+	err := m.OnUpload(key, tags, rows)
+	if err != nil {
+		m.log().Error().Err(err).Str("key", key).Msg("OnUpload hook failed")
+	}
 }
 
 func (m *DataSink) UploadFiles() {
+	m.uploadFiles(context.Background())
+}
+
+// uploadFiles is UploadFiles, stopping between files once ctx is done so
+// shutdown doesn't wait for a whole pass over a large backlog. The file being
+// uploaded when ctx is cancelled is finished, within UploadTimeoutSeconds.
+func (m *DataSink) uploadFiles(ctx context.Context) {
 	m.uploadMutex.Lock()
 	defer m.uploadMutex.Unlock()
 
-	closedFiles := filepath.Join(m.DataDir, ClosedFolder)
-	err := filepath.WalkDir(closedFiles, m.visit)
-	if err != nil {
-		log.Error().Err(err).Msg("Problem uploading file")
+	if ctx.Err() != nil {
+		return
+	}
+
+	// Recount so pending bytes don't drift from what's on disk
+	m.pendingBytes.Store(m.closedBytes())
+	m.usage.store(m.tenantBytes())
+
+	if m.Notify != NotifyNone {
+		m.publishOutbox()
+	}
+
+	m.compactClosed(ctx)
+
+	var err error
+	if m.UploadOrder != UploadOrderUnordered {
+		err = m.uploadOrdered(ctx)
+	} else {
+		err = walkDir(m.fs, filepath.Join(m.DataDir, ClosedFolder), func(path string, di fs.DirEntry) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return m.visit(path, di)
+		})
+	}
+	if errors.Is(err, context.Canceled) {
+		m.log().Debug().Msg("Stopped upload pass for shutdown")
+	} else if err != nil {
+		m.log().Error().Err(err).Msg("Problem uploading file")
+	} else {
+		m.counters.recordScan()
 	}
 }
 
 func (m *DataSink) MonitorUploads(ctx context.Context) {
 	defer m.wg.Done()
 
+	if !m.waitJitter(ctx, 10*time.Second) {
+		return
+	}
+
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			m.UploadFiles()
-			// log.Trace().Msg("Upload tick")
+			m.runUploads(ctx)
+			// m.log().Trace().Msg("Upload tick")
 		case <-ctx.Done():
-			// log.Trace().Msg("Stopping uploads")
+			// m.log().Trace().Msg("Stopping uploads")
 			return
 		}
 	}
@@ -177,31 +800,46 @@ func (m *DataSink) MonitorUploads(ctx context.Context) {
 func (m *DataSink) MonitorFiles(ctx context.Context) {
 	defer m.wg.Done()
 
+	if !m.waitJitter(ctx, 1*time.Second) {
+		return
+	}
+
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			m.RotateAllFiles(false, true)
-			// log.Trace().Msg("Rotate tick")
+			m.rotateAll(false, true)
+			// m.log().Trace().Msg("Rotate tick")
 		case <-ctx.Done():
-			// log.Trace().Msg("Stopping rotation")
+			// m.log().Trace().Msg("Stopping rotation")
 			return
 		}
 	}
 }
 
+// NeedsRotation returns true once a file reaches MaxFileSize bytes, MaxRows rows
+// or MaxFileAgeSeconds less its RotationJitter, whichever comes first, less
+// any TableRotation overrides. A zero MaxFileSize or MaxRows means that dimension is unlimited.
 func (m *DataSink) NeedsRotation(details *FileDetails) bool {
-	if details.byteCount >= m.MaxFileSize {
+	m.settingsMutex.RLock()
+	defer m.settingsMutex.RUnlock()
+
+	maxSize, maxAge := m.rotationLimits(details)
+	if maxSize > 0 && details.byteCount >= maxSize {
 		return true
 	}
 
-	if details.rowCount >= m.MaxRows {
+	if m.MaxRows > 0 && details.rowCount >= m.MaxRows {
 		return true
 	}
 
-	if details.byteCount > 0 && time.Since(details.created) >= time.Duration(time.Second*time.Duration(m.MaxFileAgeSeconds)) {
+	if details.byteCount > 0 && m.now().Sub(details.created) >= m.rotationAge(details, maxAge) {
+		return true
+	}
+
+	if m.IdleSeconds > 0 && details.byteCount > 0 && m.now().Sub(details.lastWrite) >= time.Second*time.Duration(m.IdleSeconds) {
 		return true
 	}
 
@@ -209,97 +847,210 @@ func (m *DataSink) NeedsRotation(details *FileDetails) bool {
 }
 
 func (m *DataSink) RotateFile(details *FileDetails, createNew bool) (*FileDetails, error) {
-	key := m.key(details.databaseId, details.table)
+	key := m.detailsKey(details)
 
-	err := details.fd.Close()
+	err := details.close()
 	if err != nil {
 		return nil, err
 	}
 
-	delete(m.files, key)
+	m.deleteFile(key)
 
 	if details.byteCount > 0 {
-		closedFolderPath := filepath.Join(m.DataDir, ClosedFolder, fmt.Sprintf("%d", details.databaseId), details.table)
-		err = os.MkdirAll(closedFolderPath, os.ModePerm)
+		closedName := details.Name()
+		if m.ContentAddressed {
+			closedName, err = m.contentName(details)
+			if err != nil {
+				return nil, err
+			}
+		}
+		closedID, _, _ := strings.Cut(closedName, ".")
+
+		closedFolderPath := m.closedFolder(details.databaseId, details.table, details.partition, closedID)
+		err = m.fs.MkdirAll(closedFolderPath, os.ModePerm)
 		if err != nil {
 			return nil, err
 		}
 
-		closedPath := filepath.Join(closedFolderPath, details.Name())
-		err = os.Link(details.path, closedPath)
+		closedPath := filepath.Join(closedFolderPath, closedName)
+		err = m.fs.Link(details.path, closedPath)
+		if m.ContentAddressed && errors.Is(err, fs.ErrExist) {
+			// The same content is already waiting to be uploaded
+			m.log().Debug().Str("file", details.path).Str("closed", closedPath).Msg("Dropping duplicate file")
+			m.usage.add(details.databaseId, -details.byteCount)
+		} else if err != nil {
+			return nil, err
+		} else {
+			if info, err := m.fs.Stat(closedPath); err == nil {
+				m.pendingBytes.Add(info.Size())
+			}
+			if !details.firstWrite.IsZero() {
+				m.firstWrites.store(closedRef(details.databaseId, details.table, closedID), details.firstWrite)
+			}
+			if details.trace != nil {
+				m.traces.store(closedRef(details.databaseId, details.table, closedID), details.trace)
+			}
+		}
+
+		err = m.closeIndex(details, closedPath)
 		if err != nil {
 			return nil, err
 		}
+	} else {
+		m.closeIndex(details, "")
 	}
 
-	err = os.Remove(details.path)
+	err = m.fs.Remove(details.path)
 	if err != nil {
-		log.Error().Err(err).Int64("database", details.databaseId).Str("table", details.table).Str("path", details.path).Msg("Unable to delete zombie file. Has been moved to the closed dir.")
+		m.log().Error().Err(err).Int64("database", details.databaseId).Str("table", details.table).Str("path", details.path).Msg("Unable to delete zombie file. Has been moved to the closed dir.")
 	}
 
 	if createNew {
-		newFile, err := m.CreateFile(details.databaseId, details.table)
+		newFile, err := m.createPartitionFile(details.databaseId, details.table, details.partition)
 		if err != nil {
 			return nil, err
 		}
+		newFile.shard = details.shard
 
-		m.files[key] = newFile
+		m.setFile(key, newFile)
+		m.runOnRotate(details.ID(), newFile.ID())
 		return newFile, nil
 	}
 
+	m.runOnRotate(details.ID(), "")
 	return nil, nil
 }
 
-func (m *DataSink) IsDiskFull() (bool, error) {
-	return false, nil
+// transform applies the Transform hook to a record, returning false if it
+// was dropped
+func (m *DataSink) transform(data []byte) ([]byte, bool) {
+	if m.Transform == nil {
+		return data, true
+	}
+
+	transformed, err := m.runTransform(string(data))
+	if err != nil {
+		m.counters.transformDropped.Add(1)
+		// Bytes rather than Str, so a disabled level doesn't copy the record
+		m.log().Trace().Err(err).Bytes("json", data).Msg("Transform dropped record")
+		return nil, false
+	}
+	return []byte(transformed), true
+}
+
+// runTransform calls the Transform hook, treating a panic as an error
+func (m *DataSink) runTransform(raw string) (rc string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("transform panicked: %v", r)
+		}
+	}()
+
+	return m.Transform(raw)
+}
+
+// runOnRotate calls the OnRotate hook, logging any panic
+func (m *DataSink) runOnRotate(oldFileID, newFileID string) {
+	if m.OnRotate == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			m.log().Error().Interface("panic", r).Str("file", oldFileID).Msg("OnRotate hook panicked")
+		}
+	}()
+
+	m.OnRotate(oldFileID, newFileID)
 }
 
 func (m *DataSink) CreateFile(databaseID int64, table string) (*FileDetails, error) {
-	var fd *os.File
+	return m.createPartitionFile(databaseID, table, "")
+}
+
+// createPartitionFile is CreateFile for one of PartitionFunc's partitions
+func (m *DataSink) createPartitionFile(databaseID int64, table, partition string) (*FileDetails, error) {
+	var fd File
 	var err error
 
-	fileSnowflake := m.snow.Generate()
+	fileID := m.fileID()
 	tableDir := filepath.Join(m.DataDir, OpenFolder, fmt.Sprintf("%d", databaseID), table)
-	fileName := fmt.Sprintf("%s.ndjson", fileSnowflake.String())
+	if partition != "" {
+		tableDir = filepath.Join(tableDir, partitionDir(partition))
+	}
+	fileName := fmt.Sprintf("%s.ndjson", fileID)
+	if m.OpenFileCompression == OpenFileCompressionGzip {
+		fileName += ".gz"
+	}
 
-	err = os.MkdirAll(tableDir, os.ModePerm)
+	err = m.fs.MkdirAll(tableDir, os.ModePerm)
 	if err != nil {
-		return nil, err
+		return nil, diskError(err)
 	}
 
 	filePath := filepath.Join(tableDir, fileName)
-	fd, err = os.Create(filePath)
+	fd, err = m.createFile(filePath)
 	if err != nil {
-		return nil, err
+		return nil, diskError(err)
 	}
 
 	fileDetails := &FileDetails{
 		fd:      fd,
 		path:    filePath,
-		created: time.Now(),
+		created: m.now(),
+		columns: map[string]bool{},
 
 		databaseId: databaseID,
 		table:      table,
+		partition:  partition,
+		rotation:   m.tableRotation(table),
+		jitter:     rand.Float64(),
+	}
+
+	if m.OpenFileCompression == OpenFileCompressionGzip {
+		fileDetails.gz = gzip.NewWriter(fd)
+	}
+
+	err = m.openIndex(fileDetails)
+	if err != nil {
+		fd.Close()
+		return nil, err
 	}
 
 	return fileDetails, nil
 }
 
 func (m *DataSink) EnsureFile(databaseID int64, table string) (*FileDetails, error) {
-	key := m.key(databaseID, table)
+	return m.ensureShardFile(databaseID, table, 0)
+}
+
+// ensureShardFile is EnsureFile for one of a table's WriteShards open files
+func (m *DataSink) ensureShardFile(databaseID int64, table string, shard int) (*FileDetails, error) {
+	return m.ensurePartitionFile(databaseID, table, shard, "")
+}
+
+// ensurePartitionFile is ensureShardFile for one of PartitionFunc's
+// partitions, closing the least recently used partition file first if
+// MaxOpenPartitions are already open
+func (m *DataSink) ensurePartitionFile(databaseID int64, table string, shard int, partition string) (*FileDetails, error) {
+	key := m.partitionFileKey(databaseID, table, shard, partition)
 
 	var fileDetails *FileDetails
 	var err error
 
 	// If the file doesn't exist, then create it
-	fileDetails, ok := m.files[key]
+	fileDetails, ok := m.getFile(key)
 	if !ok {
-		fileDetails, err = m.CreateFile(databaseID, table)
+		if partition != "" {
+			m.evictPartitions()
+		}
+		fileDetails, err = m.createPartitionFile(databaseID, table, partition)
 		if err != nil {
 			return nil, err
 		}
+		fileDetails.shard = shard
 
-		m.files[key] = fileDetails
+		m.setFile(key, fileDetails)
 		return fileDetails, nil
 	}
 
@@ -314,88 +1065,505 @@ func (m *DataSink) key(databaseID int64, table string) string {
 	return fmt.Sprintf("%d_%s", databaseID, table)
 }
 
+// tableName applies the configured TableNames policy to table
+func (m *DataSink) tableName(table string) (string, error) {
+	if util.IsNormalizedIdentifier(table) {
+		return table, nil
+	}
+
+	switch m.TableNames {
+	case TableNamesSanitize:
+		return util.SanitizeIdentifier(table)
+	case TableNamesReject:
+		return "", fmt.Errorf("invalid table name %q: must be lowercase alphanumeric or _", table)
+	}
+
+	return table, nil
+}
+
 func (m *DataSink) WriteData(databaseID int64, table string, data []byte) error {
+	return m.WriteBatch(databaseID, table, [][]byte{data})
+}
+
+// WriteBatch writes records to a table. With WriteShards greater than one
+// the batch is split into contiguous chunks which are written to separate
+// open files in parallel. The first invalid record fails the batch;
+// WriteBatchResult carries on past them instead.
+func (m *DataSink) WriteBatch(databaseID int64, table string, records [][]byte) error {
+	_, err := m.writeBatch(databaseID, table, records, nil, nil)
+	return err
+}
+
+// writeBatch writes records to a table. Without reject, the first error
+// fails the batch. With it, records which can't be written are passed to
+// reject by index, along with why, and the rest are still written. It
+// returns the indexes of the records which weren't dropped by Transform or
+// rejected as invalid, or nil if the batch failed before they were checked.
+// trace, if set, is kept by files which don't have one yet.
+func (m *DataSink) writeBatch(databaseID int64, table string, records [][]byte, trace map[string]string, reject func(i int, err error)) ([]int, error) {
 	if !m.enabled {
-		return errors.New("writer is disabled")
+		return nil, errors.New("writer is disabled")
+	}
+
+	table, err := m.tableName(table)
+	if err != nil {
+		return nil, err
+	}
+
+	records, indexes, err := m.prepareRecords(table, records, reject)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return indexes, nil
+	}
+
+	var shardReject func(i int, err error)
+	if reject != nil {
+		shardReject = func(i int, err error) { reject(indexes[i], err) }
+	}
+
+	err = m.checkWrite(databaseID)
+	if err != nil {
+		rejectFrom(shardReject, 0, len(records), err)
+		return indexes, err
 	}
 
 	m.wg.Add(1)
 	defer m.wg.Done()
 
-	// TODO: Is the disk full?
+	return indexes, m.writeSharded(databaseID, table, records, trace, shardReject)
+}
+
+// CheckWrite returns the error a write for the database would fail with right
+// now because the disk is full or backpressure or its quota applies, or nil
+func (m *DataSink) CheckWrite(databaseID int64) error {
+	return m.checkWrite(databaseID)
+}
+
+// checkWrite returns an error if nothing should be written for the database
+// right now, because the disk is full or backpressure or its quota applies
+func (m *DataSink) checkWrite(databaseID int64) error {
 	isFull, err := m.IsDiskFull()
 	if err != nil {
 		return err
 	}
 	if isFull {
-		return errors.New("Disk is full")
+		return datasinkmodels.ErrDiskFull
+	}
+
+	err = m.checkBackpressure()
+	if err != nil {
+		return err
+	}
+
+	return m.checkTenantQuota(databaseID)
+}
+
+// prepareRecords applies the Transform hook, InvalidUTF8 and NonObjects
+// policies and Coerce types to records, or only rawRecord's checks with
+// RawPassthrough. It returns the records to write along with each one's
+// index in records; records dropped by Transform are left out. Invalid
+// records fail the batch, or are passed to reject if it's set.
+func (m *DataSink) prepareRecords(table string, records [][]byte, reject func(i int, err error)) ([][]byte, []int, error) {
+	types, coerce := m.Coerce[table]
+
+	rc := make([][]byte, 0, len(records))
+	indexes := make([]int, 0, len(records))
+	for i, data := range records {
+		if m.RawPassthrough {
+			data, err := rawRecord(data)
+			if err != nil {
+				if reject == nil {
+					return nil, nil, err
+				}
+				reject(i, err)
+				continue
+			}
+			rc = append(rc, data)
+			indexes = append(indexes, i)
+			continue
+		}
+
+		data, ok := m.transform(data)
+		if !ok {
+			continue
+		}
+
+		data, err := utf8Record(m.InvalidUTF8, data)
+		if err == nil {
+			data, err = objectRecord(m.NonObjects, data)
+		}
+		if err == nil && coerce {
+			data, err = util.CoerceJSON(data, types, m.CoerceStrict)
+		}
+		if err != nil {
+			if reject == nil {
+				return nil, nil, err
+			}
+			reject(i, err)
+			continue
+		}
+
+		rc = append(rc, data)
+		indexes = append(indexes, i)
 	}
+	return rc, indexes, nil
+}
 
-	mutexKey := m.key(databaseID, table)
+// writeShard writes records, in order, to one of the table's open files.
+// With reject set, records failing the SchemaDrift policy or VerifyOnWrite
+// are passed to it and skipped, and if an error stops the write, every
+// record not yet written is passed to it too.
+func (m *DataSink) writeShard(databaseID int64, table string, shard int, records [][]byte, trace map[string]string, reject func(i int, err error)) error {
+	if m.PartitionFunc != nil {
+		return m.writePartitioned(databaseID, table, shard, records, trace, reject)
+	}
+	return m.writePartition(databaseID, table, shard, "", records, trace, reject)
+}
+
+// writePartition writes records to one partition's open file in a shard,
+// holding that file's lock
+func (m *DataSink) writePartition(databaseID int64, table string, shard int, partition string, records [][]byte, trace map[string]string, reject func(i int, err error)) error {
+	mutexKey := m.partitionFileKey(databaseID, table, shard, partition)
 	if m.fileMutex.TryLock(mutexKey) {
 		defer m.fileMutex.Unlock(mutexKey)
 
-		fileDetails, err := m.EnsureFile(databaseID, table)
-		if err != nil {
-			return err
+		for i, data := range records {
+			err := m.writeRecord(databaseID, table, shard, partition, data, trace)
+			if err != nil && reject != nil && isRecordError(err) {
+				reject(i, err)
+				continue
+			}
+			if err != nil {
+				rejectFrom(reject, i, len(records), err)
+				return err
+			}
 		}
+	} else {
+		err := errors.New("Could not acquire lock")
+		rejectFrom(reject, 0, len(records), err)
+		return err
+	}
 
-		bytesWritten, err := fileDetails.fd.Write(data)
+	return nil
+}
+
+// rejectFrom passes records start to end to reject, if it's set
+func rejectFrom(reject func(i int, err error), start, end int, err error) {
+	if reject == nil {
+		return
+	}
+	for i := start; i < end; i++ {
+		reject(i, err)
+	}
+}
+
+// isRecordError reports whether err only affects the record being written,
+// so the rest of a batch can still be written
+func isRecordError(err error) bool {
+	return errors.Is(err, ErrSchemaDrift) || errors.Is(err, ErrRecordTooLarge) || errors.Is(err, ErrPartition) || errors.Is(err, datasinkmodels.ErrVerifyFailed)
+}
+
+// writeRecord writes one record to a shard's open file. The caller holds
+// the shard's lock.
+func (m *DataSink) writeRecord(databaseID int64, table string, shard int, partition string, data []byte, trace map[string]string) error {
+	fileDetails, err := m.ensurePartitionFile(databaseID, table, shard, partition)
+	if err != nil {
+		return err
+	}
+
+	terminator := m.terminator()
+	fileDetails, oversized, err := m.makeRoom(fileDetails, int64(len(data)+len(terminator)))
+	if err != nil {
+		return err
+	}
+
+	if !m.RawPassthrough {
+		fileDetails, data, err = m.applySchemaPolicy(fileDetails, data)
 		if err != nil {
 			return err
 		}
-		fileDetails.byteCount += int64(bytesWritten)
+	}
+
+	if trace != nil && fileDetails.trace == nil {
+		fileDetails.trace = trace
+	}
+
+	offset := fileDetails.byteCount
+	bytesWritten, err := fileDetails.writer().Write(data)
+	if err != nil {
+		return diskError(err)
+	}
+	fileDetails.byteCount += int64(bytesWritten)
+
+	bytesWritten, err = fileDetails.writer().Write(terminator)
+	if err != nil {
+		return diskError(err)
+	}
+	fileDetails.byteCount += int64(bytesWritten)
 
-		bytesWritten, err = fileDetails.fd.Write([]byte("\n"))
+	if m.VerifyOnWrite {
+		err = m.verifyRecord(fileDetails, data, offset)
 		if err != nil {
 			return err
 		}
-		fileDetails.byteCount += int64(bytesWritten)
+	}
 
-		fileDetails.rowCount += 1
-	} else {
-		return errors.New("Could not acquire lock")
+	err = m.writeIndex(fileDetails, data, offset, fileDetails.rowCount)
+	if err != nil {
+		return err
+	}
+
+	m.usage.add(databaseID, int64(len(data)+len(terminator)))
+	fileDetails.rowCount += 1
+	fileDetails.lastWrite = m.now()
+	if fileDetails.firstWrite.IsZero() {
+		fileDetails.firstWrite = fileDetails.lastWrite
 	}
 
+	if !m.RawPassthrough {
+		m.trackFields(databaseID, table, data)
+	}
+	m.publishRecord(data)
+
+	if partition != "" {
+		m.partitions.touch(m.detailsKey(fileDetails), fileDetails.lastWrite)
+	}
+
+	if oversized {
+		_, err = m.RotateFile(fileDetails, false)
+		return err
+	}
 	return nil
 }
 
+// Shutdown stops writes, uploads everything and releases DataDir. It returns
+// an error if any file failed to upload; ShutdownWithReport has the details.
 func (m *DataSink) Shutdown() error {
-	m.enabled = false
-	m.wg.Wait()
+	_, err := m.ShutdownWithReport()
+	return err
+}
 
-	m.RotateAllFiles(true, false)
-	m.UploadFiles()
+// byteSizeSettings can be sizes such as "128MiB" as well as numbers of bytes
+var byteSizeSettings = []string{
+	"max_size_bytes",
+	"compact_target_bytes",
+	"max_pending_bytes",
+	"free_space_required_bytes",
+	"default_tenant_quota",
+	"tenant_quotas",
+}
 
-	return nil
+// NewFilesystemDataSink returns a data sink which uploads to storage's blob
+// store and queues messages on its queue. It's equivalent to New with
+// WithStorageServices.
+func NewFilesystemDataSink(settings map[string]any, storage *models.StorageServices, opts ...Option) (*DataSink, error) {
+	return New(settings, append([]Option{WithStorageServices(storage)}, opts...)...)
 }
 
-func NewFilesystemDataSink(settings map[string]any, storage *models.StorageServices) (*DataSink, error) {
+// New returns a data sink configured by settings. Options are applied
+// before the settings are validated and the data directory is created.
+func New(settings map[string]any, opts ...Option) (*DataSink, error) {
+	settings, err := parseByteSizes(settings)
+	if err != nil {
+		return nil, err
+	}
+
 	rc := util.ConfigToStruct[DataSink](settings)
+	rc.storage = &models.StorageServices{}
+	rc.now = time.Now
+	rc.startedAt = time.Now()
+	rc.fs = OSFS{}
+
+	for _, opt := range opts {
+		opt(rc)
+	}
+
+	switch rc.TableNames {
+	case TableNamesAllow, TableNamesSanitize, TableNamesReject:
+	default:
+		return nil, fmt.Errorf("invalid table_names policy %q", rc.TableNames)
+	}
+
+	switch rc.TagKeys {
+	case TagKeysAllow, TagKeysSanitize, TagKeysReject:
+	default:
+		return nil, fmt.Errorf("invalid tag_keys policy %q", rc.TagKeys)
+	}
+	if err := rc.normalizeTagKeys(); err != nil {
+		return nil, err
+	}
+	rc.prepareTagMetadata()
+	rc.prepareMessageTags()
+
+	switch rc.Notify {
+	case "":
+		rc.Notify = NotifyQueue
+	case NotifyQueue, NotifyNone:
+	default:
+		return nil, fmt.Errorf("invalid notify mode %q", rc.Notify)
+	}
+
+	switch rc.Backpressure {
+	case "":
+		rc.Backpressure = BackpressureReject
+	case BackpressureReject, BackpressureBlock:
+	default:
+		return nil, fmt.Errorf("invalid backpressure mode %q", rc.Backpressure)
+	}
+
+	switch rc.Compression {
+	case CompressionNone, CompressionZstd, CompressionLZ4:
+	default:
+		return nil, fmt.Errorf("invalid compression %q", rc.Compression)
+	}
+
+	switch rc.OpenFileCompression {
+	case CompressionNone:
+	case OpenFileCompressionGzip:
+		if rc.Compression != CompressionNone {
+			return nil, errors.New("open_file_compression can't be combined with compression")
+		}
+	default:
+		return nil, fmt.Errorf("invalid open_file_compression %q", rc.OpenFileCompression)
+	}
+
+	if rc.VerifyOnWrite && rc.OpenFileCompression != CompressionNone {
+		return nil, errors.New("verify_on_write can't be combined with open_file_compression")
+	}
+
+	if len(rc.Formats) == 0 {
+		rc.Formats = []string{util.FormatJSONEachRow}
+	}
+	queued := false
+	for _, format := range rc.Formats {
+		if _, ok := formatExtensions[format]; !ok {
+			return nil, fmt.Errorf("invalid format %q", format)
+		}
+		if format != util.FormatJSONEachRow && rc.OpenFileCompression != CompressionNone {
+			return nil, fmt.Errorf("format %q can't be combined with open_file_compression", format)
+		}
+		queued = queued || queuedFormats[format]
+	}
+	if !queued && rc.Notify != NotifyNone {
+		return nil, fmt.Errorf("formats must include %s to queue messages for the workers, or set notify to none", util.FormatJSONEachRow)
+	}
+
+	if rc.CompressionDictionary != "" && rc.Compression != CompressionZstd {
+		return nil, errors.New("compression_dictionary requires zstd compression")
+	}
+
+	err = rc.loadCompressionDictionary()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := rc.validateLive(); err != nil {
+		return nil, err
+	}
+
+	switch rc.NonObjects {
+	case NonObjectsReject, NonObjectsWrap:
+	default:
+		return nil, fmt.Errorf("invalid non_objects policy %q", rc.NonObjects)
+	}
+
+	switch rc.LineTerminator {
+	case LineTerminatorLF, LineTerminatorCRLF:
+	default:
+		return nil, fmt.Errorf("invalid line_terminator %q", rc.LineTerminator)
+	}
+
+	switch rc.UploadOrder {
+	case UploadOrderUnordered, UploadOrderOldestFirst, UploadOrderStrict:
+	default:
+		return nil, fmt.Errorf("invalid upload_order %q", rc.UploadOrder)
+	}
+
+	switch rc.InvalidUTF8 {
+	case InvalidUTF8Allow, InvalidUTF8Reject, InvalidUTF8Sanitize:
+	default:
+		return nil, fmt.Errorf("invalid invalid_utf8 policy %q", rc.InvalidUTF8)
+	}
+
+	switch rc.SchemaDrift {
+	case "":
+		rc.SchemaDrift = SchemaDriftAllow
+		for _, format := range rc.Formats {
+			if columnarFormats[format] {
+				rc.SchemaDrift = SchemaDriftRotate
+			}
+		}
+	case SchemaDriftAllow, SchemaDriftError, SchemaDriftIgnore, SchemaDriftRotate:
+	default:
+		return nil, fmt.Errorf("invalid schema_drift policy %q", rc.SchemaDrift)
+	}
+
+	switch rc.OversizedRecords {
+	case "":
+		rc.OversizedRecords = OversizedRecordsReject
+	case OversizedRecordsReject, OversizedRecordsOwnFile:
+	default:
+		return nil, fmt.Errorf("invalid oversized_records policy %q", rc.OversizedRecords)
+	}
 
 	openDir := filepath.Join(rc.DataDir, OpenFolder)
 	closedDir := filepath.Join(rc.DataDir, ClosedFolder)
 
-	err := os.MkdirAll(openDir, os.ModePerm)
+	err = rc.fs.MkdirAll(openDir, os.ModePerm)
 	if err != nil {
-		return nil, err
+		return nil, diskError(err)
+	}
+
+	err = rc.fs.MkdirAll(closedDir, os.ModePerm)
+	if err != nil {
+		return nil, diskError(err)
 	}
 
-	err = os.MkdirAll(closedDir, os.ModePerm)
+	err = rc.fs.MkdirAll(filepath.Join(rc.DataDir, OutboxFolder), os.ModePerm)
+	if err != nil {
+		return nil, diskError(err)
+	}
+
+	err = rc.checkDataDir()
 	if err != nil {
 		return nil, err
 	}
 
-	snow, err := util.NewSnowflakeGenerator()
+	err = rc.lockDataDir()
 	if err != nil {
 		return nil, err
 	}
 
-	rc.storage = storage
-	rc.snow = snow
+	if rc.newID == nil {
+		var snow *snowflake.Node
+		if rc.snowflakeNode != nil {
+			snow, err = util.NewSnowflakeNode(*rc.snowflakeNode)
+		} else {
+			snow, err = util.NewSnowflakeGenerator()
+		}
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		rc.newID = func() string { return snow.Generate().String() }
+	}
+
 	rc.fileMutex = mapmutex.NewMapMutex()
 	rc.files = map[string]*FileDetails{}
 	rc.uploadMutex = &sync.Mutex{}
 
+	rc.loadFileIDs()
+
+	err = rc.recoverOpenFiles()
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	rc.pendingBytes.Store(rc.closedBytes())
+	rc.usage.store(rc.tenantBytes())
+
 	return rc, nil
 }
@@ -0,0 +1,1801 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/scratchdata/scratchdata/models"
+	datasinkmodels "github.com/scratchdata/scratchdata/pkg/datasink/models"
+	blobmemory "github.com/scratchdata/scratchdata/pkg/storage/blobstore/memory"
+	queuememory "github.com/scratchdata/scratchdata/pkg/storage/queue/memory"
+	queuemodels "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+	"github.com/scratchdata/scratchdata/util"
+	"github.com/tidwall/gjson"
+)
+
+// writeAtOffset implements io.WriterAt over a bytes.Buffer for downloads
+type writeAtOffset struct {
+	bytes.Buffer
+}
+
+func (w *writeAtOffset) WriteAt(p []byte, off int64) (int, error) {
+	return w.Write(p)
+}
+
+func newTestSink(t *testing.T, settings map[string]any) (*DataSink, *models.StorageServices) {
+	t.Helper()
+
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	storage := &models.StorageServices{BlobStore: blobStore, Queue: queue}
+
+	if settings == nil {
+		settings = map[string]any{}
+	}
+	settings["data"] = t.TempDir()
+
+	sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation())
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	return sink, storage
+}
+
+func TestWriteRotateUpload(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	for _, line := range []string{`{"a":1}`, `{"a":2}`} {
+		if err := sink.WriteData(1, "events", []byte(line)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+
+	item, ok := storage.Queue.Dequeue()
+	if !ok {
+		t.Fatal("Expected a queued upload message")
+	}
+
+	message := queuemodels.FileUploadMessage{}
+	if err := json.Unmarshal(item, &message); err != nil {
+		t.Fatalf("Cannot decode message: %s", err)
+	}
+	if message.DatabaseID != 1 || message.Table != "events" {
+		t.Fatalf("Unexpected message %+v", message)
+	}
+
+	buf := &writeAtOffset{}
+	if err := storage.BlobStore.Download(message.Key, buf); err != nil {
+		t.Fatalf("Cannot download %s: %s", message.Key, err)
+	}
+	if s, exp := buf.String(), "{\"a\":1}\n{\"a\":2}\n"; s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+
+	if _, ok := storage.Queue.Dequeue(); ok {
+		t.Fatal("Expected a single upload message")
+	}
+}
+
+func TestUploadStats(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	if uploads := sink.Stats().Uploads; len(uploads) != 0 {
+		t.Fatalf("Expected no uploads; Got %+v", uploads)
+	}
+
+	writes := []struct {
+		databaseID int64
+		table      string
+	}{{2, "events"}, {1, "events"}, {1, "clicks"}, {2, "events"}}
+
+	// Rotating after each write gives a file per write, so events in
+	// database 2 gets two uploads
+	for _, write := range writes {
+		if err := sink.WriteData(write.databaseID, write.table, []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+		sink.RotateAllFiles(true, false)
+	}
+	sink.UploadFiles()
+
+	sizes := map[string]int64{}
+	for {
+		item, ok := storage.Queue.Dequeue()
+		if !ok {
+			break
+		}
+		message := queuemodels.FileUploadMessage{}
+		if err := json.Unmarshal(item, &message); err != nil {
+			t.Fatalf("Cannot decode message: %s", err)
+		}
+		buf := &writeAtOffset{}
+		if err := storage.BlobStore.Download(message.Key, buf); err != nil {
+			t.Fatalf("Cannot download %s: %s", message.Key, err)
+		}
+		sizes[fmt.Sprintf("%d/%s", message.DatabaseID, message.Table)] += int64(buf.Len())
+	}
+
+	exp := []DatasetUploads{
+		{DatabaseID: 1, Table: "clicks", Objects: 1, Bytes: sizes["1/clicks"]},
+		{DatabaseID: 1, Table: "events", Objects: 1, Bytes: sizes["1/events"]},
+		{DatabaseID: 2, Table: "events", Objects: 2, Bytes: sizes["2/events"]},
+	}
+	if uploads := sink.Stats().Uploads; !reflect.DeepEqual(uploads, exp) {
+		t.Fatalf("Expected uploads %+v; Got %+v", exp, uploads)
+	}
+}
+
+func TestIngestLatency(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+
+	now := time.Unix(1700000000, 0)
+	sink, err := New(
+		map[string]any{"max_age_seconds": 60},
+		WithUploadDir(t.TempDir()),
+		WithStorageBackend(blobStore),
+		WithNotifier(queue),
+		WithClock(func() time.Time { return now }),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	if stats := sink.Stats().IngestLatency; stats.Count != 0 || stats.Mean() != 0 {
+		t.Fatalf("Expected no latency before any upload; Got %+v", stats)
+	}
+
+	// Latency runs from a file's first write, not its last or its rotation
+	for _, table := range []string{"events", "clicks"} {
+		if err := sink.WriteData(1, table, []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+		now = now.Add(20 * time.Second)
+	}
+	if err := sink.WriteData(1, "events", []byte(`{"a":2}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	now = now.Add(10 * time.Second)
+	sink.RotateAllFiles(true, false)
+	now = now.Add(20 * time.Second)
+	sink.UploadFiles()
+
+	stats := sink.Stats().IngestLatency
+	if stats.Count != 2 {
+		t.Fatalf("Expected a latency for each file; Got %+v", stats)
+	}
+	if stats.Max != 70*time.Second || stats.Mean() != 60*time.Second {
+		t.Fatalf("Expected latencies of 70s and 50s; Got %+v, mean %s", stats, stats.Mean())
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{
+		"max_age_seconds": 60,
+		"tenant_quotas":   map[string]any{"1": 10},
+	})
+
+	for i, exp := range []bool{true, true, false} {
+		err := sink.WriteData(1, "events", []byte(`{"a":1}`))
+		if exp && err != nil {
+			t.Fatalf("Write %d: unexpected error %s", i, err)
+		}
+		if !exp && !errors.Is(err, datasinkmodels.ErrBackpressure) {
+			t.Fatalf("Write %d: expected backpressure; Got %v", i, err)
+		}
+	}
+
+	if err := sink.WriteData(2, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Other tenant should be unaffected: %s", err)
+	}
+
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Expected quota to free up after upload: %s", err)
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+
+	now := time.Unix(1700000000, 0)
+	sink, err := New(
+		map[string]any{"max_age_seconds": 60},
+		WithUploadDir(t.TempDir()),
+		WithStorageBackend(blobStore),
+		WithNotifier(queue),
+		WithClock(func() time.Time { return now }),
+		WithIDGenerator(func() string { return "fixed" }),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	// Nothing rotates until the clock passes max_age_seconds
+	sink.RotateAllFiles(false, false)
+	sink.UploadFiles()
+	if _, ok := queue.Dequeue(); ok {
+		t.Fatal("Expected no upload before the file is old enough")
+	}
+
+	now = now.Add(time.Minute)
+	sink.RotateAllFiles(false, false)
+	sink.UploadFiles()
+
+	item, ok := queue.Dequeue()
+	if !ok {
+		t.Fatal("Expected a queued upload message")
+	}
+	message := queuemodels.FileUploadMessage{}
+	if err := json.Unmarshal(item, &message); err != nil {
+		t.Fatalf("Cannot decode message: %s", err)
+	}
+	if exp := "data/1/events/fixed.ndjson"; message.Key != exp {
+		t.Fatalf("Expected key %s; Got %s", exp, message.Key)
+	}
+}
+
+func TestDataDirLock(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := New(map[string]any{"data": dir})
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	if _, err := New(map[string]any{"data": dir}); !errors.Is(err, ErrDataDirLocked) {
+		t.Fatalf("Expected ErrDataDirLocked; Got %v", err)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatalf("Cannot close data sink: %s", err)
+	}
+
+	second, err := New(map[string]any{"data": dir})
+	if err != nil {
+		t.Fatalf("Expected the lock to be free after Close: %s", err)
+	}
+	second.Close()
+}
+
+func TestResumeOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	settings := map[string]any{"data": dir, "max_age_seconds": 60, "resume_open_files": true}
+
+	first, err := New(settings, WithManualRotation())
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	if err := first.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	first.Close()
+
+	// Simulate a crash mid-write
+	path := first.files[first.fileKey(1, "events", 0)].path
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Cannot open %s: %s", path, err)
+	}
+	fd.WriteString(`{"a":`)
+	fd.Close()
+
+	second, err := New(settings,
+		WithStorageBackend(blobStore),
+		WithNotifier(queue),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	defer second.Close()
+
+	if err := second.WriteData(1, "events", []byte(`{"a":2}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	second.RotateAllFiles(true, false)
+	second.UploadFiles()
+
+	item, ok := queue.Dequeue()
+	if !ok {
+		t.Fatal("Expected a queued upload message")
+	}
+	message := queuemodels.FileUploadMessage{}
+	if err := json.Unmarshal(item, &message); err != nil {
+		t.Fatalf("Cannot decode message: %s", err)
+	}
+	if exp := "data/1/events/" + filepath.Base(path); message.Key != exp {
+		t.Fatalf("Expected key %s; Got %s", exp, message.Key)
+	}
+
+	buf := &writeAtOffset{}
+	if err := blobStore.Download(message.Key, buf); err != nil {
+		t.Fatalf("Cannot download %s: %s", message.Key, err)
+	}
+	if s, exp := buf.String(), "{\"a\":1}\n{\"a\":2}\n"; s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	for _, table := range []string{"events", "users"} {
+		if err := sink.WriteData(1, table, []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+
+	report, err := sink.ShutdownWithReport()
+	if err != nil {
+		t.Fatalf("Unexpected shutdown error: %s", err)
+	}
+	if !report.Clean() || report.FilesUploaded != 2 || report.BytesUploaded != 16 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := storage.Queue.Dequeue(); !ok {
+			t.Fatalf("Expected upload message %d", i)
+		}
+	}
+}
+
+func TestTriggerRotate(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	sink.rotating.Store(true)
+	if sink.TriggerRotate() {
+		t.Fatal("Expected TriggerRotate to skip while a rotation is in progress")
+	}
+	sink.rotating.Store(false)
+
+	if !sink.TriggerRotate() {
+		t.Fatal("Expected TriggerRotate to rotate")
+	}
+
+	sink.UploadFiles()
+	if _, ok := storage.Queue.Dequeue(); !ok {
+		t.Fatal("Expected the rotated file to be uploaded")
+	}
+}
+
+func TestNotifyNone(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	sink, err := New(
+		map[string]any{"data": t.TempDir(), "max_age_seconds": 60, "notify": NotifyNone},
+		WithStorageBackend(blobStore),
+		WithIDGenerator(func() string { return "fixed" }),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	report, err := sink.ShutdownWithReport()
+	if err != nil || report.FilesUploaded != 1 {
+		t.Fatalf("Expected an upload without a queue; Got %+v, %v", report, err)
+	}
+
+	buf := &writeAtOffset{}
+	if err := blobStore.Download("data/1/events/fixed.ndjson", buf); err != nil {
+		t.Fatalf("Cannot download upload: %s", err)
+	}
+}
+
+func TestIndexField(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60, "index_field": "id"})
+
+	for _, line := range []string{`{"id":"a"}`, `{"x":1}`, `{"id":7}`} {
+		if err := sink.WriteData(1, "events", []byte(line)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+
+	item, ok := storage.Queue.Dequeue()
+	if !ok {
+		t.Fatal("Expected a queued upload message")
+	}
+	message := queuemodels.FileUploadMessage{}
+	if err := json.Unmarshal(item, &message); err != nil {
+		t.Fatalf("Cannot decode message: %s", err)
+	}
+
+	fileID := strings.TrimSuffix(filepath.Base(message.Key), ".ndjson")
+	buf := &writeAtOffset{}
+	if err := storage.BlobStore.Download(indexKey("1", "events", fileID), buf); err != nil {
+		t.Fatalf("Cannot download index: %s", err)
+	}
+
+	exp := fmt.Sprintf("{\"id\":\"a\",\"offset\":0,\"row\":0,\"key\":%q}\n{\"id\":7,\"offset\":19,\"row\":2,\"key\":%q}\n", message.Key, message.Key)
+	if s := buf.String(); s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+	if _, ok := storage.Queue.Dequeue(); ok {
+		t.Fatal("Expected the index not to be queued")
+	}
+}
+
+func TestClosedSubdirs(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	dir := t.TempDir()
+
+	sink, err := New(
+		map[string]any{"data": dir, "max_age_seconds": 60, "closed_subdir_chars": 2},
+		WithStorageBackend(blobStore),
+		WithNotifier(queue),
+		WithIDGenerator(func() string { return "1234" }),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.RotateAllFiles(true, false)
+
+	path := filepath.Join(dir, ClosedFolder, "1", "events", "34", "1234.ndjson")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected closed file in subdirectory: %s", err)
+	}
+	if n := sink.pendingFiles(1, "events"); n != 1 {
+		t.Fatalf("Expected 1 pending file; Got %d", n)
+	}
+
+	sink.UploadFiles()
+	item, ok := queue.Dequeue()
+	if !ok {
+		t.Fatal("Expected a queued upload message")
+	}
+	message := queuemodels.FileUploadMessage{}
+	if err := json.Unmarshal(item, &message); err != nil {
+		t.Fatalf("Cannot decode message: %s", err)
+	}
+	if exp := "data/1/events/1234.ndjson"; message.Key != exp || message.Table != "events" {
+		t.Fatalf("Unexpected message %+v", message)
+	}
+}
+
+// flakyQueue fails to enqueue while down is set
+type flakyQueue struct {
+	*queuememory.Queue
+	down bool
+}
+
+func (q *flakyQueue) Enqueue(value []byte) error {
+	if q.down {
+		return errors.New("queue is down")
+	}
+	return q.Queue.Enqueue(value)
+}
+
+// countingStore counts uploads
+type countingStore struct {
+	*blobmemory.Storage
+	uploads int
+}
+
+func (s *countingStore) Upload(path string, r io.ReadSeeker) error {
+	s.uploads++
+	return s.Storage.Upload(path, r)
+}
+
+func TestOutboxRetriesQueueOnly(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	memQueue, _ := queuememory.NewQueue(nil)
+	store := &countingStore{Storage: blobStore}
+	q := &flakyQueue{Queue: memQueue, down: true}
+
+	sink, err := New(
+		map[string]any{"data": t.TempDir(), "max_age_seconds": 60},
+		WithStorageBackend(store),
+		WithNotifier(q),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+	sink.UploadFiles()
+
+	if _, ok := memQueue.Dequeue(); ok {
+		t.Fatal("Expected no message while the queue is down")
+	}
+
+	q.down = false
+	sink.UploadFiles()
+
+	if _, ok := memQueue.Dequeue(); !ok {
+		t.Fatal("Expected the spooled message to be queued")
+	}
+	if store.uploads != 1 {
+		t.Fatalf("Expected 1 upload; Got %d", store.uploads)
+	}
+}
+
+func TestOutboxSameNameAcrossTables(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	memQueue, _ := queuememory.NewQueue(nil)
+	q := &flakyQueue{Queue: memQueue, down: true}
+
+	sink, err := New(
+		map[string]any{"data": t.TempDir(), "max_age_seconds": 60, "content_addressed": true},
+		WithStorageBackend(blobStore),
+		WithNotifier(q),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	defer sink.Close()
+
+	// The same content gets the same file name in every table
+	for _, table := range []string{"events", "other"} {
+		if err := sink.WriteData(1, table, []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+
+	q.down = false
+	sink.UploadFiles()
+
+	tables := map[string]bool{}
+	for {
+		item, ok := memQueue.Dequeue()
+		if !ok {
+			break
+		}
+		message := queuemodels.FileUploadMessage{}
+		if err := json.Unmarshal(item, &message); err != nil {
+			t.Fatalf("Cannot decode message: %s", err)
+		}
+		tables[message.Table] = true
+	}
+	if !tables["events"] || !tables["other"] {
+		t.Fatalf("Expected a message for each table; Got %v", tables)
+	}
+}
+
+// tooLargeQueue rejects every message as over the queue's size limit
+type tooLargeQueue struct {
+	*queuememory.Queue
+	attempts int
+}
+
+func (q *tooLargeQueue) Enqueue(value []byte) error {
+	q.attempts++
+	return fmt.Errorf("%w: %d bytes", queuemodels.ErrMessageTooLarge, len(value))
+}
+
+func TestOutboxDeadLetter(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	memQueue, _ := queuememory.NewQueue(nil)
+	q := &tooLargeQueue{Queue: memQueue}
+	dir := t.TempDir()
+
+	sink, err := New(
+		map[string]any{"data": dir, "max_age_seconds": 60},
+		WithStorageBackend(blobStore),
+		WithNotifier(q),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+	sink.UploadFiles()
+
+	if q.attempts != 1 {
+		t.Fatalf("Expected a message the queue won't accept to be tried once; Got %d attempts", q.attempts)
+	}
+	if n := sink.Stats().DeadLettered; n != 1 {
+		t.Fatalf("Expected 1 dead lettered message; Got %d", n)
+	}
+
+	report, err := InspectDataDir(dir)
+	if err != nil {
+		t.Fatalf("Cannot inspect data directory: %s", err)
+	}
+	if report.Outbox.Files != 0 || report.DeadLetter.Files != 1 {
+		t.Fatalf("Expected the message to move from the outbox to the dead letter folder; Got %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(dir, DeadLetterFolder, "1", "events")); err != nil {
+		t.Fatalf("Expected the message to keep its database and table folders: %s", err)
+	}
+}
+
+// countingQueue counts enqueue attempts, failing the first fail of them
+type countingQueue struct {
+	*queuememory.Queue
+	attempts int
+	fail     int
+}
+
+func (q *countingQueue) Enqueue(value []byte) error {
+	q.attempts++
+	if q.attempts <= q.fail {
+		return errors.New("queue is busy")
+	}
+	return q.Queue.Enqueue(value)
+}
+
+func TestWithRetryable(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	memQueue, _ := queuememory.NewQueue(nil)
+	q := &countingQueue{Queue: memQueue, fail: 2}
+
+	sink, err := New(
+		map[string]any{
+			"data":            t.TempDir(),
+			"max_age_seconds": 60,
+			"retry":           map[string]any{"max_attempts": 3, "initial_backoff_millis": 1, "max_backoff_millis": 1},
+		},
+		WithStorageBackend(blobStore),
+		WithNotifier(q),
+		WithRetryable(func(err error) bool { return err.Error() == "queue is busy" }),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+
+	if q.attempts != 3 {
+		t.Fatalf("Expected the classifier to allow 3 attempts; Got %d", q.attempts)
+	}
+	if _, ok := memQueue.Dequeue(); !ok {
+		t.Fatal("Expected the message to be queued on the last attempt")
+	}
+}
+
+func TestMultipleFormats(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{
+		"max_age_seconds": 60,
+		"formats":         []string{util.FormatJSONEachRow, util.FormatCSVWithNames},
+		"schema_drift":    SchemaDriftAllow,
+	})
+
+	for _, line := range []string{`{"a":1}`, `{"a":2,"b":"x"}`} {
+		if err := sink.WriteData(1, "events", []byte(line)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+
+	var keys []string
+	sink.OnUpload = func(key string, tags map[string]string, rows int64) error {
+		keys = append(keys, key)
+		return nil
+	}
+
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+
+	// Only the format the workers insert is queued
+	var messages []queuemodels.FileUploadMessage
+	for {
+		item, ok := storage.Queue.Dequeue()
+		if !ok {
+			break
+		}
+
+		message := queuemodels.FileUploadMessage{}
+		if err := json.Unmarshal(item, &message); err != nil {
+			t.Fatalf("Cannot decode message: %s", err)
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) != 1 || messages[0].Format != util.FormatJSONEachRow {
+		t.Fatalf("Expected one JSONEachRow message; Got %+v", messages)
+	}
+
+	contents := map[string]string{}
+	for _, key := range keys {
+		buf := &writeAtOffset{}
+		if err := storage.BlobStore.Download(key, buf); err != nil {
+			t.Fatalf("Cannot download %s: %s", key, err)
+		}
+		contents[util.DetectInputFormat(key, "", "").Format] = buf.String()
+	}
+
+	exp := map[string]string{
+		util.FormatJSONEachRow:  "{\"a\":1}\n{\"a\":2,\"b\":\"x\"}\n",
+		util.FormatCSVWithNames: "a,b\n1,\n2,x\n",
+	}
+	if !reflect.DeepEqual(contents, exp) {
+		t.Fatalf("Expected %#v; Got %#v", exp, contents)
+	}
+}
+
+func TestFormatsWithoutQueuedFormat(t *testing.T) {
+	settings := map[string]any{"data": t.TempDir(), "max_age_seconds": 60, "formats": []string{util.FormatCSVWithNames}}
+	if _, err := New(settings, WithManualRotation()); err == nil {
+		t.Fatal("Expected formats without JSONEachRow to need notify none")
+	}
+
+	settings["notify"] = NotifyNone
+	sink, err := New(settings, WithManualRotation())
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	sink.Close()
+}
+
+func TestContentAddressed(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60, "content_addressed": true})
+
+	for i := 0; i < 2; i++ {
+		if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+		sink.RotateAllFiles(true, false)
+	}
+
+	if n := sink.pendingFiles(1, "events"); n != 1 {
+		t.Fatalf("Expected duplicate to be dropped; Got %d closed files", n)
+	}
+
+	sink.UploadFiles()
+
+	item, ok := storage.Queue.Dequeue()
+	if !ok {
+		t.Fatal("Expected a queued upload message")
+	}
+	message := queuemodels.FileUploadMessage{}
+	if err := json.Unmarshal(item, &message); err != nil {
+		t.Fatalf("Cannot decode message: %s", err)
+	}
+
+	sum := sha256.Sum256([]byte("{\"a\":1}\n"))
+	if exp := "data/1/events/" + hex.EncodeToString(sum[:]) + ".ndjson"; message.Key != exp {
+		t.Fatalf("Expected key %s; Got %s", exp, message.Key)
+	}
+	if _, ok := storage.Queue.Dequeue(); ok {
+		t.Fatal("Expected a single upload message")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	records, unsubscribe := sink.Subscribe()
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	if record := <-records; record != `{"a":1}` {
+		t.Fatalf("Expected the written record; Got %#q", record)
+	}
+
+	// A subscriber which doesn't read doesn't block writes
+	for i := 0; i < SubscriberBuffer+5; i++ {
+		if err := sink.WriteData(1, "events", []byte(`{"a":2}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	if n := sink.Stats().SubscriberDropped; n != 5 {
+		t.Fatalf("Expected 5 dropped records; Got %d", n)
+	}
+
+	unsubscribe()
+	unsubscribe()
+	for range records {
+	}
+}
+
+func TestByteSizeSettings(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_size_bytes": "1KiB", "tenant_quotas": map[string]any{"1": "2MB"}})
+	if sink.MaxFileSize != 1024 || sink.TenantQuotas["1"] != 2000000 {
+		t.Fatalf("Unexpected sizes %d, %v", sink.MaxFileSize, sink.TenantQuotas)
+	}
+
+	_, err := New(map[string]any{"data": t.TempDir(), "max_size_bytes": "1 pint"})
+	if err == nil || !strings.Contains(err.Error(), "max_size_bytes") {
+		t.Fatalf("Expected an error naming the setting, got %v", err)
+	}
+}
+
+func TestFileIDsNeverGoBackwards(t *testing.T) {
+	dir := t.TempDir()
+	newSink := func(ids ...string) *DataSink {
+		next := 0
+		sink, err := New(map[string]any{"data": dir, "max_age_seconds": 60}, WithManualRotation(), WithIDGenerator(func() string {
+			next++
+			return ids[next-1]
+		}))
+		if err != nil {
+			t.Fatalf("Cannot create data sink: %s", err)
+		}
+		return sink
+	}
+
+	sink := newSink("100", "50")
+	for _, exp := range []string{"100", "101"} {
+		if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+		if id := sink.files[sink.fileKey(1, "events", 0)].ID(); id != exp {
+			t.Fatalf("Expected id %s; Got %s", exp, id)
+		}
+		sink.RotateAllFiles(true, false)
+	}
+	sink.Close()
+
+	// A restart with the clock stepped back still sorts after the closed files
+	sink = newSink("60")
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	if id := sink.files[sink.fileKey(1, "events", 0)].ID(); id != "102" {
+		t.Fatalf("Expected id 102; Got %s", id)
+	}
+}
+
+func TestWriteBatchResult(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "schema_drift": SchemaDriftError})
+
+	result := sink.WriteBatchResult(1, "events", [][]byte{
+		[]byte(`{"a":1}`),
+		[]byte(`5`),
+		[]byte(`{"a":2,"b":1}`),
+		[]byte(`{"a":3}`),
+	})
+
+	if !reflect.DeepEqual(result.Written, []int{0, 3}) {
+		t.Fatalf("Expected records 0 and 3 to be written; Got %v", result.Written)
+	}
+	if len(result.Rejected) != 2 ||
+		result.Rejected[0].Index != 1 || !errors.Is(result.Rejected[0].Err, ErrNotObject) ||
+		result.Rejected[1].Index != 2 || !errors.Is(result.Rejected[1].Err, ErrSchemaDrift) {
+		t.Fatalf("Unexpected rejections %+v", result.Rejected)
+	}
+
+	details := sink.files[sink.fileKey(1, "events", 0)]
+	if details.rowCount != 2 {
+		t.Fatalf("Expected 2 rows written; Got %d", details.rowCount)
+	}
+
+	sink.enabled = false
+	result = sink.WriteBatchResult(1, "events", [][]byte{[]byte(`{"a":4}`)})
+	if len(result.Rejected) != 1 || result.OK() {
+		t.Fatalf("Expected the record to be rejected; Got %+v", result)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60, "compact_target_bytes": "1KiB"})
+
+	for i := 0; i < 3; i++ {
+		if err := sink.WriteData(1, "events", []byte(fmt.Sprintf(`{"a":%d}`, i))); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+		sink.RotateAllFiles(true, false)
+	}
+	if err := sink.WriteData(1, "other", []byte(`{"b":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.RotateAllFiles(true, false)
+
+	sink.UploadFiles()
+
+	if n := sink.Stats().CompactedFiles; n != 3 {
+		t.Fatalf("Expected 3 compacted files; Got %d", n)
+	}
+
+	messages := map[string]queuemodels.FileUploadMessage{}
+	for {
+		item, ok := storage.Queue.Dequeue()
+		if !ok {
+			break
+		}
+		message := queuemodels.FileUploadMessage{}
+		if err := json.Unmarshal(item, &message); err != nil {
+			t.Fatalf("Cannot decode message: %s", err)
+		}
+		messages[message.Table] = message
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("Expected one message per table; Got %v", messages)
+	}
+	if rows := messages["events"].Rows; rows != 3 {
+		t.Fatalf("Expected the combined file to have 3 rows; Got %d", rows)
+	}
+	if rows := messages["other"].Rows; rows != 1 {
+		t.Fatalf("Expected the other table's file to be kept apart; Got %d rows", rows)
+	}
+
+	buf := &writeAtOffset{}
+	if err := storage.BlobStore.Download(messages["events"].Key, buf); err != nil {
+		t.Fatalf("Cannot download combined file: %s", err)
+	}
+	if s, exp := buf.String(), "{\"a\":0}\n{\"a\":1}\n{\"a\":2}\n"; s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+}
+
+func TestStagedFiles(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	closed := sink.files[sink.fileKey(1, "events", 0)].Name()
+	sink.RotateAllFiles(true, true)
+
+	files := sink.StagedFiles(false)
+	if len(files) != 1 || files[0].Name != closed || files[0].Open || files[0].Size != 8 {
+		t.Fatalf("Expected closed file %s; Got %+v", closed, files)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":2}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	files = sink.StagedFiles(true)
+	if len(files) != 2 {
+		t.Fatalf("Expected closed and open files; Got %+v", files)
+	}
+	open := 0
+	for _, file := range files {
+		if file.Open {
+			open++
+		}
+	}
+	if open != 1 {
+		t.Fatalf("Expected one open file; Got %+v", files)
+	}
+}
+
+func TestGzipRotatesOnUncompressedSize(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "max_size_bytes": 1000, "open_file_compression": "gzip"})
+
+	record := []byte(`{"message":"the same text compresses very well"}`)
+	for i := 0; i < 10; i++ {
+		if err := sink.WriteData(1, "events", record); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	details := sink.files[sink.fileKey(1, "events", 0)]
+	details.gz.Flush()
+
+	writers := sink.Writers()
+	if len(writers) != 1 {
+		t.Fatalf("Expected one writer; Got %+v", writers)
+	}
+	if w := writers[0]; w.OpenFileSize != int64(10*(len(record)+1)) || w.OpenFileDiskSize >= w.OpenFileSize {
+		t.Fatalf("Expected uncompressed size %d above disk size; Got %+v", 10*(len(record)+1), w)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := sink.WriteData(1, "events", record); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	sink.RotateAllFiles(false, false)
+
+	if n := sink.pendingFiles(1, "events"); n != 1 {
+		t.Fatalf("Expected rotation once uncompressed bytes reach max_size_bytes; Got %d closed files", n)
+	}
+}
+
+func TestOversizedRecordsPolicy(t *testing.T) {
+	for _, policy := range []string{"", OversizedRecordsReject} {
+		sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "max_size_bytes": 50, "oversized_records": policy})
+		if sink.OversizedRecords != OversizedRecordsReject {
+			t.Fatalf("Expected %q to mean reject; Got %q", policy, sink.OversizedRecords)
+		}
+		big := []byte(`{"a":"` + strings.Repeat("x", 100) + `"}`)
+		if err := sink.WriteData(1, "events", big); !errors.Is(err, ErrRecordTooLarge) {
+			t.Fatalf("Expected ErrRecordTooLarge with %q; Got %v", policy, err)
+		}
+	}
+
+	settings := map[string]any{"data": t.TempDir(), "oversized_records": "truncate"}
+	if _, err := New(settings, WithManualRotation()); err == nil {
+		t.Fatal("Expected an invalid oversized_records policy to be rejected")
+	}
+}
+
+func TestOversizedRecords(t *testing.T) {
+	big := []byte(`{"a":"` + strings.Repeat("x", 100) + `"}`)
+
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "max_size_bytes": 50})
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	if err := sink.WriteData(1, "events", big); !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("Expected ErrRecordTooLarge; Got %v", err)
+	}
+	if n := sink.pendingFiles(1, "events"); n != 0 {
+		t.Fatalf("Expected no rotation for a rejected record; Got %d closed files", n)
+	}
+	if n := sink.Stats().OversizedRecords; n != 1 {
+		t.Fatalf("Expected 1 oversized record; Got %d", n)
+	}
+
+	sink, _ = newTestSink(t, map[string]any{"max_age_seconds": 60, "max_size_bytes": 50, "oversized_records": "own_file"})
+	for _, record := range [][]byte{[]byte(`{"a":1}`), big, []byte(`{"a":2}`)} {
+		if err := sink.WriteData(1, "events", record); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	if n := sink.pendingFiles(1, "events"); n != 2 {
+		t.Fatalf("Expected the small file and the oversized record's own file to be closed; Got %d", n)
+	}
+	details := sink.files[sink.fileKey(1, "events", 0)]
+	if details.rowCount != 1 || details.byteCount != 8 {
+		t.Fatalf("Expected the next record in a fresh file; Got %d rows, %d bytes", details.rowCount, details.byteCount)
+	}
+	for _, file := range sink.StagedFiles(false) {
+		if file.Size != 8 && file.Size != int64(len(big)+1) {
+			t.Fatalf("Unexpected closed file %+v", file)
+		}
+	}
+}
+
+func TestRotateBeforeExceedingMaxSize(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "max_size_bytes": 20})
+
+	for i := 0; i < 3; i++ {
+		if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	for _, file := range sink.StagedFiles(true) {
+		if file.Size > 20 {
+			t.Fatalf("Expected no file over max_size_bytes; Got %+v", file)
+		}
+	}
+}
+
+func TestUploadPassStopsOnCancel(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	for _, table := range []string{"a", "b", "c"} {
+		if err := sink.WriteData(1, table, []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	sink.RotateAllFiles(true, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	uploaded := 0
+	sink.OnUpload = func(key string, tags map[string]string, rows int64) error {
+		uploaded++
+		cancel()
+		return nil
+	}
+	sink.uploadFiles(ctx)
+
+	if uploaded != 1 {
+		t.Fatalf("Expected the pass to stop after the file being uploaded; Got %d uploads", uploaded)
+	}
+	if n := len(sink.StagedFiles(false)); n != 2 {
+		t.Fatalf("Expected 2 files left for the next pass; Got %d", n)
+	}
+}
+
+func TestPartitionFunc(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60, "max_open_partitions": 2})
+	sink.PartitionFunc = func(record string) (string, error) {
+		tenant := gjson.Get(record, "tenant")
+		if !tenant.Exists() {
+			return "", errors.New("no tenant")
+		}
+		return "tenant=" + tenant.String() + "/", nil
+	}
+
+	for _, line := range []string{`{"tenant":"a","n":1}`, `{"tenant":"b","n":2}`, `{"tenant":"a","n":3}`} {
+		if err := sink.WriteData(1, "events", []byte(line)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	if err := sink.WriteData(1, "events", []byte(`{"n":4}`)); !errors.Is(err, ErrPartition) {
+		t.Fatalf("Expected ErrPartition; Got %v", err)
+	}
+
+	// A third partition closes the least recently written, tenant b
+	if err := sink.WriteData(1, "events", []byte(`{"tenant":"c","n":5}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	if n := sink.pendingFiles(1, "events"); n != 1 {
+		t.Fatalf("Expected one partition to be closed; Got %d closed files", n)
+	}
+
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+
+	rows := map[string]int64{}
+	for {
+		item, ok := storage.Queue.Dequeue()
+		if !ok {
+			break
+		}
+		message := queuemodels.FileUploadMessage{}
+		if err := json.Unmarshal(item, &message); err != nil {
+			t.Fatalf("Cannot decode message: %s", err)
+		}
+		prefix := path.Dir(message.Key)
+		rows[prefix] += message.Rows
+	}
+
+	exp := map[string]int64{"data/1/events/tenant=a": 2, "data/1/events/tenant=b": 1, "data/1/events/tenant=c": 1}
+	if !reflect.DeepEqual(rows, exp) {
+		t.Fatalf("Expected rows by prefix %v; Got %v", exp, rows)
+	}
+}
+
+func TestPartitionLeftoversRecovered(t *testing.T) {
+	dir := t.TempDir()
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	storage := &models.StorageServices{BlobStore: blobStore, Queue: queue}
+	settings := map[string]any{"data": dir, "max_age_seconds": 60}
+
+	sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation())
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	sink.PartitionFunc = func(record string) (string, error) { return "date=2024-05-01", nil }
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.Close()
+
+	restarted, err := NewFilesystemDataSink(settings, storage, WithManualRotation())
+	if err != nil {
+		t.Fatalf("Cannot restart data sink: %s", err)
+	}
+	files := restarted.StagedFiles(true)
+	if len(files) != 1 || files[0].Open {
+		t.Fatalf("Expected the leftover partition file to be closed; Got %+v", files)
+	}
+
+	restarted.UploadFiles()
+	item, ok := queue.Dequeue()
+	if !ok {
+		t.Fatal("Expected a queued upload message")
+	}
+	message := queuemodels.FileUploadMessage{}
+	json.Unmarshal(item, &message)
+	if !strings.HasPrefix(message.Key, "data/1/events/date=2024-05-01/") {
+		t.Fatalf("Expected the partition prefix in the key; Got %s", message.Key)
+	}
+}
+
+func TestWriteSync(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60, "write_shards": 2})
+
+	if err := sink.WriteData(1, "other", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	records := [][]byte{[]byte(`{"a":1}`), []byte(`{"a":2}`)}
+	if err := sink.WriteSync(context.Background(), 1, "events", records); err != nil {
+		t.Fatalf("Cannot write data synchronously: %s", err)
+	}
+
+	rows := int64(0)
+	for {
+		data, ok := storage.Queue.Dequeue()
+		if !ok {
+			break
+		}
+		message := queuemodels.FileUploadMessage{}
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatalf("Cannot decode message: %s", err)
+		}
+		if message.Table != "events" {
+			t.Fatalf("Expected only events to be uploaded; Got %s", message.Table)
+		}
+		rows += message.Rows
+	}
+	if rows != 2 {
+		t.Fatalf("Expected 2 rows uploaded; Got %d", rows)
+	}
+
+	if sink.files[sink.fileKey(1, "other", 0)] == nil && sink.files[sink.fileKey(1, "other", 1)] == nil {
+		t.Fatal("Expected other tables' files to stay open")
+	}
+	if pending := sink.pendingFiles(1, "events"); pending != 0 {
+		t.Fatalf("Expected no closed files left; Got %d", pending)
+	}
+}
+
+func TestWriteSyncBackpressureBlock(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{
+		"max_age_seconds":           60,
+		"max_pending_bytes":         1,
+		"backpressure":              BackpressureBlock,
+		"backpressure_wait_seconds": 5,
+	})
+
+	if err := sink.WriteData(1, "other", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.RotateAllFiles(true, false)
+	if !sink.overPendingLimit() {
+		t.Fatal("Expected the closed file to apply backpressure")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sink.WriteSync(context.Background(), 1, "events", [][]byte{[]byte(`{"a":1}`)})
+	}()
+
+	// Upload passes must be able to run while WriteSync waits
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Expected WriteSync to succeed once uploads caught up; Got %s", err)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+			sink.UploadFiles()
+		}
+	}
+}
+
+func TestWriteSyncWaitsForWriter(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	key := sink.fileKey(1, "events", 0)
+	if !sink.fileMutex.TryLock(key) {
+		t.Fatal("Cannot lock file")
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sink.fileMutex.Unlock(key)
+	}()
+
+	if err := sink.closeTableFiles(context.Background(), 1, "events"); err != nil {
+		t.Fatalf("Expected closing to wait for the writer; Got %s", err)
+	}
+	if pending := sink.pendingFiles(1, "events"); pending != 1 {
+		t.Fatalf("Expected the file to be closed; Got %d closed files", pending)
+	}
+}
+
+func TestTableRotation(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{
+		"max_age_seconds": 60,
+		"max_size_bytes":  "1KiB",
+		"table_rotation": map[string]any{
+			"small": map[string]any{"max_size_bytes": "16B"},
+			"quick": map[string]any{"max_age_seconds": 1},
+		},
+	})
+
+	for _, table := range []string{"small", "quick", "events"} {
+		for i := 0; i < 3; i++ {
+			if err := sink.WriteData(1, table, []byte(`{"a":1}`)); err != nil {
+				t.Fatalf("Cannot write data: %s", err)
+			}
+		}
+	}
+
+	if pending := sink.pendingFiles(1, "small"); pending != 1 {
+		t.Fatalf("Expected small to rotate once at 16 bytes; Got %d closed files", pending)
+	}
+	if pending := sink.pendingFiles(1, "events"); pending != 0 {
+		t.Fatalf("Expected events to use the sink's max_size_bytes; Got %d closed files", pending)
+	}
+
+	now := time.Now().Add(2 * time.Second)
+	sink.now = func() time.Time { return now }
+	if !sink.NeedsRotation(sink.files[sink.fileKey(1, "quick", 0)]) {
+		t.Fatal("Expected quick to be due for rotation after 1 second")
+	}
+	if sink.NeedsRotation(sink.files[sink.fileKey(1, "events", 0)]) {
+		t.Fatal("Expected events to use the sink's max_age_seconds")
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "health_window_seconds": 60})
+	sink.startedAt = time.Now().Add(-time.Hour)
+
+	if err := sink.CheckHealth(); err != nil {
+		t.Fatalf("Expected a sink with nothing pending to be healthy: %s", err)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.TriggerRotate()
+
+	if err := sink.CheckHealth(); err == nil {
+		t.Fatal("Expected pending files with no recent uploads to be unhealthy")
+	}
+
+	sink.UploadFiles()
+	if err := sink.CheckHealth(); err != nil {
+		t.Fatalf("Expected a sink which just uploaded to be healthy: %s", err)
+	}
+}
+
+func TestUploadDelay(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60, "upload_delay_seconds": 30})
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.TriggerRotate()
+
+	sink.UploadFiles()
+	if _, ok := storage.Queue.Dequeue(); ok {
+		t.Fatal("Expected the closed file to be held back")
+	}
+
+	now := time.Now().Add(time.Minute)
+	sink.now = func() time.Time { return now }
+	sink.UploadFiles()
+	if _, ok := storage.Queue.Dequeue(); !ok {
+		t.Fatal("Expected the closed file to be uploaded once the delay passed")
+	}
+}
+
+func TestTransform(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	var seen []string
+	var mu sync.Mutex
+	sink.Transform = func(raw string) (string, error) {
+		mu.Lock()
+		seen = append(seen, raw)
+		mu.Unlock()
+
+		switch {
+		case strings.Contains(raw, "drop"):
+			return "", errors.New("dropped")
+		case strings.Contains(raw, "panic"):
+			panic("transform failed")
+		case raw == "[1]":
+			// Runs before NonObjects, so it can make records acceptable
+			return `{"wrapped":[1]}`, nil
+		}
+		return strings.Replace(raw, "}", `,"geo":"eu"}`, 1), nil
+	}
+
+	records := [][]byte{
+		[]byte(`{"a":1,"__row_id":7}`),
+		[]byte(`{"drop":true}`),
+		[]byte(`[1]`),
+		[]byte(`{"panic":true}`),
+	}
+	result := sink.WriteBatchResult(1, "events", records)
+	if !result.OK() || !reflect.DeepEqual(result.Written, []int{0, 2}) || !reflect.DeepEqual(result.Dropped, []int{1, 3}) {
+		t.Fatalf("Expected records 1 and 3 to be dropped; Got %+v", result)
+	}
+	if n := sink.Stats().TransformDropped; n != 2 {
+		t.Fatalf("Expected 2 dropped records; Got %d", n)
+	}
+
+	// The record's row id, added by the API, is already there
+	if seen[0] != `{"a":1,"__row_id":7}` {
+		t.Fatalf("Expected Transform to see the record as written; Got %s", seen[0])
+	}
+
+	details, _ := sink.getFile(sink.fileKey(1, "events", 0))
+	data, err := os.ReadFile(details.path)
+	if err != nil {
+		t.Fatalf("Cannot read open file: %s", err)
+	}
+	if s, exp := string(data), "{\"a\":1,\"__row_id\":7,\"geo\":\"eu\"}\n{\"wrapped\":[1]}\n"; s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+}
+
+func TestTransformRawPassthrough(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "raw_passthrough": true})
+	sink.Transform = func(raw string) (string, error) {
+		t.Fatal("Expected Transform not to be called with raw_passthrough")
+		return raw, nil
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+}
+
+func TestRawPassthrough(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "raw_passthrough": true, "invalid_utf8": "reject", "schema_drift": "error"})
+
+	records := [][]byte{[]byte(`{"a":1}` + "\n"), []byte(`[1,2]`), []byte("{\"b\":\n2}"), []byte("\xff")}
+	result := sink.WriteBatchResult(1, "events", records)
+	if len(result.Written) != 3 || len(result.Rejected) != 1 || !errors.Is(result.Rejected[0].Err, ErrEmbeddedNewline) {
+		t.Fatalf("Expected only the multi-line record to be rejected; Got %+v", result)
+	}
+
+	details := sink.files[sink.fileKey(1, "events", 0)]
+	data, err := os.ReadFile(details.path)
+	if err != nil {
+		t.Fatalf("Cannot read open file: %s", err)
+	}
+	if s, exp := string(data), "{\"a\":1}\n[1,2]\n\xff\n"; s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+}
+
+func TestRotationJitter(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "rotation_jitter": 0.5})
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	details := sink.files[sink.fileKey(1, "events", 0)]
+	details.jitter = 1
+
+	now := details.created.Add(29 * time.Second)
+	sink.now = func() time.Time { return now }
+	if sink.NeedsRotation(details) {
+		t.Fatal("Expected no rotation before half of max_age_seconds")
+	}
+
+	now = details.created.Add(30 * time.Second)
+	if !sink.NeedsRotation(details) {
+		t.Fatal("Expected rotation once the jittered age is reached")
+	}
+
+	_, err := NewFilesystemDataSink(map[string]any{"data": t.TempDir(), "max_age_seconds": 60, "rotation_jitter": 1.5}, nil)
+	if err == nil || !strings.Contains(err.Error(), "rotation_jitter") {
+		t.Fatalf("Expected rotation_jitter over 1 to be rejected; Got %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60, "write_shards": 2})
+
+	for _, table := range []string{"events", "other"} {
+		if err := sink.WriteData(1, table, []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+
+	if err := sink.Drain(context.Background()); err != nil {
+		t.Fatalf("Cannot drain: %s", err)
+	}
+
+	for _, table := range []string{"events", "other"} {
+		if _, ok := storage.Queue.Dequeue(); !ok {
+			t.Fatalf("Expected a message for each table")
+		}
+		if pending := sink.pendingFiles(1, table); pending != 0 {
+			t.Fatalf("Expected no closed files left for %s; Got %d", table, pending)
+		}
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":2}`)); err != nil {
+		t.Fatalf("Expected writes to carry on after draining: %s", err)
+	}
+}
+
+func TestDrainDeadLetter(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	memQueue, _ := queuememory.NewQueue(nil)
+
+	sink, err := New(
+		map[string]any{"data": t.TempDir(), "max_age_seconds": 60},
+		WithStorageBackend(blobStore),
+		WithNotifier(&tooLargeQueue{Queue: memQueue}),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	// A message which can never be queued doesn't hold Drain up
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sink.Drain(ctx); err != nil {
+		t.Fatalf("Expected Drain to finish once the message was dead lettered: %s", err)
+	}
+	if n := sink.Stats().DeadLettered; n != 1 {
+		t.Fatalf("Expected 1 dead lettered message; Got %d", n)
+	}
+}
+
+func TestWriteBatchTrace(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60})
+
+	trace := map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	if err := sink.WriteBatchTrace(1, "events", [][]byte{[]byte(`{"a":1}`)}, trace); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	if err := sink.WriteBatchTrace(1, "events", [][]byte{[]byte(`{"a":2}`)}, map[string]string{"traceparent": "other"}); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.TriggerRotate()
+
+	if err := sink.WriteData(1, "untraced", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.TriggerRotate()
+	sink.UploadFiles()
+
+	messages := 0
+	for {
+		data, ok := storage.Queue.Dequeue()
+		if !ok {
+			break
+		}
+		messages++
+		message := queuemodels.FileUploadMessage{}
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatalf("Cannot decode message: %s", err)
+		}
+
+		exp := trace
+		if message.Table == "untraced" {
+			exp = nil
+		}
+		if !reflect.DeepEqual(message.Trace, exp) {
+			t.Fatalf("Expected %s's trace to be %v; Got %v", message.Table, exp, message.Trace)
+		}
+	}
+
+	if messages != 2 {
+		t.Fatalf("Expected 2 messages; Got %d", messages)
+	}
+	if n := len(sink.traces.traces); n != 0 {
+		t.Fatalf("Expected traces to be dropped after upload; Got %d", n)
+	}
+}
+
+func TestCompactionKeepsTraces(t *testing.T) {
+	sink, storage := newTestSink(t, map[string]any{"max_age_seconds": 60, "compact_target_bytes": "1KiB"})
+
+	first := map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	second := map[string]string{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}
+	for _, trace := range []map[string]string{first, first, second, nil} {
+		if err := sink.WriteBatchTrace(1, "events", [][]byte{[]byte(`{"a":1}`)}, trace); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+		sink.RotateAllFiles(true, false)
+	}
+
+	sink.UploadFiles()
+
+	if n := sink.Stats().CompactedFiles; n != 2 {
+		t.Fatalf("Expected only the files sharing a trace to be compacted; Got %d", n)
+	}
+
+	rows := map[string]int64{}
+	for {
+		item, ok := storage.Queue.Dequeue()
+		if !ok {
+			break
+		}
+		message := queuemodels.FileUploadMessage{}
+		if err := json.Unmarshal(item, &message); err != nil {
+			t.Fatalf("Cannot decode message: %s", err)
+		}
+		rows[message.Trace["traceparent"]] += message.Rows
+	}
+
+	exp := map[string]int64{first["traceparent"]: 2, second["traceparent"]: 1, "": 1}
+	if !reflect.DeepEqual(rows, exp) {
+		t.Fatalf("Expected rows by trace %v; Got %v", exp, rows)
+	}
+}
+
+func TestSchemaDriftDefault(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]any
+		expected string
+	}{
+		{name: "json", settings: map[string]any{}, expected: SchemaDriftAllow},
+		{name: "csv", settings: map[string]any{"formats": []string{util.FormatJSONEachRow, util.FormatCSVWithNames}}, expected: SchemaDriftRotate},
+		{name: "csv allow", settings: map[string]any{"formats": []string{util.FormatJSONEachRow, util.FormatCSVWithNames}, "schema_drift": SchemaDriftAllow}, expected: SchemaDriftAllow},
+		{name: "json error", settings: map[string]any{"schema_drift": SchemaDriftError}, expected: SchemaDriftError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.settings["max_age_seconds"] = 60
+			sink, _ := newTestSink(t, test.settings)
+			if sink.SchemaDrift != test.expected {
+				t.Fatalf("Expected %s; Got %s", test.expected, sink.SchemaDrift)
+			}
+		})
+	}
+}
+
+func TestSchemaDriftMetrics(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "formats": []string{util.FormatJSONEachRow, util.FormatCSVWithNames}})
+
+	counter := schemaDriftTotal.WithLabelValues(SchemaDriftRotate)
+	before := counterValue(t, counter)
+
+	for _, line := range []string{`{"a":1}`, `{"a":2}`, `{"a":3,"b":1}`} {
+		if err := sink.WriteData(1, "events", []byte(line)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+
+	if n := sink.Stats().SchemaDriftRotations; n != 1 {
+		t.Fatalf("Expected 1 rotation; Got %d", n)
+	}
+	if n := counterValue(t, counter) - before; n != 1 {
+		t.Fatalf("Expected the rotate counter to increase by 1; Got %v", n)
+	}
+}
+
+// counterValue returns a Prometheus counter's current value
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+
+	metric := &dto.Metric{}
+	if err := counter.Write(metric); err != nil {
+		t.Fatalf("Cannot read counter: %s", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestIdleRotation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	sink, err := New(
+		map[string]any{"max_age_seconds": 3600, "idle_seconds": 10},
+		WithUploadDir(t.TempDir()),
+		WithClock(func() time.Time { return now }),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	// Writes keep resetting the idle time, however old the file gets
+	for i := 0; i < 3; i++ {
+		if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+		now = now.Add(8 * time.Second)
+
+		details, _ := sink.getFile(sink.fileKey(1, "events", 0))
+		if sink.NeedsRotation(details) {
+			t.Fatalf("Expected no rotation 8s after a write, %d writes in", i+1)
+		}
+	}
+
+	now = now.Add(2 * time.Second)
+	details, _ := sink.getFile(sink.fileKey(1, "events", 0))
+	if !sink.NeedsRotation(details) {
+		t.Fatal("Expected rotation once idle_seconds pass without a write")
+	}
+}
+
+func TestOnRotate(t *testing.T) {
+	dir := t.TempDir()
+	next := 0
+	sink, err := New(
+		map[string]any{"max_age_seconds": 60},
+		WithUploadDir(dir),
+		WithIDGenerator(func() string { next++; return fmt.Sprint(next) }),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	type rotation struct{ oldID, newID string }
+	var rotations []rotation
+	sink.OnRotate = func(oldFileID, newFileID string) {
+		rotations = append(rotations, rotation{oldFileID, newFileID})
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	details, _ := sink.getFile(sink.fileKey(1, "events", 0))
+	closedID := details.ID()
+
+	if _, err := sink.RotateFile(details, true); err != nil {
+		t.Fatalf("Cannot rotate: %s", err)
+	}
+	open, _ := sink.getFile(sink.fileKey(1, "events", 0))
+
+	var closed []string
+	filepath.WalkDir(filepath.Join(dir, ClosedFolder), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			id, _, _ := strings.Cut(d.Name(), ".")
+			closed = append(closed, id)
+		}
+		return nil
+	})
+
+	if len(closed) != 1 || closed[0] != closedID {
+		t.Fatalf("Expected closed file %s; Got %v", closedID, closed)
+	}
+	if open.ID() == closedID {
+		t.Fatalf("Expected a new open file; Got %s again", open.ID())
+	}
+	if exp := []rotation{{closedID, open.ID()}}; !reflect.DeepEqual(rotations, exp) {
+		t.Fatalf("Expected %+v; Got %+v", exp, rotations)
+	}
+
+	// Rotating without a replacement passes no new id
+	rotations = nil
+	sink.RotateAllFiles(true, false)
+	if exp := []rotation{{open.ID(), ""}}; !reflect.DeepEqual(rotations, exp) {
+		t.Fatalf("Expected %+v; Got %+v", exp, rotations)
+	}
+}
@@ -0,0 +1,210 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore"
+	blobmodels "github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
+	queuemodels "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// formatExtensions are the file extensions for each supported upload format
+var formatExtensions = map[string]string{
+	util.FormatJSONEachRow:  ".ndjson",
+	util.FormatCSVWithNames: ".csv",
+}
+
+// columnarFormats are the formats with a fixed set of columns per file, which
+// default SchemaDrift to rotate
+var columnarFormats = map[string]bool{
+	util.FormatCSVWithNames: true,
+}
+
+// queuedFormats are the formats whose objects get a queue message. They're
+// the formats the bundled workers insert: a message for any other format
+// would fail in the workers every time it was delivered, and a file queued
+// in two formats would be inserted twice.
+var queuedFormats = map[string]bool{
+	util.FormatJSONEachRow: true,
+}
+
+// uploadedObject is one format of a closed file, uploaded to the blob store
+type uploadedObject struct {
+	// name is the object's file name, such as 1234.csv
+	name    string
+	key     string
+	format  string
+	message []byte
+	result  UploadResult
+}
+
+// queued reports whether the object gets a queue message under notify
+func (o uploadedObject) queued(notify string) bool {
+	return notify != NotifyNone && queuedFormats[o.format]
+}
+
+// UploadResult describes one object uploaded for a closed file
+type UploadResult struct {
+	Key string
+
+	// Bytes is the size of the object as uploaded, after any conversion and
+	// compression
+	Bytes int64
+
+	// Duration is how long the upload took, including retries
+	Duration time.Duration
+
+	// ETag is the blob store's ETag for the object, if it reports one
+	ETag string
+}
+
+// uploadObject uploads the closed NDJSON file at path, holding rows records,
+// in format, converting and compressing it on the way, and returns the
+// message to queue for it
+func (m *DataSink) uploadObject(ctx context.Context, closed closedFile, path, format string, gzipped bool, rows int64) (uploadedObject, error) {
+	name := closed.name
+	uploadPath := path
+	fileID, _, _ := strings.Cut(closed.name, ".")
+
+	if format != util.FormatJSONEachRow {
+		name = fileID + formatExtensions[format]
+
+		converted, err := m.convertFile(path, format)
+		if err != nil {
+			return uploadedObject{}, err
+		}
+		defer m.fs.Remove(converted)
+		uploadPath = converted
+	}
+
+	key := fmt.Sprintf("data/%s/%s/%s", closed.dbID, closed.table, name)
+	if closed.partition != "" {
+		key = fmt.Sprintf("data/%s/%s/%s/%s", closed.dbID, closed.table, closed.partition, name)
+	}
+	metadata := m.tagMetadata(closed.dbID, closed.table)
+
+	if gzipped {
+		metadata["compression"] = OpenFileCompressionGzip
+	} else if m.Compression != CompressionNone {
+		compressed, err := m.compressFile(uploadPath)
+		if err != nil {
+			return uploadedObject{}, err
+		}
+		defer m.fs.Remove(compressed)
+		uploadPath = compressed
+
+		key += compressionExtensions[m.Compression]
+		for k, v := range m.compressionMetadata() {
+			metadata[k] = v
+		}
+	}
+
+	fd, err := m.openFile(uploadPath)
+	if err != nil {
+		return uploadedObject{}, err
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return uploadedObject{}, err
+	}
+
+	checksum, err := util.SHA256(fd)
+	if err != nil {
+		return uploadedObject{}, err
+	}
+
+	var object blobmodels.ObjectInfo
+	start := time.Now()
+	err = m.retryPolicy().Do(ctx, func() error {
+		if _, err := fd.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		object, err = blobstore.UploadInfo(ctx, m.storage.BlobStore, key, fd, metadata)
+		return err
+	})
+	result := UploadResult{Key: key, Bytes: info.Size(), Duration: time.Since(start), ETag: object.ETag}
+	if err != nil {
+		return uploadedObject{}, err
+	}
+	m.counters.recordUpload()
+	m.counters.uploads.add(closed.databaseID, closed.table, info.Size())
+
+	uploadMessage := queuemodels.FileUploadMessage{
+		DatabaseID:  closed.databaseID,
+		Table:       closed.table,
+		Key:         key,
+		Location:    object.Location,
+		Rows:        rows,
+		Checksum:    checksum,
+		Compression: m.Compression,
+		Format:      format,
+		Trace:       m.traces.load(closedRef(closed.databaseID, closed.table, fileID)),
+	}
+
+	if gzipped {
+		uploadMessage.Compression = OpenFileCompressionGzip
+	}
+
+	message, err := m.queueMessage(uploadMessage)
+	if err != nil {
+		return uploadedObject{}, err
+	}
+
+	return uploadedObject{name: name, key: key, format: format, message: message, result: result}, nil
+}
+
+// queueMessage adds the sink's tags, dictionary and destinations to an
+// uploaded file's message and encodes it
+func (m *DataSink) queueMessage(uploadMessage queuemodels.FileUploadMessage) ([]byte, error) {
+	uploadMessage.Tags = m.uploadMessageTags(uploadMessage.Table)
+
+	if len(m.dictionary) > 0 {
+		uploadMessage.CompressionDictionaryID = m.dictionaryID
+	}
+
+	if multi, ok := m.storage.BlobStore.(interface{ Destinations() []string }); ok {
+		uploadMessage.Destinations = multi.Destinations()
+	}
+
+	return json.Marshal(uploadMessage)
+}
+
+// convertFile writes the NDJSON file at path in format to a temporary file
+// outside the closed folder and returns its path. The caller removes it.
+func (m *DataSink) convertFile(path, format string) (string, error) {
+	src, err := m.openFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := m.fs.CreateTemp(m.DataDir, "convert-*"+formatExtensions[format])
+	if err != nil {
+		return "", diskError(err)
+	}
+
+	switch format {
+	case util.FormatCSVWithNames:
+		err = util.NDJSONToCSVWithCRLF(dst, src, m.LineTerminator == LineTerminatorCRLF)
+	default:
+		err = fmt.Errorf("unsupported format %q", format)
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		m.fs.Remove(dst.Name())
+		return "", diskError(err)
+	}
+
+	return dst.Name(), nil
+}
@@ -0,0 +1,99 @@
+package filesystem
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+// FS is the filesystem the data sink keeps its files on. OSFS, the default,
+// is the local disk; WithFS substitutes another, such as one which injects
+// disk-full or rename failures in tests.
+type FS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	CreateTemp(dir, pattern string) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+}
+
+// File is an open file or directory on an FS. *os.File implements it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Writer
+	io.Closer
+
+	Name() string
+	Stat() (fs.FileInfo, error)
+	ReadDir(n int) ([]fs.DirEntry, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OSFS is the local filesystem
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	fd, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (OSFS) CreateTemp(dir, pattern string) (File, error) {
+	fd, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (OSFS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (OSFS) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (OSFS) Remove(name string) error { return os.Remove(name) }
+
+func (OSFS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (OSFS) Link(oldname, newname string) error { return os.Link(oldname, newname) }
+
+// openFile opens name for reading
+func (m *DataSink) openFile(name string) (File, error) {
+	return m.fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// createFile creates or truncates name for writing, like os.Create
+func (m *DataSink) createFile(name string) (File, error) {
+	return m.fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// readFile returns the contents of name, like os.ReadFile
+func (m *DataSink) readFile(name string) ([]byte, error) {
+	fd, err := m.openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return io.ReadAll(fd)
+}
+
+// readDir returns the entries in the directory name sorted by file name,
+// like os.ReadDir
+func (m *DataSink) readDir(name string) ([]fs.DirEntry, error) {
+	dir, err := m.openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	entries, err := dir.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
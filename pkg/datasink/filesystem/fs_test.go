@@ -0,0 +1,482 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/scratchdata/scratchdata/models"
+	datasinkmodels "github.com/scratchdata/scratchdata/pkg/datasink/models"
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore"
+	blobmemory "github.com/scratchdata/scratchdata/pkg/storage/blobstore/memory"
+	blobmodels "github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
+	queuememory "github.com/scratchdata/scratchdata/pkg/storage/queue/memory"
+	queuemodels "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+)
+
+// faultyFS is the local disk, failing or corrupting writes and failing
+// links on request
+type faultyFS struct {
+	OSFS
+	diskFull  atomic.Bool
+	corrupt   atomic.Bool
+	linkFails atomic.Bool
+}
+
+type faultyFile struct {
+	File
+	fsys *faultyFS
+}
+
+func (f *faultyFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	fd, err := f.OSFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return faultyFile{File: fd, fsys: f}, nil
+}
+
+func (f *faultyFS) Link(oldname, newname string) error {
+	if f.linkFails.Load() {
+		return &fs.PathError{Op: "link", Path: oldname, Err: syscall.EIO}
+	}
+	return f.OSFS.Link(oldname, newname)
+}
+
+func (f faultyFile) Write(p []byte) (int, error) {
+	if f.fsys.diskFull.Load() {
+		return 0, &fs.PathError{Op: "write", Path: f.Name(), Err: syscall.ENOSPC}
+	}
+	if f.fsys.corrupt.Load() && len(p) > 0 {
+		corrupted := append([]byte{}, p...)
+		corrupted[0] ^= 0xff
+		return f.File.Write(corrupted)
+	}
+	return f.File.Write(p)
+}
+
+func TestFaultyFS(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	storage := &models.StorageServices{BlobStore: blobStore, Queue: queue}
+
+	fsys := &faultyFS{}
+	settings := map[string]any{"data": t.TempDir(), "max_age_seconds": 60}
+	sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation(), WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	fsys.diskFull.Store(true)
+	err = sink.WriteData(1, "events", []byte(`{"a":2}`))
+	if !errors.Is(err, datasinkmodels.ErrDiskFull) {
+		t.Fatalf("Expected disk full error, got %v", err)
+	}
+	fsys.diskFull.Store(false)
+
+	fsys.linkFails.Store(true)
+	details := sink.files[sink.fileKey(1, "events", 0)]
+	if _, err := sink.RotateFile(details, true); err == nil {
+		t.Fatal("Expected rotation to fail")
+	}
+	if pending := sink.pendingFiles(1, "events"); pending != 0 {
+		t.Fatalf("Expected no closed files, got %d", pending)
+	}
+	if _, err := fsys.Stat(details.path); err != nil {
+		t.Fatalf("Expected open file to be kept: %s", err)
+	}
+}
+
+func TestVerifyOnWrite(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	storage := &models.StorageServices{BlobStore: blobStore, Queue: queue}
+
+	fsys := &faultyFS{}
+	settings := map[string]any{"data": t.TempDir(), "max_age_seconds": 60, "verify_on_write": true}
+	sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation(), WithFS(fsys))
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+
+	fsys.corrupt.Store(true)
+	err = sink.WriteData(1, "events", []byte(`{"a":2}`))
+	if !errors.Is(err, datasinkmodels.ErrVerifyFailed) {
+		t.Fatalf("Expected verification error, got %v", err)
+	}
+	fsys.corrupt.Store(false)
+
+	if n := sink.Stats().VerifyFailures; n != 1 {
+		t.Fatalf("Expected 1 verification failure; Got %d", n)
+	}
+
+	details := sink.files[sink.fileKey(1, "events", 0)]
+	data, err := os.ReadFile(details.path)
+	if err != nil {
+		t.Fatalf("Cannot read open file: %s", err)
+	}
+	if s, exp := string(data), "{\"a\":1}\n"; s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+}
+
+// panickyStore is a blob store which panics uploading keys containing
+// panicOn
+type panickyStore struct {
+	blobstore.BlobStore
+	panicOn string
+}
+
+func (s panickyStore) Upload(path string, r io.ReadSeeker) error {
+	if strings.Contains(path, s.panicOn) {
+		panic("corrupt file")
+	}
+	return s.BlobStore.Upload(path, r)
+}
+
+func TestUploadPanicSkipsFile(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	storage := &models.StorageServices{BlobStore: panickyStore{BlobStore: blobStore, panicOn: "/bad/"}, Queue: queue}
+
+	settings := map[string]any{"data": t.TempDir(), "max_age_seconds": 60}
+	sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation())
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	for _, table := range []string{"bad", "good"} {
+		if err := sink.WriteData(1, table, []byte(`{"a":1}`)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	sink.TriggerRotate()
+	sink.UploadFiles()
+
+	data, ok := queue.Dequeue()
+	if !ok || !strings.Contains(string(data), `"table":"good"`) {
+		t.Fatalf("Expected good to be uploaded; Got %s", data)
+	}
+	if pending := sink.pendingFiles(1, "bad"); pending != 1 {
+		t.Fatalf("Expected the panicking file to be kept; Got %d closed files", pending)
+	}
+}
+
+// locatingStore is a blob store which reports uploads as landing under base
+type locatingStore struct {
+	blobstore.BlobStore
+	base string
+}
+
+func (s locatingStore) UploadInfo(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) (blobmodels.ObjectInfo, error) {
+	return blobmodels.ObjectInfo{Location: s.base + path, ETag: `"etag"`}, s.BlobStore.Upload(path, r)
+}
+
+func TestUploadLocation(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	storage := &models.StorageServices{BlobStore: locatingStore{BlobStore: blobStore, base: "https://partner.example/"}, Queue: queue}
+
+	settings := map[string]any{"data": t.TempDir(), "max_age_seconds": 60}
+	sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation())
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.TriggerRotate()
+	sink.UploadFiles()
+
+	data, ok := queue.Dequeue()
+	if !ok {
+		t.Fatal("Expected an upload message")
+	}
+	message := queuemodels.FileUploadMessage{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatalf("Cannot decode message: %s", err)
+	}
+	if exp := "https://partner.example/" + message.Key; message.Location != exp {
+		t.Fatalf("Expected location %s; Got %s", exp, message.Location)
+	}
+}
+
+func TestUploadFileResults(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	storage := &models.StorageServices{BlobStore: locatingStore{BlobStore: blobStore}, Queue: queue}
+
+	settings := map[string]any{"data": t.TempDir(), "max_age_seconds": 60, "formats": []string{"JSONEachRow", "CSVWithNames"}}
+	sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation())
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.TriggerRotate()
+
+	dir := sink.closedFolder(1, "events", "", "")
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 closed file; Got %v, %v", entries, err)
+	}
+
+	results, err := sink.uploadFileResults(context.Background(), filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("Cannot upload file: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected a result per format; Got %v", results)
+	}
+	for i, ext := range []string{".ndjson", ".csv"} {
+		result := results[i]
+		if !strings.HasSuffix(result.Key, ext) || result.ETag != `"etag"` || result.Bytes == 0 {
+			t.Fatalf("Unexpected result %+v", result)
+		}
+	}
+}
+
+func TestUploadOrder(t *testing.T) {
+	for _, order := range []string{UploadOrderOldestFirst, UploadOrderStrict} {
+		blobStore, _ := blobmemory.NewStorage(nil)
+		queue, _ := queuememory.NewQueue(nil)
+		storage := &models.StorageServices{BlobStore: panickyStore{BlobStore: blobStore, panicOn: "/oldest/"}, Queue: queue}
+
+		settings := map[string]any{"data": t.TempDir(), "max_age_seconds": 60, "upload_order": order}
+		sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation())
+		if err != nil {
+			t.Fatalf("Cannot create data sink: %s", err)
+		}
+
+		for _, table := range []string{"oldest", "middle", "newest"} {
+			if err := sink.WriteData(1, table, []byte(`{"a":1}`)); err != nil {
+				t.Fatalf("Cannot write data: %s", err)
+			}
+			sink.TriggerRotate()
+			time.Sleep(2 * time.Millisecond)
+		}
+		sink.UploadFiles()
+
+		tables := []string{}
+		for {
+			data, ok := queue.Dequeue()
+			if !ok {
+				break
+			}
+			message := queuemodels.FileUploadMessage{}
+			if err := json.Unmarshal(data, &message); err != nil {
+				t.Fatalf("Cannot decode message: %s", err)
+			}
+			tables = append(tables, message.Table)
+		}
+
+		exp := []string{"middle", "newest"}
+		if order == UploadOrderStrict {
+			exp = []string{}
+		}
+		if !reflect.DeepEqual(tables, exp) {
+			t.Fatalf("Expected %s to upload %v; Got %v", order, exp, tables)
+		}
+	}
+
+	// Compacting would give the older events files a new id, sorting them
+	// after clicks, so it's skipped while files are ordered
+	for _, order := range []string{UploadOrderOldestFirst, UploadOrderStrict} {
+		blobStore, _ := blobmemory.NewStorage(nil)
+		queue, _ := queuememory.NewQueue(nil)
+		storage := &models.StorageServices{BlobStore: blobStore, Queue: queue}
+
+		settings := map[string]any{"data": t.TempDir(), "max_age_seconds": 60, "upload_order": order, "compact_target_bytes": 1 << 20}
+		sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation())
+		if err != nil {
+			t.Fatalf("Cannot create data sink: %s", err)
+		}
+
+		for _, table := range []string{"events", "clicks", "events"} {
+			if err := sink.WriteData(1, table, []byte(`{"a":1}`)); err != nil {
+				t.Fatalf("Cannot write data: %s", err)
+			}
+			sink.TriggerRotate()
+			time.Sleep(2 * time.Millisecond)
+		}
+		sink.UploadFiles()
+
+		tables := []string{}
+		for {
+			data, ok := queue.Dequeue()
+			if !ok {
+				break
+			}
+			message := queuemodels.FileUploadMessage{}
+			if err := json.Unmarshal(data, &message); err != nil {
+				t.Fatalf("Cannot decode message: %s", err)
+			}
+			tables = append(tables, message.Table)
+		}
+
+		exp := []string{"events", "clicks", "events"}
+		if !reflect.DeepEqual(tables, exp) {
+			t.Fatalf("Expected %s with compaction to upload %v; Got %v", order, exp, tables)
+		}
+	}
+}
+
+// hangingStore is a blob store whose uploads hang until they're cancelled
+// while hang is set
+type hangingStore struct {
+	blobstore.BlobStore
+	hang     atomic.Bool
+	attempts atomic.Int32
+}
+
+func (s *hangingStore) UploadContext(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) error {
+	s.attempts.Add(1)
+	if s.hang.Load() {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.BlobStore.Upload(path, r)
+}
+
+func TestUploadTimeout(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	store := &hangingStore{BlobStore: blobStore}
+	store.hang.Store(true)
+	storage := &models.StorageServices{BlobStore: store, Queue: queue}
+
+	settings := map[string]any{"data": t.TempDir(), "max_age_seconds": 60, "upload_timeout_seconds": 1}
+	sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation())
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.TriggerRotate()
+
+	start := time.Now()
+	sink.UploadFiles()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected the hung upload to time out after 1s; Took %s", elapsed)
+	}
+	if _, ok := queue.Dequeue(); ok {
+		t.Fatal("Expected no message for a timed out upload")
+	}
+	if pending := sink.pendingFiles(1, "events"); pending != 1 {
+		t.Fatalf("Expected the timed out file to be kept; Got %d closed files", pending)
+	}
+
+	// The next pass retries it
+	store.hang.Store(false)
+	sink.UploadFiles()
+	if _, ok := queue.Dequeue(); !ok {
+		t.Fatal("Expected the file to upload on the next pass")
+	}
+	if n := store.attempts.Load(); n != 2 {
+		t.Fatalf("Expected 2 upload attempts; Got %d", n)
+	}
+}
+
+// downStore fails every upload while down is set
+type downStore struct {
+	*blobmemory.Storage
+	down bool
+}
+
+func (s *downStore) Upload(path string, r io.ReadSeeker) error {
+	if s.down {
+		return errors.New("store is down")
+	}
+	return s.Storage.Upload(path, r)
+}
+
+func TestMultiStorage(t *testing.T) {
+	hot, _ := blobmemory.NewStorage(nil)
+	archiveStorage, _ := blobmemory.NewStorage(nil)
+	archive := &downStore{Storage: archiveStorage, down: true}
+	memQueue, _ := queuememory.NewQueue(nil)
+
+	store := blobstore.NewMultiStorageWithStores([]string{"hot", "archive"}, []blobstore.BlobStore{hot, archive})
+	sink, err := New(
+		map[string]any{"data": t.TempDir(), "max_age_seconds": 60},
+		WithStorageBackend(store),
+		WithNotifier(memQueue),
+		WithManualRotation(),
+	)
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+	defer sink.Close()
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.RotateAllFiles(true, false)
+
+	var closed []string
+	filepath.WalkDir(filepath.Join(sink.DataDir, ClosedFolder), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			closed = append(closed, path)
+		}
+		return err
+	})
+	if len(closed) != 1 {
+		t.Fatalf("Expected 1 closed file; Got %v", closed)
+	}
+
+	if err := sink.uploadFile(context.Background(), closed[0]); err == nil || !strings.Contains(err.Error(), "archive") {
+		t.Fatalf("Expected the archive store's error; Got %v", err)
+	}
+	if pending := sink.pendingFiles(1, "events"); pending != 1 {
+		t.Fatalf("Expected the file to stay in closed/; Got %d closed files", pending)
+	}
+	if _, ok := memQueue.Dequeue(); ok {
+		t.Fatal("Expected no message while a store is down")
+	}
+
+	archive.down = false
+	sink.UploadFiles()
+
+	if pending := sink.pendingFiles(1, "events"); pending != 0 {
+		t.Fatalf("Expected the file to be uploaded; Got %d closed files", pending)
+	}
+	item, ok := memQueue.Dequeue()
+	if !ok {
+		t.Fatal("Expected a message once every store accepts the file")
+	}
+	message := queuemodels.FileUploadMessage{}
+	if err := json.Unmarshal(item, &message); err != nil {
+		t.Fatalf("Cannot decode message: %s", err)
+	}
+	if exp := []string{"hot", "archive"}; !reflect.DeepEqual(message.Destinations, exp) {
+		t.Fatalf("Expected destinations %v; Got %v", exp, message.Destinations)
+	}
+	for name, s := range map[string]blobstore.BlobStore{"hot": hot, "archive": archiveStorage} {
+		if err := s.Download(message.Key, &writeAtOffset{}); err != nil {
+			t.Fatalf("Expected %s in the %s store: %s", message.Key, name, err)
+		}
+	}
+}
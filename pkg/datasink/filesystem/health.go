@@ -0,0 +1,59 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultHealthWindowSeconds is used when HealthWindowSeconds isn't set
+const DefaultHealthWindowSeconds = 300
+
+// recordScan notes that an upload pass over the closed files just finished
+func (c *counters) recordScan() {
+	c.lastScanAt.Store(time.Now().UnixNano())
+}
+
+func (m *DataSink) healthWindow() time.Duration {
+	if m.HealthWindowSeconds > 0 {
+		return time.Duration(m.HealthWindowSeconds) * time.Second
+	}
+	return DefaultHealthWindowSeconds * time.Second
+}
+
+// CheckHealth returns an error if files are waiting to be uploaded but
+// neither an upload nor a full upload pass has happened within
+// HealthWindowSeconds, as when the uploader has stalled or died while the
+// process carries on. It's for liveness probes, so a stalled node is
+// restarted rather than quietly filling its disk.
+func (m *DataSink) CheckHealth() error {
+	pending := m.PendingBytes()
+	if pending <= 0 {
+		return nil
+	}
+
+	last := m.startedAt
+	for _, ts := range []int64{m.counters.lastUploadAt.Load(), m.counters.lastScanAt.Load()} {
+		if t := time.Unix(0, ts); ts > 0 && t.After(last) {
+			last = t
+		}
+	}
+
+	window := m.healthWindow()
+	if since := time.Since(last); since > window {
+		return fmt.Errorf("no uploads for %s with %d bytes pending, window is %s", since.Round(time.Second), pending, window)
+	}
+	return nil
+}
+
+// runUploads is one upload pass for MonitorUploads, recovering from a panic
+// so the uploader carries on with the next pass rather than dying
+func (m *DataSink) runUploads(ctx context.Context) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.log().Error().Interface("panic", r).Msg("Upload pass panicked")
+		}
+	}()
+
+	m.uploadFiles(ctx)
+}
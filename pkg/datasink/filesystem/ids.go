@@ -0,0 +1,73 @@
+package filesystem
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// fileIDs keeps file ids from going backwards. Snowflake ids sort by creation
+// time: within a data directory, a file created later has a larger id than
+// any file before it which is still on disk, open or closed. A restart seeds
+// from the files left in the directory, so ordering only holds across a
+// restart against those; once every file has been uploaded there is nothing
+// to seed from, and after a backwards clock step new ids may sort before ones
+// already uploaded. The snowflake generator uses the monotonic clock while
+// running, but its epoch comes from the wall clock at startup, so without
+// seeding a process restarted after a step, such as an NTP correction, would
+// name new files before older ones still on disk.
+type fileIDs struct {
+	mu   sync.Mutex
+	last int64
+}
+
+// observe records the id of an existing file, so new ids sort after it
+func (f *fileIDs) observe(id int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id > f.last {
+		f.last = id
+	}
+}
+
+// next returns id, or the smallest id after the last one if id would sort
+// before it
+func (f *fileIDs) next(id int64) (int64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id <= f.last {
+		f.last++
+		return f.last, false
+	}
+	f.last = id
+	return id, true
+}
+
+// fileID returns the id for a new file. Ids which aren't numbers, from
+// WithIDGenerator, are returned unchanged.
+func (m *DataSink) fileID() string {
+	id := m.newID()
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return id
+	}
+
+	next, ok := m.ids.next(n)
+	if !ok {
+		m.log().Warn().Str("generated", id).Int64("id", next).Msg("File id went backwards, the clock may have stepped back; using the next id after the newest file instead")
+	}
+	return strconv.FormatInt(next, 10)
+}
+
+// loadFileIDs finds the newest id among files left on disk
+func (m *DataSink) loadFileIDs() {
+	for _, folder := range []string{OpenFolder, ClosedFolder} {
+		walkDir(m.fs, filepath.Join(m.DataDir, folder), func(path string, di fs.DirEntry) error {
+			m.ids.observe(openFileOrder(path))
+			return nil
+		})
+	}
+}
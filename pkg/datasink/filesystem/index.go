@@ -0,0 +1,118 @@
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// IndexExtension is appended to a data file's name for its index sidecar
+const IndexExtension = ".index"
+
+// isIndexFile reports whether path is an index sidecar rather than data
+func isIndexFile(path string) bool {
+	return strings.HasSuffix(path, IndexExtension)
+}
+
+// indexKey returns the blob key a data file's index is uploaded to:
+// data/1/events/1234.ndjson => index/1/events/1234.ndjson
+func indexKey(dbID, table, fileID string) string {
+	return fmt.Sprintf("index/%s/%s/%s.ndjson", dbID, table, fileID)
+}
+
+// openIndex creates the index sidecar for a new open file
+func (m *DataSink) openIndex(details *FileDetails) error {
+	if m.IndexField == "" {
+		return nil
+	}
+
+	fd, err := m.createFile(details.path + IndexExtension)
+	if err != nil {
+		return diskError(err)
+	}
+	details.index = fd
+	return nil
+}
+
+// writeIndex records where data, written at offset as row number row, is in
+// its file. Records without IndexField aren't indexed.
+func (m *DataSink) writeIndex(details *FileDetails, data []byte, offset, row int64) error {
+	if details.index == nil {
+		return nil
+	}
+
+	id := gjson.GetBytes(data, m.IndexField)
+	if !id.Exists() {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(details.index, "{\"id\":%s,\"offset\":%d,\"row\":%d}\n", id.Raw, offset, row)
+	return diskError(err)
+}
+
+// closeIndex moves the index sidecar alongside its data file, which has been
+// moved to closedPath, or deletes it if closedPath is empty
+func (m *DataSink) closeIndex(details *FileDetails, closedPath string) error {
+	if details.index == nil {
+		return nil
+	}
+
+	path := details.path + IndexExtension
+	if closedPath != "" {
+		err := m.fs.Link(path, closedPath+IndexExtension)
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			return diskError(err)
+		}
+	}
+	return m.fs.Remove(path)
+}
+
+// uploadIndex uploads the index sidecar for the closed file at path, if
+// there is one, adding the data file's key to each entry
+func (m *DataSink) uploadIndex(ctx context.Context, path, dbID, table, fileID, key string) error {
+	fd, err := m.openFile(path + IndexExtension)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	buf := &bytes.Buffer{}
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		// A crash can leave an incomplete trailing entry
+		if !gjson.ValidBytes(scanner.Bytes()) {
+			continue
+		}
+
+		entry, err := sjson.SetBytes(scanner.Bytes(), "key", key)
+		if err != nil {
+			return err
+		}
+		buf.Write(entry)
+		buf.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return m.retryPolicy().Do(ctx, func() error {
+		return blobstore.UploadContext(ctx, m.storage.BlobStore, indexKey(dbID, table, fileID), bytes.NewReader(buf.Bytes()), nil)
+	})
+}
+
+// removeIndex deletes the index sidecar for the closed file at path, if
+// any. A sidecar left behind is only wasted space, so errors are ignored.
+func (m *DataSink) removeIndex(path string) {
+	m.fs.Remove(path + IndexExtension)
+}
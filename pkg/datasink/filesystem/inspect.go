@@ -0,0 +1,116 @@
+package filesystem
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FolderReport counts the files in one of a data directory's folders
+type FolderReport struct {
+	Files int
+	Bytes int64
+}
+
+// DirReport describes a data directory, as found by InspectDataDir
+type DirReport struct {
+	Open   FolderReport
+	Closed FolderReport
+
+	// Outbox counts the messages for uploaded files still waiting to be queued
+	Outbox FolderReport
+
+	// DeadLetter counts the messages the queue would never accept
+	DeadLetter FolderReport
+
+	// OldestPending is when the oldest closed file was last written, or zero
+	// if none are waiting to be uploaded
+	OldestPending time.Time
+
+	// Incomplete are the files whose last line is cut short. Open files
+	// being written at the time may show up here without being damaged.
+	Incomplete []string
+}
+
+// InspectDataDir reports the files waiting in a data directory without
+// changing anything, so it's safe to run against one a sink is using. Files
+// which disappear while it looks, because they were uploaded or rotated,
+// are skipped.
+func InspectDataDir(dir string) (DirReport, error) {
+	fsys := OSFS{}
+	rc := DirReport{}
+
+	folders := map[string]*FolderReport{
+		OpenFolder:       &rc.Open,
+		ClosedFolder:     &rc.Closed,
+		OutboxFolder:     &rc.Outbox,
+		DeadLetterFolder: &rc.DeadLetter,
+	}
+	for _, folder := range []string{OpenFolder, ClosedFolder, OutboxFolder, DeadLetterFolder} {
+		report := folders[folder]
+		err := walkDir(fsys, filepath.Join(dir, folder), func(path string, di fs.DirEntry) error {
+			if isIndexFile(path) || strings.HasPrefix(di.Name(), ".") {
+				return nil
+			}
+
+			info, err := di.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			report.Files++
+			report.Bytes += info.Size()
+
+			if folder == OutboxFolder || folder == DeadLetterFolder {
+				return nil
+			}
+			if folder == ClosedFolder && (rc.OldestPending.IsZero() || info.ModTime().Before(rc.OldestPending)) {
+				rc.OldestPending = info.ModTime()
+			}
+
+			if strings.HasSuffix(path, ".gz") {
+				return nil
+			}
+			incomplete, err := hasIncompleteLine(fsys, path)
+			if err != nil {
+				return err
+			}
+			if incomplete {
+				rc.Incomplete = append(rc.Incomplete, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return rc, err
+		}
+	}
+
+	return rc, nil
+}
+
+// hasIncompleteLine reports whether the file at path ends with an incomplete
+// line, opening it read-only
+func hasIncompleteLine(fsys FS, path string) (bool, error) {
+	fd, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	_, trailing, err := incompleteLine(fd, info.Size())
+	return trailing > 0, err
+}
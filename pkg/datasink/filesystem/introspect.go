@@ -0,0 +1,143 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
+)
+
+// Writers returns details for each file currently open for writing
+func (m *DataSink) Writers() []models.WriterInfo {
+	rc := []models.WriterInfo{}
+
+	for _, key := range m.fileKeys() {
+		if m.fileMutex.TryLock(key) {
+			details, ok := m.getFile(key)
+			if ok && details != nil {
+				rc = append(rc, models.WriterInfo{
+					ID:               key,
+					Directory:        details.Directory(),
+					Tags:             m.fileTags(fmt.Sprintf("%d", details.databaseId), details.table),
+					OpenFileSize:     details.byteCount,
+					OpenFileDiskSize: details.diskSize(),
+					OpenFileRows:     details.rowCount,
+					PendingFiles:     m.pendingFiles(details.databaseId, details.table),
+				})
+			}
+			m.fileMutex.Unlock(key)
+		}
+	}
+
+	sort.Slice(rc, func(i, j int) bool { return rc[i].ID < rc[j].ID })
+	return rc
+}
+
+// StagedFiles lists the closed files waiting to be uploaded and, with
+// includeOpen, the files still being written, sorted by database id, table
+// and file name. It's a directory listing taken without locks, so files
+// rotating or uploading while it runs may be missed or reported in both
+// states, which is fine for reconciliation against the blob store.
+func (m *DataSink) StagedFiles(includeOpen bool) []models.StagedFileInfo {
+	rc := []models.StagedFileInfo{}
+
+	folders := []string{ClosedFolder}
+	if includeOpen {
+		folders = append(folders, OpenFolder)
+	}
+
+	for _, folder := range folders {
+		root := filepath.Join(m.DataDir, folder)
+		walkDir(m.fs, root, func(path string, di fs.DirEntry) error {
+			if isIndexFile(path) {
+				return nil
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return nil
+			}
+			tokens := strings.Split(rel, string(filepath.Separator))
+			if len(tokens) < 3 {
+				return nil
+			}
+			databaseID, err := strconv.ParseInt(tokens[0], 10, 64)
+			if err != nil {
+				return nil
+			}
+
+			info, err := di.Info()
+			if err != nil {
+				// Uploaded or rotated since it was listed
+				return nil
+			}
+
+			rc = append(rc, models.StagedFileInfo{
+				DatabaseID: databaseID,
+				Table:      tokens[1],
+				Name:       tokens[len(tokens)-1],
+				Size:       info.Size(),
+				ModifiedAt: info.ModTime(),
+				Open:       folder == OpenFolder,
+			})
+			return nil
+		})
+	}
+
+	sort.Slice(rc, func(i, j int) bool {
+		if rc[i].DatabaseID != rc[j].DatabaseID {
+			return rc[i].DatabaseID < rc[j].DatabaseID
+		}
+		if rc[i].Table != rc[j].Table {
+			return rc[i].Table < rc[j].Table
+		}
+		return rc[i].Name < rc[j].Name
+	})
+	return rc
+}
+
+// FlushWriter closes the open file for the given writer id and uploads all closed files
+func (m *DataSink) FlushWriter(id string) error {
+	if !m.fileMutex.TryLock(id) {
+		return errors.New("could not acquire lock")
+	}
+
+	details, ok := m.getFile(id)
+	if !ok || details == nil {
+		m.fileMutex.Unlock(id)
+		return errors.New("writer not found")
+	}
+
+	_, err := m.RotateFile(details, false)
+	m.fileMutex.Unlock(id)
+	if err != nil {
+		return err
+	}
+
+	m.UploadFiles()
+	return nil
+}
+
+// TriggerRotate closes every open file so it's uploaded on the next upload
+// pass, e.g. at the end of a batch job. New files are created by the next
+// write. It takes the same locks as timed rotation and returns false without
+// waiting if a rotation is already in progress.
+func (m *DataSink) TriggerRotate() bool {
+	return m.rotateAll(true, false)
+}
+
+// rotateAll is RotateAllFiles, skipped if another pass is already running
+func (m *DataSink) rotateAll(forceRotation bool, createNew bool) bool {
+	if !m.rotating.CompareAndSwap(false, true) {
+		return false
+	}
+	defer m.rotating.Store(false)
+
+	m.RotateAllFiles(forceRotation, createNew)
+	return true
+}
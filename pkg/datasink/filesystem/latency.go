@@ -0,0 +1,99 @@
+package filesystem
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// closedRef identifies a closed file across databases and tables, as
+// <database id>/<table>/<id>. File ids alone can repeat between tables, such
+// as with ContentAddressed or WithIDGenerator.
+func closedRef(databaseID int64, table, id string) string {
+	return fmt.Sprintf("%d/%s/%s", databaseID, table, id)
+}
+
+// firstWrites remembers when each closed file first had a record written to
+// it, from rotation until upload, keyed by closedRef. It's only in memory, so
+// files closed before a restart aren't measured.
+type firstWrites struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+func (f *firstWrites) store(name string, t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.times == nil {
+		f.times = map[string]time.Time{}
+	}
+	f.times[name] = t
+}
+
+// take removes and returns the first write time recorded for name
+func (f *firstWrites) take(name string) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, ok := f.times[name]
+	delete(f.times, name)
+	return t, ok
+}
+
+// LatencyStats summarizes the time from a file's first write until it was
+// uploaded and its message queued
+type LatencyStats struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+}
+
+// Mean returns the average latency, or zero if nothing has been uploaded
+func (l LatencyStats) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+// latencyCounters holds the live values behind LatencyStats
+type latencyCounters struct {
+	count atomic.Int64
+	total atomic.Int64
+	max   atomic.Int64
+}
+
+func (c *latencyCounters) observe(d time.Duration) {
+	c.count.Add(1)
+	c.total.Add(int64(d))
+	for {
+		max := c.max.Load()
+		if int64(d) <= max || c.max.CompareAndSwap(max, int64(d)) {
+			break
+		}
+	}
+	ingestLatency.Observe(d.Seconds())
+}
+
+func (c *latencyCounters) stats() LatencyStats {
+	return LatencyStats{
+		Count: c.count.Load(),
+		Total: time.Duration(c.total.Load()),
+		Max:   time.Duration(c.max.Load()),
+	}
+}
+
+// recordIngestLatency observes the latency of a file which has just been
+// uploaded, if its first write was recorded. Only the first of a file's
+// objects to be queued is measured.
+func (m *DataSink) recordIngestLatency(databaseID int64, table, name string) {
+	id, _, _ := strings.Cut(name, ".")
+	firstWrite, ok := m.firstWrites.take(closedRef(databaseID, table, id))
+	if !ok {
+		return
+	}
+	m.counters.ingestLatency.observe(m.now().Sub(firstWrite))
+}
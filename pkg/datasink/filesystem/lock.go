@@ -0,0 +1,71 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// LockFile is held in DataDir by the data sink using it
+const LockFile = ".lock"
+
+// ErrDataDirLocked is returned when another data sink is already using DataDir
+var ErrDataDirLocked = errors.New("data directory is in use by another data sink")
+
+// lockDataDir takes an exclusive flock on DataDir's lock file so two
+// processes, such as overlapping old and new instances during a restart,
+// can't use the same open and closed files. The lock is released when the
+// process exits, even if it crashes.
+func (m *DataSink) lockDataDir() error {
+	path := filepath.Join(m.DataDir, LockFile)
+	fd, err := m.fs.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return diskError(err)
+	}
+
+	// Filesystems other than the local disk can't be flocked
+	osFile, ok := fd.(*os.File)
+	if !ok {
+		m.lockFile = fd
+		return nil
+	}
+
+	err = unix.Flock(int(osFile.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		fd.Close()
+		return fmt.Errorf("%s: %w", m.DataDir, ErrDataDirLocked)
+	}
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	// Record who holds the lock to help whoever hits the error
+	fd.Truncate(0)
+	fmt.Fprintf(fd, "%d\n", os.Getpid())
+
+	m.lockFile = fd
+	return nil
+}
+
+// Close releases DataDir for other data sinks. Shutdown calls it once
+// everything has been uploaded.
+func (m *DataSink) Close() error {
+	if m.lockFile == nil {
+		return nil
+	}
+
+	var err error
+	if osFile, ok := m.lockFile.(*os.File); ok {
+		err = unix.Flock(int(osFile.Fd()), unix.LOCK_UN)
+	}
+	closeErr := m.lockFile.Close()
+	m.lockFile = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,39 @@
+package filesystem
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	lastUploadTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "scratchdata_last_upload_timestamp_seconds",
+		Help: "Unix time of the last file successfully uploaded by the filesystem data sink",
+	})
+
+	newFieldsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "scratchdata_new_fields_total",
+		Help: "Top-level fields seen for the first time in a dataset since startup",
+	})
+
+	ingestLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "scratchdata_ingest_latency_seconds",
+		Help:    "Time from a file's first write until it was uploaded and queued",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	schemaDriftTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scratchdata_schema_drift_total",
+		Help: "Records which introduced new fields into an open file, by the schema_drift policy applied",
+	}, []string{"policy"})
+
+	uploadedObjectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scratchdata_uploaded_objects_total",
+		Help: "Data files uploaded to the blob store since startup",
+	}, []string{"database_id", "table"})
+
+	uploadedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "scratchdata_uploaded_bytes_total",
+		Help: "Bytes of data files uploaded to the blob store since startup, after compression",
+	}, []string{"database_id", "table"})
+)
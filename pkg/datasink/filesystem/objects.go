@@ -0,0 +1,46 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Policies for records which are valid JSON but not objects, such as arrays,
+// numbers, strings and null
+const (
+	NonObjectsReject = ""
+	NonObjectsWrap   = "wrap"
+)
+
+// ErrNotObject is returned when a record isn't a JSON object and NonObjects
+// is "reject"
+var ErrNotObject = errors.New("record is not a JSON object")
+
+// ErrInvalidJSON is returned when a record isn't valid JSON, whatever the
+// NonObjects policy, so it's never wrapped or written as it is
+var ErrInvalidJSON = errors.New("record is not valid JSON")
+
+// wrapField is the field non-object records are wrapped in
+const wrapField = "value"
+
+// objectRecord applies the NonObjects policy to a record, returning it as an
+// object
+func objectRecord(policy string, data []byte) ([]byte, error) {
+	if !gjson.ValidBytes(data) {
+		return nil, fmt.Errorf("%w: %.32q", ErrInvalidJSON, data)
+	}
+
+	if gjson.ParseBytes(data).IsObject() {
+		return data, nil
+	}
+
+	if policy != NonObjectsWrap {
+		return nil, fmt.Errorf("%w: %.32q", ErrNotObject, data)
+	}
+
+	return sjson.SetRawBytes([]byte("{}"), wrapField, bytes.TrimSpace(data))
+}
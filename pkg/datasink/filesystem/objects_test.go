@@ -0,0 +1,50 @@
+package filesystem
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestObjectRecord(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"a":1}`, `{"a":1}`},
+		{` {"a":1}`, ` {"a":1}`},
+		{`[1,2]`, `{"value":[1,2]}`},
+		{`42`, `{"value":42}`},
+		{`-1.5`, `{"value":-1.5}`},
+		{`"hello"`, `{"value":"hello"}`},
+		{`null`, `{"value":null}`},
+		{` true `, `{"value":true}`},
+	}
+
+	for _, test := range tests {
+		rc, err := objectRecord(NonObjectsWrap, []byte(test.input))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.input, err)
+		} else if string(rc) != test.expected {
+			t.Errorf("%s: expected %s; got %s", test.input, test.expected, rc)
+		}
+
+		rc, err = objectRecord(NonObjectsReject, []byte(test.input))
+		if test.input == test.expected {
+			if err != nil || string(rc) != test.input {
+				t.Errorf("%s: expected object to be kept; got %s, %v", test.input, rc, err)
+			}
+		} else if !errors.Is(err, ErrNotObject) {
+			t.Errorf("%s: expected ErrNotObject; got %v", test.input, err)
+		}
+	}
+}
+
+func TestObjectRecordInvalidJSON(t *testing.T) {
+	for _, input := range []string{`{"a":`, `{"a":1}}`, `[1,`, `hello`, ``, `{"a":1} {"b":2}`} {
+		for _, policy := range []string{NonObjectsReject, NonObjectsWrap} {
+			if rc, err := objectRecord(policy, []byte(input)); !errors.Is(err, ErrInvalidJSON) {
+				t.Errorf("%q with policy %q: expected ErrInvalidJSON; got %s, %v", input, policy, rc, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package filesystem
+
+import (
+	"sync"
+	"time"
+)
+
+// The open files map is shared by every writer, so it's only touched through
+// these, under filesMutex. Holding a file's fileMutex key only protects the
+// FileDetails behind it, not the map.
+
+// getFile returns the open file held under key
+func (m *DataSink) getFile(key string) (*FileDetails, bool) {
+	m.filesMutex.RLock()
+	defer m.filesMutex.RUnlock()
+
+	details, ok := m.files[key]
+	return details, ok
+}
+
+// setFile holds details under key, tracking it for eviction if it's one of
+// PartitionFunc's partitions
+func (m *DataSink) setFile(key string, details *FileDetails) {
+	m.filesMutex.Lock()
+	m.files[key] = details
+	m.filesMutex.Unlock()
+
+	if details.partition != "" {
+		m.partitions.touch(key, details.lastWrite)
+	}
+}
+
+// deleteFile stops holding an open file under key
+func (m *DataSink) deleteFile(key string) {
+	m.filesMutex.Lock()
+	delete(m.files, key)
+	m.filesMutex.Unlock()
+
+	m.partitions.remove(key)
+}
+
+// fileKeys returns the keys of every open file, for passes which then lock
+// each one in turn
+func (m *DataSink) fileKeys() []string {
+	m.filesMutex.RLock()
+	defer m.filesMutex.RUnlock()
+
+	keys := make([]string, 0, len(m.files))
+	for key := range m.files {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// openPartitions tracks when each open partition file was last written, so
+// the least recently used can be found without reading files other writers
+// hold
+type openPartitions struct {
+	mu        sync.Mutex
+	lastWrite map[string]time.Time
+}
+
+func (p *openPartitions) touch(key string, t time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.lastWrite == nil {
+		p.lastWrite = map[string]time.Time{}
+	}
+	p.lastWrite[key] = t
+}
+
+func (p *openPartitions) remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.lastWrite, key)
+}
+
+// oldest returns the key of the least recently written partition file, and
+// how many are open
+func (p *openPartitions) oldest() (string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rc := ""
+	var oldest time.Time
+	for key, t := range p.lastWrite {
+		if rc == "" || t.Before(oldest) {
+			rc, oldest = key, t
+		}
+	}
+	return rc, len(p.lastWrite)
+}
@@ -0,0 +1,310 @@
+package filesystem
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/scratchdata/scratchdata/models"
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore"
+	"github.com/scratchdata/scratchdata/pkg/storage/queue"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// Option configures a DataSink at construction
+type Option func(*DataSink)
+
+// WithManualRotation disables the background rotation and upload loops, and
+// enables writes immediately without calling Start. Callers drive
+// RotateAllFiles and UploadFiles themselves, which makes tests deterministic.
+func WithManualRotation() Option {
+	return func(m *DataSink) {
+		m.manual = true
+		m.enabled = true
+	}
+}
+
+// WithStorageServices uses storage's blob store and queue
+func WithStorageServices(storage *models.StorageServices) Option {
+	return func(m *DataSink) {
+		if storage != nil {
+			m.storage = storage
+		}
+	}
+}
+
+// WithStorageBackend sets the blob store files are uploaded to
+func WithStorageBackend(store blobstore.BlobStore) Option {
+	return func(m *DataSink) {
+		storage := *m.storage
+		storage.BlobStore = store
+		m.storage = &storage
+	}
+}
+
+// WithNotifier sets the queue upload messages are sent to
+func WithNotifier(q queue.Queue) Option {
+	return func(m *DataSink) {
+		storage := *m.storage
+		storage.Queue = q
+		m.storage = &storage
+	}
+}
+
+// WithUploadDir overrides the data setting, the directory open and closed
+// files are kept in
+func WithUploadDir(dir string) Option {
+	return func(m *DataSink) {
+		m.DataDir = dir
+	}
+}
+
+// WithTags adds tags which are passed to the OnUpload hook and reported by
+// Writers along with each file's database_id and table
+func WithTags(tags map[string]string) Option {
+	return func(m *DataSink) {
+		if m.tags == nil {
+			m.tags = map[string]string{}
+		}
+		for k, v := range tags {
+			m.tags[k] = v
+		}
+	}
+}
+
+// WithTableTags adds tags for one table's files, merged over those from
+// WithTags, like the table_tags setting
+func WithTableTags(table string, tags map[string]string) Option {
+	return func(m *DataSink) {
+		if m.TableTags == nil {
+			m.TableTags = map[string]map[string]string{}
+		}
+		if m.TableTags[table] == nil {
+			m.TableTags[table] = map[string]string{}
+		}
+		for k, v := range tags {
+			m.TableTags[table][k] = v
+		}
+	}
+}
+
+// WithLogger logs to logger instead of the global logger
+func WithLogger(logger zerolog.Logger) Option {
+	return func(m *DataSink) {
+		m.logger = &logger
+	}
+}
+
+// WithClock replaces time.Now for file age and idle checks
+func WithClock(now func() time.Time) Option {
+	return func(m *DataSink) {
+		m.now = now
+	}
+}
+
+// WithIDGenerator replaces the snowflake ids used to name files, e.g. with
+// a counter so tests can assert on keys. ids must be unique and safe to use
+// in file names. Numeric ids are still kept from going backwards.
+func WithIDGenerator(newID func() string) Option {
+	return func(m *DataSink) {
+		m.newID = newID
+	}
+}
+
+// WithSnowflakeNode names files with snowflake ids from the given node id,
+// 0-1023, instead of one derived from the hostname. Use it to keep ids
+// unique when several sinks run on one host, or where hostnames collide.
+func WithSnowflakeNode(node int64) Option {
+	return func(m *DataSink) {
+		m.snowflakeNode = &node
+	}
+}
+
+// WithRetryable replaces the classifier Retry uses to decide which upload
+// and queue send errors are worth retrying, which can't be set from settings
+func WithRetryable(isRetryable func(err error) bool) Option {
+	return func(m *DataSink) {
+		m.Retry.IsRetryable = isRetryable
+	}
+}
+
+// WithFS keeps the open, closed and outbox files on fsys instead of the
+// local disk. Free space checks still use the local disk, and DataDir is
+// only locked against other processes if fsys returns *os.File.
+func WithFS(fsys FS) Option {
+	return func(m *DataSink) {
+		m.fs = fsys
+	}
+}
+
+// log returns the logger set by WithLogger, or the global logger. The global
+// logger is looked up on each call because it's configured after startup.
+func (m *DataSink) log() *zerolog.Logger {
+	if m.logger != nil {
+		return m.logger
+	}
+	return &log.Logger
+}
+
+// fileTags returns the tags for a file: those set by WithTags, then the
+// table's TableTags, then database_id and table, each taking precedence over
+// the ones before
+func (m *DataSink) fileTags(databaseID string, table string) map[string]string {
+	tableTags := m.TableTags[table]
+	rc := make(map[string]string, len(m.tags)+len(tableTags)+2)
+	for k, v := range m.tags {
+		rc[k] = v
+	}
+	for k, v := range tableTags {
+		rc[k] = v
+	}
+	rc["database_id"] = databaseID
+	rc["table"] = table
+	return rc
+}
+
+// normalizeTagKeys applies the TagKeys policy to the keys of the sink's tags
+// and each table's TableTags
+func (m *DataSink) normalizeTagKeys() error {
+	if m.TagKeys == TagKeysAllow {
+		return nil
+	}
+
+	tags, err := m.tagKeys(m.tags)
+	if err != nil {
+		return err
+	}
+	m.tags = tags
+
+	for table, tableTags := range m.TableTags {
+		tags, err := m.tagKeys(tableTags)
+		if err != nil {
+			return fmt.Errorf("table_tags %s: %w", table, err)
+		}
+		m.TableTags[table] = tags
+	}
+	return nil
+}
+
+// tagKeys returns tags with each key which isn't a normalized identifier
+// sanitized, or an error if it can't be
+func (m *DataSink) tagKeys(tags map[string]string) (map[string]string, error) {
+	if tags == nil {
+		return nil, nil
+	}
+
+	rc := make(map[string]string, len(tags))
+	for k, v := range tags {
+		key := k
+		if !util.IsNormalizedIdentifier(k) {
+			if m.TagKeys == TagKeysReject {
+				return nil, fmt.Errorf("invalid tag key %q: must be lowercase alphanumeric or _", k)
+			}
+
+			var err error
+			key, err = util.SanitizeIdentifier(k)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tag key: %w", err)
+			}
+		}
+
+		if _, ok := rc[key]; ok {
+			return nil, fmt.Errorf("tag keys sanitize to the same key %q", key)
+		}
+		rc[key] = v
+	}
+	return rc, nil
+}
+
+// prepareMessageTags builds the tags sent in queue messages once, so each
+// upload shares them rather than copying every tag. database_id and table
+// are left out, as messages already carry them.
+func (m *DataSink) prepareMessageTags() {
+	m.messageTags = messageTags(m.tags, nil)
+	m.tableMessageTags = make(map[string]map[string]string, len(m.TableTags))
+	for table, tableTags := range m.TableTags {
+		m.tableMessageTags[table] = messageTags(m.tags, tableTags)
+	}
+}
+
+// messageTags returns tags merged with tableTags, without database_id and
+// table, or nil if that leaves none
+func messageTags(tags, tableTags map[string]string) map[string]string {
+	rc := map[string]string{}
+	for k, v := range tags {
+		rc[k] = v
+	}
+	for k, v := range tableTags {
+		rc[k] = v
+	}
+	delete(rc, "database_id")
+	delete(rc, "table")
+	if len(rc) == 0 {
+		return nil
+	}
+	return rc
+}
+
+// uploadMessageTags returns the tags for table's queue messages. They're
+// shared between messages and mustn't be modified.
+func (m *DataSink) uploadMessageTags(table string) map[string]string {
+	if tags, ok := m.tableMessageTags[table]; ok {
+		return tags
+	}
+	return m.messageTags
+}
+
+// tagMetadataSelected reports whether MetadataTags stores the tag named k
+func (m *DataSink) tagMetadataSelected(k string) bool {
+	if len(m.MetadataTagKeys) == 0 {
+		return true
+	}
+	for _, selected := range m.MetadataTagKeys {
+		if selected == k {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareTagMetadata normalizes the static tags stored as object metadata once,
+// so each upload only adds the database id and table
+func (m *DataSink) prepareTagMetadata() {
+	if !m.MetadataTags {
+		return
+	}
+
+	m.staticMetadata = map[string]string{}
+	for k, v := range m.tags {
+		if k != "database_id" && k != "table" && m.tagMetadataSelected(k) {
+			m.staticMetadata[blobstore.MetadataKey(k)] = v
+		}
+	}
+	m.metadataDatabaseID = m.tagMetadataSelected("database_id")
+	m.metadataTable = m.tagMetadataSelected("table")
+}
+
+// tagMetadata returns the object metadata for a file's tags, if MetadataTags
+// is set
+func (m *DataSink) tagMetadata(databaseID string, table string) map[string]string {
+	tableTags := m.TableTags[table]
+	rc := make(map[string]string, len(m.staticMetadata)+len(tableTags)+2)
+	for k, v := range m.staticMetadata {
+		rc[k] = v
+	}
+	if m.MetadataTags {
+		for k, v := range tableTags {
+			if k != "database_id" && k != "table" && m.tagMetadataSelected(k) {
+				rc[blobstore.MetadataKey(k)] = v
+			}
+		}
+	}
+	if m.metadataDatabaseID {
+		rc["database-id"] = databaseID
+	}
+	if m.metadataTable {
+		rc["table"] = table
+	}
+	return rc
+}
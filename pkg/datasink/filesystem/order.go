@@ -0,0 +1,96 @@
+package filesystem
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+const (
+	// UploadOrderUnordered uploads closed files in directory order, which is
+	// the fastest and uses the least memory
+	UploadOrderUnordered = ""
+
+	// UploadOrderOldestFirst uploads closed files oldest first across every
+	// table, carrying on past files which fail
+	UploadOrderOldestFirst = "oldest_first"
+
+	// UploadOrderStrict uploads closed files oldest first and stops the pass
+	// at the first file which isn't uploaded and queued, so no file is ever
+	// delivered ahead of an older one
+	UploadOrderStrict = "strict"
+)
+
+// orderedFile is a closed file waiting for an ordered upload pass
+type orderedFile struct {
+	path    string
+	entry   fs.DirEntry
+	created time.Time
+}
+
+// uploadOrdered is the walk of an upload pass with UploadOrder set. Every
+// closed file's path is listed and sorted first, so memory grows with the
+// backlog, and with UploadOrderStrict one failing file holds back all the
+// rest until it uploads.
+func (m *DataSink) uploadOrdered(ctx context.Context) error {
+	var files []orderedFile
+	err := walkDir(m.fs, filepath.Join(m.DataDir, ClosedFolder), func(path string, di fs.DirEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isIndexFile(path) {
+			return nil
+		}
+		if created, ok := m.fileCreated(path, di); ok {
+			files = append(files, orderedFile{path: path, entry: di, created: created})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if !files[i].created.Equal(files[j].created) {
+			return files[i].created.Before(files[j].created)
+		}
+		return filepath.Base(files[i].path) < filepath.Base(files[j].path)
+	})
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if m.UploadOrder == UploadOrderStrict {
+			err = m.visitFile(file.path, file.entry)
+		} else {
+			err = m.visit(file.path, file.entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileCreated returns when a closed file was created, from the time in its
+// file id, or its modification time for files named by checksum. It returns
+// false if the file has already gone.
+func (m *DataSink) fileCreated(path string, di fs.DirEntry) (time.Time, bool) {
+	id, _, _ := strings.Cut(filepath.Base(path), ".")
+	if parsed, err := snowflake.ParseString(id); err == nil {
+		return time.UnixMilli(parsed.Time()), true
+	}
+
+	info, err := di.Info()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
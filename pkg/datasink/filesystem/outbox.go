@@ -0,0 +1,153 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/scratchdata/scratchdata/pkg/storage/queue"
+	queuemodels "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+)
+
+// OutboxFolder holds the messages for uploaded files which haven't been
+// queued yet. Spooling them means a queue outage only delays messages, rather
+// than losing them or uploading files again.
+const OutboxFolder = "outbox"
+
+// DeadLetterFolder holds outbox messages the queue will never accept, such as
+// those over its size limit, so they aren't retried forever. The files they
+// describe have been uploaded; their messages need sending some other way.
+const DeadLetterFolder = "deadletter"
+
+// outboxEntry is a message waiting to be queued, along with what's needed to
+// run the upload hooks once it is
+type outboxEntry struct {
+	File    string          `json:"file"`
+	Rows    int64           `json:"rows"`
+	Message json.RawMessage `json:"message"`
+}
+
+// spoolMessage saves the message for an uploaded file to the outbox, under
+// <database id>/<table>/ since file names can repeat between tables, and
+// returns its path
+func (m *DataSink) spoolMessage(databaseID int64, table string, file string, rows int64, message []byte) (string, error) {
+	data, err := json.Marshal(outboxEntry{File: file, Rows: rows, Message: message})
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(m.DataDir, OutboxFolder, fmt.Sprintf("%d", databaseID), table)
+	if err := m.fs.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", diskError(err)
+	}
+	path := filepath.Join(dir, file+".json")
+
+	// Write then rename, so a crash can't leave a partial message
+	tmp, err := m.fs.CreateTemp(dir, ".spool-*")
+	if err != nil {
+		return "", diskError(err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = m.fs.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		m.fs.Remove(tmp.Name())
+		return "", diskError(err)
+	}
+
+	return path, nil
+}
+
+// publish queues a spooled message, then removes it from the outbox and runs
+// the upload hooks
+func (m *DataSink) publish(ctx context.Context, path string, entry outboxEntry) error {
+	err := m.retryPolicy().Do(ctx, func() error {
+		return queue.EnqueueContext(ctx, m.storage.Queue, entry.Message)
+	})
+	if errors.Is(err, queuemodels.ErrMessageTooLarge) {
+		m.log().Error().Err(err).Str("path", path).Str("message", string(entry.Message)).Msg("Queue will not accept message. Moving it to the dead letter folder.")
+		m.deadLetter(path)
+		return fmt.Errorf("%w: %w", errNotQueued, err)
+	}
+	if err != nil {
+		m.log().Error().Err(err).Str("path", path).Str("message", string(entry.Message)).Msg("Did not enqueue file. Will retry from the outbox.")
+		return fmt.Errorf("%w: %w", errNotQueued, err)
+	}
+
+	err = m.fs.Remove(path)
+	if err != nil {
+		m.log().Error().Err(err).Str("path", path).Msg("Unable to remove queued message from the outbox")
+	}
+
+	message := queuemodels.FileUploadMessage{}
+	json.Unmarshal(entry.Message, &message)
+
+	m.recordIngestLatency(message.DatabaseID, message.Table, entry.File)
+	m.runOnUpload(message.Key, fmt.Sprintf("%d", message.DatabaseID), message.Table, entry.Rows)
+	return nil
+}
+
+// deadLetter moves the outbox message at path to DeadLetterFolder, keeping
+// its <database id>/<table>/ folders. If it can't be moved it stays in the
+// outbox, to be moved on the next attempt.
+func (m *DataSink) deadLetter(path string) {
+	rel, err := filepath.Rel(filepath.Join(m.DataDir, OutboxFolder), path)
+	if err != nil {
+		m.log().Error().Err(err).Str("path", path).Msg("Unable to move message to the dead letter folder")
+		return
+	}
+
+	dst := filepath.Join(m.DataDir, DeadLetterFolder, rel)
+	err = m.fs.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err == nil {
+		err = m.fs.Rename(path, dst)
+	}
+	if err != nil {
+		m.log().Error().Err(err).Str("path", path).Msg("Unable to move message to the dead letter folder")
+		return
+	}
+	m.counters.deadLettered.Add(1)
+}
+
+// publishOutbox retries queueing every spooled message. It returns the
+// number of messages still waiting, not counting those moved to
+// DeadLetterFolder.
+func (m *DataSink) publishOutbox() int {
+	remaining := 0
+	walkDir(m.fs, filepath.Join(m.DataDir, OutboxFolder), func(path string, di fs.DirEntry) error {
+		if !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+
+		data, err := m.readFile(path)
+		if err != nil {
+			remaining++
+			return nil
+		}
+
+		entry := outboxEntry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			m.log().Error().Err(err).Str("path", path).Msg("Unable to read outbox message")
+			remaining++
+			return nil
+		}
+
+		ctx, cancel := m.uploadContext(context.Background())
+		err = m.publish(ctx, path, entry)
+		cancel()
+		if err != nil && !errors.Is(err, queuemodels.ErrMessageTooLarge) {
+			remaining++
+		}
+		return nil
+	})
+	return remaining
+}
@@ -0,0 +1,47 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Policies for records which are bigger than MaxFileSize on their own
+const (
+	OversizedRecordsReject  = "reject"
+	OversizedRecordsOwnFile = "own_file"
+)
+
+// ErrRecordTooLarge is returned for records bigger than MaxFileSize when
+// OversizedRecords is "reject", the default
+var ErrRecordTooLarge = errors.New("record is larger than max_size_bytes")
+
+// makeRoom returns the file a record of size bytes, including its newline,
+// should be written to, rotating first so the record won't take a non-empty
+// file past its MaxFileSize. oversized reports whether the record is bigger than
+// MaxFileSize by itself and is to be written to its own file, which the
+// caller closes once it's written.
+func (m *DataSink) makeRoom(details *FileDetails, size int64) (rc *FileDetails, oversized bool, err error) {
+	m.settingsMutex.RLock()
+	maxSize, _ := m.rotationLimits(details)
+	m.settingsMutex.RUnlock()
+
+	if maxSize <= 0 {
+		return details, false, nil
+	}
+
+	if size > maxSize {
+		m.counters.oversizedRecords.Add(1)
+		if m.OversizedRecords != OversizedRecordsOwnFile {
+			return nil, false, fmt.Errorf("%w: %d bytes, limit is %d", ErrRecordTooLarge, size, maxSize)
+		}
+		oversized = true
+	}
+
+	if details.byteCount > 0 && (oversized || details.byteCount+size > maxSize) {
+		details, err = m.RotateFile(details, true)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return details, oversized, nil
+}
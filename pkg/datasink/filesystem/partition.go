@@ -0,0 +1,160 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// partitionDirPrefix starts the name of the directory holding one
+// partition's files within a table's open and closed dirs. ClosedSubdirChars
+// subdirectories are named by file id characters, so they never clash.
+const partitionDirPrefix = "p="
+
+// DefaultMaxOpenPartitions bounds the open files PartitionFunc can create
+// when MaxOpenPartitions isn't set
+const DefaultMaxOpenPartitions = 64
+
+// ErrPartition is returned for records PartitionFunc failed on
+var ErrPartition = errors.New("unable to partition record")
+
+// partitionDir returns the directory name for partition's files, escaped
+// into a single path segment
+func partitionDir(partition string) string {
+	return partitionDirPrefix + url.PathEscape(partition)
+}
+
+// parsePartitionDir returns the partition a directory name holds, if it's a
+// partition directory
+func parsePartitionDir(name string) (string, bool) {
+	if !strings.HasPrefix(name, partitionDirPrefix) {
+		return "", false
+	}
+	partition, err := url.PathUnescape(strings.TrimPrefix(name, partitionDirPrefix))
+	if err != nil {
+		return "", false
+	}
+	return partition, true
+}
+
+// partitionFileKey identifies a partition's open file within a table's
+// shard. The default partition uses the plain file key.
+func (m *DataSink) partitionFileKey(databaseID int64, table string, shard int, partition string) string {
+	key := m.fileKey(databaseID, table, shard)
+	if partition == "" {
+		return key
+	}
+	return key + "_" + partitionDir(partition)
+}
+
+// detailsKey returns the key an open file is held under in m.files
+func (m *DataSink) detailsKey(details *FileDetails) string {
+	return m.partitionFileKey(details.databaseId, details.table, details.shard, details.partition)
+}
+
+// partition returns the key prefix PartitionFunc picks for a record, or ""
+// without a PartitionFunc. Slashes at either end are trimmed.
+func (m *DataSink) partition(data []byte) (partition string, err error) {
+	if m.PartitionFunc == nil {
+		return "", nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: PartitionFunc panicked: %v", ErrPartition, r)
+		}
+	}()
+
+	partition, err = m.PartitionFunc(string(data))
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrPartition, err)
+	}
+	return strings.Trim(partition, "/"), nil
+}
+
+// maxOpenPartitions returns MaxOpenPartitions or its default
+func (m *DataSink) maxOpenPartitions() int {
+	if m.MaxOpenPartitions > 0 {
+		return m.MaxOpenPartitions
+	}
+	return DefaultMaxOpenPartitions
+}
+
+// evictPartitions closes the least recently written partition files until
+// there's room to open another. Files being written elsewhere are skipped,
+// so the bound can be briefly exceeded rather than waiting on their locks.
+// Candidates come from m.partitions rather than the open files themselves,
+// whose lastWrite only their own writer may read.
+func (m *DataSink) evictPartitions() {
+	for {
+		key, open := m.partitions.oldest()
+		if key == "" || open < m.maxOpenPartitions() {
+			return
+		}
+
+		if !m.fileMutex.TryLock(key) {
+			return
+		}
+		oldest, ok := m.getFile(key)
+		if !ok || oldest == nil {
+			// Closed by someone else since it was tracked
+			m.partitions.remove(key)
+		} else {
+			m.log().Trace().Str("file", oldest.path).Msg("Closing least recently used partition")
+			if _, err := m.RotateFile(oldest, false); err != nil {
+				m.log().Error().Err(err).Str("file", oldest.path).Msg("Unable to close partition file")
+				m.fileMutex.Unlock(key)
+				return
+			}
+		}
+		m.fileMutex.Unlock(key)
+	}
+}
+
+// writePartitioned splits a shard's records by partition, keeping their
+// order within each, and writes each partition's records to its own file
+func (m *DataSink) writePartitioned(databaseID int64, table string, shard int, records [][]byte, trace map[string]string, reject func(i int, err error)) error {
+	order := []string{}
+	indexes := map[string][]int{}
+	for i, data := range records {
+		partition, err := m.partition(data)
+		if err != nil {
+			if reject == nil {
+				return err
+			}
+			reject(i, err)
+			continue
+		}
+		if _, ok := indexes[partition]; !ok {
+			order = append(order, partition)
+		}
+		indexes[partition] = append(indexes[partition], i)
+	}
+
+	for n, partition := range order {
+		partitionIndexes := indexes[partition]
+		partitionRecords := make([][]byte, len(partitionIndexes))
+		for j, i := range partitionIndexes {
+			partitionRecords[j] = records[i]
+		}
+
+		var partitionReject func(j int, err error)
+		if reject != nil {
+			partitionReject = func(j int, err error) { reject(partitionIndexes[j], err) }
+		}
+
+		err := m.writePartition(databaseID, table, shard, partition, partitionRecords, trace, partitionReject)
+		if err != nil {
+			for _, rest := range order[n+1:] {
+				for _, i := range indexes[rest] {
+					if reject != nil {
+						reject(i, err)
+					}
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package filesystem
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
+)
+
+// tenantUsage tracks bytes on disk, open and closed, by database id
+type tenantUsage struct {
+	mutex sync.Mutex
+	bytes map[int64]int64
+}
+
+func (u *tenantUsage) add(databaseID int64, n int64) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.bytes == nil {
+		u.bytes = map[int64]int64{}
+	}
+	u.bytes[databaseID] += n
+}
+
+func (u *tenantUsage) get(databaseID int64) int64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.bytes[databaseID]
+}
+
+func (u *tenantUsage) store(bytes map[int64]int64) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.bytes = bytes
+}
+
+// tenantQuota returns the disk quota for a database, or 0 for unlimited
+func (m *DataSink) tenantQuota(databaseID int64) int64 {
+	if quota, ok := m.TenantQuotas[strconv.FormatInt(databaseID, 10)]; ok {
+		return quota
+	}
+	return m.DefaultTenantQuota
+}
+
+// checkTenantQuota returns models.ErrBackpressure if the database's open and
+// closed files take up more than its quota, so one tenant can't fill the disk
+// for everyone else
+func (m *DataSink) checkTenantQuota(databaseID int64) error {
+	quota := m.tenantQuota(databaseID)
+	if quota <= 0 {
+		return nil
+	}
+
+	if m.usage.get(databaseID) >= quota {
+		return fmt.Errorf("database %d is over its disk quota of %d bytes: %w", databaseID, quota, models.ErrBackpressure)
+	}
+	return nil
+}
+
+// tenantBytes totals the size of open and closed files by database id
+func (m *DataSink) tenantBytes() map[int64]int64 {
+	rc := map[int64]int64{}
+
+	for _, folder := range []string{OpenFolder, ClosedFolder} {
+		root := filepath.Join(m.DataDir, folder)
+		walkDir(m.fs, root, func(path string, di fs.DirEntry) error {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return nil
+			}
+			databaseID, err := strconv.ParseInt(strings.Split(rel, string(filepath.Separator))[0], 10, 64)
+			if err != nil {
+				return nil
+			}
+
+			if info, err := di.Info(); err == nil {
+				rc[databaseID] += info.Size()
+			}
+			return nil
+		})
+	}
+
+	return rc
+}
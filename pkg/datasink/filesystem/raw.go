@@ -0,0 +1,27 @@
+package filesystem
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrEmbeddedNewline is returned with RawPassthrough for records containing a
+// newline other than a single trailing one, as they'd be split into several
+// rows downstream
+var ErrEmbeddedNewline = errors.New("record contains a newline")
+
+// rawRecord checks a record written with RawPassthrough, dropping one
+// trailing "\n" or "\r\n" so the line terminator isn't doubled
+func rawRecord(data []byte) ([]byte, error) {
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\r"))
+	if bytes.IndexByte(data, '\n') >= 0 {
+		return nil, ErrEmbeddedNewline
+	}
+	return data, nil
+}
+
+// WritesRaw reports whether RawPassthrough is set
+func (m *DataSink) WritesRaw() bool {
+	return m.RawPassthrough
+}
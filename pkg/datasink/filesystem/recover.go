@@ -0,0 +1,269 @@
+package filesystem
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+// recoverOpenFiles deals with open files left behind by a previous process.
+// With ResumeOpenFiles, the newest plain file for each table is repaired and
+// reopened for appending if it's still under the rotation limits. Every
+// other leftover file is moved to the closed dir to be uploaded.
+func (m *DataSink) recoverOpenFiles() error {
+	openDir := filepath.Join(m.DataDir, OpenFolder)
+
+	dbDirs, err := m.readDir(openDir)
+	if err != nil {
+		return err
+	}
+
+	for _, dbDir := range dbDirs {
+		if !dbDir.IsDir() {
+			continue
+		}
+
+		databaseID, err := strconv.ParseInt(dbDir.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		tableDirs, err := m.readDir(filepath.Join(openDir, dbDir.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, tableDir := range tableDirs {
+			if !tableDir.IsDir() {
+				continue
+			}
+
+			err = m.recoverTable(databaseID, tableDir.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// recoverTable resumes or closes the leftover open files for one table
+func (m *DataSink) recoverTable(databaseID int64, table string) error {
+	tableDir := filepath.Join(m.DataDir, OpenFolder, fmt.Sprintf("%d", databaseID), table)
+
+	entries, err := m.readDir(tableDir)
+	if err != nil {
+		return err
+	}
+
+	paths := []string{}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !isIndexFile(entry.Name()) {
+			paths = append(paths, filepath.Join(tableDir, entry.Name()))
+		}
+
+		// Partition files are never resumed
+		if partition, ok := parsePartitionDir(entry.Name()); ok && entry.IsDir() {
+			err = m.recoverPartition(databaseID, table, partition, filepath.Join(tableDir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	// Snowflake ids sort by creation time when compared numerically
+	sort.Slice(paths, func(i, j int) bool {
+		return openFileOrder(paths[i]) < openFileOrder(paths[j])
+	})
+
+	if m.ResumeOpenFiles && m.IndexField == "" {
+		last := paths[len(paths)-1]
+		details, err := m.resumeFile(databaseID, table, last)
+		if err != nil {
+			m.log().Warn().Err(err).Str("path", last).Msg("Unable to resume open file, starting a new one")
+		}
+		if details != nil {
+			m.setFile(m.fileKey(databaseID, table, 0), details)
+			paths = paths[:len(paths)-1]
+		}
+	}
+
+	for _, path := range paths {
+		err = m.closeLeftover(databaseID, table, "", path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recoverPartition closes the leftover open files in one partition's dir
+func (m *DataSink) recoverPartition(databaseID int64, table, partition, dir string) error {
+	entries, err := m.readDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isIndexFile(entry.Name()) {
+			continue
+		}
+		err = m.closeLeftover(databaseID, table, partition, filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeLeftover moves an open file from a previous process to the closed dir,
+// as RotateFile would have. Empty files are deleted.
+func (m *DataSink) closeLeftover(databaseID int64, table, partition, path string) error {
+	info, err := m.fs.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() > 0 {
+		fileID, _, _ := strings.Cut(filepath.Base(path), ".")
+		closedFolderPath := m.closedFolder(databaseID, table, partition, fileID)
+		err = m.fs.MkdirAll(closedFolderPath, os.ModePerm)
+		if err != nil {
+			return diskError(err)
+		}
+
+		// The previous process may have crashed between linking and removing
+		err = m.fs.Link(path, filepath.Join(closedFolderPath, filepath.Base(path)))
+		if err != nil && !os.IsExist(err) {
+			return diskError(err)
+		}
+
+		err = m.fs.Link(path+IndexExtension, filepath.Join(closedFolderPath, filepath.Base(path)+IndexExtension))
+		if err != nil && !os.IsExist(err) && !os.IsNotExist(err) {
+			return diskError(err)
+		}
+	}
+
+	m.removeIndex(path)
+
+	m.log().Info().Str("path", path).Msg("Closing leftover open file")
+	return m.fs.Remove(path)
+}
+
+// resumeFile reopens an open file for appending. It returns nil if the file
+// can't be appended to or is already due for rotation.
+func (m *DataSink) resumeFile(databaseID int64, table, path string) (*FileDetails, error) {
+	if strings.HasSuffix(path, ".gz") {
+		return nil, nil
+	}
+
+	dropped, err := repairTrailingLine(m.fs, path)
+	if err != nil {
+		return nil, err
+	}
+	if dropped > 0 {
+		m.log().Warn().Str("path", path).Int64("bytes", dropped).Msg("Truncated incomplete trailing line")
+	}
+
+	details, err := m.leftoverFile(databaseID, table, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if details.byteCount == 0 || m.NeedsRotation(details) {
+		return nil, nil
+	}
+
+	fd, err := m.fs.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	details.fd = fd
+
+	if m.SchemaDrift != SchemaDriftAllow {
+		err = m.loadFields(details)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+
+	m.log().Info().Str("path", path).Int64("rows", details.rowCount).Msg("Resuming open file")
+	return details, nil
+}
+
+// leftoverFile builds the FileDetails for an existing open file without
+// opening it for writing
+func (m *DataSink) leftoverFile(databaseID int64, table, path string) (*FileDetails, error) {
+	info, err := m.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := m.countRows(path)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &FileDetails{
+		path:      path,
+		rowCount:  rows,
+		byteCount: info.Size(),
+		created:   info.ModTime(),
+		lastWrite: info.ModTime(),
+		columns:   map[string]bool{},
+
+		databaseId: databaseID,
+		table:      table,
+		rotation:   m.tableRotation(table),
+		jitter:     rand.Float64(),
+	}
+
+	if id, err := snowflake.ParseString(details.ID()); err == nil {
+		details.created = time.UnixMilli(id.Time())
+	}
+
+	return details, nil
+}
+
+// loadFields reads the columns already written to a resumed file, so the
+// SchemaDrift policy carries on where it left off
+func (m *DataSink) loadFields(details *FileDetails) error {
+	fd, err := m.openFile(details.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		details.addFields(scanner.Bytes())
+	}
+
+	return scanner.Err()
+}
+
+// openFileOrder returns the numeric id an open file is named with, or 0 if
+// it isn't a number
+func openFileOrder(path string) int64 {
+	name := filepath.Base(path)
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	id, _ := strconv.ParseInt(name, 10, 64)
+	return id
+}
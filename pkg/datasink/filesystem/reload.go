@@ -0,0 +1,86 @@
+package filesystem
+
+import (
+	"fmt"
+
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// Reload applies new settings to a running data sink. Only these settings
+// take effect immediately:
+//
+//	max_size_bytes, max_rows, max_age_seconds, idle_seconds,
+//	rotation_jitter, max_pending_bytes, backpressure_wait_seconds,
+//	upload_timeout_seconds, table_rotation, retry
+//
+// table_rotation applies to files created after the reload, and retry to
+// uploads and queue sends started after it. Invalid settings are rejected,
+// leaving the current ones in place.
+// Changes to any other setting are logged and only applied after a restart.
+func (m *DataSink) Reload(settings map[string]any) error {
+	settings, err := parseByteSizes(settings)
+	if err != nil {
+		return err
+	}
+
+	next := util.ConfigToStruct[DataSink](settings)
+	if err := next.validateLive(); err != nil {
+		return err
+	}
+
+	m.settingsMutex.Lock()
+	m.MaxFileSize = next.MaxFileSize
+	m.MaxRows = next.MaxRows
+	m.MaxFileAgeSeconds = next.MaxFileAgeSeconds
+	m.IdleSeconds = next.IdleSeconds
+	m.RotationJitter = next.RotationJitter
+	m.MaxPendingBytes = next.MaxPendingBytes
+	m.BackpressureWaitSeconds = next.BackpressureWaitSeconds
+	m.UploadTimeoutSeconds = next.UploadTimeoutSeconds
+	m.TableRotation = next.TableRotation
+	// IsRetryable is set by WithRetryable, not settings
+	next.Retry.IsRetryable = m.Retry.IsRetryable
+	m.Retry = next.Retry
+	m.settingsMutex.Unlock()
+
+	deferred := map[string]bool{
+		"data":                   next.DataDir != m.DataDir,
+		"table_names":            next.TableNames != m.TableNames,
+		"tag_keys":               next.TagKeys != m.TagKeys,
+		"schema_drift":           next.SchemaDrift != "" && next.SchemaDrift != m.SchemaDrift,
+		"coerce_strict":          next.CoerceStrict != m.CoerceStrict,
+		"backpressure":           next.Backpressure != "" && next.Backpressure != m.Backpressure,
+		"compression":            next.Compression != m.Compression,
+		"compression_dictionary": next.CompressionDictionary != m.CompressionDictionary,
+	}
+	for setting, changed := range deferred {
+		if changed {
+			m.log().Warn().Str("setting", setting).Msg("Setting cannot be changed while running, restart to apply")
+		}
+	}
+
+	m.log().Info().
+		Int64("max_size_bytes", next.MaxFileSize).
+		Int64("max_rows", next.MaxRows).
+		Int("max_age_seconds", next.MaxFileAgeSeconds).
+		Int("idle_seconds", next.IdleSeconds).
+		Int64("max_pending_bytes", next.MaxPendingBytes).
+		Msg("Reloaded data sink settings")
+
+	return nil
+}
+
+// validateLive checks the settings Reload can change, which New checks too
+func (m *DataSink) validateLive() error {
+	if m.RotationJitter < 0 || m.RotationJitter > 1 {
+		return fmt.Errorf("rotation_jitter %v must be between 0 and 1", m.RotationJitter)
+	}
+	return nil
+}
+
+// retryPolicy returns the current Retry, which Reload can change
+func (m *DataSink) retryPolicy() util.RetryPolicy {
+	m.settingsMutex.RLock()
+	defer m.settingsMutex.RUnlock()
+	return m.Retry
+}
@@ -0,0 +1,83 @@
+package filesystem
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	settings := map[string]any{"max_age_seconds": 60, "max_rows": 10, "max_size_bytes": "1MiB"}
+	sink, _ := newTestSink(t, settings)
+
+	for _, line := range []string{`{"a":1}`, `{"a":2}`} {
+		if err := sink.WriteData(1, "events", []byte(line)); err != nil {
+			t.Fatalf("Cannot write data: %s", err)
+		}
+	}
+	details, _ := sink.getFile(sink.fileKey(1, "events", 0))
+	if sink.NeedsRotation(details) {
+		t.Fatal("Expected no rotation under the starting limits")
+	}
+
+	settings["max_rows"] = 2
+	if err := sink.Reload(settings); err != nil {
+		t.Fatalf("Cannot reload: %s", err)
+	}
+	if !sink.NeedsRotation(details) {
+		t.Fatal("Expected rotation once max_rows is reloaded below the row count")
+	}
+
+	settings["max_rows"] = 10
+	settings["max_size_bytes"] = 8
+	if err := sink.Reload(settings); err != nil {
+		t.Fatalf("Cannot reload: %s", err)
+	}
+	if !sink.NeedsRotation(details) {
+		t.Fatal("Expected rotation once max_size_bytes is reloaded below the file size")
+	}
+
+	settings["max_size_bytes"] = "1MiB"
+	settings["retry"] = map[string]any{"max_attempts": 5}
+	if err := sink.Reload(settings); err != nil {
+		t.Fatalf("Cannot reload: %s", err)
+	}
+	if sink.NeedsRotation(details) {
+		t.Fatal("Expected no rotation once the limits are raised again")
+	}
+	if n := sink.retryPolicy().MaxAttempts; n != 5 {
+		t.Fatalf("Expected retry to be reloaded; Got %d attempts", n)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	settings := map[string]any{"max_age_seconds": 60, "max_rows": 10, "rotation_jitter": 0.5}
+	sink, _ := newTestSink(t, settings)
+
+	tests := []struct {
+		name    string
+		setting string
+		value   any
+		err     string
+	}{
+		{name: "jitter", setting: "rotation_jitter", value: 2, err: "rotation_jitter"},
+		{name: "size", setting: "max_size_bytes", value: "lots", err: "max_size_bytes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := map[string]any{"max_age_seconds": 60, "max_rows": 1}
+			next[test.setting] = test.value
+
+			err := sink.Reload(next)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected a %s error; Got %v", test.err, err)
+			}
+
+			sink.settingsMutex.RLock()
+			defer sink.settingsMutex.RUnlock()
+			if sink.MaxRows != 10 || sink.RotationJitter != 0.5 {
+				t.Fatalf("Expected the old settings to be kept; Got max_rows %d, rotation_jitter %v", sink.MaxRows, sink.RotationJitter)
+			}
+		})
+	}
+}
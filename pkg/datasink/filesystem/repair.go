@@ -0,0 +1,86 @@
+package filesystem
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/tidwall/gjson"
+)
+
+// repairTrailingLine truncates a file whose last line is incomplete: it has no
+// trailing newline and isn't valid JSON, as happens when the process crashes
+// mid-write. Complete files are left unchanged. It returns the number of bytes
+// dropped.
+func repairTrailingLine(fsys FS, path string) (int64, error) {
+	fd, err := fsys.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size()
+	if size == 0 {
+		return 0, nil
+	}
+
+	lastNewline, trailing, err := incompleteLine(fd, size)
+	if err != nil || trailing == 0 {
+		return 0, err
+	}
+
+	if err := fd.Truncate(lastNewline + 1); err != nil {
+		return 0, err
+	}
+
+	return trailing, nil
+}
+
+// incompleteLine finds an incomplete last line in fd, which is size bytes
+// long, without changing it. It returns the offset of the newline before
+// that line, or -1 if there isn't one, and the line's length, which is 0 if
+// the file is complete.
+func incompleteLine(fd File, size int64) (int64, int64, error) {
+	if size == 0 {
+		return -1, 0, nil
+	}
+
+	// Scan backwards for the last newline
+	lastNewline := int64(-1)
+	chunk := make([]byte, 4096)
+	for end := size; end > 0 && lastNewline < 0; {
+		start := end - int64(len(chunk))
+		if start < 0 {
+			start = 0
+		}
+
+		buf := chunk[:end-start]
+		if _, err := fd.ReadAt(buf, start); err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			lastNewline = start + int64(i)
+		}
+		end = start
+	}
+
+	if lastNewline == size-1 {
+		return lastNewline, 0, nil
+	}
+
+	trailing := make([]byte, size-lastNewline-1)
+	if _, err := fd.ReadAt(trailing, lastNewline+1); err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+
+	if gjson.ValidBytes(trailing) {
+		return lastNewline, 0, nil
+	}
+	return lastNewline, int64(len(trailing)), nil
+}
@@ -0,0 +1,89 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairTrailingLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		output  string
+		dropped int64
+	}{
+		{"empty", "", "", 0},
+		{"complete", "{\"a\":1}\n{\"a\":2}\n", "{\"a\":1}\n{\"a\":2}\n", 0},
+		{"no trailing newline", "{\"a\":1}\n{\"a\":2}", "{\"a\":1}\n{\"a\":2}", 0},
+		{"truncated", "{\"a\":1}\n{\"a\":2}\n{\"a\":", "{\"a\":1}\n{\"a\":2}\n", 5},
+		{"only partial line", "{\"a\":1", "", 6},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name+".ndjson")
+		if err := os.WriteFile(path, []byte(test.input), 0644); err != nil {
+			t.Fatalf("Cannot write file: %s", err)
+		}
+
+		dropped, err := repairTrailingLine(OSFS{}, path)
+		if err != nil {
+			t.Fatalf("%s: Cannot repair file: %s", test.name, err)
+		}
+		if dropped != test.dropped {
+			t.Fatalf("%s: Expected %d bytes dropped; Got %d", test.name, test.dropped, dropped)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Cannot read file: %s", err)
+		}
+		if string(data) != test.output {
+			t.Fatalf("%s: Expected %#q; Got %#q", test.name, test.output, string(data))
+		}
+	}
+}
+
+func TestInspectDataDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"open/1/events/1.ndjson":         "{\"a\":1}\n",
+		"closed/1/events/2.ndjson":       "{\"a\":1}\n{\"a\":2}\n",
+		"closed/1/events/3.ndjson":       "{\"a\":1}\n{\"a\":",
+		"closed/1/events/3.ndjson.index": "[]",
+		"outbox/2.ndjson.json":           "{}",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Cannot create dir: %s", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Cannot write file: %s", err)
+		}
+	}
+
+	report, err := InspectDataDir(dir)
+	if err != nil {
+		t.Fatalf("Cannot inspect data dir: %s", err)
+	}
+
+	if report.Open.Files != 1 || report.Closed.Files != 2 || report.Outbox.Files != 1 {
+		t.Fatalf("Expected 1 open, 2 closed and 1 outbox file; Got %+v", report)
+	}
+	if report.Closed.Bytes != 29 {
+		t.Fatalf("Expected 29 closed bytes; Got %d", report.Closed.Bytes)
+	}
+	if report.OldestPending.IsZero() {
+		t.Fatal("Expected the oldest pending file's time")
+	}
+	if exp := filepath.Join(dir, "closed/1/events/3.ndjson"); len(report.Incomplete) != 1 || report.Incomplete[0] != exp {
+		t.Fatalf("Expected %s to be incomplete; Got %v", exp, report.Incomplete)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "closed/1/events/3.ndjson"))
+	if string(data) != "{\"a\":1}\n{\"a\":" {
+		t.Fatal("Expected inspection to leave files unchanged")
+	}
+}
@@ -0,0 +1,95 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// TableRotation overrides when one table's files are rotated. Zero values
+// fall back to the sink's MaxFileSize and MaxFileAgeSeconds.
+type TableRotation struct {
+	MaxFileSize       int64 `mapstructure:"max_size_bytes"`
+	MaxFileAgeSeconds int   `mapstructure:"max_age_seconds"`
+}
+
+// parseByteSizes is util.ByteSizeSettings for the sink's settings, including
+// each table's max_size_bytes in table_rotation
+func parseByteSizes(settings map[string]any) (map[string]any, error) {
+	settings, err := util.ByteSizeSettings(settings, byteSizeSettings...)
+	if err != nil {
+		return nil, err
+	}
+
+	tables, ok := settings["table_rotation"].(map[string]any)
+	if !ok {
+		return settings, nil
+	}
+
+	parsed := make(map[string]any, len(tables))
+	for table, value := range tables {
+		parsed[table] = value
+		if rotation, ok := value.(map[string]any); ok {
+			parsed[table], err = util.ByteSizeSettings(rotation, "max_size_bytes")
+			if err != nil {
+				return nil, fmt.Errorf("table_rotation.%s: %w", table, err)
+			}
+		}
+	}
+	settings["table_rotation"] = parsed
+	return settings, nil
+}
+
+// tableRotation returns table's overrides, to be kept by each file created
+// for it
+func (m *DataSink) tableRotation(table string) TableRotation {
+	m.settingsMutex.RLock()
+	defer m.settingsMutex.RUnlock()
+	return m.TableRotation[table]
+}
+
+// rotationLimits returns the size and age details is rotated at: its table's
+// overrides from when it was created, or else the sink's current settings.
+// The caller holds settingsMutex.
+func (m *DataSink) rotationLimits(details *FileDetails) (int64, int) {
+	maxSize, maxAge := m.MaxFileSize, m.MaxFileAgeSeconds
+	if details.rotation.MaxFileSize > 0 {
+		maxSize = details.rotation.MaxFileSize
+	}
+	if details.rotation.MaxFileAgeSeconds > 0 {
+		maxAge = details.rotation.MaxFileAgeSeconds
+	}
+	return maxSize, maxAge
+}
+
+// rotationAge returns how old details may get before it's rotated: maxAge,
+// less its share of RotationJitter. The caller holds settingsMutex.
+func (m *DataSink) rotationAge(details *FileDetails, maxAge int) time.Duration {
+	age := time.Duration(maxAge) * time.Second
+	return age - time.Duration(float64(age)*m.RotationJitter*details.jitter)
+}
+
+// waitJitter waits up to RotationJitter of interval, picked at random, before
+// a monitor's first tick. It returns false if ctx was done first.
+func (m *DataSink) waitJitter(ctx context.Context, interval time.Duration) bool {
+	m.settingsMutex.RLock()
+	jitter := m.RotationJitter
+	m.settingsMutex.RUnlock()
+
+	wait := time.Duration(float64(interval) * jitter * rand.Float64())
+	if wait <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Policies for records which introduce a new top-level field into an open file
+const (
+	SchemaDriftAllow  = "allow"
+	SchemaDriftError  = "error"
+	SchemaDriftIgnore = "ignore"
+	SchemaDriftRotate = "rotate"
+)
+
+// ErrSchemaDrift is returned for records which introduce new fields when
+// SchemaDrift is "error"
+var ErrSchemaDrift = errors.New("record introduces new fields")
+
+// newFields returns the top-level fields in data which aren't part of the file's schema
+func (d *FileDetails) newFields(data []byte) []string {
+	rc := []string{}
+	gjson.ParseBytes(data).ForEach(func(key, value gjson.Result) bool {
+		if !d.columns[key.String()] {
+			rc = append(rc, key.String())
+		}
+		return true
+	})
+	return rc
+}
+
+// addFields records the top-level fields in data as part of the file's schema
+func (d *FileDetails) addFields(data []byte) {
+	gjson.ParseBytes(data).ForEach(func(key, value gjson.Result) bool {
+		d.columns[key.String()] = true
+		return true
+	})
+}
+
+// applySchemaPolicy checks data against the file's schema and applies the SchemaDrift policy.
+// It returns the file and data which should be written, which may differ from the input.
+func (m *DataSink) applySchemaPolicy(details *FileDetails, data []byte) (*FileDetails, []byte, error) {
+	if m.SchemaDrift == SchemaDriftAllow {
+		return details, data, nil
+	}
+
+	if details.rowCount == 0 {
+		details.addFields(data)
+		return details, data, nil
+	}
+
+	fields := details.newFields(data)
+	if len(fields) == 0 {
+		return details, data, nil
+	}
+
+	switch m.SchemaDrift {
+	case SchemaDriftError:
+		m.counters.schemaDriftErrors.Add(1)
+		schemaDriftTotal.WithLabelValues(SchemaDriftError).Inc()
+		return nil, nil, fmt.Errorf("%w %v", ErrSchemaDrift, fields)
+
+	case SchemaDriftIgnore:
+		m.counters.schemaDriftIgnored.Add(1)
+		schemaDriftTotal.WithLabelValues(SchemaDriftIgnore).Inc()
+		var err error
+		for _, field := range fields {
+			data, err = sjson.DeleteBytes(data, gjson.Escape(field))
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return details, data, nil
+
+	case SchemaDriftRotate:
+		m.counters.schemaDriftRotations.Add(1)
+		schemaDriftTotal.WithLabelValues(SchemaDriftRotate).Inc()
+		m.log().Trace().Str("file", details.path).Strs("fields", fields).Msg("Rotating file on schema change")
+		newDetails, err := m.RotateFile(details, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		newDetails.addFields(data)
+		return newDetails, data, nil
+	}
+
+	return details, data, nil
+}
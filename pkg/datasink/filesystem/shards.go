@@ -0,0 +1,70 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// fileKey identifies one of a table's open files. Shard 0 uses the plain
+// table key so writer ids don't change when sharding is off.
+func (m *DataSink) fileKey(databaseID int64, table string, shard int) string {
+	key := m.key(databaseID, table)
+	if shard == 0 {
+		return key
+	}
+	return fmt.Sprintf("%s_shard%d", key, shard)
+}
+
+// shards returns the number of open files to spread each table's writes over
+func (m *DataSink) shards() int {
+	if m.WriteShards < 1 {
+		return 1
+	}
+	return m.WriteShards
+}
+
+// nextShard picks shards round-robin so concurrent writers spread out
+func (m *DataSink) nextShard() int {
+	return int(m.shardCounter.Add(1) % uint64(m.shards()))
+}
+
+// writeSharded writes a batch to a single shard, or splits it into one
+// contiguous chunk per shard and writes them in parallel. reject, if set,
+// is called with indexes into records and must be safe for concurrent use.
+func (m *DataSink) writeSharded(databaseID int64, table string, records [][]byte, trace map[string]string, reject func(i int, err error)) error {
+	shards := m.shards()
+	if shards == 1 || len(records) < 2 {
+		return m.writeShard(databaseID, table, m.nextShard(), records, trace, reject)
+	}
+
+	if shards > len(records) {
+		shards = len(records)
+	}
+	chunkSize := (len(records) + shards - 1) / shards
+	first := m.nextShard()
+
+	var wg sync.WaitGroup
+	errs := make([]error, shards)
+	for i := 0; i < shards; i++ {
+		start := i * chunkSize
+		end := min(start+chunkSize, len(records))
+		if start >= end {
+			break
+		}
+
+		var chunkReject func(j int, err error)
+		if reject != nil {
+			chunkReject = func(j int, err error) { reject(start+j, err) }
+		}
+
+		wg.Add(1)
+		go func(i int, chunk [][]byte) {
+			defer wg.Done()
+			errs[i] = m.writeShard(databaseID, table, (first+i)%m.shards(), chunk, trace, chunkReject)
+		}(i, records[start:end])
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,94 @@
+package filesystem
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestWriteShardsConcurrent writes multi-shard batches from several
+// goroutines at once, with PartitionFunc evicting partition files as it
+// goes. Run it with -race.
+func TestWriteShardsConcurrent(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "write_shards": 4, "max_open_partitions": 3})
+	sink.PartitionFunc = func(record string) (string, error) {
+		return fmt.Sprintf("p=%d", len(record)%5), nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			records := make([][]byte, 64)
+			for j := range records {
+				records[j] = []byte(fmt.Sprintf(`{"writer":%d,"n":%d,"pad":"%s"}`, i, j, strings.Repeat("x", j%7)))
+			}
+			table := fmt.Sprintf("events_%d", i%2)
+			errs[i] = sink.WriteBatch(1, table, records)
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			sink.Writers()
+			sink.RotateAllFiles(false, true)
+		}
+	}()
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Writer %d failed: %s", i, err)
+		}
+	}
+}
+
+// TestOpenPartitionsTracked checks the partitions evictPartitions picks from
+// follow the open files as they're written, evicted and rotated away
+func TestOpenPartitionsTracked(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "write_shards": 2, "max_open_partitions": 2})
+	sink.PartitionFunc = func(record string) (string, error) {
+		return fmt.Sprintf("p=%d", len(record)%4), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 32; j++ {
+				record := fmt.Sprintf(`{"writer":%d,"pad":"%s"}`, i, strings.Repeat("x", j%4))
+				if err := sink.WriteData(1, "events", []byte(record)); err != nil {
+					t.Errorf("Cannot write data: %s", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, key := range sink.fileKeys() {
+		details, _ := sink.getFile(key)
+		if details == nil || details.partition == "" {
+			continue
+		}
+		if _, ok := sink.partitions.lastWrite[key]; !ok {
+			t.Fatalf("Open partition file %s is not tracked", key)
+		}
+	}
+	for key := range sink.partitions.lastWrite {
+		if _, ok := sink.getFile(key); !ok {
+			t.Fatalf("Tracked partition %s has no open file", key)
+		}
+	}
+
+	sink.RotateAllFiles(true, false)
+	if key, open := sink.partitions.oldest(); open != 0 {
+		t.Fatalf("Expected no tracked partitions after rotating; Got %d, oldest %s", open, key)
+	}
+}
@@ -0,0 +1,142 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+)
+
+// FileError is a file which couldn't be uploaded during shutdown
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e FileError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+func (e FileError) Unwrap() error {
+	return e.Err
+}
+
+// ShutdownReport describes what happened to pending data during Shutdown
+type ShutdownReport struct {
+	FilesUploaded int
+	BytesUploaded int64
+
+	// FilesRemaining and BytesRemaining are what was left on disk, in both
+	// the open and closed dirs, once uploads finished
+	FilesRemaining int
+	BytesRemaining int64
+
+	// MessagesPending is the number of uploaded files whose messages are
+	// still waiting in the outbox to be queued
+	MessagesPending int
+
+	Errors []FileError
+}
+
+// Clean reports whether everything was uploaded
+func (r ShutdownReport) Clean() bool {
+	return r.FilesRemaining == 0 && r.MessagesPending == 0 && len(r.Errors) == 0
+}
+
+// Err returns the upload errors joined together, or an error for leftover
+// files if uploads succeeded but files remain
+func (r ShutdownReport) Err() error {
+	errs := []error{}
+	for _, err := range r.Errors {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 && r.FilesRemaining > 0 {
+		errs = append(errs, fmt.Errorf("%d files (%d bytes) were not uploaded", r.FilesRemaining, r.BytesRemaining))
+	}
+	if len(errs) == 0 && r.MessagesPending > 0 {
+		errs = append(errs, fmt.Errorf("%d messages were not queued", r.MessagesPending))
+	}
+	return errors.Join(errs...)
+}
+
+func (r ShutdownReport) MarshalZerologObject(e *zerolog.Event) {
+	e.Int("files_uploaded", r.FilesUploaded).
+		Int64("bytes_uploaded", r.BytesUploaded).
+		Int("files_remaining", r.FilesRemaining).
+		Int64("bytes_remaining", r.BytesRemaining).
+		Int("messages_pending", r.MessagesPending).
+		Int("errors", len(r.Errors))
+}
+
+// ShutdownWithReport is Shutdown, also returning what was uploaded and what
+// was left behind. Unlike UploadFiles, it carries on past failed files so
+// the report covers every one of them.
+func (m *DataSink) ShutdownWithReport() (ShutdownReport, error) {
+	m.enabled = false
+	m.wg.Wait()
+
+	m.RotateAllFiles(true, false)
+
+	report := ShutdownReport{}
+
+	m.uploadMutex.Lock()
+	if m.Notify != NotifyNone {
+		m.publishOutbox()
+	}
+
+	closedFiles := filepath.Join(m.DataDir, ClosedFolder)
+	err := walkDir(m.fs, closedFiles, func(path string, di fs.DirEntry) error {
+		if isIndexFile(path) {
+			return nil
+		}
+
+		info, err := di.Info()
+		if err != nil {
+			report.Errors = append(report.Errors, FileError{Path: path, Err: err})
+			return nil
+		}
+
+		err = m.safeUploadFile(context.Background(), path)
+		if err != nil {
+			report.Errors = append(report.Errors, FileError{Path: path, Err: err})
+			return nil
+		}
+
+		report.FilesUploaded++
+		report.BytesUploaded += info.Size()
+		return nil
+	})
+	m.uploadMutex.Unlock()
+	if err != nil {
+		report.Errors = append(report.Errors, FileError{Path: closedFiles, Err: err})
+	}
+
+	walkDir(m.fs, filepath.Join(m.DataDir, OutboxFolder), func(path string, di fs.DirEntry) error {
+		report.MessagesPending++
+		return nil
+	})
+
+	for _, folder := range []string{OpenFolder, ClosedFolder} {
+		walkDir(m.fs, filepath.Join(m.DataDir, folder), func(path string, di fs.DirEntry) error {
+			if isIndexFile(path) {
+				return nil
+			}
+			if info, err := di.Info(); err == nil {
+				report.FilesRemaining++
+				report.BytesRemaining += info.Size()
+			}
+			return nil
+		})
+	}
+
+	if report.Clean() {
+		m.log().Info().EmbedObject(report).Msg("Shutdown complete")
+	} else {
+		m.log().Error().EmbedObject(report).Err(report.Err()).Msg("Shutdown left data behind")
+	}
+
+	return report, errors.Join(report.Err(), m.Close())
+}
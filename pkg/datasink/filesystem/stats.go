@@ -0,0 +1,99 @@
+package filesystem
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time snapshot of the data sink's counters
+type Stats struct {
+	SchemaDriftErrors    int64
+	SchemaDriftIgnored   int64
+	SchemaDriftRotations int64
+
+	// TransformDropped counts records dropped by the Transform hook
+	TransformDropped int64
+
+	// SubscriberDropped counts records not sent to a Subscribe channel
+	// because the subscriber had fallen behind
+	SubscriberDropped int64
+
+	// VerifyFailures counts records which failed VerifyOnWrite
+	VerifyFailures int64
+
+	// OversizedRecords counts records bigger than MaxFileSize, whether
+	// rejected or written to their own file
+	OversizedRecords int64
+
+	// CompactedFiles counts closed files merged into larger ones by
+	// CompactTargetBytes
+	CompactedFiles int64
+
+	// DeadLettered counts outbox messages moved to DeadLetterFolder because
+	// the queue would never accept them
+	DeadLettered int64
+
+	// NewFields counts fields seen for the first time in a dataset
+	NewFields int64
+
+	// IngestLatency is the time from each file's first write until its upload
+	IngestLatency LatencyStats
+
+	// Uploads counts the data files uploaded for each table, for attributing
+	// storage costs
+	Uploads []DatasetUploads
+
+	// LastUploadAt is when a file was last uploaded, or zero if none has been
+	LastUploadAt time.Time
+}
+
+// counters holds the live values behind Stats
+type counters struct {
+	schemaDriftErrors    atomic.Int64
+	schemaDriftIgnored   atomic.Int64
+	schemaDriftRotations atomic.Int64
+	transformDropped     atomic.Int64
+	newFields            atomic.Int64
+	verifyFailures       atomic.Int64
+	subscriberDropped    atomic.Int64
+	compactedFiles       atomic.Int64
+	oversizedRecords     atomic.Int64
+	deadLettered         atomic.Int64
+	ingestLatency        latencyCounters
+	uploads              uploadCounters
+
+	// lastUploadAt and lastScanAt are in unix nanoseconds
+	lastUploadAt atomic.Int64
+	lastScanAt   atomic.Int64
+}
+
+// recordUpload notes that a file was just uploaded
+func (c *counters) recordUpload() {
+	now := time.Now()
+	c.lastUploadAt.Store(now.UnixNano())
+	lastUploadTimestamp.Set(float64(now.Unix()))
+}
+
+// Stats returns a snapshot of the data sink's counters
+func (m *DataSink) Stats() Stats {
+	var lastUploadAt time.Time
+	if ts := m.counters.lastUploadAt.Load(); ts > 0 {
+		lastUploadAt = time.Unix(0, ts)
+	}
+
+	return Stats{
+		LastUploadAt:         lastUploadAt,
+		SchemaDriftErrors:    m.counters.schemaDriftErrors.Load(),
+		SchemaDriftIgnored:   m.counters.schemaDriftIgnored.Load(),
+		SchemaDriftRotations: m.counters.schemaDriftRotations.Load(),
+		TransformDropped:     m.counters.transformDropped.Load(),
+		NewFields:            m.counters.newFields.Load(),
+		VerifyFailures:       m.counters.verifyFailures.Load(),
+		SubscriberDropped:    m.counters.subscriberDropped.Load(),
+		CompactedFiles:       m.counters.compactedFiles.Load(),
+		OversizedRecords:     m.counters.oversizedRecords.Load(),
+		DeadLettered:         m.counters.deadLettered.Load(),
+		IngestLatency:        m.counters.ingestLatency.stats(),
+		Uploads:              m.counters.uploads.stats(),
+	}
+}
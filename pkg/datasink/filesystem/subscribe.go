@@ -0,0 +1,72 @@
+package filesystem
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SubscriberBuffer is how many records a subscriber can fall behind by
+// before further records are dropped for it
+const SubscriberBuffer = 1000
+
+// subscribers fans written records out to Subscribe's channels
+type subscribers struct {
+	mu    sync.RWMutex
+	count atomic.Int64
+	next  int
+	chans map[int]chan string
+}
+
+// Subscribe returns a channel receiving a copy of every record written from
+// now on, as written to disk, and a function to unsubscribe which closes the
+// channel. It's a best-effort tap for previews and debugging: records are
+// dropped for subscribers which fall SubscriberBuffer behind, counted in
+// Stats.SubscriberDropped, so a slow subscriber never blocks writes.
+func (m *DataSink) Subscribe() (<-chan string, func()) {
+	s := &m.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chans == nil {
+		s.chans = map[int]chan string{}
+	}
+	id := s.next
+	s.next++
+
+	ch := make(chan string, SubscriberBuffer)
+	s.chans[id] = ch
+	s.count.Add(1)
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			delete(s.chans, id)
+			s.count.Add(-1)
+			close(ch)
+		})
+	}
+}
+
+// publishRecord sends data to every subscriber without blocking
+func (m *DataSink) publishRecord(data []byte) {
+	s := &m.subscribers
+	if s.count.Load() == 0 {
+		return
+	}
+
+	record := string(data)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, ch := range s.chans {
+		select {
+		case ch <- record:
+		default:
+			m.counters.subscriberDropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// WriteSync writes records to a table like WriteBatch, then closes the
+// table's open files and uploads its closed files, returning once they're in
+// the blob store and, unless Notify is none, their messages are queued.
+//
+// It's meant for low-volume writes which need an acknowledgment only once
+// they're durable. Every call produces at least one object and queue message,
+// and calls wait for each other and for any upload pass in progress, so
+// throughput is a handful of calls a second at best, bounded by upload
+// latency, rather than the thousands of records a second WriteBatch manages.
+// Records written to the table by other callers in the meantime are uploaded
+// along with them.
+//
+// If the upload or queueing fails, the records aren't lost: they're retried by
+// the next upload pass, so retrying the call may write them twice.
+func (m *DataSink) WriteSync(ctx context.Context, databaseID int64, table string, records [][]byte) error {
+	table, err := m.tableName(table)
+	if err != nil {
+		return err
+	}
+
+	// WriteBatch checks backpressure before writing anything. The upload lock
+	// isn't held yet, so upload passes can relieve it in block mode.
+	err = m.WriteBatch(databaseID, table, records)
+	if err != nil {
+		return err
+	}
+
+	// Holding the upload lock from here stops an upload pass from taking the
+	// files first, so their errors are returned to the caller. A pass which
+	// took them during the write either uploaded them or left them closed
+	// for the walk below.
+	m.uploadMutex.Lock()
+	defer m.uploadMutex.Unlock()
+
+	err = m.closeTableFiles(ctx, databaseID, table)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(m.DataDir, ClosedFolder, fmt.Sprintf("%d", databaseID), table)
+	return walkDir(m.fs, dir, func(path string, di fs.DirEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isIndexFile(path) {
+			return nil
+		}
+		return m.safeUploadFile(ctx, path)
+	})
+}
+
+// syncLockInterval is how often closeTableFiles retries a file lock held by
+// a writer
+const syncLockInterval = 10 * time.Millisecond
+
+// waitFileLock waits for key's file lock until ctx is done
+func (m *DataSink) waitFileLock(ctx context.Context, key string) error {
+	for !m.fileMutex.TryLock(key) {
+		timer := time.NewTimer(syncLockInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("could not acquire lock for %s: %w", key, ctx.Err())
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// closeTableFiles rotates every open file of a table, in all its shards and
+// partitions, without creating new ones. Files being written are waited for,
+// since records already written to them must be uploaded with this call.
+func (m *DataSink) closeTableFiles(ctx context.Context, databaseID int64, table string) error {
+	for _, key := range m.fileKeys() {
+		details, ok := m.getFile(key)
+		if !ok || details == nil || details.databaseId != databaseID || details.table != table {
+			continue
+		}
+
+		if err := m.waitFileLock(ctx, key); err != nil {
+			return err
+		}
+		var err error
+		if current, ok := m.getFile(key); ok && current == details {
+			_, err = m.RotateFile(details, false)
+		}
+		m.fileMutex.Unlock(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/scratchdata/scratchdata/models"
+	blobmemory "github.com/scratchdata/scratchdata/pkg/storage/blobstore/memory"
+	queuememory "github.com/scratchdata/scratchdata/pkg/storage/queue/memory"
+	queuemodels "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// newTaggedSink returns a sink with n static tags stored as object metadata
+func newTaggedSink(b *testing.B, n int) *DataSink {
+	tags := map[string]string{}
+	for i := 0; i < n; i++ {
+		tags[fmt.Sprintf("Tag_%d", i)] = fmt.Sprintf("value-%d", i)
+	}
+
+	sink, err := New(map[string]any{"data": b.TempDir(), "metadata_tags": true}, WithTags(tags), WithManualRotation())
+	if err != nil {
+		b.Fatalf("Cannot create data sink: %s", err)
+	}
+	b.Cleanup(func() { sink.Close() })
+	return sink
+}
+
+// BenchmarkUploadTags50 measures the per-file cost of tags for a sink with 50
+// tags: object metadata, the tags passed to OnUpload and the queue message
+func BenchmarkUploadTags50(b *testing.B) {
+	sink := newTaggedSink(b, 50)
+	sink.OnUpload = func(key string, tags map[string]string, rows int64) error { return nil }
+	upload := queuemodels.FileUploadMessage{DatabaseID: 1, Table: "events", Key: "data/1/events/1.ndjson", Rows: 1}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		metadata := sink.tagMetadata("1", "events")
+		if len(metadata) != 52 {
+			b.Fatalf("Expected 52 metadata entries; Got %d", len(metadata))
+		}
+		sink.runOnUpload("data/1/events/1.ndjson", "1", "events", 1)
+		if _, err := sink.queueMessage(upload); err != nil {
+			b.Fatalf("Cannot build queue message: %s", err)
+		}
+	}
+}
+
+func TestTableTags(t *testing.T) {
+	blobStore, _ := blobmemory.NewStorage(nil)
+	queue, _ := queuememory.NewQueue(nil)
+	storage := &models.StorageServices{BlobStore: blobStore, Queue: queue}
+
+	settings := map[string]any{
+		"data":            t.TempDir(),
+		"max_age_seconds": 60,
+		"table_tags":      map[string]any{"events": map[string]any{"region": "eu-west-1", "table": "ignored"}},
+	}
+	sink, err := NewFilesystemDataSink(settings, storage, WithManualRotation(),
+		WithTags(map[string]string{"env": "prod", "region": "us-east-1"}),
+		WithTableTags("events", map[string]string{"team": "growth"}))
+	if err != nil {
+		t.Fatalf("Cannot create data sink: %s", err)
+	}
+
+	exp := map[string]string{"env": "prod", "region": "eu-west-1", "team": "growth", "database_id": "1", "table": "events"}
+	if tags := sink.fileTags("1", "events"); !reflect.DeepEqual(tags, exp) {
+		t.Fatalf("Expected %v; Got %v", exp, tags)
+	}
+	if tags := sink.fileTags("1", "other"); tags["region"] != "us-east-1" || tags["team"] != "" {
+		t.Fatalf("Expected only the sink's tags for another table; Got %v", tags)
+	}
+
+	if err := sink.WriteData(1, "events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	sink.RotateAllFiles(true, false)
+	sink.UploadFiles()
+
+	item, ok := queue.Dequeue()
+	if !ok {
+		t.Fatal("Expected a queued upload message")
+	}
+	message := queuemodels.FileUploadMessage{}
+	if err := json.Unmarshal(item, &message); err != nil {
+		t.Fatalf("Cannot decode message: %s", err)
+	}
+	expMessage := map[string]string{"env": "prod", "region": "eu-west-1", "team": "growth"}
+	if !reflect.DeepEqual(message.Tags, expMessage) {
+		t.Fatalf("Expected message tags %v; Got %v", expMessage, message.Tags)
+	}
+}
+
+func TestTagKeys(t *testing.T) {
+	tags := map[string]string{"env": "prod", "My Tag!": "a"}
+	tableTags := map[string]any{"events": map[string]any{"Team-Name": "growth"}}
+
+	tests := []struct {
+		policy string
+		exp    map[string]string
+		err    bool
+	}{
+		{policy: TagKeysAllow, exp: map[string]string{"env": "prod", "My Tag!": "a", "Team-Name": "growth"}},
+		{policy: TagKeysSanitize, exp: map[string]string{"env": "prod", "my_tag_": "a", "team_name": "growth"}},
+		{policy: TagKeysReject, err: true},
+	}
+
+	for _, test := range tests {
+		settings := map[string]any{"data": t.TempDir(), "tag_keys": test.policy, "table_tags": tableTags}
+		sink, err := New(settings, WithTags(tags), WithManualRotation())
+		if test.err {
+			if err == nil {
+				sink.Close()
+				t.Fatalf("%q: expected invalid tag keys to be rejected", test.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: cannot create data sink: %s", test.policy, err)
+		}
+		defer sink.Close()
+
+		test.exp["database_id"] = "1"
+		test.exp["table"] = "events"
+		if got := sink.fileTags("1", "events"); !reflect.DeepEqual(got, test.exp) {
+			t.Fatalf("%q: expected %v; Got %v", test.policy, test.exp, got)
+		}
+	}
+
+	// Keys with nothing left once sanitized, or which collide, are errors
+	for _, tags := range []map[string]string{{"!!": "a"}, {"my_tag": "a", "My Tag": "b"}} {
+		_, err := New(map[string]any{"data": t.TempDir(), "tag_keys": TagKeysSanitize}, WithTags(tags), WithManualRotation())
+		if err == nil {
+			t.Fatalf("Expected tags %v to be rejected", tags)
+		}
+	}
+
+	if _, err := New(map[string]any{"data": t.TempDir(), "tag_keys": "lowercase"}); err == nil {
+		t.Fatal("Expected an invalid tag_keys policy to be rejected")
+	}
+}
+
+func TestTableNamesSanitizeEmpty(t *testing.T) {
+	sink, _ := newTestSink(t, map[string]any{"max_age_seconds": 60, "table_names": TableNamesSanitize})
+
+	if err := sink.WriteData(1, "My Events", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Cannot write data: %s", err)
+	}
+	if _, ok := sink.getFile(sink.fileKey(1, "my_events", 0)); !ok {
+		t.Fatal("Expected the table name to be sanitized")
+	}
+	if err := sink.WriteData(1, "!!", []byte(`{"a":1}`)); !errors.Is(err, util.ErrEmptyIdentifier) {
+		t.Fatalf("Expected a table name with nothing left once sanitized to be rejected; Got %v", err)
+	}
+}
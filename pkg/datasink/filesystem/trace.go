@@ -0,0 +1,67 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// fileTraces remembers the trace context each closed file was written with,
+// from rotation until upload, keyed by closedRef. A file has at most one: that
+// of its first traced write, with any later writes' traces dropped. Like
+// firstWrites it's only in memory, so files closed before a restart are
+// queued without one.
+type fileTraces struct {
+	mu     sync.Mutex
+	traces map[string]map[string]string
+}
+
+func (f *fileTraces) store(id string, trace map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.traces == nil {
+		f.traces = map[string]map[string]string{}
+	}
+	f.traces[id] = trace
+}
+
+// load returns the trace recorded for id, if any, leaving it in place for the
+// file's other formats
+func (f *fileTraces) load(id string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.traces[id]
+}
+
+// take removes and returns the trace recorded for id
+func (f *fileTraces) take(id string) (map[string]string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	trace, ok := f.traces[id]
+	delete(f.traces, id)
+	return trace, ok
+}
+
+// traceKey returns a string identifying trace, the same for equal traces
+func traceKey(trace map[string]string) string {
+	if len(trace) == 0 {
+		return ""
+	}
+	// Maps are marshalled with sorted keys
+	data, _ := json.Marshal(trace)
+	return string(data)
+}
+
+// WriteBatchTrace is WriteBatch, carrying trace, such as a W3C traceparent
+// and baggage, through to the queue messages of the files the records are
+// written to, so a consumer can match its insert to the write. A file keeps
+// the trace of its first traced write; later writes to the same file share
+// it.
+func (m *DataSink) WriteBatchTrace(databaseID int64, table string, records [][]byte, trace map[string]string) error {
+	if len(trace) == 0 {
+		trace = nil
+	}
+	_, err := m.writeBatch(databaseID, table, records, trace, nil)
+	return err
+}
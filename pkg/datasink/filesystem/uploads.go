@@ -0,0 +1,68 @@
+package filesystem
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DatasetUploads counts the data files uploaded for one table since startup,
+// and their size as stored, after any compression
+type DatasetUploads struct {
+	DatabaseID int64
+	Table      string
+	Objects    int64
+	Bytes      int64
+}
+
+type datasetKey struct {
+	databaseID int64
+	table      string
+}
+
+// uploadCounters holds the live values behind Stats.Uploads. They only ever
+// increase, and aren't affected by rotation.
+type uploadCounters struct {
+	mu       sync.Mutex
+	datasets map[datasetKey]*DatasetUploads
+}
+
+func (u *uploadCounters) add(databaseID int64, table string, bytes int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.datasets == nil {
+		u.datasets = map[datasetKey]*DatasetUploads{}
+	}
+
+	key := datasetKey{databaseID: databaseID, table: table}
+	dataset, ok := u.datasets[key]
+	if !ok {
+		dataset = &DatasetUploads{DatabaseID: databaseID, Table: table}
+		u.datasets[key] = dataset
+	}
+	dataset.Objects++
+	dataset.Bytes += bytes
+
+	labels := []string{strconv.FormatInt(databaseID, 10), table}
+	uploadedObjectsTotal.WithLabelValues(labels...).Inc()
+	uploadedBytesTotal.WithLabelValues(labels...).Add(float64(bytes))
+}
+
+// stats returns every dataset's counters, ordered by database id then table
+func (u *uploadCounters) stats() []DatasetUploads {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	rc := make([]DatasetUploads, 0, len(u.datasets))
+	for _, dataset := range u.datasets {
+		rc = append(rc, *dataset)
+	}
+	sort.Slice(rc, func(i, j int) bool {
+		if rc[i].DatabaseID != rc[j].DatabaseID {
+			return rc[i].DatabaseID < rc[j].DatabaseID
+		}
+		return rc[i].Table < rc[j].Table
+	})
+	return rc
+}
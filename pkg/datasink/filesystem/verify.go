@@ -0,0 +1,37 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/scratchdata/scratchdata/pkg/datasink/models"
+	"github.com/tidwall/gjson"
+)
+
+// verifyRecord syncs the line just written for data at offset, reads it
+// back and checks it's unchanged, valid JSON. If it isn't, the line is
+// truncated from the file so nothing after it is written on top.
+func (m *DataSink) verifyRecord(details *FileDetails, data []byte, offset int64) error {
+	err := details.fd.Sync()
+	if err != nil {
+		return diskError(err)
+	}
+
+	terminator := m.terminator()
+	line := make([]byte, len(data)+len(terminator))
+	_, err = details.fd.ReadAt(line, offset)
+	if err == nil && !(bytes.Equal(line[len(data):], terminator) && bytes.Equal(line[:len(data)], data) && gjson.ValidBytes(line[:len(data)])) {
+		err = fmt.Errorf("%s: line at offset %d doesn't match what was written", details.path, offset)
+	}
+	if err == nil {
+		return nil
+	}
+
+	m.counters.verifyFailures.Add(1)
+	m.log().Error().Err(err).Str("file", details.path).Int64("offset", offset).Msg("Record failed verification")
+
+	if truncErr := details.fd.Truncate(offset); truncErr == nil {
+		details.byteCount = offset
+	}
+	return fmt.Errorf("%w: %w", models.ErrVerifyFailed, err)
+}
@@ -0,0 +1,51 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// walkChunkSize is how many directory entries walkDir reads at a time
+const walkChunkSize = 1000
+
+// walkDir calls fn for every file under root, depth first. Unlike
+// filepath.WalkDir it reads directories in chunks rather than loading and
+// sorting every entry up front, so memory stays bounded when a large backlog
+// of closed files builds up. Files are visited in directory order. A missing
+// root is not an error.
+func walkDir(fsys FS, root string, fn func(path string, di fs.DirEntry) error) error {
+	dir, err := fsys.OpenFile(root, os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		entries, err := dir.ReadDir(walkChunkSize)
+		for _, entry := range entries {
+			path := filepath.Join(root, entry.Name())
+			if entry.IsDir() {
+				if err := walkDir(fsys, path, fn); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(path, entry); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
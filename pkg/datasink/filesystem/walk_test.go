@@ -0,0 +1,67 @@
+package filesystem
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalkDirLargeDirectory(t *testing.T) {
+	root := t.TempDir()
+
+	// Several chunks' worth of files in one directory, plus a nested one
+	expected := map[string]bool{}
+	for i, dir := range []string{"1/events", "1/events/nested", "2/logs"} {
+		count := walkChunkSize*2 + 17
+		if i > 0 {
+			count = 10
+		}
+
+		full := filepath.Join(root, dir)
+		if err := os.MkdirAll(full, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < count; j++ {
+			path := filepath.Join(full, fmt.Sprintf("%d.ndjson", j))
+			if err := os.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			expected[path] = true
+		}
+	}
+
+	seen := map[string]bool{}
+	err := walkDir(OSFS{}, root, func(path string, di fs.DirEntry) error {
+		if seen[path] {
+			t.Fatalf("Visited %s twice", path)
+		}
+		seen[path] = true
+
+		// Deleting as we go, like UploadFiles does, mustn't skip anything
+		return os.Remove(path)
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %s", err)
+	}
+
+	if len(seen) != len(expected) {
+		t.Fatalf("Expected %d files; Got %d", len(expected), len(seen))
+	}
+	for path := range expected {
+		if !seen[path] {
+			t.Fatalf("Did not visit %s", path)
+		}
+	}
+}
+
+func TestWalkDirMissingRoot(t *testing.T) {
+	err := walkDir(OSFS{}, filepath.Join(t.TempDir(), "missing"), func(string, fs.DirEntry) error {
+		t.Fatal("Unexpected file")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error; Got %s", err)
+	}
+}
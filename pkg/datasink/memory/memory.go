@@ -25,6 +25,11 @@ func (m DataSink) WriteData(databaseID int64, table string, data []byte) error {
 	key := fmt.Sprintf("%d/%s/%d.ndjson", databaseID, table, fileId.Int64())
 	reader := bytes.NewReader(data)
 
+	checksum, err := util.SHA256(reader)
+	if err != nil {
+		return err
+	}
+
 	uploadErr := m.storage.BlobStore.Upload(key, reader)
 	if uploadErr != nil {
 		return uploadErr
@@ -34,6 +39,12 @@ func (m DataSink) WriteData(databaseID int64, table string, data []byte) error {
 		DatabaseID: databaseID,
 		Table:      table,
 		Key:        key,
+		Checksum:   checksum,
+		Format:     util.FormatJSONEachRow,
+	}
+
+	if multi, ok := m.storage.BlobStore.(interface{ Destinations() []string }); ok {
+		uploadMessage.Destinations = multi.Destinations()
 	}
 
 	// TODO: log payload for replay
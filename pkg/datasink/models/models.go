@@ -0,0 +1,46 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrBackpressure is returned when a data sink won't accept more data until
+// pending uploads have caught up
+var ErrBackpressure = errors.New("too much data pending upload, try again later")
+
+// ErrDiskFull is returned when a data sink has run out of local disk space
+var ErrDiskFull = errors.New("no space left in data directory")
+
+// ErrVerifyFailed is returned when a record read back after writing didn't
+// match what was written
+var ErrVerifyFailed = errors.New("record failed verification after writing")
+
+// WriterInfo describes an open file being written by a data sink
+type WriterInfo struct {
+	ID        string            `json:"id"`
+	Directory string            `json:"directory"`
+	Tags      map[string]string `json:"tags"`
+
+	// OpenFileSize is the uncompressed bytes written, which size-based
+	// rotation is measured against. OpenFileDiskSize is the file's size on
+	// disk, which is smaller when open files are compressed.
+	OpenFileSize     int64 `json:"open_file_size"`
+	OpenFileDiskSize int64 `json:"open_file_disk_size"`
+	OpenFileRows     int64 `json:"open_file_rows"`
+	PendingFiles     int   `json:"pending_files"`
+}
+
+// StagedFileInfo describes a data file held on local disk by a data sink
+// which hasn't been uploaded yet
+type StagedFileInfo struct {
+	DatabaseID int64     `json:"database_id"`
+	Table      string    `json:"table"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+
+	// Open is true for files still being written, false for closed files
+	// waiting for upload
+	Open bool `json:"open"`
+}
@@ -0,0 +1,82 @@
+package clickhouse
+
+import (
+	"strconv"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// AsyncInsert enables ClickHouse's async inserts for a table, which buffer
+// small inserts server-side and write them as one part, avoiding "too many
+// parts" errors from frequent small batches
+type AsyncInsert struct {
+	Enabled bool `mapstructure:"enabled"`
+
+	// NoWait returns as soon as ClickHouse has buffered the data, rather than
+	// once it's been flushed to the table. Errors during the flush are then
+	// lost, so it trades safety for latency.
+	NoWait bool `mapstructure:"no_wait"`
+
+	// BusyTimeoutMillis is how long ClickHouse buffers data before flushing.
+	// Zero uses the server's default.
+	BusyTimeoutMillis int `mapstructure:"busy_timeout_ms"`
+}
+
+// asyncInsertDefault is the AsyncInserts key applying to tables which aren't listed
+const asyncInsertDefault = "*"
+
+// asyncInsert returns the async insert settings for table
+func (s *ClickhouseServer) asyncInsert(table string) AsyncInsert {
+	if async, ok := s.AsyncInserts[table]; ok {
+		return async
+	}
+	return s.AsyncInserts[asyncInsertDefault]
+}
+
+// insertSettings returns the query settings for inserts into table
+func (s *ClickhouseServer) insertSettings(table string) clickhouse.Settings {
+	async := s.asyncInsert(table)
+	if !async.Enabled {
+		return nil
+	}
+
+	settings := clickhouse.Settings{
+		"async_insert":          1,
+		"wait_for_async_insert": 1,
+	}
+	if async.NoWait {
+		settings["wait_for_async_insert"] = 0
+	}
+	if async.BusyTimeoutMillis > 0 {
+		settings["async_insert_busy_timeout_ms"] = async.BusyTimeoutMillis
+	}
+	return settings
+}
+
+// settingsParams converts query settings to HTTP query parameters
+func settingsParams(settings clickhouse.Settings) map[string]string {
+	rc := map[string]string{}
+	for name, value := range settings {
+		switch v := value.(type) {
+		case int:
+			rc[name] = strconv.Itoa(v)
+		case string:
+			rc[name] = v
+		}
+	}
+	return rc
+}
+
+// logAsyncInsert records that an async insert into table returned, and
+// whether it was configured to wait for the flush. ClickHouse doesn't report
+// the flush itself, so with NoWait it's unknown whether the data has reached
+// the table yet.
+func (s *ClickhouseServer) logAsyncInsert(table string) {
+	async := s.asyncInsert(table)
+	if !async.Enabled {
+		return
+	}
+
+	log.Debug().Str("table", table).Bool("async_insert", true).Bool("wait_for_async_insert", !async.NoWait).Msg("Async insert complete")
+}
@@ -0,0 +1,51 @@
+package clickhouse
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+func TestInsertSettings(t *testing.T) {
+	s := &ClickhouseServer{AsyncInserts: map[string]AsyncInsert{
+		asyncInsertDefault: {Enabled: true},
+		"events":           {Enabled: true, NoWait: true, BusyTimeoutMillis: 500},
+		"orders":           {Enabled: false},
+	}}
+
+	tests := []struct {
+		table    string
+		expected clickhouse.Settings
+	}{
+		{table: "other", expected: clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 1}},
+		{table: "events", expected: clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 0, "async_insert_busy_timeout_ms": 500}},
+		{table: "orders", expected: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.table, func(t *testing.T) {
+			settings := s.insertSettings(test.table)
+			if !reflect.DeepEqual(settings, test.expected) {
+				t.Fatalf("Expected %v; Got %v", test.expected, settings)
+			}
+		})
+	}
+
+	if settings := (&ClickhouseServer{}).insertSettings("events"); settings != nil {
+		t.Fatalf("Expected no settings without async inserts; Got %v", settings)
+	}
+}
+
+func TestSettingsParams(t *testing.T) {
+	params := settingsParams(clickhouse.Settings{
+		"async_insert":               1,
+		"insert_deduplication_token": "token",
+		"ignored":                    true,
+	})
+
+	expected := map[string]string{"async_insert": "1", "insert_deduplication_token": "token"}
+	if !reflect.DeepEqual(params, expected) {
+		t.Fatalf("Expected %v; Got %v", expected, params)
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/scratchdata/scratchdata/pkg/credentials"
 	"github.com/scratchdata/scratchdata/util"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
@@ -23,24 +26,86 @@ type ClickhouseServer struct {
 	TCPPort      int    `mapstructure:"tcp_port"`
 	Username     string `mapstructure:"username"`
 	Password     string `mapstructure:"password"`
+
+	// ReadUsername and ReadPassword, if set, are used for queries, so the
+	// query API can run as a read-only user. Username and Password are used
+	// for inserts and DDL.
+	ReadUsername string `mapstructure:"read_username"`
+	ReadPassword string `mapstructure:"read_password"`
 	Database     string `mapstructure:"database"`
 	TLS          bool   `mapstructure:"tls"`
 
 	StoragePolicy string `mapstructure:"storage_policy"`
+	Cluster       string `mapstructure:"cluster"`
+
+	// ClusterDDL creates and alters tables ON CLUSTER Cluster, so they exist
+	// on every node rather than just the one connected to, and waits up to
+	// ClusterDDLTimeoutSeconds (default: the server's
+	// distributed_ddl_task_timeout) for every node to finish
+	ClusterDDL               bool `mapstructure:"cluster_ddl"`
+	ClusterDDLTimeoutSeconds int  `mapstructure:"cluster_ddl_timeout_seconds"`
+
+	// RowIDField is the path of the row id added to each row: __row_id
+	// (default), or key.row_id when it's nested under a metadata key
+	RowIDField string `mapstructure:"row_id_field"`
+
+	// Tables sets the ORDER BY and PARTITION BY used when creating each table
+	Tables map[string]TableLayout `mapstructure:"tables"`
+
+	// AsyncInserts enables async inserts per table. The "*" entry applies to
+	// tables which aren't listed.
+	AsyncInserts map[string]AsyncInsert `mapstructure:"async_inserts"`
+
+	// Distributed maps table names to the Distributed table inserts are routed through
+	Distributed map[string]DistributedTable `mapstructure:"distributed"`
 
 	MaxOpenConns        int `mapstructure:"max_open_conns"`
 	MaxIdleConns        int `mapstructure:"max_idle_conns"`
 	ConnMaxLifetimeSecs int `mapstructure:"conn_max_lifetime_secs"`
 
-	conn driver.Conn
+	// Retry retries DDL and inserts which fail with a retryable error.
+	// Retry.IsRetryable replaces the default classifier, IsRetryable.
+	// Inserts send the same insert_deduplication_token on every attempt, so
+	// a retry after an attempt which did land is only dropped, rather than
+	// duplicating rows, on tables which deduplicate inserts.
+	Retry util.RetryPolicy `mapstructure:"retry"`
+
+	// S3 is where InsertFromS3 reads Parquet uploads from
+	S3 S3Source `mapstructure:"s3"`
+
+	conn         driver.Conn
+	password     credentials.Provider
+	readPassword credentials.Provider
+}
+
+// readCredentials returns the user and password queries are run as
+func (s *ClickhouseServer) readCredentials() (string, string, error) {
+	if s.ReadUsername == "" {
+		password, err := s.password.Get()
+		return s.Username, password, err
+	}
+
+	password, err := s.readPassword.Get()
+	return s.ReadUsername, password, err
+}
+
+// writeCredentials returns the user and password inserts and DDL are run as
+func (s *ClickhouseServer) writeCredentials() (string, string, error) {
+	password, err := s.password.Get()
+	return s.Username, password, err
 }
 
 func openConn(s *ClickhouseServer) (driver.Conn, error) {
+	password, err := s.password.Get()
+	if err != nil {
+		return nil, err
+	}
+
 	options := &clickhouse.Options{
 		Addr: []string{fmt.Sprintf("%s:%d", s.Host, s.TCPPort)},
 		Auth: clickhouse.Auth{
 			Username: s.Username,
-			Password: s.Password,
+			Password: password,
 		},
 		Debug:       false,
 		DialTimeout: 120 * time.Second,
@@ -63,7 +128,7 @@ func openConn(s *ClickhouseServer) (driver.Conn, error) {
 	}
 
 	var ctx = context.Background()
-	var conn, err = clickhouse.Open(options)
+	conn, err := clickhouse.Open(options)
 
 	if err != nil {
 		return nil, err
@@ -83,12 +148,32 @@ func openConn(s *ClickhouseServer) (driver.Conn, error) {
 	return conn, nil
 }
 
+// Check runs SELECT 1 to confirm the server is reachable and the credentials work
+func (s *ClickhouseServer) Check(ctx context.Context) error {
+	return s.conn.Exec(ctx, "SELECT 1")
+}
+
 func (s *ClickhouseServer) Close() error {
 	return s.conn.Close()
 }
 
+// httpQuery runs query over HTTP as the read user and returns the response
+// body. ClickHouse is asked to gzip the response; Go's HTTP client sends
+// Accept-Encoding: gzip and decompresses transparently, so callers always
+// read plain output.
 func (s *ClickhouseServer) httpQuery(query string) (io.ReadCloser, error) {
-	url := fmt.Sprintf("%s://%s:%d", s.HTTPProtocol, s.Host, s.HTTPPort)
+	return s.httpQueryAs(query, s.readCredentials)
+}
+
+// httpWriteQuery is httpQuery as the user inserts are run as, for queries on
+// the insert path, which the read user may not be allowed to run
+func (s *ClickhouseServer) httpWriteQuery(query string) (io.ReadCloser, error) {
+	return s.httpQueryAs(query, s.writeCredentials)
+}
+
+// httpQueryAs runs query over HTTP as the user credentials returns
+func (s *ClickhouseServer) httpQueryAs(query string, credentials func() (string, string, error)) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%s://%s:%d/?enable_http_compression=1", s.HTTPProtocol, s.Host, s.HTTPPort)
 
 	var jsonStr = []byte(query)
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
@@ -96,8 +181,13 @@ func (s *ClickhouseServer) httpQuery(query string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	req.Header.Set("X-Clickhouse-User", s.Username)
-	req.Header.Set("X-Clickhouse-Key", s.Password)
+	username, password, err := credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Clickhouse-User", username)
+	req.Header.Set("X-Clickhouse-Key", password)
 	req.Header.Set("X-Clickhouse-Database", s.Database)
 
 	client := &http.Client{}
@@ -107,11 +197,77 @@ func (s *ClickhouseServer) httpQuery(query string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp, "query")
+	}
+
 	return resp.Body, nil
 }
 
+// responseError returns the error for a failed HTTP response, with
+// ClickHouse's message and, so the retry policy can classify it, its
+// exception code
+func responseError(resp *http.Response, action string) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err := fmt.Errorf("clickhouse %s failed: %s: %s", action, resp.Status, bytes.TrimSpace(msg))
+
+	if code, convErr := strconv.Atoi(resp.Header.Get("X-ClickHouse-Exception-Code")); convErr == nil {
+		return &clickhouse.Exception{Code: int32(code), Message: err.Error()}
+	}
+	return err
+}
+
+// httpInsert posts body to ClickHouse as the data for an INSERT query,
+// with settings passed as query parameters
+func (s *ClickhouseServer) httpInsert(query string, settings clickhouse.Settings, body io.Reader) error {
+	params := url.Values{}
+	params.Set("query", query)
+	for name, value := range settingsParams(settings) {
+		params.Set(name, value)
+	}
+	u := fmt.Sprintf("%s://%s:%d/?%s", s.HTTPProtocol, s.Host, s.HTTPPort, params.Encode())
+
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return err
+	}
+
+	username, password, err := s.writeCredentials()
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Clickhouse-User", username)
+	req.Header.Set("X-Clickhouse-Key", password)
+	req.Header.Set("X-Clickhouse-Database", s.Database)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Error().Err(err).Msg("request failed")
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, "insert")
+	}
+
+	return nil
+}
+
 func OpenServer(settings map[string]any) (*ClickhouseServer, error) {
-	srv := util.ConfigToStruct[ClickhouseServer](settings)
+	return NewServer(*util.ConfigToStruct[ClickhouseServer](settings))
+}
+
+// NewServer connects to the server described by config, for callers which
+// build it in code rather than from a settings map. Password and
+// ReadPassword take the same forms as in settings, such as env://NAME.
+func NewServer(config ClickhouseServer) (*ClickhouseServer, error) {
+	srv := &config
+	srv.password = credentials.Parse(srv.Password)
+	srv.readPassword = credentials.Parse(srv.ReadPassword)
 	conn, err := openConn(srv)
 	if err != nil {
 		return nil, fmt.Errorf("OpenServer: %w", err)
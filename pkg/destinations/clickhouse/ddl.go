@@ -0,0 +1,44 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// onCluster returns the ON CLUSTER clause for DDL, or an empty string unless
+// ClusterDDL is enabled
+func (s *ClickhouseServer) onCluster() string {
+	if !s.ClusterDDL || s.Cluster == "" {
+		return ""
+	}
+	return fmt.Sprintf(" ON CLUSTER '%s'", s.Cluster)
+}
+
+// execDDL runs a CREATE or ALTER statement. With ClusterDDL, ClickHouse waits
+// for every node to apply it, and throws if any fails or doesn't finish
+// within ClusterDDLTimeoutSeconds. Retryable failures are retried per Retry.
+func (s *ClickhouseServer) execDDL(sql string) error {
+	ctx := context.TODO()
+	if settings := s.ddlSettings(); settings != nil {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(settings))
+	}
+	return s.retryPolicy().Do(ctx, func() error {
+		return s.conn.Exec(ctx, sql)
+	})
+}
+
+// ddlSettings returns the query settings for DDL, or nil unless ClusterDDL is
+// enabled
+func (s *ClickhouseServer) ddlSettings() clickhouse.Settings {
+	if s.onCluster() == "" {
+		return nil
+	}
+
+	settings := clickhouse.Settings{"distributed_ddl_output_mode": "throw"}
+	if s.ClusterDDLTimeoutSeconds > 0 {
+		settings["distributed_ddl_task_timeout"] = s.ClusterDDLTimeoutSeconds
+	}
+	return settings
+}
@@ -0,0 +1,90 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// execConn records the statements run on it, failing the first fail of them
+// with err
+type execConn struct {
+	driver.Conn
+	statements []string
+	fail       int
+	err        error
+}
+
+func (c *execConn) Exec(ctx context.Context, query string, args ...any) error {
+	c.statements = append(c.statements, query)
+	if len(c.statements) <= c.fail {
+		return c.err
+	}
+	return nil
+}
+
+func TestOnCluster(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   ClickhouseServer
+		clause   string
+		settings clickhouse.Settings
+	}{
+		{name: "disabled", server: ClickhouseServer{Cluster: "c"}},
+		{name: "no cluster", server: ClickhouseServer{ClusterDDL: true}},
+		{
+			name:     "cluster",
+			server:   ClickhouseServer{Cluster: "c", ClusterDDL: true},
+			clause:   " ON CLUSTER 'c'",
+			settings: clickhouse.Settings{"distributed_ddl_output_mode": "throw"},
+		},
+		{
+			name:     "timeout",
+			server:   ClickhouseServer{Cluster: "c", ClusterDDL: true, ClusterDDLTimeoutSeconds: 30},
+			clause:   " ON CLUSTER 'c'",
+			settings: clickhouse.Settings{"distributed_ddl_output_mode": "throw", "distributed_ddl_task_timeout": 30},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if clause := test.server.onCluster(); clause != test.clause {
+				t.Fatalf("Expected clause %q; Got %q", test.clause, clause)
+			}
+			if settings := test.server.ddlSettings(); !reflect.DeepEqual(settings, test.settings) {
+				t.Fatalf("Expected settings %v; Got %v", test.settings, settings)
+			}
+		})
+	}
+}
+
+func TestExecDDL(t *testing.T) {
+	retryable := errors.New("retryable")
+	conn := &execConn{fail: 1, err: retryable}
+	s := &ClickhouseServer{Cluster: "c", ClusterDDL: true, conn: conn, Retry: util.RetryPolicy{
+		MaxAttempts:          2,
+		InitialBackoffMillis: 1,
+		IsRetryable:          func(err error) bool { return errors.Is(err, retryable) },
+	}}
+
+	if err := s.execDDL("CREATE TABLE t"); err != nil {
+		t.Fatalf("Expected a retryable failure to be retried: %s", err)
+	}
+	if len(conn.statements) != 2 || conn.statements[1] != "CREATE TABLE t" {
+		t.Fatalf("Expected the statement to be run twice; Got %q", conn.statements)
+	}
+
+	conn = &execConn{fail: 1, err: errors.New("syntax error")}
+	s.conn = conn
+	if err := s.execDDL("CREATE TABLE t"); err == nil {
+		t.Fatal("Expected a permanent failure to be returned")
+	}
+	if len(conn.statements) != 1 {
+		t.Fatalf("Expected a permanent failure not to be retried; Got %q", conn.statements)
+	}
+}
@@ -0,0 +1,235 @@
+package clickhouse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// Rows decodes a JSONEachRow or JSON query result one row at a time, so large
+// results aren't held in memory. With FORMAT JSON, column types from the
+// result's meta are used to turn the 64-bit integers ClickHouse sends as
+// strings back into numbers. JSONEachRow has no types, so those stay strings
+// in Next's maps, though Scan converts them for numeric struct fields.
+type Rows struct {
+	body   io.Reader
+	dec    *json.Decoder
+	format string
+
+	// types maps column name to ClickHouse type, from FORMAT JSON's meta
+	types map[string]string
+
+	started bool
+	done    bool
+}
+
+// NewRows decodes body, a query result in format
+func NewRows(body io.Reader, format string) (*Rows, error) {
+	if format != util.FormatJSON && format != util.FormatJSONEachRow {
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	return &Rows{body: body, dec: dec, format: format}, nil
+}
+
+// QueryRows runs query and returns its rows for decoding. The caller must
+// Close them. QueryJSON still streams the raw result for callers which don't
+// need to decode it.
+func (s *ClickhouseServer) QueryRows(query string) (*Rows, error) {
+	sql := "SELECT * FROM (" + util.TrimQuery(query) + ") FORMAT " + util.FormatJSON
+
+	resp, err := s.httpQuery(sql)
+	if err != nil {
+		return nil, err
+	}
+	return NewRows(resp, util.FormatJSON)
+}
+
+// Close closes the result body, if it can be closed
+func (r *Rows) Close() error {
+	if closer, ok := r.body.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Next returns the next row, or io.EOF after the last one. Integers are
+// int64 or uint64 and other numbers float64.
+func (r *Rows) Next() (map[string]any, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+
+	if !r.started {
+		r.started = true
+		if r.format == util.FormatJSON {
+			if err := r.readHeader(); err != nil {
+				r.done = true
+				return nil, err
+			}
+		}
+	}
+
+	if r.format == util.FormatJSON && !r.dec.More() {
+		// The rest of the result is row counts and statistics
+		r.done = true
+		return nil, io.EOF
+	}
+
+	row := map[string]any{}
+	err := r.dec.Decode(&row)
+	if err == io.EOF {
+		r.done = true
+		return nil, io.EOF
+	}
+	if err != nil {
+		r.done = true
+		return nil, err
+	}
+
+	for name, value := range row {
+		row[name] = convertValue(r.types[name], value)
+	}
+	return row, nil
+}
+
+// Scan decodes every remaining row into dest, a pointer to a slice of
+// structs or maps. Struct fields are matched by their json tag, or their name
+// otherwise, and strings are converted to numbers or bools where the field
+// needs one.
+func (r *Rows) Scan(dest any) error {
+	rows := []map[string]any{}
+	for {
+		row, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           dest,
+		TagName:          "json",
+		WeaklyTypedInput: true,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(rows)
+}
+
+// readHeader reads a FORMAT JSON result up to the start of its data array,
+// keeping the column types from meta
+func (r *Rows) readHeader() error {
+	if err := r.expectDelim('{'); err != nil {
+		return err
+	}
+
+	for r.dec.More() {
+		token, err := r.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch token {
+		case "meta":
+			meta := []struct {
+				Name string `json:"name"`
+				Type string `json:"type"`
+			}{}
+			if err := r.dec.Decode(&meta); err != nil {
+				return err
+			}
+			r.types = map[string]string{}
+			for _, column := range meta {
+				r.types[column.Name] = column.Type
+			}
+		case "data":
+			return r.expectDelim('[')
+		default:
+			var skip json.RawMessage
+			if err := r.dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+
+	return errors.New("query result has no data")
+}
+
+func (r *Rows) expectDelim(delim json.Delim) error {
+	token, err := r.dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("unexpected %v in query result, expected %v", token, delim)
+	}
+	return nil
+}
+
+// baseType strips Nullable and LowCardinality from a ClickHouse type
+func baseType(chType string) string {
+	for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+		for strings.HasPrefix(chType, wrapper) && strings.HasSuffix(chType, ")") {
+			chType = chType[len(wrapper) : len(chType)-1]
+		}
+	}
+	return chType
+}
+
+// convertValue turns a decoded value into the Go type for chType. With no
+// type, json.Numbers become int64 if they're integers, float64 otherwise.
+func convertValue(chType string, value any) any {
+	chType = baseType(chType)
+
+	switch v := value.(type) {
+	case json.Number:
+		return convertNumber(chType, string(v))
+	case string:
+		// 64-bit integers are quoted so JavaScript doesn't lose precision
+		if chType == "Int64" || chType == "UInt64" {
+			return convertNumber(chType, v)
+		}
+		return v
+	case []any:
+		inner := ""
+		if strings.HasPrefix(chType, "Array(") && strings.HasSuffix(chType, ")") {
+			inner = chType[len("Array(") : len(chType)-1]
+		}
+		for i, item := range v {
+			v[i] = convertValue(inner, item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func convertNumber(chType, s string) any {
+	if strings.HasPrefix(chType, "UInt") {
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return n
+		}
+	}
+	if !strings.HasPrefix(chType, "Float") && !strings.HasPrefix(chType, "Decimal") {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n
+		}
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
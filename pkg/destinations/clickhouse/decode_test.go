@@ -0,0 +1,93 @@
+package clickhouse
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+func TestRowsJSON(t *testing.T) {
+	body := `{
+		"meta": [{"name": "id", "type": "UInt64"}, {"name": "name", "type": "Nullable(String)"}, {"name": "score", "type": "Float64"}, {"name": "tags", "type": "Array(Int64)"}],
+		"data": [
+			{"id": "18446744073709551615", "name": "a", "score": 1.5, "tags": ["1", "2"]},
+			{"id": "2", "name": null, "score": 2, "tags": []}
+		],
+		"rows": 2,
+		"statistics": {"elapsed": 0.001}
+	}`
+
+	rows, err := NewRows(strings.NewReader(body), util.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := rows.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]any{"id": uint64(18446744073709551615), "name": "a", "score": 1.5, "tags": []any{int64(1), int64(2)}}
+	if !reflect.DeepEqual(row, exp) {
+		t.Fatalf("Expected %#v; Got %#v", exp, row)
+	}
+
+	row, err = rows.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row["id"] != uint64(2) || row["name"] != nil || row["score"] != float64(2) {
+		t.Fatalf("Unexpected row %#v", row)
+	}
+
+	if _, err := rows.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("Expected EOF; Got %v", err)
+	}
+}
+
+func TestRowsScan(t *testing.T) {
+	body := "{\"id\":\"1\",\"name\":\"a\",\"active\":1}\n{\"id\":\"2\",\"name\":\"b\",\"active\":0}\n"
+
+	rows, err := NewRows(strings.NewReader(body), util.FormatJSONEachRow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type user struct {
+		ID     int64  `json:"id"`
+		Name   string `json:"name"`
+		Active bool   `json:"active"`
+	}
+	users := []user{}
+	if err := rows.Scan(&users); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []user{{ID: 1, Name: "a", Active: true}, {ID: 2, Name: "b"}}
+	if !reflect.DeepEqual(users, exp) {
+		t.Fatalf("Expected %+v; Got %+v", exp, users)
+	}
+}
+
+func TestQueryRowsError(t *testing.T) {
+	s := newHTTPTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-ClickHouse-Exception-Code", "60")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Code: 60. DB::Exception: Table db.missing does not exist."))
+	})
+
+	_, err := s.QueryRows("SELECT * FROM missing")
+	var exception *clickhouse.Exception
+	if !errors.As(err, &exception) || exception.Code != 60 || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("Expected the ClickHouse exception; Got %v", err)
+	}
+
+	if err := s.QueryJSON("SELECT * FROM missing", io.Discard); err == nil {
+		t.Fatal("Expected QueryJSON to fail rather than stream the error")
+	}
+}
@@ -1,23 +1,19 @@
 package clickhouse
 
 import (
-	"context"
-	"fmt"
 	"github.com/rs/zerolog/log"
 	"os"
 )
 
 func (s *ClickhouseServer) CreateEmptyTable(table string) error {
-	sql := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS "%s"."%s" 
-		(
-		    __row_id Int64
-		)
-		 ENGINE = MergeTree
-		PRIMARY KEY(__row_id)
-	`, s.Database, table)
+	sql := s.createTableSQL(table)
 
-	return s.conn.Exec(context.TODO(), sql)
+	err := s.execDDL(sql)
+	if err != nil {
+		return err
+	}
+
+	return s.createDistributedTable(table)
 }
 
 func (s *ClickhouseServer) CreateColumns(table string, filePath string) error {
@@ -55,7 +51,12 @@ func (s *ClickhouseServer) InsertFromNDJsonFile(table string, filePath string) e
 		return err
 	}
 
-	err = s.insertData(input, table, columns)
+	token, err := contentToken(input)
+	if err != nil {
+		return err
+	}
+
+	err = s.insertData(input, table, columns, token)
 	if err != nil {
 		log.Err(err).Msg("Failed to insert data")
 		return err
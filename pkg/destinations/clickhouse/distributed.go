@@ -0,0 +1,73 @@
+package clickhouse
+
+import (
+	"fmt"
+)
+
+// DistributedTable routes inserts for a table through a Distributed engine table.
+// ClickHouse forwards each row to the shard chosen by ShardingKey, so inserts
+// can be sent to any node in the cluster rather than a specific shard.
+//
+// This is independent of how a server is picked: a database's destination
+// connects to its one Host, and if that's a load balancer choosing nodes by
+// consistent hashing, the hash only decides which node accepts an insert.
+// Rows still go to shards by ShardingKey, so the two don't need to agree,
+// and a hash on the table no longer pins a table's data to one shard.
+type DistributedTable struct {
+	// Table is the name of the Distributed table. Defaults to <table>_distributed.
+	Table string `mapstructure:"table"`
+
+	// Cluster is the cluster the Distributed table spans. Defaults to the server's cluster.
+	Cluster string `mapstructure:"cluster"`
+
+	// ShardingKey is the expression used to pick a shard. Defaults to rand().
+	ShardingKey string `mapstructure:"sharding_key"`
+}
+
+// distributedTable returns the Distributed table configured for table, with defaults applied
+func (s *ClickhouseServer) distributedTable(table string) (DistributedTable, bool) {
+	dist, ok := s.Distributed[table]
+	if !ok {
+		return DistributedTable{}, false
+	}
+
+	if dist.Table == "" {
+		dist.Table = table + "_distributed"
+	}
+	if dist.Cluster == "" {
+		dist.Cluster = s.Cluster
+	}
+	if dist.ShardingKey == "" {
+		dist.ShardingKey = "rand()"
+	}
+
+	return dist, true
+}
+
+// insertTable returns the table inserts for table should be sent to
+func (s *ClickhouseServer) insertTable(table string) string {
+	if dist, ok := s.distributedTable(table); ok {
+		return dist.Table
+	}
+	return table
+}
+
+// createDistributedTable creates the Distributed table for table, if one is configured
+func (s *ClickhouseServer) createDistributedTable(table string) error {
+	dist, ok := s.distributedTable(table)
+	if !ok {
+		return nil
+	}
+
+	if dist.Cluster == "" {
+		return fmt.Errorf("no cluster configured for distributed table %s", dist.Table)
+	}
+
+	sql := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS "%s"."%s"%s
+		AS "%s"."%s"
+		ENGINE = Distributed('%s', '%s', '%s', %s)
+	`, s.Database, dist.Table, s.onCluster(), s.Database, table, dist.Cluster, s.Database, table, dist.ShardingKey)
+
+	return s.execDDL(sql)
+}
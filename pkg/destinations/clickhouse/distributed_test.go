@@ -0,0 +1,94 @@
+package clickhouse
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDistributedTable(t *testing.T) {
+	s := &ClickhouseServer{Database: "db", Cluster: "main", Distributed: map[string]DistributedTable{
+		"events": {},
+		"clicks": {Table: "clicks_all", Cluster: "other", ShardingKey: "cityHash64(user)"},
+	}}
+
+	tests := []struct {
+		table    string
+		expected DistributedTable
+		ok       bool
+	}{
+		{table: "events", expected: DistributedTable{Table: "events_distributed", Cluster: "main", ShardingKey: "rand()"}, ok: true},
+		{table: "clicks", expected: DistributedTable{Table: "clicks_all", Cluster: "other", ShardingKey: "cityHash64(user)"}, ok: true},
+		{table: "orders"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.table, func(t *testing.T) {
+			dist, ok := s.distributedTable(test.table)
+			if ok != test.ok || dist != test.expected {
+				t.Fatalf("Expected %+v, %v; Got %+v, %v", test.expected, test.ok, dist, ok)
+			}
+
+			expTable := test.table
+			if test.ok {
+				expTable = test.expected.Table
+			}
+			if table := s.insertTable(test.table); table != expTable {
+				t.Fatalf("Expected inserts into %s; Got %s", expTable, table)
+			}
+		})
+	}
+}
+
+func TestCreateDistributedTable(t *testing.T) {
+	conn := &execConn{}
+	s := &ClickhouseServer{Database: "db", Cluster: "main", ClusterDDL: true, conn: conn, Distributed: map[string]DistributedTable{
+		"clicks": {ShardingKey: "cityHash64(user)"},
+	}}
+
+	if err := s.createDistributedTable("orders"); err != nil || len(conn.statements) != 0 {
+		t.Fatalf("Expected nothing for a table without a Distributed table; Got %q, %v", conn.statements, err)
+	}
+
+	if err := s.createDistributedTable("clicks"); err != nil {
+		t.Fatalf("Cannot create distributed table: %s", err)
+	}
+	if len(conn.statements) != 1 {
+		t.Fatalf("Expected one statement; Got %q", conn.statements)
+	}
+	for _, exp := range []string{
+		`CREATE TABLE IF NOT EXISTS "db"."clicks_distributed" ON CLUSTER 'main'`,
+		`AS "db"."clicks"`,
+		`ENGINE = Distributed('main', 'db', 'clicks', cityHash64(user))`,
+	} {
+		if !strings.Contains(conn.statements[0], exp) {
+			t.Fatalf("Expected %q in %s", exp, conn.statements[0])
+		}
+	}
+
+	s.Cluster = ""
+	if err := s.createDistributedTable("clicks"); err == nil || !strings.Contains(err.Error(), "no cluster") {
+		t.Fatalf("Expected an error without a cluster; Got %v", err)
+	}
+}
+
+func TestAddColumnsDistributed(t *testing.T) {
+	conn := &execConn{}
+	s := &ClickhouseServer{Database: "db", Cluster: "main", conn: conn, Distributed: map[string]DistributedTable{"clicks": {}}}
+
+	if err := s.addColumns("clicks", map[string]string{"page": "String"}); err != nil {
+		t.Fatalf("Cannot add columns: %s", err)
+	}
+	if len(conn.statements) != 2 ||
+		!strings.Contains(conn.statements[0], `ALTER TABLE "db"."clicks" ADD COLUMN IF NOT EXISTS "page" String`) ||
+		!strings.Contains(conn.statements[1], `ALTER TABLE "db"."clicks_distributed" ADD COLUMN IF NOT EXISTS "page" String`) {
+		t.Fatalf("Expected the local then the Distributed table to be altered; Got %q", conn.statements)
+	}
+
+	conn.statements = nil
+	if err := s.addColumns("orders", map[string]string{"total": "Float64"}); err != nil {
+		t.Fatalf("Cannot add columns: %s", err)
+	}
+	if len(conn.statements) != 1 {
+		t.Fatalf("Expected only the local table to be altered; Got %q", conn.statements)
+	}
+}
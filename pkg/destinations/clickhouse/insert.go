@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/rs/zerolog/log"
 	"github.com/shopspring/decimal"
 	"github.com/tidwall/gjson"
@@ -94,8 +95,7 @@ func (s *ClickhouseServer) inferColumnTypes(file io.ReadSeeker) (map[string]stri
 }
 
 func (s *ClickhouseServer) createColumnsWithTypes(table string, columns map[string]string) error {
-	sql := fmt.Sprintf(`ALTER TABLE "%s"."%s" `, s.Database, table)
-	columnSql := []string{}
+	types := map[string]string{}
 	for colName, jsonType := range columns {
 		var colType string
 		switch jsonType {
@@ -110,6 +110,32 @@ func (s *ClickhouseServer) createColumnsWithTypes(table string, columns map[stri
 		default:
 			colType = "String"
 		}
+		types[colName] = colType
+	}
+
+	return s.addColumns(table, types)
+}
+
+// addColumns adds columns, mapping names to ClickHouse types, to table if
+// they don't exist yet
+func (s *ClickhouseServer) addColumns(table string, columns map[string]string) error {
+	err := s.alterColumns(table, columns)
+	if err != nil {
+		return err
+	}
+
+	// A Distributed table doesn't pick up new columns from its local table
+	if dist, ok := s.distributedTable(table); ok {
+		return s.alterColumns(dist.Table, columns)
+	}
+
+	return nil
+}
+
+func (s *ClickhouseServer) alterColumns(table string, columns map[string]string) error {
+	sql := fmt.Sprintf(`ALTER TABLE "%s"."%s"%s `, s.Database, table, s.onCluster())
+	columnSql := []string{}
+	for colName, colType := range columns {
 		columnSql = append(columnSql, fmt.Sprintf(`ADD COLUMN IF NOT EXISTS "%s" %s`, colName, colType))
 	}
 
@@ -117,19 +143,28 @@ func (s *ClickhouseServer) createColumnsWithTypes(table string, columns map[stri
 
 	log.Trace().Msg(sql)
 
-	return s.conn.Exec(context.TODO(), sql)
+	return s.execDDL(sql)
 }
 
 func (s *ClickhouseServer) getClickhouseTypes(table string) (map[string]string, error) {
-	rc := map[string]string{}
+	rc, err := s.describe(fmt.Sprintf("\"%s\"", table))
+	if err == nil {
+		log.Trace().Interface("clickhouse_column_types", rc).Str("table", table).Send()
+	}
+	return rc, err
+}
 
-	sql := fmt.Sprintf("DESCRIBE TABLE \"%s\" FORMAT JSON", table)
-	resp, err := s.httpQuery(sql)
-	defer resp.Close()
+// describe returns the column types of target, a table or table function.
+// It's only used to insert, so it runs as the insert user.
+func (s *ClickhouseServer) describe(target string) (map[string]string, error) {
+	rc := map[string]string{}
 
+	sql := fmt.Sprintf("DESCRIBE TABLE %s FORMAT JSON", target)
+	resp, err := s.httpWriteQuery(sql)
 	if err != nil {
 		return rc, err
 	}
+	defer resp.Close()
 
 	data, err := io.ReadAll(resp)
 	if err != nil {
@@ -141,7 +176,6 @@ func (s *ClickhouseServer) getClickhouseTypes(table string) (map[string]string,
 		rc[field.Get("name").String()] = field.Get("type").String()
 	}
 
-	log.Trace().Interface("clickhouse_column_types", rc).Str("table", table).Send()
 	return rc, nil
 }
 
@@ -200,7 +234,7 @@ func (s *ClickhouseServer) jsonToGoType(clickhouseType string, data gjson.Result
 	return data.String()
 }
 
-func (s *ClickhouseServer) insertData(file io.ReadSeeker, table string, columns map[string]string) error {
+func (s *ClickhouseServer) insertData(file io.ReadSeeker, table string, columns map[string]string, token string) error {
 	// Get list of columns so we use the same order
 	colNames := make([]string, len(columns))
 	i := 0
@@ -216,7 +250,7 @@ func (s *ClickhouseServer) insertData(file io.ReadSeeker, table string, columns
 	}
 
 	// Create INSERT statement
-	insertSql := fmt.Sprintf(`INSERT INTO "%s"."%s" (`, s.Database, table)
+	insertSql := fmt.Sprintf(`INSERT INTO "%s"."%s" (`, s.Database, s.insertTable(table))
 	for i, colName := range colNames {
 		insertSql += fmt.Sprintf("`%s`", colName)
 		if i < len(columns)-1 {
@@ -236,8 +270,10 @@ func (s *ClickhouseServer) insertData(file io.ReadSeeker, table string, columns
 	}
 	// defer file.Close()
 
+	ctx := clickhouse.Context(context.Background(), clickhouse.WithSettings(dedupSettings(s.insertSettings(table), token)))
+
 	// Begin batch
-	batch, err := s.conn.PrepareBatch(context.Background(), insertSql)
+	batch, err := s.conn.PrepareBatch(ctx, insertSql)
 	if err != nil {
 		log.Err(err).Msg("unable to initiate batch query")
 		return err
@@ -272,7 +308,13 @@ func (s *ClickhouseServer) insertData(file io.ReadSeeker, table string, columns
 		return err
 	}
 
-	return batch.Send()
+	err = batch.Send()
+	if err != nil {
+		return err
+	}
+
+	s.logAsyncInsert(table)
+	return nil
 }
 
 func (s *ClickhouseServer) InsertBatchFromNDJson(table string, input io.ReadSeeker) error {
@@ -289,7 +331,14 @@ func (s *ClickhouseServer) InsertBatchFromNDJson(table string, input io.ReadSeek
 		return err
 	}
 
-	err = s.insertData(input, table, columns)
+	token, err := contentToken(input)
+	if err != nil {
+		return err
+	}
+
+	err = s.retryPolicy().Do(context.Background(), func() error {
+		return s.insertData(input, table, columns, token)
+	})
 	if err != nil {
 		log.Err(err).Msg("Failed to insert data")
 		return err
@@ -297,3 +346,39 @@ func (s *ClickhouseServer) InsertBatchFromNDJson(table string, input io.ReadSeek
 
 	return nil
 }
+
+// InsertJSONEachRow creates any missing columns, then sends input to
+// ClickHouse over HTTP as INSERT ... FORMAT JSONEachRow. It suits small,
+// frequent batches such as inserts into a Buffer table.
+func (s *ClickhouseServer) InsertJSONEachRow(table string, input io.ReadSeeker) error {
+	columns, err := s.inferColumnTypes(input)
+	if err != nil {
+		log.Err(err).Msg("failed to retrieve columns from input JSON")
+		return err
+	}
+
+	err = s.createColumnsWithTypes(table, columns)
+	if err != nil {
+		log.Err(err).Msg("failed to create columns")
+		return err
+	}
+
+	token, err := contentToken(input)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO \"%s\".\"%s\" FORMAT JSONEachRow", s.Database, s.insertTable(table))
+	err = s.retryPolicy().Do(context.Background(), func() error {
+		if _, err := input.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return s.httpInsert(query, dedupSettings(s.insertSettings(table), token), input)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.logAsyncInsert(table)
+	return nil
+}
@@ -0,0 +1,69 @@
+package clickhouse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/scratchdata/scratchdata/pkg/credentials"
+)
+
+// newHTTPTestServer returns a server whose HTTP interface is handler
+func newHTTPTestServer(t *testing.T, handler http.HandlerFunc) *ClickhouseServer {
+	t.Helper()
+
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return &ClickhouseServer{
+		HTTPProtocol: "http",
+		Host:         u.Hostname(),
+		HTTPPort:     port,
+		Database:     "db",
+		Username:     "writer",
+		ReadUsername: "reader",
+		password:     credentials.Parse("write-secret"),
+		readPassword: credentials.Parse("read-secret"),
+	}
+}
+
+func TestDescribeRunsAsWriter(t *testing.T) {
+	var user, key string
+	s := newHTTPTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		user, key = r.Header.Get("X-Clickhouse-User"), r.Header.Get("X-Clickhouse-Key")
+		w.Write([]byte(`{"data":[{"name":"a","type":"Int64"}]}`))
+	})
+
+	types, err := s.getClickhouseTypes("events")
+	if err != nil {
+		t.Fatalf("Cannot describe table: %s", err)
+	}
+	if types["a"] != "Int64" {
+		t.Fatalf("Expected column a; Got %v", types)
+	}
+	if user != "writer" || key != "write-secret" {
+		t.Fatalf("Expected describe to run as the insert user; Got %s", user)
+	}
+
+	body, err := s.httpQuery("SELECT 1")
+	if err != nil {
+		t.Fatalf("Cannot query: %s", err)
+	}
+	body.Close()
+	if user != "reader" || key != "read-secret" {
+		t.Fatalf("Expected queries to run as the read user; Got %s", user)
+	}
+}
+
+func TestDescribeUnreachable(t *testing.T) {
+	s := newHTTPTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	s.HTTPPort = 1
+
+	if _, err := s.describe(`"events"`); err == nil {
+		t.Fatal("Expected an error for an unreachable server")
+	}
+}
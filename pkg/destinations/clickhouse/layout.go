@@ -0,0 +1,122 @@
+package clickhouse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TableLayout sets the sort and partition keys used when a table is created.
+// Columns referenced by the keys have to exist when the table is created, so
+// they're declared up front in Columns rather than inferred from the data.
+type TableLayout struct {
+	// OrderBy lists the ORDER BY expressions. Defaults to TimestampField if
+	// set, otherwise the row id.
+	OrderBy []string `mapstructure:"order_by"`
+
+	// PartitionBy is the PARTITION BY expression. Defaults to monthly
+	// partitions on TimestampField if set, otherwise none.
+	PartitionBy string `mapstructure:"partition_by"`
+
+	// TimestampField is the event time column, created as DateTime64(3)
+	// unless Columns says otherwise
+	TimestampField string `mapstructure:"timestamp_field"`
+
+	// Columns maps column names to ClickHouse types for columns created
+	// along with the table
+	Columns map[string]string `mapstructure:"columns"`
+}
+
+// rowIDColumn returns the column the row id is stored in, its type, and the
+// expression for the row id itself. A row id nested under a metadata key is
+// stored as JSON in the metadata key's String column.
+func (s *ClickhouseServer) rowIDColumn() (column, colType, expr string) {
+	field := s.RowIDField
+	if field == "" {
+		field = "__row_id"
+	}
+
+	column, path, nested := strings.Cut(field, ".")
+	if !nested {
+		return column, "Int64", fmt.Sprintf("\"%s\"", column)
+	}
+	return column, "String", fmt.Sprintf("JSONExtractInt(\"%s\", '%s')", column, path)
+}
+
+// tableLayout returns the layout configured for table, with defaults applied
+func (s *ClickhouseServer) tableLayout(table string) (TableLayout, bool) {
+	layout, ok := s.Tables[table]
+	if !ok {
+		return TableLayout{}, false
+	}
+
+	columns := map[string]string{}
+	for name, colType := range layout.Columns {
+		columns[name] = colType
+	}
+
+	if layout.TimestampField != "" {
+		if _, ok := columns[layout.TimestampField]; !ok {
+			columns[layout.TimestampField] = "DateTime64(3)"
+		}
+		if len(layout.OrderBy) == 0 {
+			layout.OrderBy = []string{fmt.Sprintf("\"%s\"", layout.TimestampField)}
+		}
+		if layout.PartitionBy == "" {
+			layout.PartitionBy = fmt.Sprintf("toYYYYMM(\"%s\")", layout.TimestampField)
+		}
+	}
+
+	if len(layout.OrderBy) == 0 {
+		_, _, rowID := s.rowIDColumn()
+		layout.OrderBy = []string{rowID}
+	}
+
+	layout.Columns = columns
+	return layout, true
+}
+
+// createTableSQL returns the CREATE TABLE statement for table
+func (s *ClickhouseServer) createTableSQL(table string) string {
+	rowIDColumn, rowIDType, rowID := s.rowIDColumn()
+
+	layout, ok := s.tableLayout(table)
+	if !ok {
+		return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS "%s"."%s"%s
+		(
+		    "%s" %s
+		)
+		 ENGINE = MergeTree
+		PRIMARY KEY(%s)
+	`, s.Database, table, s.onCluster(), rowIDColumn, rowIDType, rowID)
+	}
+
+	names := make([]string, 0, len(layout.Columns))
+	for name := range layout.Columns {
+		if name != rowIDColumn {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	columns := []string{fmt.Sprintf("\"%s\" %s", rowIDColumn, rowIDType)}
+	for _, name := range names {
+		columns = append(columns, fmt.Sprintf("\"%s\" %s", name, layout.Columns[name]))
+	}
+
+	sql := fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS "%s"."%s"%s
+		(
+		    %s
+		)
+		ENGINE = MergeTree
+	`, s.Database, table, s.onCluster(), strings.Join(columns, ",\n\t\t    "))
+
+	if layout.PartitionBy != "" {
+		sql += fmt.Sprintf("\tPARTITION BY %s\n", layout.PartitionBy)
+	}
+	sql += fmt.Sprintf("\tORDER BY (%s)\n", strings.Join(layout.OrderBy, ", "))
+
+	return sql
+}
@@ -0,0 +1,104 @@
+package clickhouse
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateTableSQLRowID(t *testing.T) {
+	tests := []struct {
+		name       string
+		rowIDField string
+		tables     map[string]TableLayout
+		contains   []string
+	}{
+		{
+			name:     "default",
+			contains: []string{`"__row_id" Int64`, `PRIMARY KEY("__row_id")`},
+		},
+		{
+			name:       "metadata key",
+			rowIDField: "_scratch.row_id",
+			contains:   []string{`"_scratch" String`, `PRIMARY KEY(JSONExtractInt("_scratch", 'row_id'))`},
+		},
+		{
+			name:       "metadata key with layout",
+			rowIDField: "_scratch.row_id",
+			tables:     map[string]TableLayout{"events": {Columns: map[string]string{"n": "Int64"}}},
+			contains:   []string{`"_scratch" String`, `"n" Int64`, `ORDER BY (JSONExtractInt("_scratch", 'row_id'))`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &ClickhouseServer{Database: "db", RowIDField: test.rowIDField, Tables: test.tables}
+			sql := s.createTableSQL("events")
+			if strings.Contains(sql, "__row_id") != (test.rowIDField == "") {
+				t.Fatalf("Unexpected __row_id in %s", sql)
+			}
+			for _, exp := range test.contains {
+				if !strings.Contains(sql, exp) {
+					t.Fatalf("Expected %q in %s", exp, sql)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateTableSQL(t *testing.T) {
+	s := &ClickhouseServer{Database: "db", Tables: map[string]TableLayout{
+		"events": {TimestampField: "ts", Columns: map[string]string{"user": "String", "country": "LowCardinality(String)"}},
+		"clicks": {TimestampField: "ts", Columns: map[string]string{"ts": "DateTime"}, OrderBy: []string{`"page"`, `"ts"`}, PartitionBy: `toDate("ts")`},
+		"orders": {Columns: map[string]string{"total": "Float64"}},
+	}}
+
+	tests := []struct {
+		table    string
+		contains []string
+		excludes []string
+	}{
+		{
+			table: "events",
+			// Columns after the row id are sorted, so the statement is stable
+			contains: []string{`"__row_id" Int64,`, `"country" LowCardinality(String),`, `"ts" DateTime64(3),`, `"user" String`, `PARTITION BY toYYYYMM("ts")`, `ORDER BY ("ts")`},
+			excludes: []string{"PRIMARY KEY"},
+		},
+		{
+			table:    "clicks",
+			contains: []string{`"ts" DateTime`, `PARTITION BY toDate("ts")`, `ORDER BY ("page", "ts")`},
+			excludes: []string{"DateTime64", "toYYYYMM"},
+		},
+		{
+			table:    "orders",
+			contains: []string{`"total" Float64`, `ORDER BY ("__row_id")`},
+			excludes: []string{"PARTITION BY"},
+		},
+		{
+			table:    "other",
+			contains: []string{`CREATE TABLE IF NOT EXISTS "db"."other"`, `"__row_id" Int64`, `PRIMARY KEY("__row_id")`},
+			excludes: []string{"ORDER BY", "PARTITION BY"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.table, func(t *testing.T) {
+			sql := s.createTableSQL(test.table)
+			last := -1
+			for _, exp := range test.contains {
+				i := strings.Index(sql, exp)
+				if i < 0 {
+					t.Fatalf("Expected %q in %s", exp, sql)
+				}
+				if i < last {
+					t.Fatalf("Expected %q later in %s", exp, sql)
+				}
+				last = i
+			}
+			for _, unexp := range test.excludes {
+				if strings.Contains(sql, unexp) {
+					t.Fatalf("Unexpected %q in %s", unexp, sql)
+				}
+			}
+		})
+	}
+}
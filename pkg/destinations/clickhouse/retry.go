@@ -0,0 +1,80 @@
+package clickhouse
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// retryableCodes are ClickHouse exception codes for conditions which usually
+// clear up on their own
+var retryableCodes = map[int32]bool{
+	159: true, // TIMEOUT_EXCEEDED
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	242: true, // TABLE_IS_READ_ONLY, e.g. a replica which lost its Keeper session
+	252: true, // TOO_MANY_PARTS
+	319: true, // UNKNOWN_STATUS_OF_INSERT
+	999: true, // KEEPER_EXCEPTION
+}
+
+// IsRetryable is the default classifier for ClickHouse: util.IsRetryableError
+// plus exceptions with a transient code. Custom Retry.IsRetryable hooks can
+// call it and add codes of their own.
+func IsRetryable(err error) bool {
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return retryableCodes[exception.Code]
+	}
+	return util.IsRetryableError(err)
+}
+
+// dedupSettings returns settings with an insert_deduplication_token added,
+// so that when an insert is retried after an attempt which did land,
+// ClickHouse drops the repeat instead of writing the rows twice. Every
+// attempt must send the same token. It only takes effect on tables which
+// deduplicate inserts: Replicated tables, or other MergeTree tables with
+// non_replicated_deduplication_window set.
+func dedupSettings(settings clickhouse.Settings, token string) clickhouse.Settings {
+	rc := clickhouse.Settings{}
+	for name, value := range settings {
+		rc[name] = value
+	}
+	rc["insert_deduplication_token"] = token
+	if rc["async_insert"] == 1 {
+		rc["async_insert_deduplicate"] = 1
+	}
+	return rc
+}
+
+// contentToken returns a deduplication token for an insert of input, a hash
+// of its contents, leaving input back at the start
+func contentToken(input io.ReadSeeker) (string, error) {
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, input); err != nil {
+		return "", err
+	}
+
+	if _, err := input.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// retryPolicy returns Retry, classified by IsRetryable unless a hook is set
+func (s *ClickhouseServer) retryPolicy() util.RetryPolicy {
+	policy := s.Retry
+	if policy.IsRetryable == nil {
+		policy.IsRetryable = IsRetryable
+	}
+	return policy
+}
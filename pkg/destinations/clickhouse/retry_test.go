@@ -0,0 +1,44 @@
+package clickhouse
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+func TestDedupSettings(t *testing.T) {
+	async := clickhouse.Settings{"async_insert": 1, "wait_for_async_insert": 1}
+	settings := dedupSettings(async, "token")
+	if settings["insert_deduplication_token"] != "token" || settings["async_insert_deduplicate"] != 1 {
+		t.Fatalf("Expected a token with async deduplication; Got %v", settings)
+	}
+	if _, ok := async["insert_deduplication_token"]; ok {
+		t.Fatalf("Expected the insert settings to be left as they are; Got %v", async)
+	}
+
+	settings = dedupSettings(nil, "token")
+	if _, ok := settings["async_insert_deduplicate"]; ok || settings["insert_deduplication_token"] != "token" {
+		t.Fatalf("Expected only a token; Got %v", settings)
+	}
+}
+
+func TestContentToken(t *testing.T) {
+	input := strings.NewReader(`{"a":1}`)
+	input.Seek(3, io.SeekStart)
+
+	token, err := contentToken(input)
+	if err != nil {
+		t.Fatalf("Cannot get token: %s", err)
+	}
+	if pos, _ := input.Seek(0, io.SeekCurrent); pos != 0 {
+		t.Fatalf("Expected input to be rewound; Got offset %d", pos)
+	}
+
+	again, _ := contentToken(strings.NewReader(`{"a":1}`))
+	other, _ := contentToken(strings.NewReader(`{"a":2}`))
+	if token != again || token == other {
+		t.Fatalf("Expected tokens to match only for the same content; Got %s, %s, %s", token, again, other)
+	}
+}
@@ -0,0 +1,198 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// S3Source is where ClickHouse reads uploaded files from, with the s3 table
+// function, for formats it can read directly such as Parquet
+type S3Source struct {
+	// URL is the HTTP(S) URL of the bucket, including the blob store's
+	// prefix, e.g. https://bucket.s3.us-east-1.amazonaws.com/prefix.
+	// Object keys are appended to it.
+	URL string `mapstructure:"url"`
+
+	// AccessKeyId and SecretAccessKey are passed to the s3 function. Without
+	// them ClickHouse uses its own configured credentials.
+	AccessKeyId     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+}
+
+// ErrNoS3Source is returned by InsertFromS3 when S3.URL isn't set
+var ErrNoS3Source = errors.New("clickhouse: no s3 source is configured")
+
+// s3Function returns the s3 table function call reading key in format
+func (s *ClickhouseServer) s3Function(key, format string) string {
+	sql := util.StringBuffer{}
+	sql.Printf("s3(").SQLString("%s", strings.TrimSuffix(s.S3.URL, "/")+"/"+strings.TrimPrefix(key, "/"))
+	if s.S3.AccessKeyId != "" {
+		sql.Printf(", ").SQLString("%s", s.S3.AccessKeyId).Printf(", ").SQLString("%s", s.S3.SecretAccessKey)
+	}
+	sql.Printf(", ").SQLString("%s", format).Printf(")")
+	return sql.String()
+}
+
+// InsertFromS3 has ClickHouse read the object at key, in format, straight
+// from S3 and insert it into table, which is much faster than decoding it
+// here for a columnar format like Parquet. The file's columns are matched to
+// the table's by name, ignoring case and characters which aren't valid in an
+// identifier, and any the table doesn't have yet are added with the file's
+// types. Columns whose types can't be converted fail the insert and are
+// named in the error.
+func (s *ClickhouseServer) InsertFromS3(table, key, format string) error {
+	if s.S3.URL == "" {
+		return ErrNoS3Source
+	}
+
+	source := s.s3Function(key, format)
+	sourceTypes, err := s.describe(source)
+	if err != nil {
+		return err
+	}
+	if len(sourceTypes) == 0 {
+		return fmt.Errorf("clickhouse: no columns found in %s", key)
+	}
+
+	tableTypes, err := s.getClickhouseTypes(table)
+	if err != nil {
+		return err
+	}
+
+	mapping, missing, err := mapColumns(sourceTypes, tableTypes)
+	if err != nil {
+		return fmt.Errorf("clickhouse: %s does not match table %s: %w", key, table, err)
+	}
+
+	if len(missing) > 0 {
+		err = s.addColumns(table, missing)
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(mapping))
+	for name := range mapping {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	targets := make([]string, len(names))
+	for i, name := range names {
+		targets[i] = mapping[name]
+	}
+
+	sql := util.StringBuffer{}
+	sql.Printf("INSERT INTO ").SQLIdent("%s", s.Database).Printf(".").SQLIdent("%s", s.insertTable(table)).Printf(" (")
+	for i, target := range targets {
+		if i > 0 {
+			sql.Printf(", ")
+		}
+		sql.Quote('"', `""`, "%s", target)
+	}
+	sql.Printf(") SELECT ")
+	for i, name := range names {
+		if i > 0 {
+			sql.Printf(", ")
+		}
+		sql.Quote('"', `""`, "%s", name)
+	}
+	sql.Printf(" FROM %s", source)
+
+	// The key identifies the file, so it's the deduplication token
+	ctx := clickhouse.Context(context.Background(), clickhouse.WithSettings(dedupSettings(s.insertSettings(table), key)))
+	err = s.retryPolicy().Do(ctx, func() error {
+		return s.conn.Exec(ctx, sql.String())
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Str("table", table).Str("key", key).Str("format", format).Int("columns", len(names)).Msg("Inserted file from S3")
+	s.logAsyncInsert(table)
+	return nil
+}
+
+// mapColumns matches a file's columns to a table's, both mapping names to
+// ClickHouse types. It returns the table column for each file column, and
+// the file columns the table doesn't have, with their types. Columns which
+// match more than one other, or whose types are incompatible, are an error.
+func mapColumns(source, table map[string]string) (map[string]string, map[string]string, error) {
+	normalized := map[string][]string{}
+	for name := range table {
+		key := util.NormalizeIdentifier(name)
+		normalized[key] = append(normalized[key], name)
+	}
+
+	mapping := map[string]string{}
+	missing := map[string]string{}
+	targets := map[string][]string{}
+	for name, sourceType := range source {
+		target := name
+		if _, ok := table[name]; !ok {
+			candidates := normalized[util.NormalizeIdentifier(name)]
+			switch len(candidates) {
+			case 0:
+				missing[name] = sourceType
+			case 1:
+				target = candidates[0]
+			default:
+				sort.Strings(candidates)
+				return nil, nil, fmt.Errorf("column %q matches more than one table column: %s", name, strings.Join(candidates, ", "))
+			}
+		}
+		mapping[name] = target
+		targets[target] = append(targets[target], name)
+	}
+
+	problems := []string{}
+	for target, names := range targets {
+		if len(names) > 1 {
+			sort.Strings(names)
+			problems = append(problems, fmt.Sprintf("%s all map to %q", strings.Join(names, ", "), target))
+			continue
+		}
+		tableType, ok := table[target]
+		if !ok {
+			continue
+		}
+		if sourceType := source[names[0]]; typeFamily(sourceType) != typeFamily(tableType) {
+			problems = append(problems, fmt.Sprintf("%q is %s in the file but %s in the table", names[0], sourceType, tableType))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, nil, fmt.Errorf("mismatched columns: %s", strings.Join(problems, "; "))
+	}
+
+	return mapping, missing, nil
+}
+
+// typeFamily groups ClickHouse types which convert to each other on insert
+func typeFamily(chType string) string {
+	chType = baseType(chType)
+	switch {
+	case strings.HasPrefix(chType, "Int"), strings.HasPrefix(chType, "UInt"),
+		strings.HasPrefix(chType, "Float"), strings.HasPrefix(chType, "Decimal"),
+		chType == "Bool", chType == "Boolean":
+		return "number"
+	case chType == "String", strings.HasPrefix(chType, "FixedString"),
+		strings.HasPrefix(chType, "Enum"), chType == "UUID":
+		return "string"
+	case strings.HasPrefix(chType, "Date"):
+		return "time"
+	case strings.HasPrefix(chType, "Array("):
+		return "array"
+	case strings.HasPrefix(chType, "Map("), strings.HasPrefix(chType, "Tuple("):
+		return "map"
+	default:
+		return chType
+	}
+}
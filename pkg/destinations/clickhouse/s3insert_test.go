@@ -0,0 +1,42 @@
+package clickhouse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMapColumns(t *testing.T) {
+	source := map[string]string{"id": "Nullable(Int32)", "User Name": "Nullable(String)", "score": "Float64"}
+	table := map[string]string{"__row_id": "Int64", "id": "Int64", "user_name": "String"}
+
+	mapping, missing, err := mapColumns(source, table)
+	if err != nil {
+		t.Fatalf("Cannot map columns: %s", err)
+	}
+	if exp := map[string]string{"id": "id", "User Name": "user_name", "score": "score"}; !reflect.DeepEqual(mapping, exp) {
+		t.Fatalf("Expected %v; Got %v", exp, mapping)
+	}
+	if exp := map[string]string{"score": "Float64"}; !reflect.DeepEqual(missing, exp) {
+		t.Fatalf("Expected missing %v; Got %v", exp, missing)
+	}
+
+	source = map[string]string{"id": "String", "user_name": "String", "User_Name": "String"}
+	_, _, err = mapColumns(source, table)
+	if err == nil {
+		t.Fatal("Expected mismatched columns to fail")
+	}
+	for _, s := range []string{`"id" is String in the file but Int64 in the table`, `User_Name, user_name all map to "user_name"`} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("Expected %q in error; Got %s", s, err)
+		}
+	}
+}
+
+func TestS3Function(t *testing.T) {
+	s := ClickhouseServer{S3: S3Source{URL: "https://bucket.s3.amazonaws.com/prefix/", AccessKeyId: "key", SecretAccessKey: "it's"}}
+	exp := `s3('https://bucket.s3.amazonaws.com/prefix/data/1/t/1.parquet', 'key', 'it''s', 'Parquet')`
+	if got := s.s3Function("data/1/t/1.parquet", "Parquet"); got != exp {
+		t.Fatalf("Expected %s; Got %s", exp, got)
+	}
+}
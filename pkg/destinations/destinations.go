@@ -15,6 +15,10 @@ type DestinationManager struct {
 	storage *models.StorageServices
 	pool    map[int64]Destination
 	mux     *mapmutex.Mutex
+
+	// RowIDField is the path of the row id the API adds to each row, passed
+	// to destinations as row_id_field unless their settings have one
+	RowIDField string
 }
 
 type Destination interface {
@@ -28,6 +32,12 @@ type Destination interface {
 	Close() error
 }
 
+// S3Inserter is implemented by destinations which can read an uploaded file
+// straight from the blob store, in a format such as Parquet
+type S3Inserter interface {
+	InsertFromS3(table, key, format string) error
+}
+
 func NewDestinationManager(storage *models.StorageServices) *DestinationManager {
 	mux := mapmutex.NewMapMutex()
 	rc := DestinationManager{
@@ -66,11 +76,20 @@ func (m *DestinationManager) Destination(databaseID int64) (Destination, error)
 			return nil, err
 		}
 
+		settings := creds.Settings
+		if _, ok := settings["row_id_field"]; !ok && m.RowIDField != "" {
+			settings = map[string]any{}
+			for k, v := range creds.Settings {
+				settings[k] = v
+			}
+			settings["row_id_field"] = m.RowIDField
+		}
+
 		switch creds.Type {
 		case "duckdb":
-			dest, err = duckdb.OpenServer(creds.Settings)
+			dest, err = duckdb.OpenServer(settings)
 		case "clickhouse":
-			dest, err = clickhouse.OpenServer(creds.Settings)
+			dest, err = clickhouse.OpenServer(settings)
 		}
 
 		if err != nil {
@@ -23,6 +23,10 @@ type DuckDBServer struct {
 
 	InMemory bool `mapstructure:"in_memory"`
 
+	// RowIDField is the path of the row id added to each row: __row_id
+	// (default), or key.row_id when it's nested under a metadata key
+	RowIDField string `mapstructure:"row_id_field"`
+
 	MaxOpenConns        int `mapstructure:"max_open_conns"`
 	MaxIdleConns        int `mapstructure:"max_idle_conns"`
 	ConnMaxLifetimeSecs int `mapstructure:"conn_max_lifetime_secs"`
@@ -30,6 +34,12 @@ type DuckDBServer struct {
 	db *sql.DB
 }
 
+// Check runs SELECT 1 to confirm the database can be queried
+func (s *DuckDBServer) Check(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "SELECT 1")
+	return err
+}
+
 func (s *DuckDBServer) Close() error {
 	return s.db.Close()
 }
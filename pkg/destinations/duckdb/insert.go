@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/scratchdata/scratchdata/util"
 
@@ -70,8 +71,24 @@ func (s *DuckDBServer) insertFromLocal(table string, localPath string) error {
 	return err
 }
 
+// rowIDColumn returns the column definition the row id is stored in. A row
+// id nested under a metadata key is stored as JSON in the metadata key's
+// column, which is a string like any other nested object.
+func (s *DuckDBServer) rowIDColumn() string {
+	field := s.RowIDField
+	if field == "" {
+		field = "__row_id"
+	}
+
+	column, _, nested := strings.Cut(field, ".")
+	if nested {
+		return fmt.Sprintf("\"%s\" %s", column, jsonToDuck["string"])
+	}
+	return fmt.Sprintf("\"%s\" BIGINT", column)
+}
+
 func (s *DuckDBServer) CreateEmptyTable(table string) error {
-	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS \"%s\" (__row_id BIGINT)", table)
+	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS \"%s\" (%s)", table, s.rowIDColumn())
 	_, err := s.db.Exec(sql)
 	return err
 }
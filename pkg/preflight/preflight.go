@@ -0,0 +1,79 @@
+package preflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/scratchdata/scratchdata/config"
+	"github.com/scratchdata/scratchdata/models"
+	"github.com/scratchdata/scratchdata/pkg/destinations"
+)
+
+// Checker is implemented by services which can confirm they're reachable and
+// usable without ingesting any data
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// Result is the outcome of checking one service
+type Result struct {
+	Name string
+	Err  error
+
+	// Skipped is true if the service doesn't support checking
+	Skipped bool
+}
+
+// Results is the outcome of a preflight run
+type Results []Result
+
+// Err returns every failed check joined together, or nil if all passed
+func (r Results) Err() error {
+	var errs []error
+	for _, result := range r {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.Name, result.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func check(ctx context.Context, name string, service any) Result {
+	checker, ok := service.(Checker)
+	if !ok {
+		return Result{Name: name, Skipped: true}
+	}
+	return Result{Name: name, Err: checker.Check(ctx)}
+}
+
+// CheckStorage checks the blob store and queue can be reached, which is what
+// the data sink needs to get data off local disk
+func CheckStorage(ctx context.Context, storage *models.StorageServices) Results {
+	return Results{
+		check(ctx, "blob_store", storage.BlobStore),
+		check(ctx, "queue", storage.Queue),
+	}
+}
+
+// Run validates the config, then checks the blob store, queue and each
+// destination can be reached. Every check is run; failures don't stop later
+// checks.
+func Run(ctx context.Context, conf config.ScratchDataConfig, storage *models.StorageServices, destinationManager *destinations.DestinationManager) Results {
+	rc := Results{{Name: "config", Err: conf.Validate()}}
+
+	rc = append(rc, CheckStorage(ctx, storage)...)
+
+	for i := range conf.Destinations {
+		name := fmt.Sprintf("destinations[%d]", i)
+
+		destination, err := destinationManager.Destination(int64(i))
+		if err != nil {
+			rc = append(rc, Result{Name: name, Err: err})
+			continue
+		}
+		rc = append(rc, check(ctx, name, destination))
+	}
+
+	return rc
+}
@@ -1,23 +1,155 @@
 package blobstore
 
 import (
+	"context"
+	"errors"
 	"github.com/scratchdata/scratchdata/config"
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/filesystem"
 	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/memory"
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/presigned"
 	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/s3"
+	"github.com/scratchdata/scratchdata/util"
 	"io"
+	"strings"
 )
 
+// gcsEndpoint is Google Cloud Storage's S3-compatible XML API
+const gcsEndpoint = "https://storage.googleapis.com"
+
 type BlobStore interface {
 	Upload(path string, r io.ReadSeeker) error
 	Download(path string, w io.WriterAt) error
 }
 
+// MetadataUploader is implemented by blob stores which can attach user metadata to objects
+type MetadataUploader interface {
+	UploadWithMetadata(path string, r io.ReadSeeker, metadata map[string]string) error
+}
+
+// UploadWithMetadata uploads r with metadata if store supports it, and without otherwise
+func UploadWithMetadata(store BlobStore, path string, r io.ReadSeeker, metadata map[string]string) error {
+	if len(metadata) > 0 {
+		if m, ok := store.(MetadataUploader); ok {
+			return m.UploadWithMetadata(path, r, metadata)
+		}
+	}
+	return store.Upload(path, r)
+}
+
+// MetadataKey normalizes name to a valid user metadata key: lowercase
+// letters, digits and dashes, e.g. "Database_ID" => "database-id"
+func MetadataKey(name string) string {
+	rc := []byte(strings.ToLower(name))
+	for i, c := range rc {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			rc[i] = '-'
+		}
+	}
+	return string(rc)
+}
+
+// ContextUploader is implemented by blob stores whose uploads can be cancelled
+type ContextUploader interface {
+	UploadContext(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) error
+}
+
+// UploadContext uploads r with metadata, cancelling the upload when ctx is
+// done if store supports it. Other stores only check ctx before starting.
+func UploadContext(ctx context.Context, store BlobStore, path string, r io.ReadSeeker, metadata map[string]string) error {
+	if u, ok := store.(ContextUploader); ok {
+		return u.UploadContext(ctx, path, r, metadata)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return UploadWithMetadata(store, path, r, metadata)
+}
+
+// InfoUploader is implemented by blob stores which can describe each object
+// they upload
+type InfoUploader interface {
+	UploadInfo(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) (models.ObjectInfo, error)
+}
+
+// UploadInfo is UploadContext, also returning what store reports about the
+// uploaded object, or an empty ObjectInfo if it doesn't
+func UploadInfo(ctx context.Context, store BlobStore, path string, r io.ReadSeeker, metadata map[string]string) (models.ObjectInfo, error) {
+	if u, ok := store.(InfoUploader); ok {
+		return u.UploadInfo(ctx, path, r, metadata)
+	}
+	return models.ObjectInfo{}, UploadContext(ctx, store, path, r, metadata)
+}
+
+// TagReader is implemented by blob stores which can read an object's tags
+type TagReader interface {
+	ObjectTags(ctx context.Context, path string) (map[string]string, error)
+}
+
+// ErrTagsNotSupported is returned by ObjectTags for blob stores without tags
+var ErrTagsNotSupported = errors.New("blob store does not support object tags")
+
+// ObjectTags returns the tags of the object at path, models.ErrNotFound if
+// there's no such object, or ErrTagsNotSupported if store has no tags
+func ObjectTags(ctx context.Context, store BlobStore, path string) (map[string]string, error) {
+	if r, ok := store.(TagReader); ok {
+		return r.ObjectTags(ctx, path)
+	}
+	return nil, ErrTagsNotSupported
+}
+
+// applyURI fills in the blob store type and settings from conf.URI.
+// Explicit settings take precedence over values from the URI.
+func applyURI(conf config.BlobStore) (config.BlobStore, error) {
+	uri, err := util.ParseStorageURI(conf.URI)
+	if err != nil {
+		return conf, err
+	}
+
+	settings := map[string]any{}
+	switch uri.Scheme {
+	case "s3":
+		conf.Type = "s3"
+		settings["bucket"] = uri.Bucket
+		settings["prefix"] = uri.Prefix
+	case "gs":
+		conf.Type = "s3"
+		settings["bucket"] = uri.Bucket
+		settings["prefix"] = uri.Prefix
+		settings["endpoint"] = gcsEndpoint
+	case "file":
+		conf.Type = "filesystem"
+		settings["directory"] = uri.Prefix
+	}
+
+	for k, v := range conf.Settings {
+		settings[k] = v
+	}
+	conf.Settings = settings
+
+	return conf, nil
+}
+
 func NewBlobStore(conf config.BlobStore) (BlobStore, error) {
+	if conf.URI != "" {
+		var err error
+		conf, err = applyURI(conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	switch conf.Type {
+	case "filesystem":
+		return filesystem.NewStorage(conf.Settings)
 	case "memory":
 		return memory.NewStorage(conf.Settings)
 	case "s3":
 		return s3.NewStorage(conf.Settings)
+	case "multi":
+		return NewMultiStorage(conf.Settings)
+	case "presigned":
+		return presigned.NewStorage(conf.Settings)
 	}
 
 	return nil, nil
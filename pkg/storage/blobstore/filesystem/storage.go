@@ -0,0 +1,73 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// Storage keeps uploaded files in a local directory
+type Storage struct {
+	Directory string `mapstructure:"directory"`
+}
+
+func (s *Storage) Upload(path string, r io.ReadSeeker) error {
+	dest := filepath.Join(s.Directory, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return err
+	}
+
+	fd, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fd, r)
+	closeErr := fd.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (s *Storage) Download(path string, w io.WriterAt) error {
+	data, err := os.ReadFile(filepath.Join(s.Directory, filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		return models.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("Storage.Download: %s: %w", path, err)
+	}
+	return nil
+}
+
+// Check confirms the directory can be written to
+func (s *Storage) Check(ctx context.Context) error {
+	if err := os.MkdirAll(s.Directory, os.ModePerm); err != nil {
+		return err
+	}
+
+	fd, err := os.CreateTemp(s.Directory, ".preflight-*")
+	if err != nil {
+		return err
+	}
+	fd.Close()
+	return os.Remove(fd.Name())
+}
+
+// NewStorage returns a new initialized Storage
+func NewStorage(conf map[string]any) (*Storage, error) {
+	rc := util.ConfigToStruct[Storage](conf)
+	if rc.Directory == "" {
+		return nil, fmt.Errorf("filesystem blob store requires a directory")
+	}
+	return rc, nil
+}
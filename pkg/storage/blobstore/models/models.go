@@ -3,3 +3,13 @@ package models
 import "errors"
 
 var ErrNotFound = errors.New("not found")
+
+// ObjectInfo is what a blob store reports about an object it just uploaded.
+// Fields it doesn't know are empty.
+type ObjectInfo struct {
+	// Location is where the object ended up, such as the URL it was
+	// delivered to, for stores where the path alone doesn't say
+	Location string
+
+	ETag string
+}
@@ -0,0 +1,111 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/scratchdata/scratchdata/config"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// MultiStorage uploads every file to all of its stores, e.g. a hot bucket for
+// ingestion and an archive bucket in another region
+type MultiStorage struct {
+	names  []string
+	stores []BlobStore
+}
+
+type multiStoreSettings struct {
+	Stores []struct {
+		Name     string         `mapstructure:"name"`
+		Type     string         `mapstructure:"type"`
+		URI      string         `mapstructure:"uri"`
+		Settings map[string]any `mapstructure:"settings"`
+	} `mapstructure:"stores"`
+}
+
+// Upload uploads to each store in order. It fails if any store fails, so the
+// caller keeps the file and retries the whole set.
+func (m *MultiStorage) Upload(path string, r io.ReadSeeker) error {
+	return m.UploadWithMetadata(path, r, nil)
+}
+
+func (m *MultiStorage) UploadWithMetadata(path string, r io.ReadSeeker, metadata map[string]string) error {
+	return m.UploadContext(context.TODO(), path, r, metadata)
+}
+
+func (m *MultiStorage) UploadContext(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) error {
+	for i, store := range m.stores {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := UploadContext(ctx, store, path, r, metadata); err != nil {
+			return fmt.Errorf("MultiStorage.Upload: %s: %w", m.names[i], err)
+		}
+	}
+	return nil
+}
+
+// Download reads the file from the first store
+func (m *MultiStorage) Download(path string, w io.WriterAt) error {
+	return m.stores[0].Download(path, w)
+}
+
+// ObjectTags reads the object's tags from the first store, like Download
+func (m *MultiStorage) ObjectTags(ctx context.Context, path string) (map[string]string, error) {
+	return ObjectTags(ctx, m.stores[0], path)
+}
+
+// Destinations returns the names of the stores files are uploaded to
+func (m *MultiStorage) Destinations() []string {
+	return m.names
+}
+
+// Check checks each store which supports it
+func (m *MultiStorage) Check(ctx context.Context) error {
+	var errs []error
+	for i, store := range m.stores {
+		if checker, ok := store.(interface{ Check(context.Context) error }); ok {
+			if err := checker.Check(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", m.names[i], err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewMultiStorageWithStores uploads to stores in order, naming each with the
+// matching entry in names
+func NewMultiStorageWithStores(names []string, stores []BlobStore) *MultiStorage {
+	return &MultiStorage{names: names, stores: stores}
+}
+
+func NewMultiStorage(settings map[string]any) (*MultiStorage, error) {
+	conf := util.ConfigToStruct[multiStoreSettings](settings)
+	if len(conf.Stores) == 0 {
+		return nil, errors.New("multi blob store requires at least one store")
+	}
+
+	rc := &MultiStorage{}
+	for i, storeConf := range conf.Stores {
+		store, err := NewBlobStore(config.BlobStore{Type: storeConf.Type, URI: storeConf.URI, Settings: storeConf.Settings})
+		if err != nil {
+			return nil, err
+		}
+		if store == nil {
+			return nil, fmt.Errorf("unsupported blob store type %q", storeConf.Type)
+		}
+
+		name := storeConf.Name
+		if name == "" {
+			name = fmt.Sprintf("store_%d", i)
+		}
+
+		rc.names = append(rc.names, name)
+		rc.stores = append(rc.stores, store)
+	}
+
+	return rc, nil
+}
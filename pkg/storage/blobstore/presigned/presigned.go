@@ -0,0 +1,183 @@
+package presigned
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// DefaultTimeoutSeconds is used when TimeoutSeconds isn't set
+const DefaultTimeoutSeconds = 60
+
+// ErrDownloadNotSupported is returned by Download, as files are delivered to
+// someone else's bucket
+var ErrDownloadNotSupported = errors.New("presigned: download is not supported")
+
+// Storage delivers each file with an HTTP PUT to a presigned URL for it, for
+// partners who provide upload URLs rather than bucket credentials. Object
+// metadata isn't sent, as presigned URLs reject headers they weren't signed
+// with.
+type Storage struct {
+	// URLEndpoint is asked for each file's URL when URLFunc isn't set: a GET
+	// to URLEndpoint?key=<path> must return the presigned PUT URL as its body
+	URLEndpoint string `mapstructure:"url_endpoint"`
+
+	// Headers are sent with every PUT, such as a Content-Type the URLs are
+	// signed with
+	Headers map[string]string `mapstructure:"headers"`
+
+	// TimeoutSeconds (default DefaultTimeoutSeconds) bounds each request
+	TimeoutSeconds int `mapstructure:"timeout_seconds"`
+
+	// URLFunc, if set, returns the presigned PUT URL for path. A panic is
+	// returned as an error.
+	URLFunc func(ctx context.Context, path string) (string, error) `mapstructure:"-"`
+
+	client *http.Client
+}
+
+// StatusError is an unsuccessful response to a request for a URL or a PUT
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("presigned: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// RetryableError reports whether the request may succeed if it's retried,
+// for util.IsRetryableError
+func (e *StatusError) RetryableError() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+func (s *Storage) Upload(path string, r io.ReadSeeker) error {
+	return s.UploadContext(context.TODO(), path, r, nil)
+}
+
+func (s *Storage) UploadWithMetadata(path string, r io.ReadSeeker, metadata map[string]string) error {
+	return s.UploadContext(context.TODO(), path, r, metadata)
+}
+
+func (s *Storage) UploadContext(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) error {
+	_, err := s.UploadInfo(ctx, path, r, metadata)
+	return err
+}
+
+// UploadInfo PUTs r to path's presigned URL. The object's location is the URL
+// without its signature.
+func (s *Storage) UploadInfo(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) (models.ObjectInfo, error) {
+	presignedURL, err := s.url(ctx, path)
+	if err != nil {
+		return models.ObjectInfo{}, err
+	}
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return models.ObjectInfo{}, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return models.ObjectInfo{}, err
+	}
+
+	// Presigned PUTs need a Content-Length rather than a chunked body
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, presignedURL, io.NopCloser(r))
+	if err != nil {
+		return models.ObjectInfo{}, err
+	}
+	req.ContentLength = size
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	_, header, err := s.do(req)
+	if err != nil {
+		return models.ObjectInfo{}, fmt.Errorf("presigned: upload %s: %w", path, err)
+	}
+
+	return models.ObjectInfo{Location: location(presignedURL), ETag: header.Get("ETag")}, nil
+}
+
+func (s *Storage) Download(path string, w io.WriterAt) error {
+	return ErrDownloadNotSupported
+}
+
+// url returns the presigned URL for path from URLFunc or URLEndpoint
+func (s *Storage) url(ctx context.Context, path string) (rc string, err error) {
+	if s.URLFunc != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("presigned: URLFunc panicked for %s: %v", path, r)
+			}
+		}()
+		return s.URLFunc(ctx, path)
+	}
+
+	if s.URLEndpoint == "" {
+		return "", errors.New("presigned: neither url_endpoint nor URLFunc is set")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URLEndpoint+"?key="+url.QueryEscape(path), nil)
+	if err != nil {
+		return "", err
+	}
+	body, _, err := s.do(req)
+	if err != nil {
+		return "", fmt.Errorf("presigned: get URL for %s: %w", path, err)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// do sends req, returning the response body and headers or a StatusError if
+// it wasn't successful
+func (s *Storage) do(req *http.Request) ([]byte, http.Header, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, &StatusError{StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(body))}
+	}
+	return body, resp.Header, nil
+}
+
+// location strips the signature from a presigned URL
+func location(presignedURL string) string {
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// NewStorage returns a Storage for settings. Set URLFunc on it to provide
+// URLs in code rather than from url_endpoint.
+func NewStorage(c map[string]any) (*Storage, error) {
+	s := util.ConfigToStruct[Storage](c)
+
+	timeout := s.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = DefaultTimeoutSeconds
+	}
+	s.client = &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	return s, nil
+}
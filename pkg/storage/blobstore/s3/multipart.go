@@ -0,0 +1,147 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog/log"
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// staleSweepInterval is how often stale multipart uploads are looked for
+// when AbortStaleUploadsAfterHours is set
+const staleSweepInterval = time.Hour
+
+// size returns the number of bytes left in r, leaving its offset unchanged
+func size(r io.ReadSeeker) (int64, error) {
+	current, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(current, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - current, nil
+}
+
+// uploadMultipart uploads r in MultipartPartSizeBytes parts. If any part
+// fails the upload is aborted, so no parts are left behind to be billed for.
+func (s *Storage) uploadMultipart(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) (models.ObjectInfo, error) {
+	uploader := manager.NewUploader(s.client, func(u *manager.Uploader) {
+		u.PartSize = s.MultipartPartSizeBytes
+		u.LeavePartsOnError = false
+		if s.inflight != nil {
+			u.Concurrency = 1
+		}
+	})
+
+	output, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(s.Bucket),
+		Key:                aws.String(s.key(path)),
+		Body:               r,
+		ContentDisposition: aws.String("attachment"),
+		Metadata:           metadata,
+	})
+	if err != nil {
+		err = util.WrapAWSError("s3.UploadMultipart", err)
+		util.AWSErrorFields(log.Error(), err).Err(err).Str("bucket", s.Bucket).Str("key", s.key(path)).Msg("Multipart upload failed")
+		return models.ObjectInfo{}, err
+	}
+	return models.ObjectInfo{ETag: aws.ToString(output.ETag)}, nil
+}
+
+// errNoPrefix is returned by AbortStaleUploads without a Prefix to limit it to
+var errNoPrefix = errors.New("s3: aborting stale uploads needs a prefix")
+
+// AbortStaleUploads aborts multipart uploads under Prefix started more than
+// olderThan ago, such as those left by a crash mid-upload, and returns how
+// many it aborted. Without a Prefix it aborts nothing and returns an error,
+// rather than aborting other clients' uploads anywhere in the bucket.
+func (s *Storage) AbortStaleUploads(ctx context.Context, olderThan time.Duration) (int, error) {
+	if strings.Trim(s.Prefix, "/") == "" {
+		return 0, errNoPrefix
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	aborted := 0
+
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(s.Bucket), Prefix: aws.String(s.key(""))}
+
+	for {
+		output, err := s.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return aborted, util.WrapAWSError("s3.ListMultipartUploads", err)
+		}
+
+		for _, upload := range output.Uploads {
+			if upload.Initiated == nil || upload.Initiated.After(cutoff) {
+				continue
+			}
+
+			_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(s.Bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				err = util.WrapAWSError("s3.AbortMultipartUpload", err)
+				util.AWSErrorFields(log.Warn(), err).Err(err).Str("bucket", s.Bucket).Str("key", aws.ToString(upload.Key)).Msg("Unable to abort stale multipart upload")
+				continue
+			}
+			aborted++
+		}
+
+		if !aws.ToBool(output.IsTruncated) {
+			return aborted, nil
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+}
+
+// startSweep runs sweepStaleUploads in the background until Close
+func (s *Storage) startSweep() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopSweep = cancel
+	s.sweepDone = make(chan struct{})
+
+	go func() {
+		defer close(s.sweepDone)
+		s.sweepStaleUploads(ctx, staleSweepInterval)
+	}()
+}
+
+// sweepStaleUploads runs AbortStaleUploads straight away and then every
+// interval until ctx is done
+func (s *Storage) sweepStaleUploads(ctx context.Context, interval time.Duration) {
+	olderThan := time.Duration(s.AbortStaleUploadsAfterHours) * time.Hour
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		aborted, err := s.AbortStaleUploads(ctx, olderThan)
+		if err != nil && ctx.Err() == nil {
+			util.AWSErrorFields(log.Error(), err).Err(err).Str("bucket", s.Bucket).Msg("Unable to sweep stale multipart uploads")
+		} else if err == nil {
+			log.Info().Str("bucket", s.Bucket).Int("aborted", aborted).Dur("older_than", olderThan).Msg("Swept stale multipart uploads")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,15 +2,21 @@ package s3
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/scratchdata/scratchdata/pkg/credentials"
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
 	"github.com/scratchdata/scratchdata/util"
 	"io"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/rs/zerolog/log"
 )
 
 type Storage struct {
@@ -20,42 +26,190 @@ type Storage struct {
 	Region          string `mapstructure:"region"`
 	Endpoint        string `mapstructure:"endpoint"`
 
+	// Prefix is prepended to every object key
+	Prefix string `mapstructure:"prefix"`
+
+	// MultipartPartSizeBytes, if set, uploads objects bigger than this in
+	// parts of this size, at least 5MiB, instead of a single PutObject.
+	// Multipart uploads don't send a Content-MD5 for the whole object. A
+	// failed multipart upload is aborted so no parts are left behind.
+	MultipartPartSizeBytes int64 `mapstructure:"multipart_part_size_bytes"`
+
+	// AbortStaleUploadsAfterHours, if set, aborts multipart uploads under
+	// Prefix which were started more than this many hours ago, at startup and
+	// hourly until Close, so parts orphaned by crashes don't build up storage
+	// costs. It needs a Prefix, so other uploads to the bucket are left alone.
+	AbortStaleUploadsAfterHours int `mapstructure:"abort_stale_uploads_after_hours"`
+
+	// MaxInflightUploads, if set, limits how many uploads run at once,
+	// however many callers are uploading, to stay within an S3 request
+	// budget. Callers wait for a slot before sending anything. A multipart
+	// upload takes one slot and sends its parts one at a time.
+	MaxInflightUploads int `mapstructure:"max_inflight_uploads"`
+
 	client     *s3.Client
 	downloader *manager.Downloader
+
+	// inflight holds a token for each upload in progress, when
+	// MaxInflightUploads is set
+	inflight chan struct{}
+
+	// stopSweep stops the stale upload sweep, and sweepDone is closed once
+	// it has stopped
+	stopSweep context.CancelFunc
+	sweepDone chan struct{}
+}
+
+// Close stops the stale upload sweep, if it's running, waiting for a sweep
+// in progress to finish
+func (s *Storage) Close() error {
+	if s.stopSweep != nil {
+		s.stopSweep()
+		<-s.sweepDone
+	}
+	return nil
+}
+
+// acquireUpload waits for an upload slot, if uploads are limited, and returns
+// the function releasing it
+func (s *Storage) acquireUpload(ctx context.Context) (func(), error) {
+	if s.inflight == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case s.inflight <- struct{}{}:
+		return func() { <-s.inflight }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// key returns the object key for path, including the configured prefix
+func (s *Storage) key(path string) string {
+	if s.Prefix == "" {
+		return path
+	}
+	return strings.TrimSuffix(s.Prefix, "/") + "/" + strings.TrimPrefix(path, "/")
 }
 
 func (s *Storage) Upload(path string, r io.ReadSeeker) error {
+	return s.UploadWithMetadata(path, r, nil)
+}
+
+// UploadWithMetadata uploads r, storing metadata as x-amz-meta-* user metadata
+func (s *Storage) UploadWithMetadata(path string, r io.ReadSeeker, metadata map[string]string) error {
+	return s.UploadContext(context.TODO(), path, r, metadata)
+}
+
+// UploadContext is UploadWithMetadata, cancelled when ctx is done
+func (s *Storage) UploadContext(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) error {
+	_, err := s.UploadInfo(ctx, path, r, metadata)
+	return err
+}
+
+// UploadInfo is UploadContext, also returning the object's ETag
+func (s *Storage) UploadInfo(ctx context.Context, path string, r io.ReadSeeker, metadata map[string]string) (models.ObjectInfo, error) {
+	release, err := s.acquireUpload(ctx)
+	if err != nil {
+		return models.ObjectInfo{}, err
+	}
+	defer release()
+
+	if s.MultipartPartSizeBytes > 0 {
+		n, err := size(r)
+		if err != nil {
+			return models.ObjectInfo{}, err
+		}
+		if n > s.MultipartPartSizeBytes {
+			return s.uploadMultipart(ctx, path, r, metadata)
+		}
+	}
+
+	// S3 rejects the upload if the body doesn't match the checksum
+	contentMD5, err := util.ContentMD5(r)
+	if err != nil {
+		return models.ObjectInfo{}, err
+	}
+
 	input := &s3.PutObjectInput{
 		Bucket:             aws.String(s.Bucket),
-		Key:                aws.String(path),
+		Key:                aws.String(s.key(path)),
 		Body:               r,
 		ContentDisposition: aws.String("attachment"),
+		ContentMD5:         aws.String(contentMD5),
+		Metadata:           metadata,
 	}
-	if _, err := s.client.PutObject(context.TODO(), input); err != nil {
-		return err
+	output, err := s.client.PutObject(ctx, input)
+	if err != nil {
+		err = util.WrapAWSError("s3.PutObject", err)
+		util.AWSErrorFields(log.Error(), err).Err(err).Str("bucket", s.Bucket).Str("key", s.key(path)).Msg("Upload failed")
+		return models.ObjectInfo{}, err
 	}
-	return nil
+	return models.ObjectInfo{ETag: aws.ToString(output.ETag)}, nil
 }
 
 func (s *Storage) Download(path string, w io.WriterAt) error {
 	_, err := s.downloader.Download(context.TODO(), w, &s3.GetObjectInput{
 		Bucket: aws.String(s.Bucket),
-		Key:    aws.String(path),
+		Key:    aws.String(s.key(path)),
 	})
 
 	if err != nil {
+		err = util.WrapAWSError("s3.GetObject", err)
+		util.AWSErrorFields(log.Error(), err).Err(err).Str("bucket", s.Bucket).Str("key", s.key(path)).Msg("Download failed")
 		return err
 	}
 
 	return nil
 }
 
+// Check confirms the bucket exists and can be written to by putting, then
+// deleting, a small temporary object
+func (s *Storage) Check(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.Bucket)})
+	if err != nil {
+		return fmt.Errorf("s3: cannot access bucket %s: %w", s.Bucket, err)
+	}
+
+	key := s.key(fmt.Sprintf(".preflight/%d", time.Now().UnixNano()))
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(""),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: cannot write to bucket %s: %w", s.Bucket, err)
+	}
+
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: cannot delete %s from bucket %s: %w", key, s.Bucket, err)
+	}
+
+	return nil
+}
+
 // NewStorage returns a new initialized Storage
 func NewStorage(c map[string]any) (*Storage, error) {
 
+	c, err := util.ByteSizeSettings(c, "multipart_part_size_bytes")
+	if err != nil {
+		return nil, err
+	}
+
 	q := util.ConfigToStruct[Storage](c)
+	if q.MultipartPartSizeBytes > 0 && q.MultipartPartSizeBytes < manager.MinUploadPartSize {
+		return nil, fmt.Errorf("s3: multipart_part_size_bytes must be at least %d", manager.MinUploadPartSize)
+	}
+	if q.AbortStaleUploadsAfterHours > 0 && strings.Trim(q.Prefix, "/") == "" {
+		return nil, errors.New("s3: abort_stale_uploads_after_hours needs a prefix, so it doesn't abort uploads to the whole bucket")
+	}
 
-	appCreds := aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(q.AccessKeyId, q.SecretAccessKey, ""))
+	appCreds := credentials.AWSCredentials(credentials.Parse(q.AccessKeyId), credentials.Parse(q.SecretAccessKey))
 
 	cfg, err := config.LoadDefaultConfig(context.TODO())
 	if err != nil {
@@ -71,5 +225,13 @@ func NewStorage(c map[string]any) (*Storage, error) {
 	q.client = client
 	q.downloader = manager.NewDownloader(q.client)
 
+	if q.MaxInflightUploads > 0 {
+		q.inflight = make(chan struct{}, q.MaxInflightUploads)
+	}
+
+	if q.AbortStaleUploadsAfterHours > 0 {
+		q.startSweep()
+	}
+
 	return q, nil
 }
@@ -0,0 +1,241 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeS3 serves the multipart listing and abort calls, and PutObject, for a
+// bucket named "bucket"
+type fakeS3 struct {
+	mu       sync.Mutex
+	uploads  map[string]time.Time // key -> initiated
+	prefixes []string
+	aborted  []string
+	lists    int
+
+	// put, if set, handles PutObject
+	put func(w http.ResponseWriter, r *http.Request)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// put may block, so it runs without the lock
+	if r.Method == http.MethodPut && f.put != nil {
+		f.put(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Has("uploads"):
+		f.lists++
+		prefix := r.URL.Query().Get("prefix")
+		f.prefixes = append(f.prefixes, prefix)
+
+		body := `<?xml version="1.0" encoding="UTF-8"?><ListMultipartUploadsResult><Bucket>bucket</Bucket><IsTruncated>false</IsTruncated>`
+		for key, initiated := range f.uploads {
+			if strings.HasPrefix(key, prefix) {
+				body += fmt.Sprintf(`<Upload><Key>%s</Key><UploadId>%s-id</UploadId><Initiated>%s</Initiated></Upload>`, key, key, initiated.UTC().Format(time.RFC3339))
+			}
+		}
+		body += `</ListMultipartUploadsResult>`
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(body))
+	case r.Method == http.MethodDelete && r.URL.Query().Get("uploadId") == key+"-id":
+		f.aborted = append(f.aborted, key)
+		delete(f.uploads, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// newTestStorage returns a Storage for bucket on a fake S3
+func newTestStorage(t *testing.T, fake *fakeS3, storage *Storage) *Storage {
+	t.Helper()
+
+	ts := httptest.NewServer(fake)
+	t.Cleanup(ts.Close)
+
+	storage.Bucket = "bucket"
+	storage.client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(ts.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	return storage
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	now := time.Now()
+	fake := &fakeS3{uploads: map[string]time.Time{
+		"ingest/data/old": now.Add(-48 * time.Hour),
+		"ingest/data/new": now,
+		"other/data/old":  now.Add(-48 * time.Hour),
+	}}
+	s := newTestStorage(t, fake, &Storage{Prefix: "ingest/"})
+
+	aborted, err := s.AbortStaleUploads(context.Background(), 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Cannot abort stale uploads: %s", err)
+	}
+	if aborted != 1 || len(fake.aborted) != 1 || fake.aborted[0] != "ingest/data/old" {
+		t.Fatalf("Expected only the old upload under the prefix to be aborted; Got %d, %v", aborted, fake.aborted)
+	}
+	if fake.prefixes[0] != "ingest/" {
+		t.Fatalf("Expected uploads to be listed under the prefix; Got %q", fake.prefixes[0])
+	}
+}
+
+func TestAbortStaleUploadsNeedsPrefix(t *testing.T) {
+	fake := &fakeS3{uploads: map[string]time.Time{"data/old": time.Now().Add(-48 * time.Hour)}}
+
+	for _, prefix := range []string{"", "/"} {
+		s := newTestStorage(t, fake, &Storage{Prefix: prefix})
+		if _, err := s.AbortStaleUploads(context.Background(), time.Hour); err == nil {
+			t.Fatalf("Expected an error without a prefix (%q)", prefix)
+		}
+	}
+	if fake.lists != 0 || len(fake.aborted) != 0 {
+		t.Fatalf("Expected the bucket to be left alone; Got %d lists, %v aborted", fake.lists, fake.aborted)
+	}
+
+	if _, err := NewStorage(map[string]any{"bucket": "bucket", "abort_stale_uploads_after_hours": 24}); err == nil {
+		t.Fatal("Expected abort_stale_uploads_after_hours to need a prefix")
+	}
+}
+
+func TestSweepStaleUploadsStops(t *testing.T) {
+	fake := &fakeS3{uploads: map[string]time.Time{}}
+	s := newTestStorage(t, fake, &Storage{Prefix: "ingest", AbortStaleUploadsAfterHours: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopSweep = cancel
+	s.sweepDone = make(chan struct{})
+	go func() {
+		defer close(s.sweepDone)
+		s.sweepStaleUploads(ctx, time.Millisecond)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fake.mu.Lock()
+		lists := fake.lists
+		fake.mu.Unlock()
+		if lists >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected repeated sweeps; Got %d", lists)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Cannot close: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Close to stop the sweep")
+	}
+
+	select {
+	case <-s.sweepDone:
+	default:
+		t.Fatal("Expected the sweep to have stopped once Close returns")
+	}
+}
+
+// failingSeeker is a body which can't be read
+type failingSeeker struct{}
+
+func (failingSeeker) Read([]byte) (int, error)       { return 0, errors.New("read failed") }
+func (failingSeeker) Seek(int64, int) (int64, error) { return 0, errors.New("seek failed") }
+
+func TestMaxInflightUploads(t *testing.T) {
+	started := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	var puts int
+	var putsMu sync.Mutex
+
+	fake := &fakeS3{put: func(w http.ResponseWriter, r *http.Request) {
+		putsMu.Lock()
+		puts++
+		first := puts == 1
+		putsMu.Unlock()
+		started <- struct{}{}
+
+		if first {
+			<-unblock
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<Error><Code>AccessDenied</Code><Message>denied</Message></Error>`))
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+	}}
+	s := newTestStorage(t, fake, &Storage{MaxInflightUploads: 1})
+	s.inflight = make(chan struct{}, s.MaxInflightUploads)
+
+	failed := make(chan error)
+	go func() {
+		_, err := s.UploadInfo(context.Background(), "first", strings.NewReader("data"), nil)
+		failed <- err
+	}()
+	<-started
+
+	// The only slot is taken, so the next upload waits until its ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.UploadInfo(ctx, "second", strings.NewReader("data"), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the upload to wait for a slot; Got %v", err)
+	}
+	putsMu.Lock()
+	if puts != 1 {
+		t.Fatalf("Expected one upload in flight; Got %d", puts)
+	}
+	putsMu.Unlock()
+
+	// A failed upload releases its slot
+	close(unblock)
+	if err := <-failed; err == nil {
+		t.Fatal("Expected the first upload to fail")
+	}
+	if len(s.inflight) != 0 {
+		t.Fatalf("Expected a failed upload to release its slot; Got %d held", len(s.inflight))
+	}
+
+	// As does one which fails before it's sent
+	if _, err := s.UploadInfo(context.Background(), "unreadable", failingSeeker{}, nil); err == nil {
+		t.Fatal("Expected an unreadable body to fail")
+	}
+	if len(s.inflight) != 0 {
+		t.Fatalf("Expected an unsent upload to release its slot; Got %d held", len(s.inflight))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	info, err := s.UploadInfo(ctx, "third", strings.NewReader("data"), nil)
+	if err != nil {
+		t.Fatalf("Expected a released slot to be reused; Got %s", err)
+	}
+	if info.ETag != `"etag"` {
+		t.Fatalf("Expected the uploaded ETag; Got %q", info.ETag)
+	}
+}
@@ -0,0 +1,36 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+// ObjectTags returns the object's tags, or models.ErrNotFound if there's no
+// such object. Each call is a GetObjectTagging request, billed like a GET, so
+// callers looking up the same object often should cache the result.
+func (s *Storage) ObjectTags(ctx context.Context, path string) (map[string]string, error) {
+	output, err := s.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(path)),
+	})
+	if err != nil {
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound {
+			return nil, models.ErrNotFound
+		}
+		return nil, util.WrapAWSError("s3.GetObjectTagging", err)
+	}
+
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
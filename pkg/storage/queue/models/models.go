@@ -1,7 +1,58 @@
 package models
 
+import "errors"
+
+// ErrMessageTooLarge is returned when a message is over the queue's size
+// limit, even after dropping optional fields
+var ErrMessageTooLarge = errors.New("queue message too large")
+
 type FileUploadMessage struct {
 	DatabaseID int64  `json:"database_id"`
 	Table      string `json:"table"`
 	Key        string `json:"key"`
+
+	// Location is where the blob store says the file ended up, such as the
+	// URL it was delivered to, when it reports one
+	Location string `json:"location,omitempty"`
+
+	// Trace is the trace context, such as a W3C traceparent and baggage, the
+	// file's first traced write had; later writes' traces aren't kept. The
+	// workers only log it with the insert; other consumers may use it to
+	// continue the trace.
+	Trace map[string]string `json:"trace,omitempty"`
+
+	// Format is the ClickHouse input format of the file, such as JSONEachRow.
+	// When empty it's inferred from the key's extension.
+	Format string `json:"format,omitempty"`
+
+	// Rows is the number of records in the file, before any conversion to
+	// Format
+	Rows int64 `json:"rows,omitempty"`
+
+	// Tags are the file's tags other than database_id and table: the data
+	// sink's tags merged with the table's, the table's taking precedence
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Checksum is the hex-encoded SHA-256 of the uploaded file
+	Checksum string `json:"checksum,omitempty"`
+
+	// Destinations names each blob store the file was uploaded to, when
+	// uploading to more than one
+	Destinations []string `json:"destinations,omitempty"`
+
+	// Compression is the algorithm the file was compressed with, if any, and
+	// CompressionDictionaryID the id of the zstd dictionary used
+	Compression             string `json:"compression,omitempty"`
+	CompressionDictionaryID uint32 `json:"compression_dictionary_id,omitempty"`
+}
+
+// Message is a message received from a queue which supports acknowledgement
+type Message struct {
+	Body []byte
+
+	// Handle identifies this delivery of the message to the queue
+	Handle string
+
+	// ReceiveCount is the number of times the message has been delivered
+	ReceiveCount int
 }
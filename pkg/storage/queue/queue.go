@@ -1,8 +1,12 @@
 package queue
 
 import (
+	"context"
+	"time"
+
 	"github.com/scratchdata/scratchdata/config"
 	"github.com/scratchdata/scratchdata/pkg/storage/queue/memory"
+	"github.com/scratchdata/scratchdata/pkg/storage/queue/models"
 	"github.com/scratchdata/scratchdata/pkg/storage/queue/sqs"
 )
 
@@ -11,6 +15,41 @@ type Queue interface {
 	Dequeue() ([]byte, bool)
 }
 
+// AckQueue is implemented by queues where received messages stay invisible
+// while being processed, and are only removed once acknowledged
+type AckQueue interface {
+	Receive() (models.Message, bool)
+
+	// Ack removes a successfully processed message from the queue
+	Ack(msg models.Message) error
+
+	// Nack returns a failed message to the queue or dead-letters it,
+	// depending on configuration
+	Nack(msg models.Message) error
+
+	// ExtendVisibility keeps a message hidden from other consumers for
+	// another VisibilityTimeout
+	ExtendVisibility(msg models.Message) error
+	VisibilityTimeout() time.Duration
+}
+
+// ContextEnqueuer is implemented by queues whose sends can be cancelled
+type ContextEnqueuer interface {
+	EnqueueContext(ctx context.Context, value []byte) error
+}
+
+// EnqueueContext enqueues value, cancelling the send when ctx is done if q
+// supports it. Other queues only check ctx before sending.
+func EnqueueContext(ctx context.Context, q Queue, value []byte) error {
+	if e, ok := q.(ContextEnqueuer); ok {
+		return e.EnqueueContext(ctx, value)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return q.Enqueue(value)
+}
+
 func NewQueue(conf config.Queue) (Queue, error) {
 	switch conf.Type {
 	case "memory":
@@ -2,13 +2,23 @@ package sqs
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 
+	"github.com/scratchdata/scratchdata/pkg/credentials"
+	"github.com/scratchdata/scratchdata/pkg/storage/queue/models"
 	"github.com/scratchdata/scratchdata/util"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/rs/zerolog/log"
 )
@@ -20,23 +30,216 @@ type Queue struct {
 	SecretAccessKey string `mapstructure:"secret_access_key"`
 	Region          string `mapstructure:"region"`
 
+	// MessageAttributes lists fields of the message body which are also
+	// sent as SQS message attributes, so consumers can filter on them
+	MessageAttributes []string `mapstructure:"message_attributes"`
+
+	// MessageGroupField and DeduplicationField name the message body fields
+	// used as MessageGroupId and MessageDeduplicationId for FIFO queues.
+	// They're ignored for standard queues, which reject both.
+	MessageGroupField  string `mapstructure:"message_group_field"`
+	DeduplicationField string `mapstructure:"deduplication_field"`
+
+	// VisibilityTimeoutSeconds is how long a received message stays hidden
+	// from other consumers. Zero uses the queue's default.
+	VisibilityTimeoutSeconds int32 `mapstructure:"visibility_timeout_seconds"`
+
+	// OnFailure is "retry" (default) to return failed messages to the queue
+	// or "dead_letter" to send them to DeadLetterURL once they have been
+	// received MaxReceiveCount times
+	OnFailure       string `mapstructure:"on_failure"`
+	MaxReceiveCount int    `mapstructure:"max_receive_count"`
+	DeadLetterURL   string `mapstructure:"dead_letter_url"`
+
+	// Routes sends messages to a different queue depending on the value of
+	// RouteField in the message, e.g. table => queue url. Messages which
+	// don't match a route go to URL. Only URL is consumed by Dequeue and
+	// Receive; routed queues are for other consumers.
+	RouteField string            `mapstructure:"route_field"`
+	Routes     map[string]string `mapstructure:"routes"`
+
+	// MaxMessageBytes is the largest message, body plus attributes, which
+	// will be sent. Defaults to SQS's limit of 256 KiB. Larger messages have
+	// OptionalFields removed from the body, in order, until they fit, or
+	// fail with models.ErrMessageTooLarge.
+	MaxMessageBytes int      `mapstructure:"max_message_bytes"`
+	OptionalFields  []string `mapstructure:"optional_fields"`
+
 	client *sqs.Client
 }
 
+const (
+	OnFailureRetry      = "retry"
+	OnFailureDeadLetter = "dead_letter"
+)
+
+// defaultVisibilityTimeout is SQS's own default, used to schedule visibility
+// extensions when none is configured
+const defaultVisibilityTimeout = 30 * time.Second
+
+// defaultMessageGroupField is used to group messages on FIFO queues when
+// message_group_field is not configured, so ordering is guaranteed per table
+const defaultMessageGroupField = "table"
+
+// defaultRouteField is used to pick a queue from Routes when route_field is not configured
+const defaultRouteField = "table"
+
+// defaultMaxMessageBytes is the largest message SQS accepts
+const defaultMaxMessageBytes = 256 * 1024
+
+// defaultMessageGroupID is used when a FIFO message has no value for the group field
+const defaultMessageGroupID = "default"
+
+// fileID returns the file identifier from an upload's blob key:
+// data/1/events/1234.ndjson => 1234
+func fileID(key string) string {
+	base := path.Base(key)
+	if i := strings.Index(base, "."); i > 0 {
+		base = base[:i]
+	}
+	return base
+}
+
+// messageAttributes builds the SQS attributes for the configured message fields.
+// Fields which are not present in the message are skipped.
+func (q *Queue) messageAttributes(parsed gjson.Result) map[string]types.MessageAttributeValue {
+	if len(q.MessageAttributes) == 0 {
+		return nil
+	}
+
+	rc := map[string]types.MessageAttributeValue{}
+	for _, field := range q.MessageAttributes {
+		value := parsed.Get(field)
+		if !value.Exists() || value.String() == "" {
+			continue
+		}
+
+		dataType := "String"
+		if value.Type == gjson.Number {
+			dataType = "Number"
+		}
+
+		rc[field] = types.MessageAttributeValue{
+			DataType:    aws.String(dataType),
+			StringValue: aws.String(value.String()),
+		}
+	}
+	return rc
+}
+
+// messageSize approximates how SQS counts a message against its size limit:
+// the body plus each attribute's name, type and value
+func messageSize(body string, attributes map[string]types.MessageAttributeValue) int {
+	rc := len(body)
+	for name, value := range attributes {
+		rc += len(name) + len(aws.ToString(value.DataType)) + len(aws.ToString(value.StringValue))
+	}
+	return rc
+}
+
+// fitMessage drops OptionalFields from msg until it's under MaxMessageBytes
+func (q *Queue) fitMessage(msg string, attributes map[string]types.MessageAttributeValue) (string, error) {
+	size := messageSize(msg, attributes)
+	for _, field := range q.OptionalFields {
+		if size <= q.MaxMessageBytes {
+			break
+		}
+
+		trimmed, err := sjson.Delete(msg, field)
+		if err != nil {
+			return "", err
+		}
+		if trimmed != msg {
+			log.Warn().Str("field", field).Int("size", size).Int("max_message_bytes", q.MaxMessageBytes).Msg("Dropped field from oversized queue message")
+		}
+		msg = trimmed
+		size = messageSize(msg, attributes)
+	}
+
+	if size > q.MaxMessageBytes {
+		return "", fmt.Errorf("sqs: %w: %d bytes, limit is %d", models.ErrMessageTooLarge, size, q.MaxMessageBytes)
+	}
+	return msg, nil
+}
+
+// queueURL returns the queue a message should be sent to
+func (q *Queue) queueURL(parsed gjson.Result) string {
+	if len(q.Routes) == 0 {
+		return q.URL
+	}
+
+	if url, ok := q.Routes[parsed.Get(q.RouteField).String()]; ok {
+		return url
+	}
+	return q.URL
+}
+
 // Enqueue implements queue.QueueBackend.Enqueue
 func (q *Queue) Enqueue(message []byte) error {
+	return q.EnqueueContext(context.TODO(), message)
+}
+
+// EnqueueContext implements queue.ContextEnqueuer.EnqueueContext
+func (q *Queue) EnqueueContext(ctx context.Context, message []byte) error {
 	msg := string(message)
-	_, err := q.client.SendMessage(context.TODO(), &sqs.SendMessageInput{
-		QueueUrl:    aws.String(q.URL),
-		MessageBody: aws.String(msg),
-	})
-	log.Trace().Str("sqs_url", q.URL).Err(err).Str("message", msg).Msg("Enqueue")
+	parsed := gjson.Parse(msg)
+
+	url := q.queueURL(parsed)
+	attributes := q.messageAttributes(parsed)
+
+	body, err := q.fitMessage(msg, attributes)
+	if err != nil {
+		log.Error().Err(err).Str("sqs_url", url).Str("message", msg).Msg("Enqueue failed")
+		return err
+	}
+
+	input := q.sendInput(url, body, attributes, parsed)
+	_, err = q.client.SendMessage(ctx, input)
+	log.Trace().Str("sqs_url", url).Err(err).Str("message", body).Msg("Enqueue")
 	if err != nil {
+		err = util.WrapAWSError("sqs.SendMessage", err)
+		util.AWSErrorFields(log.Error(), err).Err(err).Str("sqs_url", url).Msg("Enqueue failed")
 		return err
 	}
 	return nil
 }
 
+// sendInput returns the request sending body to url. Standard queues reject
+// group and deduplication ids, so they're only set for FIFO queues: from
+// MessageGroupField and DeduplicationField when the message has them, else a
+// default group and the uploaded file's id, so re-sending the same file is
+// idempotent.
+func (q *Queue) sendInput(url, body string, attributes map[string]types.MessageAttributeValue, parsed gjson.Result) *sqs.SendMessageInput {
+	input := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(url),
+		MessageBody:       aws.String(body),
+		MessageAttributes: attributes,
+	}
+	if !strings.HasSuffix(url, ".fifo") {
+		return input
+	}
+
+	groupField := q.MessageGroupField
+	if groupField == "" {
+		groupField = defaultMessageGroupField
+	}
+	input.MessageGroupId = aws.String(defaultMessageGroupID)
+	if groupID := parsed.Get(groupField).String(); groupID != "" {
+		input.MessageGroupId = aws.String(groupID)
+	}
+
+	if q.DeduplicationField != "" {
+		if dedupID := parsed.Get(q.DeduplicationField).String(); dedupID != "" {
+			input.MessageDeduplicationId = aws.String(dedupID)
+			return input
+		}
+	}
+	if key := parsed.Get("key").String(); key != "" {
+		input.MessageDeduplicationId = aws.String(fileID(key))
+	}
+	return input
+}
+
 // receive fetches a message from SQS
 //
 // If no valid message is received, error queue.ErrEmpyQueue is returned
@@ -80,11 +283,133 @@ func (q *Queue) Dequeue() ([]byte, bool) {
 	return []byte(*msg.Body), true
 }
 
+// Receive implements queue.AckQueue.Receive. The message stays on the queue
+// until it is acknowledged.
+func (q *Queue) Receive() (models.Message, bool) {
+	res, err := q.client.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.URL),
+		MaxNumberOfMessages: 1,
+		VisibilityTimeout:   q.VisibilityTimeoutSeconds,
+		AttributeNames:      []types.QueueAttributeName{types.QueueAttributeName(types.MessageSystemAttributeNameApproximateReceiveCount)},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to poll SQS")
+		return models.Message{}, false
+	}
+
+	for _, msg := range res.Messages {
+		if msg.Body == nil || msg.ReceiptHandle == nil {
+			continue
+		}
+
+		receiveCount, _ := strconv.Atoi(msg.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+		return models.Message{
+			Body:         []byte(*msg.Body),
+			Handle:       *msg.ReceiptHandle,
+			ReceiveCount: receiveCount,
+		}, true
+	}
+
+	return models.Message{}, false
+}
+
+// Ack implements queue.AckQueue.Ack
+func (q *Queue) Ack(msg models.Message) error {
+	return q.delete(aws.String(msg.Handle))
+}
+
+// Nack implements queue.AckQueue.Nack. Dead-lettered messages get the same
+// attributes and, for a FIFO dead-letter queue, group and deduplication ids
+// as when they were enqueued.
+func (q *Queue) Nack(msg models.Message) error {
+	if q.OnFailure == OnFailureDeadLetter && msg.ReceiveCount >= q.MaxReceiveCount {
+		parsed := gjson.ParseBytes(msg.Body)
+		input := q.sendInput(q.DeadLetterURL, string(msg.Body), q.messageAttributes(parsed), parsed)
+		_, err := q.client.SendMessage(context.TODO(), input)
+		if err != nil {
+			return util.WrapAWSError("sqs.SendMessage", err)
+		}
+
+		log.Warn().Str("sqs_url", q.DeadLetterURL).Int("receive_count", msg.ReceiveCount).Str("message", string(msg.Body)).Msg("Dead-lettered message")
+		return q.delete(aws.String(msg.Handle))
+	}
+
+	// Make the message visible again immediately so it is retried
+	_, err := q.client.ChangeMessageVisibility(context.TODO(), &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.URL),
+		ReceiptHandle:     aws.String(msg.Handle),
+		VisibilityTimeout: 0,
+	})
+	return err
+}
+
+// ExtendVisibility implements queue.AckQueue.ExtendVisibility
+func (q *Queue) ExtendVisibility(msg models.Message) error {
+	_, err := q.client.ChangeMessageVisibility(context.TODO(), &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.URL),
+		ReceiptHandle:     aws.String(msg.Handle),
+		VisibilityTimeout: int32(q.VisibilityTimeout().Seconds()),
+	})
+	return err
+}
+
+// VisibilityTimeout implements queue.AckQueue.VisibilityTimeout
+func (q *Queue) VisibilityTimeout() time.Duration {
+	if q.VisibilityTimeoutSeconds > 0 {
+		return time.Duration(q.VisibilityTimeoutSeconds) * time.Second
+	}
+	return defaultVisibilityTimeout
+}
+
+// Check confirms the queue exists and its attributes can be read, without
+// sending or receiving anything
+func (q *Queue) Check(ctx context.Context) error {
+	urls := []string{q.URL}
+	if q.DeadLetterURL != "" {
+		urls = append(urls, q.DeadLetterURL)
+	}
+	for _, url := range q.Routes {
+		urls = append(urls, url)
+	}
+
+	for _, url := range urls {
+		_, err := q.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(url),
+			AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn},
+		})
+		if err != nil {
+			return fmt.Errorf("sqs: cannot access queue %s: %w", url, err)
+		}
+	}
+
+	return nil
+}
+
 // NewQueue returns a new initialized Queue
 func NewQueue(c map[string]any) (*Queue, error) {
+	c, err := util.ByteSizeSettings(c, "max_message_bytes")
+	if err != nil {
+		return nil, err
+	}
+
 	q := util.ConfigToStruct[Queue](c)
 
-	appCreds := aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(q.AccessKeyId, q.SecretAccessKey, ""))
+	switch q.OnFailure {
+	case "":
+		q.OnFailure = OnFailureRetry
+	case OnFailureRetry:
+	case OnFailureDeadLetter:
+		if q.DeadLetterURL == "" {
+			return nil, errors.New("sqs: dead_letter_url is required when on_failure is dead_letter")
+		}
+		if q.MaxReceiveCount <= 0 {
+			q.MaxReceiveCount = 1
+		}
+	default:
+		return nil, errors.New("sqs: on_failure must be retry or dead_letter")
+	}
+
+	appCreds := credentials.AWSCredentials(credentials.Parse(q.AccessKeyId), credentials.Parse(q.SecretAccessKey))
 	//value, err := appCreds.Retrieve(context.TODO())
 	//if err != nil {
 	//	return nil, err
@@ -102,5 +427,13 @@ func NewQueue(c map[string]any) (*Queue, error) {
 
 	q.client = client
 
+	if q.RouteField == "" {
+		q.RouteField = defaultRouteField
+	}
+
+	if q.MaxMessageBytes <= 0 {
+		q.MaxMessageBytes = defaultMaxMessageBytes
+	}
+
 	return q, nil
 }
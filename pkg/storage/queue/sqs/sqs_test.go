@@ -0,0 +1,232 @@
+package sqs
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/tidwall/gjson"
+
+	"github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+)
+
+func TestMessageSize(t *testing.T) {
+	attributes := map[string]types.MessageAttributeValue{
+		"table": {DataType: aws.String("String"), StringValue: aws.String("events")},
+		"rows":  {DataType: aws.String("Number"), StringValue: aws.String("10")},
+	}
+
+	// The body, then each attribute's name, type and value
+	exp := len(`{"a":1}`) + len("table") + len("String") + len("events") + len("rows") + len("Number") + len("10")
+	if size := messageSize(`{"a":1}`, attributes); size != exp {
+		t.Fatalf("Expected %d; Got %d", exp, size)
+	}
+	if size := messageSize(`{"a":1}`, nil); size != 7 {
+		t.Fatalf("Expected just the body without attributes; Got %d", size)
+	}
+}
+
+func TestFitMessage(t *testing.T) {
+	msg := `{"key":"data/1/events/1.ndjson","tags":{"team":"growth"},"trace":{"traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}`
+
+	tests := []struct {
+		name     string
+		max      int
+		optional []string
+		exp      string
+		err      bool
+	}{
+		{name: "fits", max: len(msg), optional: []string{"trace"}, exp: msg},
+		{name: "drops in order", max: len(msg) - 1, optional: []string{"trace", "tags"}, exp: `{"key":"data/1/events/1.ndjson","tags":{"team":"growth"}}`},
+		{name: "drops more", max: 40, optional: []string{"trace", "missing", "tags"}, exp: `{"key":"data/1/events/1.ndjson"}`},
+		{name: "too large", max: 20, optional: []string{"trace", "tags"}, err: true},
+		{name: "nothing optional", max: 40, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := &Queue{MaxMessageBytes: test.max, OptionalFields: test.optional}
+			body, err := q.fitMessage(msg, nil)
+			if test.err {
+				if !errors.Is(err, models.ErrMessageTooLarge) {
+					t.Fatalf("Expected ErrMessageTooLarge; Got %q, %v", body, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Cannot fit message: %s", err)
+			}
+			if body != test.exp {
+				t.Fatalf("Expected %s; Got %s", test.exp, body)
+			}
+			if !gjson.Valid(body) {
+				t.Fatalf("Expected valid JSON; Got %s", body)
+			}
+		})
+	}
+}
+
+func TestFitMessageCountsAttributes(t *testing.T) {
+	attributes := map[string]types.MessageAttributeValue{
+		"table": {DataType: aws.String("String"), StringValue: aws.String("events")},
+	}
+	msg := `{"key":"k","tags":{"team":"growth"}}`
+
+	// The body alone fits, but not with its attributes
+	q := &Queue{MaxMessageBytes: len(msg), OptionalFields: []string{"tags"}}
+	body, err := q.fitMessage(msg, attributes)
+	if err != nil {
+		t.Fatalf("Cannot fit message: %s", err)
+	}
+	if body != `{"key":"k"}` {
+		t.Fatalf("Expected tags to be dropped to make room for attributes; Got %s", body)
+	}
+}
+
+func TestSendInput(t *testing.T) {
+	msg := gjson.Parse(`{"key":"data/1/events/1234.ndjson","table":"events","batch":"b1"}`)
+
+	tests := []struct {
+		name  string
+		queue Queue
+		url   string
+		group string
+		dedup string
+	}{
+		{name: "standard", url: "https://sqs/q"},
+		{name: "standard ignores fields", queue: Queue{MessageGroupField: "table", DeduplicationField: "batch"}, url: "https://sqs/q"},
+		{name: "fifo defaults", url: "https://sqs/q.fifo", group: "events", dedup: "1234"},
+		{name: "fifo fields", queue: Queue{MessageGroupField: "batch", DeduplicationField: "batch"}, url: "https://sqs/q.fifo", group: "b1", dedup: "b1"},
+		{name: "fifo missing fields", queue: Queue{MessageGroupField: "team", DeduplicationField: "team"}, url: "https://sqs/q.fifo", group: defaultMessageGroupID, dedup: "1234"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := test.queue.sendInput(test.url, msg.Raw, nil, msg)
+			if aws.ToString(input.QueueUrl) != test.url || aws.ToString(input.MessageBody) != msg.Raw {
+				t.Fatalf("Unexpected input %+v", input)
+			}
+			if (input.MessageGroupId == nil) != (test.group == "") || aws.ToString(input.MessageGroupId) != test.group {
+				t.Fatalf("Expected group id %q; Got %v", test.group, input.MessageGroupId)
+			}
+			if (input.MessageDeduplicationId == nil) != (test.dedup == "") || aws.ToString(input.MessageDeduplicationId) != test.dedup {
+				t.Fatalf("Expected deduplication id %q; Got %v", test.dedup, input.MessageDeduplicationId)
+			}
+		})
+	}
+}
+
+// sqsRequest is a call made to fakeSQS
+type sqsRequest struct {
+	action string
+	input  map[string]any
+}
+
+// fakeSQS records the calls made to it and answers each with an empty result
+type fakeSQS struct {
+	mu       sync.Mutex
+	requests []sqsRequest
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	input := map[string]any{}
+	json.NewDecoder(r.Body).Decode(&input)
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS.")
+	f.requests = append(f.requests, sqsRequest{action: action, input: input})
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.Write([]byte(`{}`))
+}
+
+// newTestQueue returns q using a fake SQS
+func newTestQueue(t *testing.T, fake *fakeSQS, q *Queue) *Queue {
+	t.Helper()
+
+	ts := httptest.NewServer(fake)
+	t.Cleanup(ts.Close)
+
+	q.client = sqs.New(sqs.Options{
+		Region:                           "us-east-1",
+		BaseEndpoint:                     aws.String(ts.URL),
+		Credentials:                      aws.AnonymousCredentials{},
+		DisableMessageChecksumValidation: true,
+	})
+	return q
+}
+
+func TestAck(t *testing.T) {
+	fake := &fakeSQS{}
+	q := newTestQueue(t, fake, &Queue{URL: "https://sqs/q", VisibilityTimeoutSeconds: 60})
+	msg := models.Message{Body: []byte(`{"key":"data/1/events/1.ndjson"}`), Handle: "handle"}
+
+	if err := q.Ack(msg); err != nil {
+		t.Fatalf("Cannot ack: %s", err)
+	}
+	if err := q.ExtendVisibility(msg); err != nil {
+		t.Fatalf("Cannot extend visibility: %s", err)
+	}
+	if err := q.Nack(msg); err != nil {
+		t.Fatalf("Cannot nack: %s", err)
+	}
+
+	exp := []sqsRequest{
+		{action: "DeleteMessage", input: map[string]any{"QueueUrl": "https://sqs/q", "ReceiptHandle": "handle"}},
+		{action: "ChangeMessageVisibility", input: map[string]any{"QueueUrl": "https://sqs/q", "ReceiptHandle": "handle", "VisibilityTimeout": float64(60)}},
+		{action: "ChangeMessageVisibility", input: map[string]any{"QueueUrl": "https://sqs/q", "ReceiptHandle": "handle", "VisibilityTimeout": float64(0)}},
+	}
+	if !reflect.DeepEqual(fake.requests, exp) {
+		t.Fatalf("Expected %+v; Got %+v", exp, fake.requests)
+	}
+}
+
+func TestNackDeadLetter(t *testing.T) {
+	fake := &fakeSQS{}
+	q := newTestQueue(t, fake, &Queue{
+		URL:               "https://sqs/q.fifo",
+		OnFailure:         OnFailureDeadLetter,
+		MaxReceiveCount:   3,
+		DeadLetterURL:     "https://sqs/dlq.fifo",
+		MessageAttributes: []string{"table"},
+	})
+	msg := models.Message{Body: []byte(`{"key":"data/1/events/1234.ndjson","table":"events"}`), Handle: "handle"}
+
+	msg.ReceiveCount = 2
+	if err := q.Nack(msg); err != nil {
+		t.Fatalf("Cannot nack: %s", err)
+	}
+	if len(fake.requests) != 1 || fake.requests[0].action != "ChangeMessageVisibility" {
+		t.Fatalf("Expected the message to be retried before max_receive_count; Got %+v", fake.requests)
+	}
+
+	fake.requests = nil
+	msg.ReceiveCount = 3
+	if err := q.Nack(msg); err != nil {
+		t.Fatalf("Cannot nack: %s", err)
+	}
+	if len(fake.requests) != 2 || fake.requests[0].action != "SendMessage" || fake.requests[1].action != "DeleteMessage" {
+		t.Fatalf("Expected the message to be dead-lettered and deleted; Got %+v", fake.requests)
+	}
+
+	// A FIFO dead-letter queue rejects messages without a group id
+	send := fake.requests[0].input
+	if send["QueueUrl"] != "https://sqs/dlq.fifo" || send["MessageBody"] != string(msg.Body) {
+		t.Fatalf("Unexpected dead-letter message %v", send)
+	}
+	if send["MessageGroupId"] != "events" || send["MessageDeduplicationId"] != "1234" {
+		t.Fatalf("Expected group and deduplication ids; Got %v", send)
+	}
+	if _, ok := send["MessageAttributes"].(map[string]any)["table"]; !ok {
+		t.Fatalf("Expected the message's attributes; Got %v", send)
+	}
+}
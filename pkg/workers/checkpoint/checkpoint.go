@@ -0,0 +1,133 @@
+package checkpoint
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/scratchdata/scratchdata/config"
+)
+
+// Store records which uploaded files have been inserted into their
+// destination, so redelivered queue messages aren't inserted twice
+type Store interface {
+	// Done reports whether key has already been inserted
+	Done(key string) (bool, error)
+
+	// MarkDone records that key has been inserted
+	MarkDone(key string) error
+}
+
+// DefaultFileName is the checkpoint file used in the workers' data directory
+// when no path is configured
+const DefaultFileName = "checkpoints.log"
+
+// NewStore returns the checkpoint store described by conf. The default is a
+// file in dataDirectory; "none" disables checkpointing.
+func NewStore(conf config.Checkpoint, dataDirectory string) (Store, error) {
+	switch conf.Type {
+	case "", "file":
+		path, _ := conf.Settings["path"].(string)
+		if path == "" {
+			path = filepath.Join(dataDirectory, DefaultFileName)
+		}
+		return NewFileStore(path)
+	case "memory":
+		return NewMemoryStore(), nil
+	case "none":
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("unsupported checkpoint store %q", conf.Type)
+}
+
+// MemoryStore keeps checkpoints in memory, so they only guard against
+// redeliveries while the process is running
+type MemoryStore struct {
+	mu   sync.Mutex
+	done map[string]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{done: map[string]bool{}}
+}
+
+// Done implements Store.Done
+func (s *MemoryStore) Done(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done[key], nil
+}
+
+// MarkDone implements Store.MarkDone
+func (s *MemoryStore) MarkDone(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done[key] = true
+	return nil
+}
+
+// FileStore appends each inserted key to a local file, which is read back on
+// startup, so checkpoints survive restarts. The file grows by one line per
+// inserted file and isn't compacted.
+type FileStore struct {
+	MemoryStore
+	fd *os.File
+}
+
+// NewFileStore opens the checkpoint file at path, creating it if needed
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{MemoryStore: MemoryStore{done: map[string]bool{}}}
+
+	fd, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(fd)
+		for scanner.Scan() {
+			if key := scanner.Text(); key != "" {
+				s.done[key] = true
+			}
+		}
+		fd.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.fd, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// MarkDone implements Store.MarkDone. The key is synced to disk before
+// returning.
+func (s *FileStore) MarkDone(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done[key] {
+		return nil
+	}
+
+	if _, err := fmt.Fprintln(s.fd, key); err != nil {
+		return err
+	}
+	if err := s.fd.Sync(); err != nil {
+		return err
+	}
+
+	s.done[key] = true
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	return s.fd.Close()
+}
@@ -0,0 +1,32 @@
+package checkpoint
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultFileName)
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("Cannot open store: %s", err)
+	}
+	if err := s.MarkDone("data/1/events/1.ndjson"); err != nil {
+		t.Fatalf("Cannot mark done: %s", err)
+	}
+	s.Close()
+
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("Cannot reopen store: %s", err)
+	}
+	defer s.Close()
+
+	if done, _ := s.Done("data/1/events/1.ndjson"); !done {
+		t.Fatal("Expected checkpoint to survive reopening")
+	}
+	if done, _ := s.Done("data/1/events/2.ndjson"); done {
+		t.Fatal("Expected other keys not to be done")
+	}
+}
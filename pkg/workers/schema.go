@@ -0,0 +1,88 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scratchdata/scratchdata/config"
+	"github.com/scratchdata/scratchdata/pkg/storage/blobstore"
+	blobmodels "github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
+	models2 "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+)
+
+const (
+	DefaultSchemaVersionTag         = "schema_version"
+	DefaultSchemaVersionTableFormat = "{table}_{version}"
+)
+
+// schemaVersions looks up and caches each dataset's schema version
+type schemaVersions struct {
+	conf  config.SchemaVersion
+	store blobstore.BlobStore
+
+	mu       sync.Mutex
+	versions map[string]cachedVersion
+
+	now func() time.Time
+}
+
+type cachedVersion struct {
+	version string
+	expires time.Time
+}
+
+func newSchemaVersions(conf config.SchemaVersion, store blobstore.BlobStore) *schemaVersions {
+	if conf.Tag == "" {
+		conf.Tag = DefaultSchemaVersionTag
+	}
+	if conf.TableFormat == "" {
+		conf.TableFormat = DefaultSchemaVersionTableFormat
+	}
+	return &schemaVersions{conf: conf, store: store, versions: map[string]cachedVersion{}, now: time.Now}
+}
+
+// targetTable returns the table to insert message's file into: its table
+// named for the dataset's schema version, or just its table if the dataset
+// has no version
+func (s *schemaVersions) targetTable(ctx context.Context, message models2.FileUploadMessage) (string, error) {
+	if s == nil || s.conf.ObjectKey == "" {
+		return message.Table, nil
+	}
+
+	version, err := s.version(ctx, message.DatabaseID, message.Table)
+	if err != nil || version == "" {
+		return message.Table, err
+	}
+
+	return strings.NewReplacer("{table}", message.Table, "{version}", version).Replace(s.conf.TableFormat), nil
+}
+
+// version returns the dataset's schema version, or "" if its schema
+// definition object or tag doesn't exist
+func (s *schemaVersions) version(ctx context.Context, databaseID int64, table string) (string, error) {
+	key := strings.NewReplacer("{database_id}", strconv.FormatInt(databaseID, 10), "{table}", table).Replace(s.conf.ObjectKey)
+
+	s.mu.Lock()
+	cached, ok := s.versions[key]
+	s.mu.Unlock()
+	if ok && s.now().Before(cached.expires) {
+		return cached.version, nil
+	}
+
+	tags, err := blobstore.ObjectTags(ctx, s.store, key)
+	if err != nil && !errors.Is(err, blobmodels.ErrNotFound) {
+		return "", err
+	}
+	version := tags[s.conf.Tag]
+
+	if s.conf.CacheSeconds > 0 {
+		s.mu.Lock()
+		s.versions[key] = cachedVersion{version: version, expires: s.now().Add(time.Duration(s.conf.CacheSeconds) * time.Second)}
+		s.mu.Unlock()
+	}
+	return version, nil
+}
@@ -0,0 +1,130 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/scratchdata/scratchdata/config"
+	blobmodels "github.com/scratchdata/scratchdata/pkg/storage/blobstore/models"
+	models2 "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+)
+
+// tagStore is a blob store whose objects only have tags
+type tagStore struct {
+	tags  map[string]map[string]string
+	err   error
+	reads map[string]int
+}
+
+func (s *tagStore) Upload(path string, r io.ReadSeeker) error { return nil }
+func (s *tagStore) Download(path string, w io.WriterAt) error { return nil }
+
+func (s *tagStore) ObjectTags(ctx context.Context, path string) (map[string]string, error) {
+	s.reads[path]++
+	if s.err != nil {
+		return nil, s.err
+	}
+	tags, ok := s.tags[path]
+	if !ok {
+		return nil, blobmodels.ErrNotFound
+	}
+	return tags, nil
+}
+
+func TestTargetTable(t *testing.T) {
+	store := &tagStore{tags: map[string]map[string]string{
+		"schemas/1/events.json": {"schema_version": "v2", "version": "v3"},
+		"schemas/1/users.json":  {"owner": "data"},
+	}}
+
+	tests := []struct {
+		name     string
+		conf     config.SchemaVersion
+		database int64
+		table    string
+		expected string
+	}{
+		{name: "disabled", conf: config.SchemaVersion{}, database: 1, table: "events", expected: "events"},
+		{name: "versioned", conf: config.SchemaVersion{ObjectKey: "schemas/{database_id}/{table}.json"}, database: 1, table: "events", expected: "events_v2"},
+		{name: "tag", conf: config.SchemaVersion{ObjectKey: "schemas/{database_id}/{table}.json", Tag: "version"}, database: 1, table: "events", expected: "events_v3"},
+		{name: "table format", conf: config.SchemaVersion{ObjectKey: "schemas/{database_id}/{table}.json", TableFormat: "{version}.{table}"}, database: 1, table: "events", expected: "v2.events"},
+		{name: "other database", conf: config.SchemaVersion{ObjectKey: "schemas/{database_id}/{table}.json"}, database: 2, table: "events", expected: "events"},
+		{name: "missing object", conf: config.SchemaVersion{ObjectKey: "schemas/{database_id}/{table}.json"}, database: 1, table: "orders", expected: "orders"},
+		{name: "missing tag", conf: config.SchemaVersion{ObjectKey: "schemas/{database_id}/{table}.json"}, database: 1, table: "users", expected: "users"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store.reads = map[string]int{}
+			versions := newSchemaVersions(test.conf, store)
+
+			table, err := versions.targetTable(context.Background(), models2.FileUploadMessage{DatabaseID: test.database, Table: test.table})
+			if err != nil {
+				t.Fatalf("Cannot get target table: %s", err)
+			}
+			if table != test.expected {
+				t.Fatalf("Expected %s; Got %s", test.expected, table)
+			}
+		})
+	}
+}
+
+func TestTargetTableError(t *testing.T) {
+	store := &tagStore{err: errors.New("access denied"), reads: map[string]int{}}
+	versions := newSchemaVersions(config.SchemaVersion{ObjectKey: "schemas/{table}.json"}, store)
+
+	if _, err := versions.targetTable(context.Background(), models2.FileUploadMessage{Table: "events"}); err == nil {
+		t.Fatal("Expected an error reading tags to fail rather than use the unversioned table")
+	}
+}
+
+func TestSchemaVersionCache(t *testing.T) {
+	store := &tagStore{tags: map[string]map[string]string{"schemas/events.json": {"schema_version": "v1"}}, reads: map[string]int{}}
+	versions := newSchemaVersions(config.SchemaVersion{ObjectKey: "schemas/{table}.json", CacheSeconds: 60}, store)
+
+	now := time.Now()
+	versions.now = func() time.Time { return now }
+	message := models2.FileUploadMessage{Table: "events"}
+
+	targetTable := func() string {
+		t.Helper()
+		table, err := versions.targetTable(context.Background(), message)
+		if err != nil {
+			t.Fatalf("Cannot get target table: %s", err)
+		}
+		return table
+	}
+
+	if table := targetTable(); table != "events_v1" {
+		t.Fatalf("Expected events_v1; Got %s", table)
+	}
+
+	// The cached version is used until it expires
+	store.tags["schemas/events.json"]["schema_version"] = "v2"
+	now = now.Add(59 * time.Second)
+	if table := targetTable(); table != "events_v1" {
+		t.Fatalf("Expected the cached events_v1; Got %s", table)
+	}
+	if store.reads["schemas/events.json"] != 1 {
+		t.Fatalf("Expected tags to be read once while cached; Got %d", store.reads["schemas/events.json"])
+	}
+
+	now = now.Add(2 * time.Second)
+	if table := targetTable(); table != "events_v2" {
+		t.Fatalf("Expected events_v2 once the cache expired; Got %s", table)
+	}
+	if store.reads["schemas/events.json"] != 2 {
+		t.Fatalf("Expected tags to be read again after expiry; Got %d", store.reads["schemas/events.json"])
+	}
+
+	// Without caching, tags are read for every file
+	versions = newSchemaVersions(config.SchemaVersion{ObjectKey: "schemas/{table}.json"}, store)
+	targetTable()
+	targetTable()
+	if store.reads["schemas/events.json"] != 4 {
+		t.Fatalf("Expected tags to be read for every file without a cache; Got %d", store.reads["schemas/events.json"])
+	}
+}
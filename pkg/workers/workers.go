@@ -1,9 +1,11 @@
 package workers
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
@@ -13,18 +15,30 @@ import (
 	"github.com/scratchdata/scratchdata/config"
 	"github.com/scratchdata/scratchdata/models"
 	"github.com/scratchdata/scratchdata/pkg/destinations"
+	"github.com/scratchdata/scratchdata/pkg/storage/queue"
 	models2 "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+	"github.com/scratchdata/scratchdata/pkg/workers/checkpoint"
+	"github.com/scratchdata/scratchdata/util"
 )
 
 type ScratchDataWorker struct {
 	Config             config.Workers
 	StorageServices    *models.StorageServices
 	destinationManager *destinations.DestinationManager
+
+	zstdDictionaries [][]byte
+	checkpoints      checkpoint.Store
+	schemaVersions   *schemaVersions
 }
 
 func (w *ScratchDataWorker) Start(ctx context.Context, threadId int) {
 	log.Debug().Int("thread", threadId).Msg("Starting worker")
 
+	if ackQueue, ok := w.StorageServices.Queue.(queue.AckQueue); ok {
+		w.startAck(ctx, threadId, ackQueue)
+		return
+	}
+
 	for {
 		item, ok := w.StorageServices.Queue.Dequeue()
 
@@ -36,7 +50,7 @@ func (w *ScratchDataWorker) Start(ctx context.Context, threadId int) {
 				log.Error().Err(err).Int("thread", threadId).Bytes("message_bytes", item).Msg("Unable to decode message")
 			}
 
-			err = w.processMessage(threadId, message)
+			err = w.processMessage(ctx, threadId, message)
 			if err != nil {
 				log.Error().Err(err).Int("thread", threadId).Interface("message", message).Msg("Unable to process message")
 			}
@@ -51,22 +65,127 @@ func (w *ScratchDataWorker) Start(ctx context.Context, threadId int) {
 	}
 }
 
-func (w *ScratchDataWorker) processMessage(threadId int, message models2.FileUploadMessage) error {
+// startAck consumes a queue which supports acknowledgement. Messages are kept
+// invisible while they are processed, and only removed once inserted.
+func (w *ScratchDataWorker) startAck(ctx context.Context, threadId int, q queue.AckQueue) {
+	for {
+		msg, ok := q.Receive()
+
+		if !ok {
+			time.Sleep(1 * time.Second)
+		} else {
+			err := w.processAckMessage(ctx, threadId, q, msg)
+			if err != nil {
+				log.Error().Err(err).Int("thread", threadId).Bytes("message_bytes", msg.Body).Int("receive_count", msg.ReceiveCount).Msg("Unable to process message")
+				if nackErr := q.Nack(msg); nackErr != nil {
+					log.Error().Err(nackErr).Int("thread", threadId).Msg("Unable to return message to queue")
+				}
+			} else if ackErr := q.Ack(msg); ackErr != nil {
+				log.Error().Err(ackErr).Int("thread", threadId).Bytes("message_bytes", msg.Body).Msg("Unable to delete message from queue")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Debug().Int("thread", threadId).Msg("Stopping worker")
+			return
+		default:
+		}
+	}
+}
+
+// processAckMessage processes msg, extending its visibility until processing
+// finishes so a slow insert isn't redelivered to another worker
+func (w *ScratchDataWorker) processAckMessage(ctx context.Context, threadId int, q queue.AckQueue, msg models2.Message) error {
+	message, err := w.messageToStruct(msg.Body)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(q.VisibilityTimeout() / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := q.ExtendVisibility(msg); err != nil {
+					log.Error().Err(err).Int("thread", threadId).Str("key", message.Key).Msg("Unable to extend message visibility")
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return w.processMessage(ctx, threadId, message)
+}
+
+func (w *ScratchDataWorker) processMessage(ctx context.Context, threadId int, message models2.FileUploadMessage) error {
+	if w.checkpoints != nil {
+		done, err := w.checkpoints.Done(message.Key)
+		if err != nil {
+			return err
+		}
+		if done {
+			log.Info().Int("thread", threadId).Str("key", message.Key).Msg("Skipping file which has already been inserted")
+			return nil
+		}
+	}
+
 	destination, err := w.destinationManager.Destination(message.DatabaseID)
 	if err != nil {
 		return err
 	}
 
+	table, err := w.schemaVersions.targetTable(ctx, message)
+	if err != nil {
+		return err
+	}
+
 	fileIdent := filepath.Base(message.Key)
 	fileName := fmt.Sprintf("%d_%s_%s.ndjson", message.DatabaseID, message.Table, fileIdent)
 	filePath := filepath.Join(w.Config.DataDirectory, fileName)
 
-	err = w.downloadFile(filePath, message.Key)
+	input := util.DetectInputFormat(message.Key, message.Format, message.Compression)
+	method, err := insertMethod(input)
+	if err != nil {
+		return fmt.Errorf("%w for %s", err, message.Key)
+	}
+	if method == insertFromBlobStore {
+		return w.insertFromS3(threadId, destination, table, message, input)
+	}
+
+	downloadPath := filePath
+	if input.Compression != "" {
+		downloadPath = filePath + "." + input.Compression
+	}
+
+	err = w.downloadFile(downloadPath, message.Key)
 	if err != nil {
 		return err
 	}
 
-	err = destination.CreateEmptyTable(message.Table)
+	if message.Checksum != "" {
+		err = w.verifyChecksum(downloadPath, message.Checksum)
+		if err != nil {
+			os.Remove(downloadPath)
+			return err
+		}
+	}
+
+	if input.Compression != "" {
+		err = w.decompressFile(filePath, downloadPath, input.Compression)
+		os.Remove(downloadPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = destination.CreateEmptyTable(table)
 	if err != nil {
 		return err
 	}
@@ -77,7 +196,7 @@ func (w *ScratchDataWorker) processMessage(threadId int, message models2.FileUpl
 		return err
 	}
 
-	err = destination.CreateColumns(message.Table, filePath)
+	err = destination.CreateColumns(table, filePath)
 	if err != nil {
 		return err
 	}
@@ -87,11 +206,13 @@ func (w *ScratchDataWorker) processMessage(threadId int, message models2.FileUpl
 		return err
 	}
 
-	err = destination.InsertFromNDJsonFile(message.Table, filePath)
+	err = destination.InsertFromNDJsonFile(table, filePath)
 	if err != nil {
 		return err
 	}
 
+	w.markDone(threadId, message)
+
 	err = file.Close()
 	if err != nil {
 		log.Error().Err(err).Int("thread", threadId).Str("filename", filePath).Msg("Unable to close temp file")
@@ -105,6 +226,69 @@ func (w *ScratchDataWorker) processMessage(threadId int, message models2.FileUpl
 	return nil
 }
 
+// How files are inserted, by input format
+const (
+	// insertDownloaded downloads and decompresses the file, then inserts it
+	// as NDJSON
+	insertDownloaded = "download"
+
+	// insertFromBlobStore has the destination read the file itself
+	insertFromBlobStore = "blob_store"
+)
+
+// insertMethod returns how a file in input's format is inserted, or an error
+// for formats the workers can't insert, such as CSV
+func insertMethod(input util.InputFormat) (string, error) {
+	switch input.Format {
+	case util.FormatJSONEachRow:
+		return insertDownloaded, nil
+	case util.FormatParquet:
+		return insertFromBlobStore, nil
+	}
+	return "", fmt.Errorf("unsupported input format %q", input.Format)
+}
+
+// markDone logs an inserted file's trace, if it has one, and checkpoints it.
+// The trace is only logged, so the insert can be matched to the writes which
+// produced the file; no span is started and nothing is passed to the
+// destination. The insert has happened, so the message doesn't fail if the
+// checkpoint can't be saved; a redelivery would insert the file again.
+func (w *ScratchDataWorker) markDone(threadId int, message models2.FileUploadMessage) {
+	if len(message.Trace) > 0 {
+		log.Debug().Int("thread", threadId).Str("key", message.Key).Interface("trace", message.Trace).Msg("Inserted traced file")
+	}
+
+	if w.checkpoints != nil {
+		if err := w.checkpoints.MarkDone(message.Key); err != nil {
+			log.Error().Err(err).Int("thread", threadId).Str("key", message.Key).Msg("Unable to save checkpoint")
+		}
+	}
+}
+
+// insertFromS3 has the destination read a file straight from the blob store
+// rather than downloading it, for formats such as Parquet which it can read
+// natively, into table. The file is never downloaded, so its checksum isn't
+// verified.
+func (w *ScratchDataWorker) insertFromS3(threadId int, destination destinations.Destination, table string, message models2.FileUploadMessage, input util.InputFormat) error {
+	inserter, ok := destination.(destinations.S3Inserter)
+	if !ok {
+		return fmt.Errorf("destination for database %d can't insert %s files, such as %s", message.DatabaseID, input.Format, message.Key)
+	}
+
+	err := destination.CreateEmptyTable(table)
+	if err != nil {
+		return err
+	}
+
+	err = inserter.InsertFromS3(table, message.Key, input.Format)
+	if err != nil {
+		return err
+	}
+
+	w.markDone(threadId, message)
+	return nil
+}
+
 func (w *ScratchDataWorker) messageToStruct(item []byte) (models2.FileUploadMessage, error) {
 	message := models2.FileUploadMessage{}
 	err := json.Unmarshal(item, &message)
@@ -125,6 +309,63 @@ func (w *ScratchDataWorker) downloadFile(path string, key string) error {
 	return file.Close()
 }
 
+func (w *ScratchDataWorker) decompressFile(path string, compressedPath string, compression string) error {
+	src, err := os.Open(compressedPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	switch compression {
+	case "zstd":
+		err = util.DecompressZstd(dst, src, w.zstdDictionaries)
+	case "lz4":
+		err = util.DecompressLZ4(dst, src)
+	case "gzip":
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(src)
+		if err == nil {
+			_, err = io.Copy(dst, gz)
+			gz.Close()
+		}
+	default:
+		err = fmt.Errorf("unsupported compression %q", compression)
+	}
+
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func (w *ScratchDataWorker) verifyChecksum(path string, expected string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	checksum, err := util.SHA256(file)
+	if err != nil {
+		return err
+	}
+
+	if checksum != expected {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", path, expected, checksum)
+	}
+
+	return nil
+}
+
 func RunWorkers(ctx context.Context, config config.Workers, storageServices *models.StorageServices, destinationManager *destinations.DestinationManager) {
 	err := os.MkdirAll(config.DataDirectory, os.ModePerm)
 	if err != nil {
@@ -138,6 +379,25 @@ func RunWorkers(ctx context.Context, config config.Workers, storageServices *mod
 		destinationManager: destinationManager,
 	}
 
+	workers.checkpoints, err = checkpoint.NewStore(config.Checkpoint, config.DataDirectory)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to open checkpoint store")
+		return
+	}
+
+	if config.SchemaVersion.ObjectKey != "" {
+		workers.schemaVersions = newSchemaVersions(config.SchemaVersion, storageServices.BlobStore)
+	}
+
+	for _, dictPath := range config.ZstdDictionaries {
+		dict, err := os.ReadFile(dictPath)
+		if err != nil {
+			log.Error().Err(err).Str("path", dictPath).Msg("Unable to read zstd dictionary")
+			return
+		}
+		workers.zstdDictionaries = append(workers.zstdDictionaries, dict)
+	}
+
 	log.Debug().Msg("Starting Workers")
 	var wg sync.WaitGroup
 	i := 0
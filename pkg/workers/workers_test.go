@@ -0,0 +1,136 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	models2 "github.com/scratchdata/scratchdata/pkg/storage/queue/models"
+	"github.com/scratchdata/scratchdata/util"
+)
+
+func TestInsertMethod(t *testing.T) {
+	tests := []struct {
+		key    string
+		format string
+		method string
+	}{
+		{key: "data/1/events/1.ndjson", method: insertDownloaded},
+		{key: "data/1/events/1.ndjson.zst", method: insertDownloaded},
+		{key: "data/1/events/1", format: util.FormatJSONEachRow, method: insertDownloaded},
+		{key: "data/1/events/1.parquet", method: insertFromBlobStore},
+		{key: "data/1/events/1.csv"},
+		{key: "data/1/events/1.ndjson", format: util.FormatCSVWithNames},
+		{key: "data/1/events/1.unknown"},
+	}
+
+	for _, test := range tests {
+		method, err := insertMethod(util.DetectInputFormat(test.key, test.format, ""))
+		if test.method == "" {
+			if err == nil {
+				t.Errorf("%s (%q): expected an unsupported format; Got %s", test.key, test.format, method)
+			}
+			continue
+		}
+		if err != nil || method != test.method {
+			t.Errorf("%s (%q): expected %s; Got %s, %v", test.key, test.format, test.method, method, err)
+		}
+	}
+}
+
+// ackQueue is a queue.AckQueue over a list of messages, recording what's
+// done with each by its handle
+type ackQueue struct {
+	mu       sync.Mutex
+	messages []models2.Message
+	acked    []string
+	nacked   []string
+	extended map[string]int
+}
+
+func (q *ackQueue) Receive() (models2.Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return models2.Message{}, false
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	return msg, true
+}
+
+func (q *ackQueue) Ack(msg models2.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.acked = append(q.acked, msg.Handle)
+	return nil
+}
+
+func (q *ackQueue) Nack(msg models2.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.nacked = append(q.nacked, msg.Handle)
+	return nil
+}
+
+func (q *ackQueue) ExtendVisibility(msg models2.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.extended[msg.Handle]++
+	return nil
+}
+
+func (q *ackQueue) VisibilityTimeout() time.Duration { return 20 * time.Millisecond }
+
+// slowCheckpoints reports every key as already inserted after delay, so
+// messages succeed without a destination, except fail, which errors
+type slowCheckpoints struct {
+	delay time.Duration
+	fail  string
+}
+
+func (c *slowCheckpoints) Done(key string) (bool, error) {
+	time.Sleep(c.delay)
+	if key == c.fail {
+		return false, errors.New("checkpoint unavailable")
+	}
+	return true, nil
+}
+
+func (c *slowCheckpoints) MarkDone(key string) error { return nil }
+
+func TestStartAck(t *testing.T) {
+	q := &ackQueue{extended: map[string]int{}, messages: []models2.Message{
+		{Handle: "inserted", Body: []byte(`{"key":"data/1/events/1.ndjson"}`)},
+		{Handle: "undecodable", Body: []byte(`not json`)},
+		{Handle: "failed", Body: []byte(`{"key":"data/1/events/2.ndjson"}`)},
+	}}
+	w := &ScratchDataWorker{checkpoints: &slowCheckpoints{delay: 50 * time.Millisecond, fail: "data/1/events/2.ndjson"}}
+
+	// A done context stops the worker after each message
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range q.messages {
+		w.startAck(ctx, 0, q)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.acked) != 1 || q.acked[0] != "inserted" {
+		t.Fatalf("Expected only the inserted message to be acked; Got %v", q.acked)
+	}
+	if len(q.nacked) != 2 || q.nacked[0] != "undecodable" || q.nacked[1] != "failed" {
+		t.Fatalf("Expected the failed messages to be nacked; Got %v", q.nacked)
+	}
+
+	// Processing for 50ms extends a 20ms visibility timeout every 10ms
+	if q.extended["inserted"] < 2 || q.extended["failed"] < 2 {
+		t.Fatalf("Expected visibility to be extended while processing; Got %v", q.extended)
+	}
+	if q.extended["undecodable"] != 0 {
+		t.Fatalf("Expected no extension for a message which isn't processed; Got %v", q.extended)
+	}
+}
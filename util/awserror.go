@@ -0,0 +1,69 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/rs/zerolog"
+)
+
+// AWSError is a failed AWS request along with the ids AWS support needs to
+// trace it
+type AWSError struct {
+	Op                string
+	RequestID         string
+	ExtendedRequestID string
+	Err               error
+}
+
+func (e *AWSError) Error() string {
+	if e.ExtendedRequestID != "" {
+		return fmt.Sprintf("%s: %s (request id %s, extended request id %s)", e.Op, e.Err, e.RequestID, e.ExtendedRequestID)
+	}
+	return fmt.Sprintf("%s: %s (request id %s)", e.Op, e.Err, e.RequestID)
+}
+
+func (e *AWSError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalZerologObject logs the request ids as separate fields
+func (e *AWSError) MarshalZerologObject(event *zerolog.Event) {
+	event.Str("op", e.Op).Str("request_id", e.RequestID)
+	if e.ExtendedRequestID != "" {
+		event.Str("extended_request_id", e.ExtendedRequestID)
+	}
+}
+
+// AWSErrorFields adds the request ids from err, if any, to a log event
+func AWSErrorFields(event *zerolog.Event, err error) *zerolog.Event {
+	var awsErr *AWSError
+	if errors.As(err, &awsErr) {
+		event.EmbedObject(awsErr)
+	}
+	return event
+}
+
+// WrapAWSError returns err as an *AWSError if it came from an AWS response
+// with a request id, and unchanged otherwise
+func WrapAWSError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var respErr *awshttp.ResponseError
+	if !errors.As(err, &respErr) || respErr.ServiceRequestID() == "" {
+		return err
+	}
+
+	rc := &AWSError{Op: op, RequestID: respErr.ServiceRequestID(), Err: err}
+
+	// S3 also returns a host id, the "extended request id"
+	var hostErr interface{ ServiceHostID() string }
+	if errors.As(err, &hostErr) {
+		rc.ExtendedRequestID = hostErr.ServiceHostID()
+	}
+
+	return rc
+}
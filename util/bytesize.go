@@ -0,0 +1,90 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var byteSizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ParseByteSize parses a size such as "128MiB", "1GB" or "1.5 gib" into
+// bytes. KB, MB, GB and TB are powers of 1000; KiB, MiB, GiB and TiB are
+// powers of 1024. A bare number is a count of bytes. Units are case
+// insensitive.
+func ParseByteSize(s string) (int64, error) {
+	trimmed := strings.TrimSpace(s)
+	i := strings.IndexFunc(trimmed, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(trimmed)
+	}
+
+	number, unit := trimmed[:i], strings.ToLower(strings.TrimSpace(trimmed[i:]))
+	multiplier, ok := byteSizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, trimmed[i:])
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	bytes := n * multiplier
+	if bytes > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return int64(bytes), nil
+}
+
+// ByteSizeSettings returns a copy of settings with the string values of keys
+// parsed with ParseByteSize, so sizes can be configured as "128MiB" as well
+// as a number of bytes. Values which are maps, such as per-tenant quotas,
+// have each of their values parsed.
+func ByteSizeSettings(settings map[string]any, keys ...string) (map[string]any, error) {
+	rc := make(map[string]any, len(settings))
+	for k, v := range settings {
+		rc[k] = v
+	}
+
+	for _, key := range keys {
+		switch value := rc[key].(type) {
+		case string:
+			n, err := ParseByteSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			rc[key] = n
+
+		case map[string]any:
+			parsed := make(map[string]any, len(value))
+			for k, v := range value {
+				parsed[k] = v
+				if s, ok := v.(string); ok {
+					n, err := ParseByteSize(s)
+					if err != nil {
+						return nil, fmt.Errorf("%s.%s: %w", key, k, err)
+					}
+					parsed[k] = n
+				}
+			}
+			rc[key] = parsed
+		}
+	}
+
+	return rc, nil
+}
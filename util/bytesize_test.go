@@ -0,0 +1,56 @@
+package util
+
+import "testing"
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]int64{
+		"100":     100,
+		"100B":    100,
+		"1KB":     1000,
+		"128MiB":  128 << 20,
+		"1GB":     1000000000,
+		"1.5 gib": 3 << 29,
+		" 2TiB ":  2 << 40,
+	}
+	for s, exp := range cases {
+		n, err := ParseByteSize(s)
+		if err != nil {
+			t.Fatalf("%q: %s", s, err)
+		}
+		if n != exp {
+			t.Fatalf("%q: Expected %d; Got %d", s, exp, n)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "12 parsecs", "1.2.3MB", "-5MB"} {
+		if _, err := ParseByteSize(s); err == nil {
+			t.Fatalf("%q: Expected an error", s)
+		}
+	}
+}
+
+func TestByteSizeSettings(t *testing.T) {
+	settings := map[string]any{
+		"max_size_bytes": "1MiB",
+		"max_rows":       "1MiB",
+		"tenant_quotas":  map[string]any{"1": "1KB", "2": 5},
+	}
+
+	rc, err := ByteSizeSettings(settings, "max_size_bytes", "tenant_quotas", "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc["max_size_bytes"] != int64(1<<20) || rc["max_rows"] != "1MiB" {
+		t.Fatalf("Unexpected settings %+v", rc)
+	}
+	if quotas := rc["tenant_quotas"].(map[string]any); quotas["1"] != int64(1000) || quotas["2"] != 5 {
+		t.Fatalf("Unexpected quotas %+v", quotas)
+	}
+	if settings["max_size_bytes"] != "1MiB" {
+		t.Fatal("Expected settings to be left unchanged")
+	}
+
+	if _, err := ByteSizeSettings(map[string]any{"max_size_bytes": "lots"}, "max_size_bytes"); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
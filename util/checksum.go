@@ -0,0 +1,43 @@
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// sum hashes everything in r and rewinds it so it can be read again
+func sum(h hash.Hash, r io.ReadSeeker) ([]byte, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// SHA256 returns the hex-encoded SHA-256 of r. r is rewound to the start afterwards.
+func SHA256(r io.ReadSeeker) (string, error) {
+	b, err := sum(sha256.New(), r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ContentMD5 returns the base64-encoded MD5 of r, as used by the Content-MD5 header.
+// r is rewound to the start afterwards.
+func ContentMD5(r io.ReadSeeker) (string, error) {
+	b, err := sum(md5.New(), r)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
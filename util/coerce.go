@@ -0,0 +1,53 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// CoerceJSON converts string-valued top-level fields in data to the JSON types
+// listed in types ("int", "float" or "bool"): {"n": "123"} => {"n": 123}.
+// Fields which are missing or already non-strings are left alone. If a value
+// can't be converted it is left as-is unless strict is set, in which case an
+// error is returned.
+func CoerceJSON(data []byte, types map[string]string, strict bool) ([]byte, error) {
+	var err error
+
+	for field, jsonType := range types {
+		value := gjson.GetBytes(data, gjson.Escape(field))
+		if value.Type != gjson.String {
+			continue
+		}
+
+		var converted any
+		var convErr error
+
+		switch jsonType {
+		case "int":
+			converted, convErr = strconv.ParseInt(value.Str, 10, 64)
+		case "float":
+			converted, convErr = strconv.ParseFloat(value.Str, 64)
+		case "bool":
+			converted, convErr = strconv.ParseBool(value.Str)
+		default:
+			return data, fmt.Errorf("unsupported type %q for field %s", jsonType, field)
+		}
+
+		if convErr != nil {
+			if strict {
+				return data, fmt.Errorf("cannot convert field %s value %q to %s", field, value.Str, jsonType)
+			}
+			continue
+		}
+
+		data, err = sjson.SetBytes(data, gjson.Escape(field), converted)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	return data, nil
+}
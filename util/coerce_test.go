@@ -0,0 +1,30 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestCoerceJSON(t *testing.T) {
+	types := map[string]string{"n": "int", "f": "float", "b": "bool", "missing": "int"}
+
+	out, err := CoerceJSON([]byte(`{"n":"123","f":"1.5","b":"true","s":"x"}`), types, true)
+	if err != nil {
+		t.Fatalf("Cannot coerce: %s", err)
+	}
+	if s, exp := string(out), `{"n":123,"f":1.5,"b":true,"s":"x"}`; s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+
+	in := `{"n":"abc"}`
+	out, err = CoerceJSON([]byte(in), types, false)
+	if err != nil {
+		t.Fatalf("Expected unconvertible value to pass through; Got %s", err)
+	}
+	if string(out) != in {
+		t.Fatalf("Expected %#q; Got %#q", in, string(out))
+	}
+
+	if _, err = CoerceJSON([]byte(in), types, true); err == nil {
+		t.Fatal("Expected an error for an unconvertible value")
+	}
+}
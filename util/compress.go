@@ -0,0 +1,71 @@
+package util
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// ZstdDictionaryID returns the id embedded in a zstd dictionary
+func ZstdDictionaryID(dict []byte) (uint32, error) {
+	d, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		return 0, err
+	}
+	return d.ID(), nil
+}
+
+// CompressZstd compresses src into dst, using dict as the compression dictionary if set
+func CompressZstd(dst io.Writer, src io.Reader, dict []byte) error {
+	opts := []zstd.EOption{}
+	if len(dict) > 0 {
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+
+	enc, err := zstd.NewWriter(dst, opts...)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(enc, src); err != nil {
+		enc.Close()
+		return err
+	}
+
+	return enc.Close()
+}
+
+// CompressLZ4 compresses src into dst in the LZ4 frame format
+func CompressLZ4(dst io.Writer, src io.Reader) error {
+	enc := lz4.NewWriter(dst)
+	if _, err := io.Copy(enc, src); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// DecompressLZ4 decompresses an LZ4 frame from src into dst
+func DecompressLZ4(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, lz4.NewReader(src))
+	return err
+}
+
+// DecompressZstd decompresses src into dst. The dictionary a frame was
+// compressed with is picked from dicts by its id.
+func DecompressZstd(dst io.Writer, src io.Reader, dicts [][]byte) error {
+	opts := []zstd.DOption{}
+	if len(dicts) > 0 {
+		opts = append(opts, zstd.WithDecoderDicts(dicts...))
+	}
+
+	dec, err := zstd.NewReader(src, opts...)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	_, err = io.Copy(dst, dec)
+	return err
+}
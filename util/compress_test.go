@@ -0,0 +1,74 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// sampleNDJSON returns n lines of the kind of records we ingest
+func sampleNDJSON(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, `{"__row_id":%d,"event":"page_view","user_id":"user_%d","path":"/products/%d","duration_ms":%d}`+"\n", 1780000000000+i, i%500, i%73, i%1000)
+	}
+	return buf.Bytes()
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	data := sampleNDJSON(1000)
+
+	var compressed bytes.Buffer
+	if err := CompressLZ4(&compressed, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Cannot compress: %s", err)
+	}
+	if compressed.Len() >= len(data) {
+		t.Fatalf("Expected compression; Got %d bytes from %d", compressed.Len(), len(data))
+	}
+
+	var decompressed bytes.Buffer
+	if err := DecompressLZ4(&decompressed, &compressed); err != nil {
+		t.Fatalf("Cannot decompress: %s", err)
+	}
+	if !bytes.Equal(decompressed.Bytes(), data) {
+		t.Fatal("Round trip did not return the original data")
+	}
+}
+
+func benchmarkCompress(b *testing.B, compress func(io.Writer, io.Reader) error) {
+	data := sampleNDJSON(10_000)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	var size int
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		if err := compress(&buf, bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+		size = buf.Len()
+	}
+	b.ReportMetric(float64(len(data))/float64(size), "ratio")
+}
+
+func BenchmarkCompressGzip(b *testing.B) {
+	benchmarkCompress(b, func(dst io.Writer, src io.Reader) error {
+		gz := gzip.NewWriter(dst)
+		if _, err := io.Copy(gz, src); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+}
+
+func BenchmarkCompressZstd(b *testing.B) {
+	benchmarkCompress(b, func(dst io.Writer, src io.Reader) error {
+		return CompressZstd(dst, src, nil)
+	})
+}
+
+func BenchmarkCompressLZ4(b *testing.B) {
+	benchmarkCompress(b, CompressLZ4)
+}
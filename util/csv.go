@@ -0,0 +1,99 @@
+package util
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"sort"
+
+	"github.com/tidwall/gjson"
+)
+
+// NDJSONToCSV converts newline-delimited JSON objects in src to CSV with a
+// header row, in the CSVWithNames format. src is read twice, first to find
+// every top-level field, so only the field names are held in memory. Columns
+// are sorted; fields missing from a row and nulls are empty, nested objects
+// and arrays are written as JSON.
+func NDJSONToCSV(dst io.Writer, src io.ReadSeeker) error {
+	return NDJSONToCSVWithCRLF(dst, src, false)
+}
+
+// NDJSONToCSVWithCRLF is NDJSONToCSV, ending rows with "\r\n" if useCRLF is
+// set
+func NDJSONToCSVWithCRLF(dst io.Writer, src io.ReadSeeker, useCRLF bool) error {
+	fields := map[string]bool{}
+	err := scanObjects(src, func(row gjson.Result) {
+		row.ForEach(func(key, _ gjson.Result) bool {
+			fields[key.String()] = true
+			return true
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	columns := make([]string, 0, len(fields))
+	for field := range fields {
+		columns = append(columns, field)
+	}
+	sort.Strings(columns)
+
+	w := csv.NewWriter(dst)
+	w.UseCRLF = useCRLF
+	if err := w.Write(columns); err != nil {
+		return err
+	}
+
+	index := make(map[string]int, len(columns))
+	for i, column := range columns {
+		index[column] = i
+	}
+
+	record := make([]string, len(columns))
+	var writeErr error
+	err = scanObjects(src, func(row gjson.Result) {
+		for i := range record {
+			record[i] = ""
+		}
+		row.ForEach(func(key, value gjson.Result) bool {
+			i := index[key.String()]
+			switch value.Type {
+			case gjson.Null:
+			case gjson.String:
+				record[i] = value.Str
+			default:
+				record[i] = value.Raw
+			}
+			return true
+		})
+		if writeErr == nil {
+			writeErr = w.Write(record)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// scanObjects calls fn for each JSON object line in src, from the start
+func scanObjects(src io.ReadSeeker, fn func(row gjson.Result)) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		row := gjson.ParseBytes(scanner.Bytes())
+		if row.IsObject() {
+			fn(row)
+		}
+	}
+	return scanner.Err()
+}
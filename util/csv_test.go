@@ -0,0 +1,24 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNDJSONToCSV(t *testing.T) {
+	src := strings.NewReader(`{"b":"x,y","a":1}
+{"a":2.5,"c":{"d":true},"b":null}
+{"c":[1,2]}
+`)
+
+	buf := &bytes.Buffer{}
+	if err := NDJSONToCSV(buf, src); err != nil {
+		t.Fatalf("Cannot convert: %s", err)
+	}
+
+	exp := "a,b,c\n1,\"x,y\",\n2.5,,\"{\"\"d\"\":true}\"\n,,\"[1,2]\"\n"
+	if s := buf.String(); s != exp {
+		t.Fatalf("Expected %#q; Got %#q", exp, s)
+	}
+}
@@ -3,13 +3,20 @@ package util
 import "golang.org/x/sys/unix"
 
 func FreeDiskSpace(path string) uint64 {
+	free, _ := AvailableDiskSpace(path)
+	return free
+}
+
+// AvailableDiskSpace returns the bytes available to unprivileged users on the
+// filesystem containing path
+func AvailableDiskSpace(path string) (uint64, error) {
 	if path == "" {
 		path = "/"
 	}
 
 	var stat unix.Statfs_t
-	unix.Statfs(path, &stat)
-	currentFreeSpace := stat.Bavail * uint64(stat.Bsize)
-	return currentFreeSpace
-
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
 }
@@ -0,0 +1,63 @@
+package util
+
+import "strings"
+
+// ClickHouse input formats for uploaded files
+const (
+	FormatJSON         = "JSON"
+	FormatJSONEachRow  = "JSONEachRow"
+	FormatParquet      = "Parquet"
+	FormatCSVWithNames = "CSVWithNames"
+)
+
+// InputFormat is how an uploaded file should be read
+type InputFormat struct {
+	Format      string
+	Compression string
+}
+
+var compressionExtensions = map[string]string{
+	".gz":  "gzip",
+	".zst": "zstd",
+	".lz4": "lz4",
+}
+
+var formatExtensions = map[string]string{
+	".ndjson":  FormatJSONEachRow,
+	".parquet": FormatParquet,
+	".csv":     FormatCSVWithNames,
+}
+
+// DetectInputFormat works out the format and compression of the object at
+// key. format and compression come from the queue message and take
+// precedence; the key's extension is only used for whichever is empty. An
+// unrecognised extension leaves the format empty.
+func DetectInputFormat(key string, format string, compression string) InputFormat {
+	name := strings.ToLower(key)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	rc := InputFormat{Format: format, Compression: compression}
+
+	for ext, c := range compressionExtensions {
+		if strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			if rc.Compression == "" {
+				rc.Compression = c
+			}
+			break
+		}
+	}
+
+	if rc.Format == "" {
+		for ext, f := range formatExtensions {
+			if strings.HasSuffix(name, ext) {
+				rc.Format = f
+				break
+			}
+		}
+	}
+
+	return rc
+}
@@ -0,0 +1,27 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestDetectInputFormat(t *testing.T) {
+	type input struct {
+		key, format, compression string
+	}
+	cases := map[input]InputFormat{
+		{key: "data/1/t/123.ndjson"}:                      {Format: FormatJSONEachRow},
+		{key: "data/1/t/123.ndjson.gz"}:                   {Format: FormatJSONEachRow, Compression: "gzip"},
+		{key: "data/1/t/123.ndjson.zst"}:                  {Format: FormatJSONEachRow, Compression: "zstd"},
+		{key: "data/1/t/123.parquet"}:                     {Format: FormatParquet},
+		{key: "data/1/t/123.CSV"}:                         {Format: FormatCSVWithNames},
+		{key: "data/1/t/123"}:                             {},
+		{key: "data/1/t/123.csv", format: FormatParquet}:  {Format: FormatParquet},
+		{key: "data/1/t/123.ndjson", compression: "zstd"}: {Format: FormatJSONEachRow, Compression: "zstd"},
+	}
+	for in, exp := range cases {
+		got := DetectInputFormat(in.key, in.format, in.compression)
+		if got != exp {
+			t.Fatalf("%+v: Expected %+v; Got %+v", in, exp, got)
+		}
+	}
+}
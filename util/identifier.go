@@ -0,0 +1,42 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// invalidIdentChars matches characters which are not allowed in a normalized identifier
+	invalidIdentChars = regexp.MustCompile(`[^a-z0-9_]`)
+
+	// normalizedIdent matches an identifier which is already normalized
+	normalizedIdent = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+// ErrEmptyIdentifier is returned by SanitizeIdentifier for a name with no
+// letters or digits to keep
+var ErrEmptyIdentifier = errors.New("identifier has no letters or digits")
+
+// NormalizeIdentifier lowercases s and replaces every character which is not
+// alphanumeric or an underscore with an underscore: "My Tag!" => "my_tag_"
+func NormalizeIdentifier(s string) string {
+	return invalidIdentChars.ReplaceAllString(strings.ToLower(s), "_")
+}
+
+// IsNormalizedIdentifier returns true if s is non-empty and unchanged by NormalizeIdentifier
+func IsNormalizedIdentifier(s string) bool {
+	return normalizedIdent.MatchString(s)
+}
+
+// SanitizeIdentifier is NormalizeIdentifier, returning ErrEmptyIdentifier
+// instead of a name which would be empty, or only underscores, once
+// normalized: "My Tag!" => "my_tag_", "!!" => error
+func SanitizeIdentifier(s string) (string, error) {
+	normalized := NormalizeIdentifier(s)
+	if strings.Trim(normalized, "_") == "" {
+		return "", fmt.Errorf("%w: %q", ErrEmptyIdentifier, s)
+	}
+	return normalized, nil
+}
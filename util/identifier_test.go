@@ -0,0 +1,44 @@
+package util
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeIdentifier(t *testing.T) {
+	tests := map[string]string{
+		"events":   "events",
+		"MyTable":  "mytable",
+		"my tag!":  "my_tag_",
+		"a.b-c":    "a_b_c",
+		"snake_ok": "snake_ok",
+	}
+
+	for in, exp := range tests {
+		if s := NormalizeIdentifier(in); s != exp {
+			t.Fatalf("Expected %#q; Got %#q", exp, s)
+		}
+		if !IsNormalizedIdentifier(exp) {
+			t.Fatalf("Expected %#q to be normalized", exp)
+		}
+	}
+
+	if IsNormalizedIdentifier("") {
+		t.Fatal("Expected empty identifier to be invalid")
+	}
+	if IsNormalizedIdentifier("my tag!") {
+		t.Fatal("Expected `my tag!` to be invalid")
+	}
+}
+
+func TestSanitizeIdentifier(t *testing.T) {
+	if s, err := SanitizeIdentifier("My Tag!"); err != nil || s != "my_tag_" {
+		t.Fatalf("Expected my_tag_; Got %#q, %v", s, err)
+	}
+
+	for _, in := range []string{"", "!!", " _ "} {
+		if s, err := SanitizeIdentifier(in); !errors.Is(err, ErrEmptyIdentifier) {
+			t.Fatalf("Expected %#q to be empty once sanitized; Got %#q, %v", in, s, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"bytes"
+	"io"
+)
+
+// CountLines returns the number of newline-terminated lines in r, plus one for
+// a trailing line without a newline. r is rewound to the start afterwards.
+func CountLines(r io.ReadSeeker) (int64, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	count, err := CountReaderLines(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountReaderLines is CountLines for readers that can't be rewound. It reads
+// r to the end.
+func CountReaderLines(r io.Reader) (int64, error) {
+	var count int64
+	var last byte = '\n'
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			count += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if last != '\n' {
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,125 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultRetryMaxAttempts          = 3
+	DefaultRetryInitialBackoffMillis = 200
+	DefaultRetryMaxBackoffMillis     = 5000
+)
+
+// RetryPolicy retries an operation which fails with an error IsRetryable
+// accepts, waiting between attempts with exponential backoff. The zero value
+// makes DefaultRetryMaxAttempts attempts, classified by IsRetryableError.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, so 1 disables retries
+	MaxAttempts          int `mapstructure:"max_attempts"`
+	InitialBackoffMillis int `mapstructure:"initial_backoff_millis"`
+	MaxBackoffMillis     int `mapstructure:"max_backoff_millis"`
+
+	// IsRetryable, if set, replaces the default classifier. A panic counts
+	// as not retryable.
+	IsRetryable func(err error) bool `mapstructure:"-"`
+}
+
+// Do calls fn until it succeeds, returns an error which isn't retryable, or
+// runs out of attempts, and returns its last error. It stops waiting early
+// when ctx is done.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	attempts := p.MaxAttempts
+	if attempts <= 0 {
+		attempts = DefaultRetryMaxAttempts
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= attempts || !p.retryable(err) {
+			return err
+		}
+
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff is the wait after the given attempt, doubling each time up to
+// MaxBackoffMillis
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	initial := p.InitialBackoffMillis
+	if initial <= 0 {
+		initial = DefaultRetryInitialBackoffMillis
+	}
+	max := p.MaxBackoffMillis
+	if max <= 0 {
+		max = DefaultRetryMaxBackoffMillis
+	}
+
+	wait := initial
+	for i := 1; i < attempt && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return time.Duration(wait) * time.Millisecond
+}
+
+func (p RetryPolicy) retryable(err error) (rc bool) {
+	if p.IsRetryable == nil {
+		return IsRetryableError(err)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().Interface("panic", r).Err(err).Msg("IsRetryable hook panicked")
+			rc = false
+		}
+	}()
+
+	return p.IsRetryable(err)
+}
+
+// IsRetryableError is the default classifier. It retries timeouts, dropped
+// and refused connections, and errors which report themselves as retryable
+// or temporary, such as AWS throttling. Cancellation and the caller's
+// deadline never are.
+func IsRetryableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var retryable interface{ RetryableError() bool }
+	if errors.As(err, &retryable) {
+		return retryable.RetryableError()
+	}
+
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) && temporary.Temporary() {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
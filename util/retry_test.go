@@ -0,0 +1,63 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoffMillis: 1}
+
+	calls := 0
+	err := policy.Do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("Expected success after 3 calls; Got %d calls, err %v", calls, err)
+	}
+
+	calls = 0
+	permanent := errors.New("bad request")
+	err = policy.Do(context.Background(), func() error {
+		calls++
+		return permanent
+	})
+	if !errors.Is(err, permanent) || calls != 1 {
+		t.Fatalf("Expected 1 call for a permanent error; Got %d calls, err %v", calls, err)
+	}
+
+	calls = 0
+	policy.IsRetryable = func(err error) bool { return errors.Is(err, permanent) }
+	err = policy.Do(context.Background(), func() error {
+		calls++
+		return permanent
+	})
+	if !errors.Is(err, permanent) || calls != 3 {
+		t.Fatalf("Expected the hook to allow 3 calls; Got %d calls, err %v", calls, err)
+	}
+
+	calls = 0
+	policy.IsRetryable = func(err error) bool { panic("boom") }
+	policy.Do(context.Background(), func() error {
+		calls++
+		return permanent
+	})
+	if calls != 1 {
+		t.Fatalf("Expected a panicking hook to stop retries; Got %d calls", calls)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoffMillis: 100, MaxBackoffMillis: 300}
+	for attempt, exp := range map[int]int64{1: 100, 2: 200, 3: 300, 10: 300} {
+		if got := policy.backoff(attempt).Milliseconds(); got != exp {
+			t.Errorf("Attempt %d: expected %dms; Got %dms", attempt, exp, got)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// StorageURI is an object store location such as s3://bucket/prefix/
+type StorageURI struct {
+	Scheme string
+	Bucket string
+	Prefix string
+}
+
+// ParseStorageURI parses s3://bucket/prefix, gs://bucket/prefix and
+// file:///path URIs. For file URIs the bucket is empty and the prefix is the
+// absolute directory path.
+func ParseStorageURI(uri string) (StorageURI, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return StorageURI{}, fmt.Errorf("invalid storage uri %q: %w", uri, err)
+	}
+
+	switch u.Scheme {
+	case "s3", "gs":
+		if u.Host == "" {
+			return StorageURI{}, fmt.Errorf("invalid storage uri %q: missing bucket", uri)
+		}
+		return StorageURI{
+			Scheme: u.Scheme,
+			Bucket: u.Host,
+			Prefix: strings.Trim(u.Path, "/"),
+		}, nil
+	case "file":
+		if u.Host != "" {
+			return StorageURI{}, fmt.Errorf("invalid storage uri %q: file uris must be absolute, e.g. file:///data", uri)
+		}
+		if u.Path == "" {
+			return StorageURI{}, fmt.Errorf("invalid storage uri %q: missing path", uri)
+		}
+		return StorageURI{
+			Scheme: u.Scheme,
+			Prefix: u.Path,
+		}, nil
+	}
+
+	return StorageURI{}, fmt.Errorf("invalid storage uri %q: scheme must be s3, gs or file", uri)
+}
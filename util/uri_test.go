@@ -0,0 +1,29 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestParseStorageURI(t *testing.T) {
+	valid := map[string]StorageURI{
+		"s3://my-bucket/ingest/":  {Scheme: "s3", Bucket: "my-bucket", Prefix: "ingest"},
+		"s3://my-bucket":          {Scheme: "s3", Bucket: "my-bucket", Prefix: ""},
+		"gs://bucket/a/b":         {Scheme: "gs", Bucket: "bucket", Prefix: "a/b"},
+		"file:///var/scratchdata": {Scheme: "file", Prefix: "/var/scratchdata"},
+	}
+	for uri, exp := range valid {
+		u, err := ParseStorageURI(uri)
+		if err != nil {
+			t.Fatalf("Cannot parse %s: %s", uri, err)
+		}
+		if u != exp {
+			t.Fatalf("Expected %+v; Got %+v", exp, u)
+		}
+	}
+
+	for _, uri := range []string{"s3:///prefix", "http://bucket/x", "file://relative/path", "bucket/prefix"} {
+		if _, err := ParseStorageURI(uri); err == nil {
+			t.Fatalf("Expected an error parsing %s", uri)
+		}
+	}
+}
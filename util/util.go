@@ -21,9 +21,11 @@ func NewSnowflakeGenerator() (*snowflake.Node, error) {
 	lastByte := hash[len(hash)-1]          // Get the last byte of the hash
 	lower10Bits := int64(lastByte) & 0x3FF // Mask to get lower 10 bits
 
-	node, err := snowflake.NewNode(lower10Bits)
-	if err != nil {
-		return nil, err
-	}
-	return node, nil
+	return NewSnowflakeNode(lower10Bits)
+}
+
+// NewSnowflakeNode returns a snowflake generator for an explicit node id,
+// 0-1023. Generators with different node ids never produce the same id.
+func NewSnowflakeNode(node int64) (*snowflake.Node, error) {
+	return snowflake.NewNode(node)
 }